@@ -6,14 +6,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
 	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/algo"
 	"bixor-engine/pkg/api"
+	"bixor-engine/pkg/audit"
 	"bixor-engine/pkg/cache"
 	"bixor-engine/pkg/config"
 	"bixor-engine/pkg/database"
+	"bixor-engine/pkg/marketdata"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/scheduler"
+	"bixor-engine/pkg/settlement"
+	wsocket "bixor-engine/pkg/websocket"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -56,9 +66,114 @@ func main() {
 	}
 	defer cache.Close()
 
-	// Initialize matching engine
-	publishTrader := matching.NewMemoryPublishTrader()
-	engine := matching.NewMatchingEngine(publishTrader)
+	// Background loops run until the engine has stopped, so their final
+	// flushes include every fill
+	background, stopBackground := context.WithCancel(context.Background())
+	var backgroundWG sync.WaitGroup
+	runBackground := func(run func(context.Context)) {
+		backgroundWG.Add(1)
+		go func() {
+			defer backgroundWG.Done()
+			run(background)
+		}()
+	}
+
+	// Initialize market data consumers
+	bookTickers := marketdata.NewBookTickers(database.GetDB(), api.GetWebSocketHub())
+	runBackground(bookTickers.Run)
+
+	klines := marketdata.NewKlines(database.GetDB(), api.GetWebSocketHub(), cfg.Trading.CandlestickRetention)
+	runBackground(klines.Run)
+	api.SetKlineStore(klines)
+
+	stats := marketdata.NewStats(database.GetDB(), api.GetWebSocketHub())
+	if err := stats.Load(context.Background(), time.Now()); err != nil {
+		logrus.Errorf("Failed to load 24h market statistics: %v", err)
+	}
+	runBackground(stats.Run)
+	api.SetStatsStore(stats)
+
+	// Pre-trade risk limits use the last trade price for the price band.
+	// Kill switches live in the database and are mirrored to Redis.
+	riskChecker := risk.New(database.GetDB(), redisCache, stats)
+	if err := riskChecker.LoadKillSwitches(context.Background()); err != nil {
+		logrus.Errorf("Failed to load kill switches into Redis: %v", err)
+	}
+	api.SetRiskChecker(riskChecker)
+
+	// Initialize the audit trail
+	auditFile, err := os.OpenFile(cfg.Trading.AuditLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		logrus.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditFile.Close()
+
+	// Fan engine events out to consumers without blocking the order books.
+	// Settlement and the audit trail must see every fill; market data and
+	// WebSocket feeds skip ahead if they fall too far behind.
+	publisher := matching.NewPublishPipeline(cfg.Trading.PublisherBufferSize)
+	settler := settlement.New(database.GetDB(), api.GetWebSocketHub())
+	publisher.Subscribe("settlement", settler, matching.OverflowBlock)
+	publisher.Subscribe("audit", audit.NewTrail(auditFile), matching.OverflowBlock)
+	publisher.Subscribe("marketdata", matching.NewMultiPublishTrader(bookTickers, klines, stats), matching.OverflowDrop)
+	publisher.Subscribe("websocket", wsocket.NewTradeFeed(api.GetWebSocketHub()), matching.OverflowDrop)
+	publisher.Start()
+	api.SetPublishPipeline(publisher)
+
+	// Open the order journal and snapshot store the books are recovered from
+	if err := os.MkdirAll(filepath.Dir(cfg.Trading.JournalPath), 0750); err != nil {
+		logrus.Fatalf("Failed to create journal directory: %v", err)
+	}
+	journal, err := matching.OpenFileJournal(cfg.Trading.JournalPath)
+	if err != nil {
+		logrus.Fatalf("Failed to open order journal: %v", err)
+	}
+	defer journal.Close()
+
+	snapshots, err := matching.NewFileSnapshotStore(cfg.Trading.SnapshotDir)
+	if err != nil {
+		logrus.Fatalf("Failed to open snapshot store: %v", err)
+	}
+
+	// Initialize matching engine with the markets it may trade
+	engine := matching.NewMatchingEngineWithConfig(publisher, matching.EngineConfig{
+		InboxSize: cfg.Trading.OrderInboxSize,
+		Workers:   cfg.Trading.MatchingWorkers,
+		Journal:   journal,
+		Snapshots: snapshots,
+	})
+	settler.SetEngine(engine)
+	if err := registerMarkets(engine); err != nil {
+		logrus.Fatalf("Failed to register markets: %v", err)
+	}
+	if err := engine.Start(context.Background()); err != nil {
+		logrus.Fatalf("Failed to start matching engine: %v", err)
+	}
+	if err := settler.PlacePendingLists(); err != nil {
+		logrus.Errorf("Failed to place pending bracket lists: %v", err)
+	}
+
+	// Loops that submit orders to the engine stop before it does, so none
+	// is submitted while the books drain
+	submitters, stopSubmitters := context.WithCancel(context.Background())
+	var submittersWG sync.WaitGroup
+	runSubmitter := func(run func(context.Context)) {
+		submittersWG.Add(1)
+		go func() {
+			defer submittersWG.Done()
+			run(submitters)
+		}()
+	}
+
+	// Slice algo orders into child orders as their schedules fall due
+	algos := algo.New(database.GetDB(), engine, api.GetWebSocketHub(), klines, riskChecker)
+	runSubmitter(algos.Run)
+	api.SetAlgoService(algos)
+
+	// Submit scheduled orders to the engine as they fall due
+	orderScheduler := scheduler.New(database.GetDB(), engine, api.GetWebSocketHub(), riskChecker)
+	runSubmitter(orderScheduler.Run)
+	api.SetOrderScheduler(orderScheduler)
 
 	// Setup HTTP server
 	if !cfg.IsDevelopment() {
@@ -103,7 +218,7 @@ func main() {
 
 	// Start WebSocket hub
 	hub := api.GetWebSocketHub()
-	go hub.Run(context.Background())
+	runBackground(hub.Run)
 
 	// Create HTTP server
 	server := &http.Server{
@@ -133,13 +248,70 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	// Stop taking requests first so every acknowledged order is in an inbox
 	if err := server.Shutdown(ctx); err != nil {
 		logrus.Errorf("Server forced to shutdown: %v", err)
 	}
 
+	// Finish the algo and scheduled orders being submitted
+	stopSubmitters()
+	submittersWG.Wait()
+
+	// Drain the order books, deliver everything they published and save
+	// a snapshot of each
+	statuses, err := engine.Stop(ctx)
+	for _, status := range statuses {
+		entry := logrus.WithFields(logrus.Fields{
+			"market":         status.MarketID,
+			"sequence":       status.Sequence,
+			"drained":        status.Drained,
+			"bids":           status.Bids,
+			"asks":           status.Asks,
+			"snapshot":       status.Snapshot,
+			"journal_errors": status.JournalErrors,
+		})
+		if status.Error != "" {
+			entry.Errorf("Market stopped with error: %s", status.Error)
+		} else {
+			entry.Info("Market stopped")
+		}
+	}
+	if err != nil {
+		logrus.Errorf("Matching engine did not stop cleanly: %v", err)
+		// the books may still publish, so the pipeline is closed here instead
+		publisher.Close()
+	}
+
+	// Flush market data and disconnect WebSocket clients last so they
+	// receive the final updates
+	stopBackground()
+	backgroundWG.Wait()
+
 	logrus.Info("Bixor Engine stopped successfully")
 }
 
+// registerMarkets creates an order book for every active market
+func registerMarkets(engine *matching.MatchingEngine) error {
+	var markets []models.Market
+	if err := database.GetDB().Where("is_active = ?", true).Find(&markets).Error; err != nil {
+		return err
+	}
+
+	for _, market := range markets {
+		err := engine.RegisterMarket(matching.MarketConfig{
+			ID:             market.ID,
+			PricePrecision: market.PricePrecision,
+			SizePrecision:  market.SizePrecision,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Registered %d markets with the matching engine", len(markets))
+	return nil
+}
+
 func setupLogging(cfg *config.Config) {
 	// Set log format
 	logrus.SetFormatter(&logrus.JSONFormatter{
@@ -10,7 +10,6 @@ require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/huandu/skiplist v1.2.0
 	github.com/joho/godotenv v1.4.0
-	github.com/nite-coder/blackbear v0.0.0-20230711120252-63230a2249cd
 	github.com/pquerna/otp v1.4.0
 	github.com/rs/xid v1.4.0
 	github.com/shopspring/decimal v1.3.1
@@ -21,6 +20,7 @@ require (
 	golang.org/x/crypto v0.13.0
 	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/driver/postgres v1.5.2
+	gorm.io/driver/sqlite v1.5.3
 	gorm.io/gorm v1.25.4
 )
 
@@ -55,6 +55,7 @@ require (
 	github.com/leodido/go-urn v1.2.4 // indirect
 	github.com/mailru/easyjson v0.7.6 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
+	github.com/mattn/go-sqlite3 v1.14.17 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
@@ -0,0 +1,62 @@
+package matching
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// BookTicker is the best bid and offer of an order book. Sequence is the
+// order book sequence at which the top of book last changed.
+type BookTicker struct {
+	MarketID string          `json:"market_id"`
+	BidPrice decimal.Decimal `json:"bid_price"`
+	BidSize  decimal.Decimal `json:"bid_size"`
+	AskPrice decimal.Decimal `json:"ask_price"`
+	AskSize  decimal.Decimal `json:"ask_size"`
+	Spread   decimal.Decimal `json:"spread"`
+	Sequence uint64          `json:"sequence"`
+	Time     time.Time       `json:"time"`
+}
+
+// BookTicker returns the latest best bid and offer without going through the
+// order book goroutine.
+func (book *OrderBook) BookTicker() *BookTicker {
+	ticker := book.bookTicker.Load()
+	if ticker == nil {
+		return &BookTicker{MarketID: book.marketID}
+	}
+
+	return ticker
+}
+
+// updateBookTicker returns a new BookTicker when the top of either queue
+// changed since the last one, or nil. The top is compared in ticks and
+// lots, so commands that leave it unchanged convert nothing.
+func (book *OrderBook) updateBookTicker() *BookTicker {
+	var top [4]int64
+	top[0], top[1] = book.bidQueue.top()
+	top[2], top[3] = book.askQueue.top()
+	if top == book.top {
+		return nil
+	}
+	book.top = top
+
+	ticker := &BookTicker{
+		MarketID: book.marketID,
+		BidPrice: book.scale.price(top[0]),
+		BidSize:  book.scale.size(top[1]),
+		AskPrice: book.scale.price(top[2]),
+		AskSize:  book.scale.size(top[3]),
+		Sequence: book.sequence,
+		Time:     time.Now().UTC(),
+	}
+
+	// the spread is only meaningful when both sides are quoted
+	if top[0] != 0 && top[2] != 0 {
+		ticker.Spread = book.scale.price(top[2] - top[0])
+	}
+	book.bookTicker.Store(ticker)
+
+	return ticker
+}
@@ -2,38 +2,476 @@ package matching
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
+
+	"github.com/shopspring/decimal"
 )
 
+// DefaultInboxSize is the default number of pending commands per order book
+const DefaultInboxSize = 10000
+
+// MarketConfig describes a market the engine accepts orders for
+type MarketConfig struct {
+	ID             string
+	PricePrecision int
+	SizePrecision  int
+}
+
+// EngineConfig controls how order books are scheduled and persisted
+type EngineConfig struct {
+	// InboxSize bounds the pending commands of each order book and is
+	// rounded up to a power of two. Commands sent to a full order book fail
+	// with ErrOverloaded.
+	InboxSize int
+	// Workers multiplexes all order books onto a fixed pool of goroutines
+	// when positive. Zero runs each order book's stages on goroutines of
+	// their own.
+	Workers int
+	// Journal, if set, records every add and cancel before it is applied
+	Journal Journal
+	// Snapshots, if set, restores books on Start and saves them on Stop
+	Snapshots SnapshotStore
+}
+
+// DefaultEngineConfig runs one goroutine per order book with DefaultInboxSize
+func DefaultEngineConfig() EngineConfig {
+	return EngineConfig{
+		InboxSize: DefaultInboxSize,
+	}
+}
+
+// MarketStatus reports how a market's order book shut down
+type MarketStatus struct {
+	MarketID      string `json:"market_id"`
+	Sequence      uint64 `json:"sequence"`
+	Drained       int    `json:"drained"` // commands still queued when Stop was called
+	Bids          int    `json:"bids"`
+	Asks          int    `json:"asks"`
+	Snapshot      bool   `json:"snapshot"`
+	JournalErrors uint64 `json:"journal_errors"`
+	Error         string `json:"error,omitempty"`
+}
+
 type MatchingEngine struct {
+	config        EngineConfig
 	orderbooks    sync.Map
 	publishTrader PublishTrader
+	pool          *workerPool
+
+	mu      sync.Mutex // serializes Start, Stop and RegisterMarket
+	running atomic.Bool
+	stopped bool
 }
 
 func NewMatchingEngine(publishTrader PublishTrader) *MatchingEngine {
-	return &MatchingEngine{
+	return NewMatchingEngineWithConfig(publishTrader, DefaultEngineConfig())
+}
+
+func NewMatchingEngineWithConfig(publishTrader PublishTrader, config EngineConfig) *MatchingEngine {
+	if config.InboxSize <= 0 {
+		config.InboxSize = DefaultInboxSize
+	}
+
+	engine := &MatchingEngine{
+		config:        config,
 		publishTrader: publishTrader,
 	}
+	if config.Workers > 0 {
+		engine.pool = newWorkerPool(config.Workers)
+	}
+
+	return engine
+}
+
+// RegisterMarket creates the order book of a market. Markets registered
+// while the engine is running are recovered and started immediately.
+// Registering a market twice is a no-op.
+func (engine *MatchingEngine) RegisterMarket(market MarketConfig) error {
+	if len(market.ID) == 0 {
+		return ErrInvalidParam
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if engine.stopped {
+		return ErrEngineNotRunning
+	}
+
+	newbook := newOrderBook(market, engine.publishTrader, engine.config.InboxSize)
+	newbook.journal = engine.config.Journal
+	if _, loaded := engine.orderbooks.LoadOrStore(market.ID, newbook); loaded {
+		return nil
+	}
+
+	if engine.running.Load() {
+		if err := engine.recover([]*OrderBook{newbook}); err != nil {
+			engine.orderbooks.Delete(market.ID)
+			return err
+		}
+		engine.launch(newbook)
+	}
+
+	return nil
+}
+
+// Start restores every registered book from its snapshot and the journal,
+// then starts accepting commands
+func (engine *MatchingEngine) Start(ctx context.Context) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	if engine.running.Load() {
+		return nil
+	}
+	if engine.stopped {
+		return ErrEngineNotRunning
+	}
+
+	books := engine.books()
+	if err := engine.recover(books); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, book := range books {
+		engine.launch(book)
+	}
+	engine.running.Store(true)
+
+	return nil
+}
+
+// Stop refuses new commands, processes everything already accepted, closes
+// the publisher so consumers receive every event, flushes the journal and
+// saves a final snapshot of each book. The journal is reset once every book
+// has been snapshotted. It reports the state of each market even when it
+// returns an error.
+func (engine *MatchingEngine) Stop(ctx context.Context) ([]MarketStatus, error) {
+	engine.mu.Lock()
+	if !engine.running.Load() {
+		engine.mu.Unlock()
+		return nil, ErrEngineNotRunning
+	}
+	engine.running.Store(false)
+	engine.stopped = true
+	engine.mu.Unlock()
+
+	books := engine.books()
+	statuses := make([]MarketStatus, len(books))
+	for i, book := range books {
+		statuses[i] = MarketStatus{
+			MarketID: book.marketID,
+			Drained:  book.stop(),
+		}
+	}
+
+	var stopErr error
+	for i, book := range books {
+		select {
+		case <-book.done:
+		case <-ctx.Done():
+			statuses[i].Error = "timed out draining the order book"
+			stopErr = ctx.Err()
+		}
+	}
+	if engine.pool != nil {
+		engine.pool.close()
+	}
+	if stopErr != nil {
+		return statuses, stopErr
+	}
+
+	// every book has stopped, so no more events will be published
+	if closer, ok := engine.publishTrader.(interface{ Close() }); ok {
+		closer.Close()
+	}
+
+	if engine.config.Journal != nil {
+		if err := engine.config.Journal.Flush(); err != nil {
+			stopErr = err
+		}
+	}
+
+	snapshotted := true
+	for i, book := range books {
+		status := &statuses[i]
+		status.Sequence = book.sequence
+		status.Bids = int(book.bidQueue.orderCount())
+		status.Asks = int(book.askQueue.orderCount())
+		status.JournalErrors = book.journalErrors
+
+		if engine.config.Snapshots == nil {
+			snapshotted = false
+			continue
+		}
+		if err := engine.config.Snapshots.Save(book.snapshot()); err != nil {
+			status.Error = err.Error()
+			snapshotted = false
+			stopErr = err
+			continue
+		}
+		status.Snapshot = true
+	}
+
+	// the snapshots now hold everything the journal recorded
+	if snapshotted && stopErr == nil && engine.config.Journal != nil {
+		stopErr = engine.config.Journal.Reset()
+	}
+
+	return statuses, stopErr
+}
+
+// books returns the registered books ordered by market ID
+func (engine *MatchingEngine) books() []*OrderBook {
+	books := make([]*OrderBook, 0)
+	engine.orderbooks.Range(func(_, value any) bool {
+		book, _ := value.(*OrderBook)
+		books = append(books, book)
+		return true
+	})
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].marketID < books[j].marketID
+	})
+
+	return books
+}
+
+// recover loads each book's snapshot and replays the journal entries that
+// came after it. Nothing is published while replaying since consumers have
+// already seen those events.
+func (engine *MatchingEngine) recover(books []*OrderBook) error {
+	byMarket := make(map[string]*OrderBook, len(books))
+	for _, book := range books {
+		if engine.config.Snapshots != nil {
+			snapshot, err := engine.config.Snapshots.Load(book.marketID)
+			if err != nil {
+				return err
+			}
+			if snapshot != nil {
+				if err := book.restore(snapshot); err != nil {
+					return err
+				}
+			}
+		}
+
+		byMarket[book.marketID] = book
+		book.publishTrader = NewDiscardPublishTrader()
+	}
+
+	var err error
+	if engine.config.Journal != nil {
+		err = engine.config.Journal.Replay(func(entry *JournalEntry) error {
+			book, ok := byMarket[entry.MarketID]
+			if ok && entry.Sequence > book.sequence {
+				book.replay(entry)
+			}
+			return nil
+		})
+	}
+
+	for _, book := range books {
+		book.publishTrader = engine.publishTrader
+		book.publish(nil, nil, book.updateBookTicker())
+	}
+
+	return err
+}
+
+// launch runs a book on its own goroutines or hands it to the worker pool
+func (engine *MatchingEngine) launch(book *OrderBook) {
+	// the journal stage numbers commands from where recovery left off
+	book.sequenced = book.sequence
+
+	if engine.pool != nil {
+		book.wake = func() { engine.pool.schedule(book) }
+		if book.pending() {
+			engine.pool.schedule(book)
+		}
+		return
+	}
+
+	go func() {
+		_ = book.Start()
+	}()
 }
 
 func (engine *MatchingEngine) AddOrder(ctx context.Context, order *Order) error {
+	if !engine.running.Load() {
+		return ErrEngineNotRunning
+	}
+
 	orderbook := engine.OrderBook(order.MarketID)
+	if orderbook == nil {
+		return ErrMarketNotFound
+	}
 	return orderbook.AddOrder(ctx, order)
 }
 
 func (engine *MatchingEngine) CancelOrder(ctx context.Context, marketID string, orderID string) error {
+	if !engine.running.Load() {
+		return ErrEngineNotRunning
+	}
+
 	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return ErrMarketNotFound
+	}
 	return orderbook.CancelOrder(ctx, orderID)
 }
 
+// AddOCO places a one-cancels-other list of a limit and a stop-limit leg,
+// see OrderBook.AddOCO. Both legs must be in the same market.
+func (engine *MatchingEngine) AddOCO(ctx context.Context, listID string, limit *Order, stop *Order) error {
+	if !engine.running.Load() {
+		return ErrEngineNotRunning
+	}
+	if limit == nil || stop == nil || limit.MarketID != stop.MarketID {
+		return ErrInvalidParam
+	}
+
+	orderbook := engine.OrderBook(limit.MarketID)
+	if orderbook == nil {
+		return ErrMarketNotFound
+	}
+	return orderbook.AddOCO(ctx, listID, limit, stop)
+}
+
+// CancelOrderList cancels the legs of an order list that are still in the
+// book
+func (engine *MatchingEngine) CancelOrderList(ctx context.Context, marketID string, listID string) error {
+	if !engine.running.Load() {
+		return ErrEngineNotRunning
+	}
+
+	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return ErrMarketNotFound
+	}
+	return orderbook.CancelOrderList(ctx, listID)
+}
+
+// MassCancel cancels a user's resting orders in one market, or in every
+// market when marketID is empty, optionally only on one side. Each book
+// cancels atomically. The IDs cancelled before an error are still returned.
+func (engine *MatchingEngine) MassCancel(ctx context.Context, userID int64, marketID string, side Side) ([]string, error) {
+	if !engine.running.Load() {
+		return nil, ErrEngineNotRunning
+	}
+
+	books, err := engine.booksOf(marketID)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelled := make([]string, 0)
+	for _, book := range books {
+		ids, err := book.MassCancel(ctx, userID, side)
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, ids...)
+	}
+
+	return cancelled, nil
+}
+
+// CancelAll cancels every resting order of one market, or of every market
+// when marketID is empty. Each book cancels atomically. The IDs cancelled
+// before an error are still returned.
+func (engine *MatchingEngine) CancelAll(ctx context.Context, marketID string) ([]string, error) {
+	if !engine.running.Load() {
+		return nil, ErrEngineNotRunning
+	}
+
+	books, err := engine.booksOf(marketID)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelled := make([]string, 0)
+	for _, book := range books {
+		ids, err := book.CancelAll(ctx)
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, ids...)
+	}
+
+	return cancelled, nil
+}
+
+// booksOf returns the book of a market, or every book when marketID is empty
+func (engine *MatchingEngine) booksOf(marketID string) ([]*OrderBook, error) {
+	if len(marketID) == 0 {
+		return engine.books(), nil
+	}
+
+	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return nil, ErrMarketNotFound
+	}
+	return []*OrderBook{orderbook}, nil
+}
+
+func (engine *MatchingEngine) Depth(marketID string, limit uint32, group decimal.Decimal) (*Depth, error) {
+	if !engine.running.Load() {
+		return nil, ErrEngineNotRunning
+	}
+
+	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return nil, ErrMarketNotFound
+	}
+	return orderbook.Depth(limit, group)
+}
+
+// GetOrder returns a resting order of a market with its remaining size
+func (engine *MatchingEngine) GetOrder(marketID string, orderID string) (*Order, error) {
+	if !engine.running.Load() {
+		return nil, ErrEngineNotRunning
+	}
+
+	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return nil, ErrMarketNotFound
+	}
+	return orderbook.GetOrder(orderID)
+}
+
+// OpenOrders returns a user's resting orders in a market with their
+// remaining size, oldest first
+func (engine *MatchingEngine) OpenOrders(marketID string, userID int64) ([]*Order, error) {
+	if !engine.running.Load() {
+		return nil, ErrEngineNotRunning
+	}
+
+	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return nil, ErrMarketNotFound
+	}
+	return orderbook.OpenOrders(userID)
+}
+
+// BookTicker returns the best bid and offer of a market, or nil if the market
+// is not registered
+func (engine *MatchingEngine) BookTicker(marketID string) *BookTicker {
+	orderbook := engine.OrderBook(marketID)
+	if orderbook == nil {
+		return nil
+	}
+	return orderbook.BookTicker()
+}
+
+// OrderBook returns the order book of a registered market, or nil
 func (engine *MatchingEngine) OrderBook(marketID string) *OrderBook {
 	book, found := engine.orderbooks.Load(marketID)
 	if !found {
-		newbook := NewOrderBook(engine.publishTrader)
-		book, _ = engine.orderbooks.LoadOrStore(marketID, newbook)
-		go func() {
-			_ = newbook.Start()
-		}()
+		return nil
 	}
 
 	orderbook, _ := book.(*OrderBook)
@@ -0,0 +1,131 @@
+package matching
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/shopspring/decimal"
+)
+
+// Matching in int64 ticks and lots instead of decimals, on one CPU:
+//
+//	                          decimal                  fixed-point
+//	MatchOrders               5041 ns/op, 48 allocs    3067 ns/op, 14 allocs
+//	PlaceOrders (2000-2800)   793-1396 ns/op           990-1753 ns/op
+//
+// PlaceOrders only measures queueing, which now also converts the order to
+// ticks and lots on the caller's goroutine.
+
+const (
+	start = 2000 // actual = start  * goprocs
+	end   = 3000 // actual = end    * goprocs
+	step  = 200
+)
+
+// BenchmarkPlaceOrders reports the 99th percentile latency of AddOrder
+// under contention as p99-ns
+func BenchmarkPlaceOrders(b *testing.B) {
+	goprocs := runtime.GOMAXPROCS(0)
+
+	for i := start; i < end; i += step {
+		ctx := context.Background()
+		var errCount int64
+
+		publishTrader := NewDiscardPublishTrader()
+		engine := NewMatchingEngineWithConfig(publishTrader, EngineConfig{InboxSize: 1000000})
+		_ = engine.RegisterMarket(MarketConfig{ID: "BTC-USDT"})
+		_ = engine.Start(ctx)
+
+		b.Run(fmt.Sprintf("goroutines-%d", i*goprocs), func(b *testing.B) {
+			var mu sync.Mutex
+			var latencies []time.Duration
+
+			b.SetParallelism(i)
+			b.RunParallel(func(pb *testing.PB) {
+				local := make([]time.Duration, 0, 1024)
+				defer func() {
+					mu.Lock()
+					latencies = append(latencies, local...)
+					mu.Unlock()
+				}()
+
+				for pb.Next() {
+					n, _ := rand.Int(rand.Reader, big.NewInt(1000))
+					id := n.Int64() + 1
+
+					order := &Order{
+						ID:       xid.New().String(),
+						MarketID: "BTC-USDT",
+						Type:     Limit,
+						Side:     Buy,
+						Price:    decimal.NewFromInt(id),
+						Size:     decimal.NewFromInt(1),
+					}
+
+					began := time.Now()
+					err := engine.AddOrder(ctx, order)
+					local = append(local, time.Since(began))
+					if err != nil {
+						atomic.AddInt64(&errCount, int64(1))
+					}
+				}
+			})
+
+			sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+			if len(latencies) > 0 {
+				b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+			}
+		})
+
+		// drain the book so the next run starts from an idle engine
+		_, _ = engine.Stop(ctx)
+
+		bid := engine.OrderBook("BTC-USDT").bidQueue
+		b.Logf("order count: %d", bid.orderCount())
+		b.Logf("depth count: %d", bid.depthCount())
+		b.Logf("error count: %d", errCount)
+	}
+}
+
+// BenchmarkMatchOrders measures matching alone: a stream of crossing limit
+// orders applied directly on the book goroutine, without the inbox.
+func BenchmarkMatchOrders(b *testing.B) {
+	book := newOrderBook(MarketConfig{ID: "BTC-USDT", PricePrecision: 2, SizePrecision: 8}, NewDiscardPublishTrader(), 1)
+
+	orders := make([]*Order, 1024)
+	for i := range orders {
+		side := Buy
+		if i%2 == 1 {
+			side = Sell
+		}
+		orders[i] = &Order{
+			ID:       fmt.Sprintf("order%d", i),
+			MarketID: "BTC-USDT",
+			Type:     Limit,
+			Side:     side,
+			Price:    decimal.New(int64(5000000+(i*7919)%2000), -2),
+			Size:     decimal.New(int64(1+i%50), -3),
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		order := *orders[i%len(orders)]
+		order.ID = strconv.Itoa(i)
+		if err := book.scale.prepare(&order); err != nil {
+			b.Fatal(err)
+		}
+		book.addOrder(&order)
+	}
+}
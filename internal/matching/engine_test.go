@@ -0,0 +1,878 @@
+package matching
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+)
+
+type MatchingEngineTestSuite struct {
+	suite.Suite
+	engine *MatchingEngine
+}
+
+func TestMatchingEngineTestSuite(t *testing.T) {
+	publishTrader := NewMemoryPublishTrader()
+	matchingEngineTestSuite := MatchingEngineTestSuite{
+		engine: NewMatchingEngine(publishTrader),
+	}
+	suite.Run(t, &matchingEngineTestSuite)
+}
+
+func (suite *MatchingEngineTestSuite) TestPlaceOrders() {
+	publishTrader := NewMemoryPublishTrader()
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	// market1
+	market1 := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market1}))
+	order1 := &Order{
+		ID:       "order1",
+		MarketID: market1,
+		Type:     Limit,
+		Side:     Buy,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(2),
+	}
+
+	err := suite.engine.AddOrder(ctx, order1)
+	suite.NoError(err)
+
+	time.Sleep(50 * time.Millisecond)
+	orderbook := suite.engine.OrderBook(market1)
+	suite.Equal(int64(1), orderbook.bidQueue.orderCount())
+
+	// market2
+	market2 := "ETH-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market2}))
+	order2 := &Order{
+		ID:       "order2",
+		MarketID: market2,
+		Type:     Limit,
+		Side:     Sell,
+		Price:    decimal.NewFromInt(110),
+		Size:     decimal.NewFromInt(2),
+	}
+
+	err = suite.engine.AddOrder(ctx, order2)
+	suite.NoError(err)
+
+	time.Sleep(50 * time.Millisecond)
+	orderbook = suite.engine.OrderBook(market2)
+	suite.Equal(int64(1), orderbook.askQueue.orderCount())
+}
+
+func (suite *MatchingEngineTestSuite) TestCancelOrder() {
+	publishTrader := NewMemoryPublishTrader()
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	market1 := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market1}))
+
+	order1 := &Order{
+		ID:       "order1",
+		MarketID: market1,
+		Type:     Limit,
+		Side:     Buy,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(2),
+	}
+
+	err := suite.engine.AddOrder(ctx, order1)
+	suite.NoError(err)
+
+	order2 := &Order{
+		ID:       "order2",
+		MarketID: market1,
+		Type:     Limit,
+		Side:     Sell,
+		Price:    decimal.NewFromInt(110),
+		Size:     decimal.NewFromInt(2),
+	}
+
+	err = suite.engine.AddOrder(ctx, order2)
+	suite.NoError(err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = suite.engine.CancelOrder(ctx, market1, order1.ID)
+	suite.NoError(err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	// validate
+	orderbook := suite.engine.OrderBook(market1)
+	suite.Equal(int64(0), orderbook.bidQueue.orderCount())
+	suite.Equal(int64(1), orderbook.askQueue.orderCount())
+}
+
+func (suite *MatchingEngineTestSuite) TestFillsCarryMarketAndUsers() {
+	publishTrader := NewMemoryPublishTrader()
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+	market := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+	maker := &Order{
+		ID:       "maker",
+		MarketID: market,
+		UserID:   1,
+		Type:     Limit,
+		Side:     Sell,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(2),
+	}
+	suite.NoError(suite.engine.AddOrder(ctx, maker))
+
+	taker := &Order{
+		ID:       "taker",
+		MarketID: market,
+		UserID:   2,
+		Type:     Limit,
+		Side:     Buy,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(1),
+	}
+	suite.NoError(suite.engine.AddOrder(ctx, taker))
+
+	time.Sleep(50 * time.Millisecond)
+
+	suite.Equal(1, publishTrader.Count())
+	trade := publishTrader.Get(0)
+	suite.Equal(market, trade.MarketID)
+	suite.Equal(int64(2), trade.TakerUserID)
+	suite.Equal(int64(1), trade.MakerUserID)
+	suite.Equal(Buy, trade.TakerOrderSide)
+	suite.Equal(Limit, trade.TakerOrderType)
+}
+
+func (suite *MatchingEngineTestSuite) TestUnregisteredMarket() {
+	suite.engine = NewMatchingEngine(NewMemoryPublishTrader())
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+	order := &Order{
+		ID:       "order1",
+		MarketID: "BTC-USTD",
+		Type:     Limit,
+		Side:     Buy,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(1),
+	}
+
+	suite.ErrorIs(suite.engine.AddOrder(ctx, order), ErrMarketNotFound)
+	suite.ErrorIs(suite.engine.CancelOrder(ctx, "BTC-USTD", "order1"), ErrMarketNotFound)
+	suite.Nil(suite.engine.OrderBook("BTC-USTD"))
+	suite.Nil(suite.engine.BookTicker("BTC-USTD"))
+
+	_, err := suite.engine.Depth("BTC-USTD", 10, decimal.Zero)
+	suite.ErrorIs(err, ErrMarketNotFound)
+}
+
+func (suite *MatchingEngineTestSuite) TestOverloaded() {
+	// the book is never started, so its inbox only fills up
+	book := newOrderBook(MarketConfig{ID: "BTC-USDT"}, NewMemoryPublishTrader(), 2)
+
+	ctx := context.Background()
+	for i, id := range []string{"order1", "order2", "order3"} {
+		order := &Order{
+			ID:    id,
+			Type:  Limit,
+			Side:  Buy,
+			Price: decimal.NewFromInt(100),
+			Size:  decimal.NewFromInt(1),
+		}
+
+		err := book.AddOrder(ctx, order)
+		if i < 2 {
+			suite.NoError(err)
+		} else {
+			suite.ErrorIs(err, ErrOverloaded)
+		}
+	}
+}
+
+func (suite *MatchingEngineTestSuite) TestWorkerPool() {
+	publishTrader := NewMemoryPublishTrader()
+	suite.engine = NewMatchingEngineWithConfig(publishTrader, EngineConfig{InboxSize: 100, Workers: 2})
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+	markets := []string{"BTC-USDT", "ETH-USDT", "SOL-USDT", "XRP-USDT"}
+	for _, market := range markets {
+		suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+		for i := 0; i < 10; i++ {
+			order := &Order{
+				ID:       fmt.Sprintf("%s-%d", market, i),
+				MarketID: market,
+				Type:     Limit,
+				Side:     Buy,
+				Price:    decimal.NewFromInt(int64(100 + i)),
+				Size:     decimal.NewFromInt(1),
+			}
+			suite.NoError(suite.engine.AddOrder(ctx, order))
+		}
+		suite.NoError(suite.engine.CancelOrder(ctx, market, market+"-0"))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	for _, market := range markets {
+		orderbook := suite.engine.OrderBook(market)
+		suite.Equal(int64(9), orderbook.bidQueue.orderCount())
+
+		depth, err := suite.engine.Depth(market, 1, decimal.Zero)
+		suite.NoError(err)
+		suite.Equal("109", depth.Bids[0].Price.String())
+	}
+}
+
+func (suite *MatchingEngineTestSuite) TestCancelRightAfterAdd() {
+	suite.engine = NewMatchingEngine(NewMemoryPublishTrader())
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+	market := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+	// a cancel sent straight after its add must never overtake it
+	for i := 0; i < 200; i++ {
+		order := &Order{
+			ID:       fmt.Sprintf("order%d", i),
+			MarketID: market,
+			Type:     Limit,
+			Side:     Buy,
+			Price:    decimal.NewFromInt(int64(100 + i%10)),
+			Size:     decimal.NewFromInt(1),
+		}
+		suite.NoError(suite.engine.AddOrder(ctx, order))
+		suite.NoError(suite.engine.CancelOrder(ctx, market, order.ID))
+	}
+
+	// depth is sequenced behind every command above
+	depth, err := suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.Empty(depth.Bids)
+	suite.Equal(int64(0), suite.engine.OrderBook(market).bidQueue.orderCount())
+}
+
+func (suite *MatchingEngineTestSuite) TestStopSnapshotsAndRestores() {
+	dir := suite.T().TempDir()
+	journal, err := OpenFileJournal(filepath.Join(dir, "journal.log"))
+	suite.Require().NoError(err)
+	defer journal.Close()
+	snapshots, err := NewFileSnapshotStore(filepath.Join(dir, "snapshots"))
+	suite.Require().NoError(err)
+
+	config := EngineConfig{Journal: journal, Snapshots: snapshots}
+	market := "BTC-USDT"
+	suite.engine = NewMatchingEngineWithConfig(NewMemoryPublishTrader(), config)
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+	ctx := context.Background()
+	suite.ErrorIs(suite.engine.AddOrder(ctx, &Order{ID: "order0", MarketID: market}), ErrEngineNotRunning)
+	suite.NoError(suite.engine.Start(ctx))
+
+	for i := 0; i < 5; i++ {
+		order := &Order{
+			ID:       fmt.Sprintf("order%d", i),
+			MarketID: market,
+			Type:     Limit,
+			Side:     Buy,
+			Price:    decimal.NewFromInt(int64(100 + i)),
+			Size:     decimal.NewFromInt(1),
+		}
+		suite.NoError(suite.engine.AddOrder(ctx, order))
+	}
+	suite.NoError(suite.engine.CancelOrder(ctx, market, "order0"))
+
+	// every accepted command is applied before the snapshot is taken
+	statuses, err := suite.engine.Stop(ctx)
+	suite.NoError(err)
+	suite.Require().Len(statuses, 1)
+	suite.Equal(market, statuses[0].MarketID)
+	suite.Equal(uint64(6), statuses[0].Sequence)
+	suite.Equal(4, statuses[0].Bids)
+	suite.True(statuses[0].Snapshot)
+
+	suite.ErrorIs(suite.engine.AddOrder(ctx, &Order{ID: "order9", MarketID: market}), ErrEngineNotRunning)
+	_, err = suite.engine.Stop(ctx)
+	suite.ErrorIs(err, ErrEngineNotRunning)
+
+	// the journal is covered by the snapshot, so it was reset
+	entries := 0
+	suite.NoError(journal.Replay(func(*JournalEntry) error {
+		entries++
+		return nil
+	}))
+	suite.Equal(0, entries)
+
+	suite.engine = NewMatchingEngineWithConfig(NewMemoryPublishTrader(), config)
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+	suite.NoError(suite.engine.Start(ctx))
+
+	depth, err := suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.Len(depth.Bids, 4)
+	suite.Equal("104", suite.engine.BookTicker(market).BidPrice.String())
+}
+
+func (suite *MatchingEngineTestSuite) TestSnapshotRestoresPartlyFilledMinSizeOrder() {
+	snapshots, err := NewFileSnapshotStore(suite.T().TempDir())
+	suite.Require().NoError(err)
+
+	config := EngineConfig{Snapshots: snapshots}
+	market := "BTC-USDT"
+	suite.engine = NewMatchingEngineWithConfig(NewMemoryPublishTrader(), config)
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	// less than the minimum size of the maker remains after the first fill
+	maker := &Order{ID: "maker", MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(5), MinSize: decimal.NewFromInt(3)}
+	suite.NoError(suite.engine.AddOrder(ctx, maker))
+	suite.NoError(suite.engine.AddOrder(ctx, &Order{ID: "taker1", MarketID: market, Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(3)}))
+
+	_, err = suite.engine.Stop(ctx)
+	suite.NoError(err)
+
+	suite.engine = NewMatchingEngineWithConfig(NewMemoryPublishTrader(), config)
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+	suite.Require().NoError(suite.engine.Start(ctx))
+
+	depth, err := suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.Require().Len(depth.Asks, 1)
+	suite.Equal("2", depth.Asks[0].Size.String())
+
+	// the rest of the maker still trades as a whole
+	suite.NoError(suite.engine.AddOrder(ctx, &Order{ID: "taker2", MarketID: market, Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(2)}))
+	depth, err = suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.Empty(depth.Asks)
+	suite.Empty(depth.Bids)
+}
+
+func (suite *MatchingEngineTestSuite) TestRecoverFromJournal() {
+	dir := suite.T().TempDir()
+	journal, err := OpenFileJournal(filepath.Join(dir, "journal.log"))
+	suite.Require().NoError(err)
+	defer journal.Close()
+
+	market := "BTC-USDT"
+	crashed := NewMatchingEngineWithConfig(NewMemoryPublishTrader(), EngineConfig{Journal: journal})
+	suite.NoError(crashed.RegisterMarket(MarketConfig{ID: market}))
+
+	ctx := context.Background()
+	suite.NoError(crashed.Start(ctx))
+
+	maker := &Order{ID: "maker", MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(3)}
+	taker := &Order{ID: "taker", MarketID: market, Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1)}
+	suite.NoError(crashed.AddOrder(ctx, maker))
+	suite.NoError(crashed.AddOrder(ctx, taker))
+
+	// wait for both commands, then lose the engine without stopping it
+	_, err = crashed.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.NoError(journal.Flush())
+
+	publishTrader := NewMemoryPublishTrader()
+	suite.engine = NewMatchingEngineWithConfig(publishTrader, EngineConfig{Journal: journal})
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+	suite.NoError(suite.engine.Start(ctx))
+
+	depth, err := suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.Require().Len(depth.Asks, 1)
+	suite.Equal("2", depth.Asks[0].Size.String())
+	suite.Equal(uint64(2), suite.engine.OrderBook(market).sequence)
+
+	// replayed fills were already published before the crash
+	suite.Equal(0, publishTrader.Count())
+}
+
+func (suite *MatchingEngineTestSuite) TestJournalFlushedBeforeApplied() {
+	path := filepath.Join(suite.T().TempDir(), "journal.log")
+	journal, err := OpenFileJournal(path)
+	suite.Require().NoError(err)
+	defer journal.Close()
+
+	market := "BTC-USDT"
+	suite.engine = NewMatchingEngineWithConfig(NewMemoryPublishTrader(), EngineConfig{Journal: journal})
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	order := &Order{ID: "durable", MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1)}
+	suite.NoError(suite.engine.AddOrder(ctx, order))
+	_, err = suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+
+	// the command reached the file without an explicit Flush
+	data, err := os.ReadFile(path)
+	suite.NoError(err)
+	suite.Contains(string(data), `"id":"durable"`)
+}
+
+func (suite *MatchingEngineTestSuite) TestMarketPrecision() {
+	publishTrader := NewMemoryPublishTrader()
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	market := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market, PricePrecision: 2, SizePrecision: 3}))
+
+	// prices and sizes finer than the market's precision are rejected
+	for _, order := range []*Order{
+		{ID: "fine-price", MarketID: market, Type: Limit, Side: Sell, Price: decimal.RequireFromString("100.001"), Size: decimal.NewFromInt(1)},
+		{ID: "fine-size", MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(100), Size: decimal.RequireFromString("0.0001")},
+		{ID: "zero-size", MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(100), Size: decimal.Zero},
+		{ID: "fine-amount", MarketID: market, Type: Market, Side: Buy, Size: decimal.RequireFromString("0.000001")},
+	} {
+		suite.ErrorIs(suite.engine.AddOrder(ctx, order), ErrInvalidParam, order.ID)
+	}
+
+	maker := &Order{ID: "maker", MarketID: market, Type: Limit, Side: Sell, Price: decimal.RequireFromString("100.25"), Size: decimal.RequireFromString("1.5")}
+	suite.NoError(suite.engine.AddOrder(ctx, maker))
+
+	// 50.125 buys exactly 0.5 at 100.25, leaving 1 resting
+	taker := &Order{ID: "taker", MarketID: market, Type: Market, Side: Buy, Size: decimal.RequireFromString("50.125")}
+	suite.NoError(suite.engine.AddOrder(ctx, taker))
+
+	// 100.2 buys 0.999, rounded down to a whole lot
+	partial := &Order{ID: "partial", MarketID: market, Type: Market, Side: Buy, Size: decimal.RequireFromString("100.2")}
+	suite.NoError(suite.engine.AddOrder(ctx, partial))
+
+	// 0.1 is worth less than a lot at 100.25 and is cancelled
+	dust := &Order{ID: "dust", MarketID: market, Type: Market, Side: Buy, Size: decimal.RequireFromString("0.1")}
+	suite.NoError(suite.engine.AddOrder(ctx, dust))
+
+	depth, err := suite.engine.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.Require().Len(depth.Asks, 1)
+	suite.Equal("100.25", depth.Asks[0].Price.String())
+	suite.Equal("0.001", depth.Asks[0].Size.String())
+	suite.Equal("100.25", suite.engine.BookTicker(market).AskPrice.String())
+
+	// fills are published by a later stage than the one answering Depth
+	suite.Require().Eventually(func() bool { return publishTrader.Count() == 3 }, time.Second, time.Millisecond)
+	suite.Equal("0.5", publishTrader.Get(0).Size.String())
+	suite.Equal("100.25", publishTrader.Get(0).Price.String())
+	suite.Equal("0.999", publishTrader.Get(1).Size.String())
+	suite.True(publishTrader.Get(2).IsCancel)
+	suite.Equal("0.1", publishTrader.Get(2).Size.String())
+}
+
+func (suite *MatchingEngineTestSuite) TestGetOrderAndOpenOrders() {
+	suite.engine = NewMatchingEngine(NewMemoryPublishTrader())
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	market := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market, PricePrecision: 2, SizePrecision: 4}))
+
+	now := time.Now()
+	orders := []*Order{
+		{ID: "ask1", UserID: 1, Side: Sell, Price: decimal.NewFromInt(101), Size: decimal.NewFromInt(2), CreatedAt: now},
+		{ID: "bid1", UserID: 1, Side: Buy, Price: decimal.NewFromInt(99), Size: decimal.NewFromInt(1), CreatedAt: now.Add(time.Second)},
+		{ID: "ask2", UserID: 2, Side: Sell, Price: decimal.NewFromInt(102), Size: decimal.NewFromInt(1), CreatedAt: now.Add(2 * time.Second)},
+		{ID: "bid2", UserID: 1, Side: Buy, Price: decimal.NewFromInt(98), Size: decimal.NewFromInt(1), CreatedAt: now.Add(3 * time.Second)},
+		// user 2 takes half of ask1
+		{ID: "take", UserID: 2, Side: Buy, Price: decimal.NewFromInt(101), Size: decimal.RequireFromString("0.5"), CreatedAt: now.Add(4 * time.Second)},
+	}
+	for _, order := range orders {
+		order.MarketID = market
+		order.Type = Limit
+		suite.NoError(suite.engine.AddOrder(ctx, order))
+	}
+	suite.NoError(suite.engine.CancelOrder(ctx, market, "bid2"))
+
+	order, err := suite.engine.GetOrder(market, "ask1")
+	suite.NoError(err)
+	suite.Equal(int64(1), order.UserID)
+	suite.Equal("101", order.Price.String())
+	suite.Equal("1.5", order.Size.String())
+
+	// the returned order is a copy
+	order.Size = decimal.Zero
+	order, err = suite.engine.GetOrder(market, "ask1")
+	suite.NoError(err)
+	suite.Equal("1.5", order.Size.String())
+
+	_, err = suite.engine.GetOrder(market, "take")
+	suite.ErrorIs(err, ErrOrderNotFound)
+	_, err = suite.engine.GetOrder(market, "bid2")
+	suite.ErrorIs(err, ErrOrderNotFound)
+	_, err = suite.engine.GetOrder("ETH-USDT", "ask1")
+	suite.ErrorIs(err, ErrMarketNotFound)
+
+	open, err := suite.engine.OpenOrders(market, 1)
+	suite.NoError(err)
+	suite.Require().Len(open, 2)
+	suite.Equal("ask1", open[0].ID)
+	suite.Equal("bid1", open[1].ID)
+
+	open, err = suite.engine.OpenOrders(market, 2)
+	suite.NoError(err)
+	suite.Require().Len(open, 1)
+	suite.Equal("ask2", open[0].ID)
+
+	open, err = suite.engine.OpenOrders(market, 3)
+	suite.NoError(err)
+	suite.Empty(open)
+}
+
+// batchPublishTrader records each PublishTrades call separately
+type batchPublishTrader struct {
+	mu      sync.Mutex
+	batches [][]*Trade
+}
+
+func (p *batchPublishTrader) PublishTrades(trades ...*Trade) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.batches = append(p.batches, trades)
+}
+
+func (p *batchPublishTrader) Batches() [][]*Trade {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([][]*Trade(nil), p.batches...)
+}
+
+func (suite *MatchingEngineTestSuite) TestMassCancel() {
+	publishTrader := &batchPublishTrader{}
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	for _, market := range []string{"BTC-USDT", "ETH-USDT"} {
+		suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market, PricePrecision: 2, SizePrecision: 4}))
+	}
+
+	now := time.Now()
+	orders := []*Order{
+		{ID: "btc-ask", MarketID: "BTC-USDT", UserID: 1, Side: Sell, Price: decimal.NewFromInt(101), Size: decimal.NewFromInt(2), CreatedAt: now},
+		{ID: "btc-bid", MarketID: "BTC-USDT", UserID: 1, Side: Buy, Price: decimal.NewFromInt(99), Size: decimal.NewFromInt(1), CreatedAt: now.Add(time.Second)},
+		{ID: "other", MarketID: "BTC-USDT", UserID: 2, Side: Buy, Price: decimal.NewFromInt(98), Size: decimal.NewFromInt(1), CreatedAt: now.Add(2 * time.Second)},
+		{ID: "eth-bid", MarketID: "ETH-USDT", UserID: 1, Side: Buy, Price: decimal.NewFromInt(10), Size: decimal.NewFromInt(1), CreatedAt: now.Add(3 * time.Second)},
+		// user 2 takes half of btc-ask
+		{ID: "take", MarketID: "BTC-USDT", UserID: 2, Side: Buy, Price: decimal.NewFromInt(101), Size: decimal.RequireFromString("0.5"), CreatedAt: now.Add(4 * time.Second)},
+	}
+	for _, order := range orders {
+		order.Type = Limit
+		suite.NoError(suite.engine.AddOrder(ctx, order))
+	}
+
+	ids, err := suite.engine.MassCancel(ctx, 1, "BTC-USDT", Sell)
+	suite.NoError(err)
+	suite.Equal([]string{"btc-ask"}, ids)
+
+	ids, err = suite.engine.MassCancel(ctx, 1, "", 0)
+	suite.NoError(err)
+	suite.Equal([]string{"btc-bid", "eth-bid"}, ids)
+
+	ids, err = suite.engine.MassCancel(ctx, 1, "", 0)
+	suite.NoError(err)
+	suite.Empty(ids)
+
+	_, err = suite.engine.MassCancel(ctx, 1, "SOL-USDT", 0)
+	suite.ErrorIs(err, ErrMarketNotFound)
+	_, err = suite.engine.MassCancel(ctx, 1, "", Side(3))
+	suite.ErrorIs(err, ErrInvalidParam)
+
+	open, err := suite.engine.OpenOrders("BTC-USDT", 2)
+	suite.NoError(err)
+	suite.Require().Len(open, 1)
+	suite.Equal("other", open[0].ID)
+
+	// every cancelled order is published on its own with its remaining size.
+	// Books publish independently, so only the order within a book is fixed.
+	suite.Eventually(func() bool { return len(publishTrader.Batches()) == 4 }, time.Second, time.Millisecond)
+	markers := make(map[string]*Trade)
+	var btc []string
+	for _, batch := range publishTrader.Batches() {
+		if batch[0].MarketID == "BTC-USDT" {
+			btc = append(btc, batch[0].TakerOrderID)
+		}
+		if batch[0].IsCancel {
+			suite.Require().Len(batch, 1)
+			markers[batch[0].TakerOrderID] = batch[0]
+		}
+	}
+	suite.Equal([]string{"take", "btc-ask", "btc-bid"}, btc)
+	for _, expected := range []struct{ id, size string }{{"btc-ask", "1.5"}, {"btc-bid", "1"}, {"eth-bid", "1"}} {
+		trade := markers[expected.id]
+		suite.Require().NotNil(trade)
+		suite.Equal(expected.id, trade.MakerOrderID)
+		suite.Equal(int64(1), trade.TakerUserID)
+		suite.Equal(expected.size, trade.Size.String())
+	}
+}
+
+func (suite *MatchingEngineTestSuite) TestReplayMassCancel() {
+	dir := suite.T().TempDir()
+	journal, err := OpenFileJournal(filepath.Join(dir, "journal.log"))
+	suite.Require().NoError(err)
+	defer journal.Close()
+
+	market := "BTC-USDT"
+	crashed := NewMatchingEngineWithConfig(NewMemoryPublishTrader(), EngineConfig{Journal: journal})
+	suite.NoError(crashed.RegisterMarket(MarketConfig{ID: market}))
+
+	ctx := context.Background()
+	suite.NoError(crashed.Start(ctx))
+
+	suite.NoError(crashed.AddOrder(ctx, &Order{ID: "bid", UserID: 1, MarketID: market, Type: Limit, Side: Buy, Price: decimal.NewFromInt(99), Size: decimal.NewFromInt(1)}))
+	suite.NoError(crashed.AddOrder(ctx, &Order{ID: "ask", UserID: 1, MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(101), Size: decimal.NewFromInt(1)}))
+	ids, err := crashed.MassCancel(ctx, 1, market, Buy)
+	suite.NoError(err)
+	suite.Equal([]string{"bid"}, ids)
+	suite.NoError(journal.Flush())
+
+	suite.engine = NewMatchingEngineWithConfig(NewMemoryPublishTrader(), EngineConfig{Journal: journal})
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+	suite.NoError(suite.engine.Start(ctx))
+
+	open, err := suite.engine.OpenOrders(market, 1)
+	suite.NoError(err)
+	suite.Require().Len(open, 1)
+	suite.Equal("ask", open[0].ID)
+	suite.Equal(uint64(3), suite.engine.OrderBook(market).sequence)
+}
+
+func (suite *MatchingEngineTestSuite) TestCancelAll() {
+	publishTrader := &batchPublishTrader{}
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+
+	for _, market := range []string{"BTC-USDT", "ETH-USDT"} {
+		suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+	}
+
+	now := time.Now()
+	orders := []*Order{
+		{ID: "btc-ask", MarketID: "BTC-USDT", UserID: 1, Side: Sell, Price: decimal.NewFromInt(101), CreatedAt: now},
+		{ID: "btc-bid", MarketID: "BTC-USDT", UserID: 2, Side: Buy, Price: decimal.NewFromInt(99), CreatedAt: now.Add(time.Second)},
+		{ID: "eth-bid", MarketID: "ETH-USDT", UserID: 1, Side: Buy, Price: decimal.NewFromInt(10), CreatedAt: now.Add(2 * time.Second)},
+		{ID: "eth-ask", MarketID: "ETH-USDT", UserID: 3, Side: Sell, Price: decimal.NewFromInt(11), CreatedAt: now.Add(3 * time.Second)},
+	}
+	for _, order := range orders {
+		order.Type = Limit
+		order.Size = decimal.NewFromInt(1)
+		suite.NoError(suite.engine.AddOrder(ctx, order))
+	}
+
+	// a single cancel is published as a marker too
+	suite.NoError(suite.engine.CancelOrder(ctx, "ETH-USDT", "eth-ask"))
+
+	ids, err := suite.engine.CancelAll(ctx, "BTC-USDT")
+	suite.NoError(err)
+	suite.Equal([]string{"btc-ask", "btc-bid"}, ids)
+
+	ids, err = suite.engine.CancelAll(ctx, "")
+	suite.NoError(err)
+	suite.Equal([]string{"eth-bid"}, ids)
+
+	_, err = suite.engine.CancelAll(ctx, "SOL-USDT")
+	suite.ErrorIs(err, ErrMarketNotFound)
+
+	// books publish independently, so only the set of markers is fixed
+	suite.Eventually(func() bool { return len(publishTrader.Batches()) == 4 }, time.Second, time.Millisecond)
+	var published []string
+	for _, batch := range publishTrader.Batches() {
+		suite.Require().Len(batch, 1)
+		suite.True(batch[0].IsCancel)
+		published = append(published, batch[0].TakerOrderID)
+	}
+	suite.ElementsMatch([]string{"eth-ask", "btc-ask", "btc-bid", "eth-bid"}, published)
+
+	for _, market := range []string{"BTC-USDT", "ETH-USDT"} {
+		depth, err := suite.engine.Depth(market, 10, decimal.Zero)
+		suite.NoError(err)
+		suite.Empty(depth.Bids)
+		suite.Empty(depth.Asks)
+	}
+}
+
+// ocoSell places a sell list of a take-profit at 110 and a stop-loss that
+// triggers at 95 and sells down to 94
+func (suite *MatchingEngineTestSuite) ocoSell(engine *MatchingEngine, market string, listID string) error {
+	limit := &Order{ID: listID + "-tp", MarketID: market, UserID: 1, Type: Limit, Side: Sell, Price: decimal.NewFromInt(110), Size: decimal.NewFromInt(1)}
+	stop := &Order{ID: listID + "-sl", MarketID: market, UserID: 1, Type: StopLimit, Side: Sell, Price: decimal.NewFromInt(94), StopPrice: decimal.NewFromInt(95), Size: decimal.NewFromInt(1)}
+	return engine.AddOCO(context.Background(), listID, limit, stop)
+}
+
+func (suite *MatchingEngineTestSuite) TestOCO() {
+	publishTrader := &batchPublishTrader{}
+	suite.engine = NewMatchingEngine(publishTrader)
+
+	ctx := context.Background()
+	suite.NoError(suite.engine.Start(ctx))
+	market := "BTC-USDT"
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market, PricePrecision: 2, SizePrecision: 4}))
+
+	waitBatches := func(n int) [][]*Trade {
+		suite.Require().Eventually(func() bool { return len(publishTrader.Batches()) == n }, time.Second, time.Millisecond)
+		return publishTrader.Batches()
+	}
+
+	suite.Run("take profit cancels the stop", func() {
+		suite.NoError(suite.ocoSell(suite.engine, market, "a"))
+
+		open, err := suite.engine.OpenOrders(market, 1)
+		suite.NoError(err)
+		suite.Len(open, 2)
+
+		suite.NoError(suite.engine.AddOrder(ctx, &Order{ID: "take", MarketID: market, UserID: 2, Type: Limit, Side: Buy, Price: decimal.NewFromInt(110), Size: decimal.NewFromInt(1)}))
+
+		batches := waitBatches(2)
+		suite.Equal("take", batches[0][0].TakerOrderID)
+		suite.Equal("a-tp", batches[0][0].MakerOrderID)
+		suite.True(batches[1][0].IsCancel)
+		suite.Equal("a-sl", batches[1][0].TakerOrderID)
+
+		open, err = suite.engine.OpenOrders(market, 1)
+		suite.NoError(err)
+		suite.Empty(open)
+	})
+
+	suite.Run("stop loss cancels the take profit", func() {
+		suite.NoError(suite.ocoSell(suite.engine, market, "b"))
+		suite.NoError(suite.engine.AddOrder(ctx, &Order{ID: "bid", MarketID: market, UserID: 3, Type: Limit, Side: Buy, Price: decimal.NewFromInt(95), Size: decimal.NewFromInt(1)}))
+
+		// a trade at 95 triggers the stop, which takes the rest of the bid
+		suite.NoError(suite.engine.AddOrder(ctx, &Order{ID: "dump", MarketID: market, UserID: 2, Type: Limit, Side: Sell, Price: decimal.NewFromInt(95), Size: decimal.RequireFromString("0.5")}))
+
+		batches := waitBatches(5)
+		suite.Equal("dump", batches[2][0].TakerOrderID)
+		suite.True(batches[3][0].IsCancel)
+		suite.Equal("b-tp", batches[3][0].TakerOrderID)
+		suite.Require().Len(batches[4], 1)
+		suite.Equal("b-sl", batches[4][0].TakerOrderID)
+		suite.Equal(Limit, batches[4][0].TakerOrderType)
+		suite.Equal("95", batches[4][0].Price.String())
+		suite.Equal("0.5", batches[4][0].Size.String())
+
+		// the rest of the triggered stop rests at its limit price
+		open, err := suite.engine.OpenOrders(market, 1)
+		suite.NoError(err)
+		suite.Require().Len(open, 1)
+		suite.Equal("b-sl", open[0].ID)
+		suite.Equal(Limit, open[0].Type)
+		suite.Equal("0.5", open[0].Size.String())
+
+		_, err = suite.engine.MassCancel(ctx, 1, market, 0)
+		suite.NoError(err)
+		waitBatches(6)
+	})
+
+	suite.Run("cancel the list or one leg", func() {
+		// the last trade at 95 would trigger new stops right away
+		market := "ETH-USDT"
+		suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+
+		suite.NoError(suite.ocoSell(suite.engine, market, "c"))
+		suite.NoError(suite.engine.CancelOrderList(ctx, market, "c"))
+
+		batches := waitBatches(8)
+		suite.Equal("c-tp", batches[6][0].TakerOrderID)
+		suite.Equal("c-sl", batches[7][0].TakerOrderID)
+
+		suite.NoError(suite.ocoSell(suite.engine, market, "d"))
+		suite.NoError(suite.engine.CancelOrder(ctx, market, "d-sl"))
+
+		batches = waitBatches(10)
+		suite.Equal("d-sl", batches[8][0].TakerOrderID)
+		suite.Equal("d-tp", batches[9][0].TakerOrderID)
+	})
+
+	suite.Run("invalid lists", func() {
+		limit := &Order{ID: "e-tp", MarketID: market, Type: Limit, Side: Sell, Price: decimal.NewFromInt(90), Size: decimal.NewFromInt(1)}
+		stop := &Order{ID: "e-sl", MarketID: market, Type: StopLimit, Side: Sell, Price: decimal.NewFromInt(94), StopPrice: decimal.NewFromInt(95), Size: decimal.NewFromInt(1)}
+		suite.ErrorIs(suite.engine.AddOCO(ctx, "e", limit, stop), ErrInvalidParam)
+
+		limit.Price = decimal.NewFromInt(110)
+		stop.Type = Limit
+		suite.ErrorIs(suite.engine.AddOCO(ctx, "e", limit, stop), ErrInvalidParam)
+
+		stop.Type = StopLimit
+		stop.StopPrice = decimal.Zero
+		suite.ErrorIs(suite.engine.AddOCO(ctx, "e", limit, stop), ErrInvalidParam)
+	})
+}
+
+func (suite *MatchingEngineTestSuite) TestOCOSurvivesRestart() {
+	dir := suite.T().TempDir()
+	journal, err := OpenFileJournal(filepath.Join(dir, "journal.log"))
+	suite.Require().NoError(err)
+	defer journal.Close()
+	snapshots, err := NewFileSnapshotStore(filepath.Join(dir, "snapshots"))
+	suite.Require().NoError(err)
+
+	market := "BTC-USDT"
+	ctx := context.Background()
+
+	// the first list is in the snapshot, the second only in the journal
+	stopped := NewMatchingEngineWithConfig(NewMemoryPublishTrader(), EngineConfig{Journal: journal, Snapshots: snapshots})
+	suite.NoError(stopped.RegisterMarket(MarketConfig{ID: market}))
+	suite.NoError(stopped.Start(ctx))
+	suite.NoError(suite.ocoSell(stopped, market, "a"))
+	_, err = stopped.Stop(ctx)
+	suite.NoError(err)
+
+	crashed := NewMatchingEngineWithConfig(NewMemoryPublishTrader(), EngineConfig{Journal: journal, Snapshots: snapshots})
+	suite.NoError(crashed.RegisterMarket(MarketConfig{ID: market}))
+	suite.NoError(crashed.Start(ctx))
+	suite.NoError(suite.ocoSell(crashed, market, "b"))
+	_, err = crashed.Depth(market, 10, decimal.Zero)
+	suite.NoError(err)
+	suite.NoError(journal.Flush())
+
+	publishTrader := &batchPublishTrader{}
+	suite.engine = NewMatchingEngineWithConfig(publishTrader, EngineConfig{Journal: journal, Snapshots: snapshots})
+	suite.NoError(suite.engine.RegisterMarket(MarketConfig{ID: market}))
+	suite.NoError(suite.engine.Start(ctx))
+
+	stop, err := suite.engine.GetOrder(market, "a-sl")
+	suite.NoError(err)
+	suite.Equal(StopLimit, stop.Type)
+	suite.Equal("95", stop.StopPrice.String())
+
+	// both take profits fill, so both stops are cancelled
+	suite.NoError(suite.engine.AddOrder(ctx, &Order{ID: "take", MarketID: market, UserID: 2, Type: Limit, Side: Buy, Price: decimal.NewFromInt(110), Size: decimal.NewFromInt(2)}))
+
+	suite.Eventually(func() bool { return len(publishTrader.Batches()) == 3 }, time.Second, time.Millisecond)
+	batches := publishTrader.Batches()
+	suite.Len(batches[0], 2)
+	suite.Equal("a-sl", batches[1][0].TakerOrderID)
+	suite.Equal("b-sl", batches[2][0].TakerOrderID)
+
+	open, err := suite.engine.OpenOrders(market, 1)
+	suite.NoError(err)
+	suite.Empty(open)
+}
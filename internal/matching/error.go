@@ -7,4 +7,8 @@ var (
 	ErrInvalidParam          = errors.New("the param is invalid")
 	ErrInternal              = errors.New("internal server error")
 	ErrTimeout               = errors.New("timeout")
+	ErrMarketNotFound        = errors.New("the market is not registered")
+	ErrOverloaded            = errors.New("the order book is overloaded, retry later")
+	ErrEngineNotRunning      = errors.New("the matching engine is not running")
+	ErrOrderNotFound         = errors.New("the order is not resting in the book")
 )
@@ -0,0 +1,229 @@
+package matching
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+
+	"github.com/shopspring/decimal"
+)
+
+// Precisions used by books created without a market configuration
+const (
+	DefaultPricePrecision = 8
+	DefaultSizePrecision  = 8
+)
+
+// scale converts between the decimal prices and sizes of the API and the
+// integer ticks and lots the order book matches in. A price of 101.25 in a
+// market with a price precision of 2 is 10125 ticks.
+type scale struct {
+	priceExp int32
+	sizeExp  int32
+}
+
+var defaultScale = newScale(DefaultPricePrecision, DefaultSizePrecision)
+
+func newScale(pricePrecision, sizePrecision int) scale {
+	return scale{
+		priceExp: int32(pricePrecision),
+		sizeExp:  int32(sizePrecision),
+	}
+}
+
+// prepare converts an order to ticks and lots. Limit orders need a price on
+// the tick grid and a size and minimum size on the lot grid, stop orders a
+// stop price too and pegged orders an offset and limit instead of a price.
+// The size of a market order is a quote amount and may use the precision of
+// a price times a size, while its MaxSize is on the lot grid.
+func (s scale) prepare(order *Order) error {
+	return s.convert(order, false)
+}
+
+// prepareResting converts an order restored from a snapshot. Its size is
+// what remains of it, which may be less than its minimum size once it has
+// partly filled.
+func (s scale) prepareResting(order *Order) error {
+	return s.convert(order, true)
+}
+
+func (s scale) convert(order *Order, resting bool) error {
+	if order.Type == Market {
+		amount, ok := toUint128(order.Size, s.priceExp+s.sizeExp)
+		if !ok {
+			return ErrInvalidParam
+		}
+		if !order.MaxSize.IsZero() {
+			maxSize, ok := toInt64(order.MaxSize, s.sizeExp)
+			if !ok || maxSize <= 0 {
+				return ErrInvalidParam
+			}
+			order.size = maxSize
+		}
+		order.amount = amount
+		return nil
+	}
+
+	// the book prices pegged orders, their Price is only the last one
+	price, ok := toInt64(order.Price, s.priceExp)
+	if !ok || price < 0 || price == 0 && len(order.Peg) == 0 {
+		return ErrInvalidParam
+	}
+	size, ok := toInt64(order.Size, s.sizeExp)
+	if !ok || size <= 0 {
+		return ErrInvalidParam
+	}
+
+	if order.Type == StopLimit {
+		stop, ok := toInt64(order.StopPrice, s.priceExp)
+		if !ok || stop <= 0 {
+			return ErrInvalidParam
+		}
+		order.stop = stop
+	}
+	if !order.MinSize.IsZero() {
+		minSize, ok := toInt64(order.MinSize, s.sizeExp)
+		if !ok || minSize < 0 || minSize > size && !resting {
+			return ErrInvalidParam
+		}
+		order.minSize = minSize
+	}
+	if len(order.Peg) > 0 {
+		offset, ok := toInt64(order.PegOffset, s.priceExp)
+		if !ok {
+			return ErrInvalidParam
+		}
+		limit, ok := toInt64(order.PegLimit, s.priceExp)
+		if !ok || limit < 0 {
+			return ErrInvalidParam
+		}
+		order.pegOffset, order.pegLimit = offset, limit
+	}
+
+	order.price, order.size = price, size
+	return nil
+}
+
+func (s scale) price(ticks int64) decimal.Decimal {
+	return decimal.New(ticks, -s.priceExp)
+}
+
+func (s scale) size(lots int64) decimal.Decimal {
+	return decimal.New(lots, -s.sizeExp)
+}
+
+func (s scale) amount(amount uint128) decimal.Decimal {
+	return decimal.NewFromBigInt(amount.big(), -(s.priceExp + s.sizeExp))
+}
+
+// ticks converts a price to whole ticks, rounding towards zero
+func (s scale) ticks(price decimal.Decimal) int64 {
+	return price.Shift(s.priceExp).IntPart()
+}
+
+// remaining is the unfilled part of an order in its API form
+func (s scale) remaining(order *Order) decimal.Decimal {
+	if order.Type == Market {
+		return s.amount(order.amount)
+	}
+	return s.size(order.size)
+}
+
+// toInt64 scales d by 10^exp and fails if the result is fractional or does
+// not fit in an int64. It runs on every order, so it works on the
+// coefficient directly instead of going through decimal arithmetic.
+func toInt64(d decimal.Decimal, exp int32) (int64, bool) {
+	coef := d.Coefficient()
+	if !coef.IsInt64() {
+		return 0, false
+	}
+
+	// zero scales to zero whatever its exponent, and no other int64 survives
+	// more than 19 powers of ten either way, so a huge exponent fails here
+	// instead of looping
+	n := coef.Int64()
+	if n == 0 {
+		return 0, true
+	}
+	e := int64(d.Exponent()) + int64(exp)
+	if e > 19 || e < -19 {
+		return 0, false
+	}
+
+	for e != 0 {
+		if e < 0 {
+			if n%10 != 0 {
+				return 0, false
+			}
+			n /= 10
+			e++
+			continue
+		}
+
+		if n > math.MaxInt64/10 || n < math.MinInt64/10 {
+			return 0, false
+		}
+		n *= 10
+		e--
+	}
+
+	return n, true
+}
+
+func toUint128(d decimal.Decimal, exp int32) (uint128, bool) {
+	shifted := d.Shift(exp)
+	if !shifted.IsInteger() || shifted.IsNegative() {
+		return uint128{}, false
+	}
+
+	n := shifted.BigInt()
+	if n.BitLen() > 128 {
+		return uint128{}, false
+	}
+
+	lo := new(big.Int).And(n, new(big.Int).SetUint64(math.MaxUint64))
+	return uint128{
+		hi: new(big.Int).Rsh(n, 64).Uint64(),
+		lo: lo.Uint64(),
+	}, true
+}
+
+// uint128 holds quote amounts, which are ticks times lots and overflow an
+// int64 for ordinary notionals
+type uint128 struct {
+	hi, lo uint64
+}
+
+// notional returns ticks times lots
+func notional(ticks, lots int64) uint128 {
+	hi, lo := bits.Mul64(uint64(ticks), uint64(lots))
+	return uint128{hi: hi, lo: lo}
+}
+
+func (u uint128) isZero() bool {
+	return u.hi == 0 && u.lo == 0
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || u.hi == v.hi && u.lo < v.lo
+}
+
+// sub returns u - v; v must not be greater than u
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	hi, _ := bits.Sub64(u.hi, v.hi, borrow)
+	return uint128{hi: hi, lo: lo}
+}
+
+// div returns u / d rounded down. The quotient must fit in an int64, which
+// holds whenever u is less than d times an int64.
+func (u uint128) div(d int64) int64 {
+	q, _ := bits.Div64(u.hi, u.lo, uint64(d))
+	return int64(q)
+}
+
+func (u uint128) big() *big.Int {
+	n := new(big.Int).SetUint64(u.hi)
+	n.Lsh(n, 64)
+	return n.Or(n, new(big.Int).SetUint64(u.lo))
+}
@@ -0,0 +1,39 @@
+package matching
+
+import (
+	"math"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToInt64(t *testing.T) {
+	tests := []struct {
+		value string
+		exp   int32
+		want  int64
+		ok    bool
+	}{
+		{"1.25", 2, 125, true},
+		{"-1.25", 2, -125, true},
+		{"1.255", 2, 0, false},
+		{"1200", -2, 12, true},
+		{"1201", -2, 0, false},
+		{"0", 8, 0, true},
+		{"0e2000000000", 2, 0, true},
+		{"0e-2000000000", 2, 0, true},
+		{"1e2000000000", 2, 0, false},
+		{"1e-2000000000", 2, 0, false},
+		{"9223372036854775807", 0, math.MaxInt64, true},
+		{"922337203685477581", 1, 0, false},
+		{"1", 19, 0, false},
+		{"1", 20, 0, false},
+		{"1e19", -19, 1, true},
+	}
+	for _, tt := range tests {
+		got, ok := toInt64(decimal.RequireFromString(tt.value), tt.exp)
+		assert.Equal(t, tt.ok, ok, "%s scaled by 10^%d", tt.value, tt.exp)
+		assert.Equal(t, tt.want, got, "%s scaled by 10^%d", tt.value, tt.exp)
+	}
+}
@@ -0,0 +1,141 @@
+package matching
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalEntry is one order book command as it was sequenced
+type JournalEntry struct {
+	MarketID string    `json:"market_id"`
+	Sequence uint64    `json:"sequence"`
+	Type     string    `json:"type"` // add, cancel, add_list, cancel_list, mass_cancel or cancel_all
+	Order    *Order    `json:"order,omitempty"`
+	Orders   []*Order  `json:"orders,omitempty"` // add_list
+	OrderID  string    `json:"order_id,omitempty"`
+	ListID   string    `json:"list_id,omitempty"` // cancel_list
+	UserID   int64     `json:"user_id,omitempty"` // mass_cancel
+	Side     Side      `json:"side,omitempty"`    // mass_cancel, zero for both
+	Time     time.Time `json:"time"`
+}
+
+const (
+	journalAdd    = "add"
+	journalCancel = "cancel"
+
+	journalAddList    = "add_list"
+	journalCancelList = "cancel_list"
+
+	journalMassCancel = "mass_cancel"
+	journalCancelAll  = "cancel_all"
+)
+
+// Journal records every state-changing command before it is applied, so a
+// book can be rebuilt from its last snapshot after a crash.
+type Journal interface {
+	Append(entry *JournalEntry) error
+	// Flush makes every appended entry durable
+	Flush() error
+	// Replay calls fn for every entry in append order
+	Replay(fn func(entry *JournalEntry) error) error
+	// Reset discards all entries once they are covered by snapshots
+	Reset() error
+}
+
+// FileJournal is a Journal stored as JSON lines in a single file
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	w    *bufio.Writer
+}
+
+// OpenFileJournal opens or creates the journal file at path
+func OpenFileJournal(path string) (*FileJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileJournal{
+		path: path,
+		file: file,
+		w:    bufio.NewWriter(file),
+	}, nil
+}
+
+func (j *FileJournal) Append(entry *JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.w.Write(data); err != nil {
+		return err
+	}
+	return j.w.WriteByte('\n')
+}
+
+func (j *FileJournal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *FileJournal) Replay(fn func(entry *JournalEntry) error) error {
+	if err := j.Flush(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn last line from a crash ends the journal
+			break
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (j *FileJournal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close flushes and closes the journal file
+func (j *FileJournal) Close() error {
+	if err := j.Flush(); err != nil {
+		return err
+	}
+	return j.file.Close()
+}
@@ -2,9 +2,11 @@ package matching
 
 import (
 	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/nite-coder/blackbear/pkg/cast"
 	"github.com/shopspring/decimal"
 )
 
@@ -24,6 +26,10 @@ const (
 	IOC      OrderType = "ioc"       // 立即成交并取消剩余
 	PostOnly OrderType = "post_only" // be maker order only
 	Cancel   OrderType = "cancel"    // the order has been canceled
+
+	// StopLimit waits outside the book until the last trade price reaches
+	// StopPrice, then becomes a Limit order
+	StopLimit OrderType = "stop_limit"
 )
 
 type Order struct {
@@ -35,21 +41,48 @@ type Order struct {
 	Type      OrderType       `json:"type"`
 	UserID    int64           `json:"user_id"`
 	CreatedAt time.Time       `json:"created_at"`
+	StopPrice decimal.Decimal `json:"stop_price"`        // StopLimit
+	ListID    string          `json:"list_id,omitempty"` // set on the legs of an order list
+	Hidden    bool            `json:"hidden,omitempty"`  // rests out of depth and the BBO, behind displayed orders
+	Peg       PegType         `json:"peg,omitempty"`     // the book prices pegged Limit and PostOnly orders
+	PegOffset decimal.Decimal `json:"peg_offset"`        // added to the peg's reference price, may be negative
+	PegLimit  decimal.Decimal `json:"peg_limit"`         // highest price of a pegged buy, lowest of a sell; zero for none
+	MinSize   decimal.Decimal `json:"min_size"`          // smallest match a resting order accepts, zero for any
+	AllOrNone bool            `json:"all_or_none,omitempty"`
+	MaxSize   decimal.Decimal `json:"max_size"` // most a Market order may trade in the base asset, zero for no cap
+
+	// ClientOrderID is the user's own ID for the order, echoed on its trades
+	ClientOrderID string `json:"client_order_id,omitempty"`
+
+	// Price and Size in ticks and lots, set when the order enters the book.
+	// The book only updates these, so Size is the original size.
+	price int64
+	size  int64
+	stop  int64
+	// offset and limit of pegged orders in ticks
+	pegOffset int64
+	pegLimit  int64
+	minSize   int64
+	// amount replaces size for market orders, whose Size is a quote amount;
+	// their size holds MaxSize in lots
+	amount uint128
 }
 
 type Trade struct {
-	ID             string          `json:"id"`
-	MarketID       string          `json:"market_id"`
-	TakerOrderID   string          `json:"taker_order_id"`
-	TakerOrderSide Side            `json:"taker_order_side"`
-	TakerOrderType OrderType       `json:"taker_order_type"`
-	TakerUserID    int64           `json:"taker_user_id"`
-	MakerOrderID   string          `json:"maker_order_id"`
-	MakerUserID    int64           `json:"maker_user_id"`
-	Price          decimal.Decimal `json:"price"`
-	Size           decimal.Decimal `json:"size"`
-	IsCancel       bool            `json:"is_cancel"`
-	CreatedAt      time.Time       `json:"created_at"`
+	ID                 string          `json:"id"`
+	MarketID           string          `json:"market_id"`
+	TakerOrderID       string          `json:"taker_order_id"`
+	TakerClientOrderID string          `json:"taker_client_order_id,omitempty"`
+	TakerOrderSide     Side            `json:"taker_order_side"`
+	TakerOrderType     OrderType       `json:"taker_order_type"`
+	TakerUserID        int64           `json:"taker_user_id"`
+	MakerOrderID       string          `json:"maker_order_id"`
+	MakerClientOrderID string          `json:"maker_client_order_id,omitempty"`
+	MakerUserID        int64           `json:"maker_user_id"`
+	Price              decimal.Decimal `json:"price"`
+	Size               decimal.Decimal `json:"size"`
+	IsCancel           bool            `json:"is_cancel"`
+	CreatedAt          time.Time       `json:"created_at"`
 }
 
 type Response struct {
@@ -57,10 +90,55 @@ type Response struct {
 	Data  any
 }
 
-type Message struct {
-	Action  string
-	Payload any
-	Resp    chan *Response
+type commandType uint8
+
+const (
+	commandAddOrder commandType = iota + 1
+	commandCancelOrder
+	commandDepth
+	commandGetOrder
+	commandOpenOrders
+	commandMassCancel
+	commandCancelAll
+	commandAddList
+	commandCancelList
+)
+
+// command is the single input of an order book. Adds, cancels and queries
+// share one ring, so they are applied in exactly the order they were
+// accepted and replaying the same commands rebuilds the same book.
+type command struct {
+	typ     commandType
+	order   *Order         // commandAddOrder
+	orders  []*Order       // commandAddList
+	orderID string         // commandCancelOrder, commandGetOrder
+	listID  string         // commandCancelList
+	userID  int64          // commandOpenOrders, commandMassCancel
+	side    Side           // commandMassCancel, zero for both sides
+	depth   depthQuery     // commandDepth
+	resp    chan *Response // queries
+	state   *atomic.Int32  // queries, see queryWaiting
+}
+
+// A query starts out waiting. The journal stage takes it before sequencing
+// it, unless the caller gave up first, in which case the command is dropped
+// without being journaled or applied. Once taken, the caller waits for the
+// answer however long it takes, so ErrTimeout always means the command had
+// no effect and can be retried.
+const (
+	queryWaiting int32 = iota
+	queryTaken
+	queryAbandoned
+)
+
+// queryTimeout is how long a query may wait in the ring before its caller
+// gives up on it
+const queryTimeout = time.Second
+
+// take claims a query for processing. It reports false for a query whose
+// caller has given up.
+func (cmd *command) take() bool {
+	return cmd.state == nil || cmd.state.CompareAndSwap(queryWaiting, queryTaken)
 }
 
 type OrderBookUpdateEvent struct {
@@ -74,137 +152,621 @@ type Depth struct {
 	Bids []*DepthItem
 }
 
+type depthQuery struct {
+	limit uint32
+	group decimal.Decimal
+}
+
 // OrderBook type
 type OrderBook struct {
+	marketID      string
+	scale         scale
+	sequence      uint64
+	bookTicker    atomic.Pointer[BookTicker]
+	top           [4]int64 // bid and ask ticks and lots of bookTicker
 	bidQueue      *queue
 	askQueue      *queue
-	orderChan     chan *Order
-	cancelChan    chan string
-	depthChan     chan *Message
+	stops         *stopBook
+	lastPrice     int64 // ticks of the last trade, which triggers stops
+	ring          *commandRing
 	publishTrader PublishTrader
+
+	// order lists by ID, and the lists a command ended with the leg that
+	// ended each of them
+	lists map[string][]string
+	ended []listEnd
+
+	// pegged orders by ID, the bid and ask they were last priced from and
+	// the moves of the current command
+	pegs    map[string]*Order
+	pegRef  [2]int64
+	updates []*OrderUpdate
+
+	// set when the book runs on a worker pool instead of its own goroutine
+	wake      func()
+	scheduled atomic.Bool
+
+	// owned by the journal stage
+	journal       Journal
+	journalErrors uint64
+	sequenced     uint64
+
+	// setting stopping under mu stops new commands; done is closed once
+	// every claimed command has been published
+	mu       sync.RWMutex
+	stopping atomic.Bool
+	finished atomic.Bool
+	done     chan struct{}
 }
 
 func NewOrderBook(publishTrader PublishTrader) *OrderBook {
+	market := MarketConfig{
+		PricePrecision: DefaultPricePrecision,
+		SizePrecision:  DefaultSizePrecision,
+	}
+	return newOrderBook(market, publishTrader, DefaultInboxSize)
+}
+
+func newOrderBook(market MarketConfig, publishTrader PublishTrader, inboxSize int) *OrderBook {
+	scale := newScale(market.PricePrecision, market.SizePrecision)
+
 	return &OrderBook{
-		bidQueue:      NewBuyerQueue(),
-		askQueue:      NewSellerQueue(),
-		orderChan:     make(chan *Order, 1000000),
-		cancelChan:    make(chan string, 1000000),
-		depthChan:     make(chan *Message, 1000000),
+		marketID:      market.ID,
+		scale:         scale,
+		bidQueue:      newQueue(Buy, scale),
+		askQueue:      newQueue(Sell, scale),
+		stops:         newStopBook(scale),
+		ring:          newCommandRing(inboxSize),
 		publishTrader: publishTrader,
+		lists:         make(map[string][]string),
+		pegs:          make(map[string]*Order),
+		done:          make(chan struct{}),
 	}
 }
 
+// AddOrder queues an order. It fails with ErrInvalidParam if the price or
+// size is finer than the market's precision, and with ErrOverloaded instead
+// of waiting when the ring is full.
 func (book *OrderBook) AddOrder(ctx context.Context, order *Order) error {
 	if len(order.Type) == 0 || len(order.ID) == 0 {
 		return ErrInvalidParam
 	}
-
-	select {
-	case book.orderChan <- order:
-		return nil
-	case <-ctx.Done():
+	if len(order.Peg) > 0 && !order.Peg.valid(order.Type) {
+		return ErrInvalidParam
+	}
+	if order.AllOrNone || !order.MinSize.IsZero() {
+		if order.AllOrNone && !order.MinSize.IsZero() || order.Type != Limit && order.Type != PostOnly && order.Type != StopLimit {
+			return ErrInvalidParam
+		}
+	}
+	if err := book.scale.prepare(order); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
 		return ErrTimeout
 	}
+
+	return book.send(command{typ: commandAddOrder, order: order})
 }
 
+// CancelOrder queues a cancellation. Cancelling a resting order publishes a
+// cancel marker with its remaining size. It fails with ErrOverloaded instead
+// of waiting when the ring is full.
 func (book *OrderBook) CancelOrder(ctx context.Context, id string) error {
 	if len(id) == 0 {
 		return nil
 	}
+	if ctx.Err() != nil {
+		return ErrTimeout
+	}
 
-	select {
-	case book.cancelChan <- id:
+	return book.send(command{typ: commandCancelOrder, orderID: id})
+}
+
+// AddOCO queues a one-cancels-other list: a Limit or PostOnly leg and a
+// StopLimit leg on the same side for the same user. As soon as either leg
+// trades, triggers or is cancelled, the other is cancelled in the same
+// step. The limit price must be above the stop price of a sell list and
+// below that of a buy list.
+func (book *OrderBook) AddOCO(ctx context.Context, listID string, limit *Order, stop *Order) error {
+	if len(listID) == 0 || limit == nil || stop == nil || len(limit.ID) == 0 || len(stop.ID) == 0 || limit.ID == stop.ID {
+		return ErrInvalidParam
+	}
+	if limit.Type != Limit && limit.Type != PostOnly || stop.Type != StopLimit {
+		return ErrInvalidParam
+	}
+	if len(limit.Peg) > 0 || len(stop.Peg) > 0 {
+		return ErrInvalidParam
+	}
+	if limit.Side != stop.Side || limit.UserID != stop.UserID {
+		return ErrInvalidParam
+	}
+	for _, order := range []*Order{limit, stop} {
+		if err := book.scale.prepare(order); err != nil {
+			return err
+		}
+	}
+	if limit.Side == Sell && limit.price <= stop.stop || limit.Side == Buy && limit.price >= stop.stop {
+		return ErrInvalidParam
+	}
+	if ctx.Err() != nil {
+		return ErrTimeout
+	}
+
+	limit.ListID, stop.ListID = listID, listID
+	return book.send(command{typ: commandAddList, orders: []*Order{limit, stop}})
+}
+
+// CancelOrderList queues the cancellation of every leg of an order list that
+// is still in the book
+func (book *OrderBook) CancelOrderList(ctx context.Context, listID string) error {
+	if len(listID) == 0 {
 		return nil
-	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
 		return ErrTimeout
 	}
+
+	return book.send(command{typ: commandCancelList, listID: listID})
 }
 
-func (book *OrderBook) Depth(limit uint32) (*Depth, error) {
-	if limit == 0 {
+// MassCancel cancels every resting order of a user in one step, optionally
+// only on one side, and returns the IDs of the cancelled orders. No order of
+// the user can match between the first and the last cancellation.
+func (book *OrderBook) MassCancel(ctx context.Context, userID int64, side Side) ([]string, error) {
+	if side != 0 && side != Buy && side != Sell {
 		return nil, ErrInvalidParam
 	}
+	if ctx.Err() != nil {
+		return nil, ErrTimeout
+	}
 
-	msg := &Message{
-		Action:  "depth",
-		Payload: limit,
-		Resp:    make(chan *Response),
+	data, err := book.query(command{typ: commandMassCancel, userID: userID, side: side})
+	if err != nil {
+		return nil, err
 	}
 
+	ids, _ := data.([]string)
+	return ids, nil
+}
+
+// CancelAll cancels every resting order in one step, as a market halt does,
+// and returns the IDs of the cancelled orders
+func (book *OrderBook) CancelAll(ctx context.Context) ([]string, error) {
+	if ctx.Err() != nil {
+		return nil, ErrTimeout
+	}
+
+	data, err := book.query(command{typ: commandCancelAll})
+	if err != nil {
+		return nil, err
+	}
+
+	ids, _ := data.([]string)
+	return ids, nil
+}
+
+// send queues a command without waiting. It fails with ErrOverloaded when
+// the ring is full.
+func (book *OrderBook) send(cmd command) error {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	if book.stopping.Load() {
+		return ErrEngineNotRunning
+	}
+
+	seq, ok := book.ring.claim()
+	if !ok {
+		return ErrOverloaded
+	}
+	book.ring.publish(seq, cmd)
+
+	// hand the book to the worker pool, if it runs on one
+	if book.wake != nil {
+		book.wake()
+	}
+	return nil
+}
+
+// Depth returns up to limit price levels per side. A positive group buckets
+// the levels into multiples of that tick, rounding bids down and asks up.
+func (book *OrderBook) Depth(limit uint32, group decimal.Decimal) (*Depth, error) {
+	if limit == 0 || group.IsNegative() {
+		return nil, ErrInvalidParam
+	}
+
+	data, err := book.query(command{
+		typ:   commandDepth,
+		depth: depthQuery{limit: limit, group: group},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	depth, _ := data.(*Depth)
+	return depth, nil
+}
+
+// GetOrder returns a copy of a resting order or waiting stop order with its
+// remaining size, or ErrOrderNotFound if the order is not in the book
+func (book *OrderBook) GetOrder(id string) (*Order, error) {
+	if len(id) == 0 {
+		return nil, ErrInvalidParam
+	}
+
+	data, err := book.query(command{typ: commandGetOrder, orderID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	order, _ := data.(*Order)
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+// OpenOrders returns copies of a user's resting orders and waiting stop
+// orders with their remaining size, oldest first
+func (book *OrderBook) OpenOrders(userID int64) ([]*Order, error) {
+	data, err := book.query(command{typ: commandOpenOrders, userID: userID})
+	if err != nil {
+		return nil, err
+	}
+
+	orders, _ := data.([]*Order)
+	return orders, nil
+}
+
+// query sends a command and waits for the match stage to answer. Queries
+// are sequenced like any other command, so they reflect every order
+// accepted before them. A query still queued after queryTimeout is
+// abandoned and fails with ErrTimeout without taking effect; one the book
+// has already taken is always waited for.
+func (book *OrderBook) query(cmd command) (any, error) {
+	resp := make(chan *Response, 1)
+	cmd.resp = resp
+	cmd.state = new(atomic.Int32)
+	if err := book.send(cmd); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
 	select {
-	case book.depthChan <- msg:
-		resp := <-msg.Resp
-		if resp.Error != nil {
-			return nil, resp.Error
+	case result := <-resp:
+		return result.Data, result.Error
+	case <-timer.C:
+		if cmd.state.CompareAndSwap(queryWaiting, queryAbandoned) {
+			return nil, ErrTimeout
 		}
+	}
 
-		if resp.Data != nil {
-			result, ok := resp.Data.(*Depth)
-			if ok {
-				return result, nil
-			}
+	result := <-resp
+	return result.Data, result.Error
+}
+
+// Start runs the journal, match and publish stages until the book is
+// stopped and every claimed command has been published
+func (book *OrderBook) Start() error {
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go book.runStage(&wg, book.ring.journalWake, &book.ring.journaled, book.journalStage)
+	go book.runStage(&wg, book.ring.matchWake, &book.ring.matched, book.matchStage)
+	go book.runStage(&wg, book.ring.publishWake, &book.ring.released, book.publishStage)
+	wg.Wait()
+
+	book.finish()
+	return nil
+}
+
+// runBatch runs each stage once over up to max commands on the calling
+// goroutine and returns how many new commands it took in
+func (book *OrderBook) runBatch(max int) int {
+	n := book.journalStage(max)
+	book.matchStage(max)
+	book.publishStage(max)
+
+	if book.stopping.Load() && book.ring.released.Load() == book.ring.claimed.Load() {
+		book.finish()
+	}
+	return n
+}
+
+// stop refuses new commands and returns how many are still queued. The
+// queued commands are processed before done is closed.
+func (book *OrderBook) stop() int {
+	book.mu.Lock()
+	if book.stopping.Load() {
+		book.mu.Unlock()
+		return 0
+	}
+	book.stopping.Store(true)
+	queued := book.ring.queued()
+	book.mu.Unlock()
+
+	// parked stages must wake up to notice the stop
+	notify(book.ring.journalWake)
+	notify(book.ring.matchWake)
+	notify(book.ring.publishWake)
+	if book.wake != nil {
+		book.wake()
+	}
+
+	return queued
+}
+
+func (book *OrderBook) finish() {
+	if book.finished.CompareAndSwap(false, true) {
+		close(book.done)
+	}
+}
+
+// pending reports whether any stage has work it can do now
+func (book *OrderBook) pending() bool {
+	ring := book.ring
+	journaled := ring.journaled.Load()
+	return ring.available(journaled, 1) > journaled ||
+		ring.matched.Load() < journaled ||
+		ring.released.Load() < ring.matched.Load()
+}
+
+// process applies one journaled command and leaves its events in the slot
+// for the publish stage
+func (book *OrderBook) process(slot *ringSlot) {
+	cmd := slot.cmd
+	switch cmd.typ {
+	case commandAddOrder:
+		book.sequence = slot.sequence
+		slot.trades = book.addOrder(cmd.order)
+		slot.ticker = book.updateBookTicker()
+	case commandCancelOrder:
+		book.sequence = slot.sequence
+		slot.trades = book.cancelOrder(cmd.orderID)
+		slot.ticker = book.updateBookTicker()
+	case commandAddList:
+		book.sequence = slot.sequence
+		slot.trades = book.addList(cmd.orders)
+		slot.ticker = book.updateBookTicker()
+	case commandCancelList:
+		book.sequence = slot.sequence
+		slot.trades = book.cancelList(cmd.listID)
+		slot.ticker = book.updateBookTicker()
+	case commandMassCancel, commandCancelAll:
+		book.sequence = slot.sequence
+		if cmd.typ == commandCancelAll {
+			slot.trades = book.cancelAll()
+		} else {
+			slot.trades = book.massCancel(cmd.userID, cmd.side)
 		}
+		slot.ticker = book.updateBookTicker()
 
-		return nil, nil
-	case <-time.After(time.Second):
-		return nil, ErrTimeout
+		ids := make([]string, len(slot.trades))
+		for i, trade := range slot.trades {
+			ids[i] = trade.TakerOrderID
+		}
+		book.answer(cmd, ids)
+	case commandDepth:
+		book.answer(cmd, book.depth(cmd.depth.limit, cmd.depth.group))
+	case commandGetOrder:
+		book.answer(cmd, book.restingOrder(cmd.orderID))
+	case commandOpenOrders:
+		book.answer(cmd, book.openOrders(cmd.userID))
 	}
+	slot.updates, book.updates = book.updates, nil
 }
 
-func (book *OrderBook) Start() error {
-	for {
-		select {
-		case order := <-book.orderChan:
-			book.addOrder(order)
-		case orderID := <-book.cancelChan:
-			book.cancelOrder(orderID)
-		case msg := <-book.depthChan:
-			limit, _ := cast.ToUint32(msg.Payload)
-			result := book.depth(limit)
-			resp := Response{
-				Error: nil,
-				Data:  result,
-			}
+func (book *OrderBook) answer(cmd command, data any) {
+	// the channel is buffered and answered once, so this never blocks
+	cmd.resp <- &Response{Data: data}
+}
+
+// publish hands the events of one command to the publisher. Consumers
+// expect the outcome of one order per call, while a command may end several
+// orders, so the trades are split wherever the taker changes. Pegged orders
+// the command moved follow its trades.
+func (book *OrderBook) publish(trades []*Trade, updates []*OrderUpdate, ticker *BookTicker) {
+	for start := 0; start < len(trades); {
+		end := start + 1
+		for end < len(trades) && trades[end].TakerOrderID == trades[start].TakerOrderID {
+			end++
+		}
+		book.publishTrader.PublishTrades(trades[start:end]...)
+		start = end
+	}
+	if len(updates) > 0 {
+		if publisher, ok := book.publishTrader.(OrderUpdatePublisher); ok {
+			publisher.PublishOrderUpdates(updates...)
+		}
+	}
+	if ticker == nil {
+		return
+	}
+	if publisher, ok := book.publishTrader.(BookTickerPublisher); ok {
+		publisher.PublishBookTicker(ticker)
+	}
+}
+
+// record appends a command to the journal before it is applied. A failing
+// journal does not stop matching; failures are counted and reported on Stop.
+func (book *OrderBook) record(entry *JournalEntry) {
+	if book.journal == nil {
+		return
+	}
+
+	entry.MarketID = book.marketID
+	entry.Time = time.Now().UTC()
+	if err := book.journal.Append(entry); err != nil {
+		book.journalErrors++
+	}
+}
+
+// flushJournal makes the commands recorded in this ring cycle durable. Like
+// a failing append, a failing flush is counted rather than stopping matching.
+func (book *OrderBook) flushJournal() {
+	if book.journal == nil {
+		return
+	}
+
+	if err := book.journal.Flush(); err != nil {
+		book.journalErrors++
+	}
+}
 
-			msg.Resp <- &resp
+// replay applies a journaled command without journaling it again
+func (book *OrderBook) replay(entry *JournalEntry) {
+	book.sequence = entry.Sequence
+	switch entry.Type {
+	case journalAdd:
+		if book.scale.prepare(entry.Order) == nil {
+			_ = book.addOrder(entry.Order)
 		}
+	case journalCancel:
+		_ = book.cancelOrder(entry.OrderID)
+	case journalAddList:
+		for _, order := range entry.Orders {
+			if book.scale.prepare(order) != nil {
+				return
+			}
+		}
+		_ = book.addList(entry.Orders)
+	case journalCancelList:
+		_ = book.cancelList(entry.ListID)
+	case journalMassCancel:
+		_ = book.massCancel(entry.UserID, entry.Side)
+	case journalCancelAll:
+		_ = book.cancelAll()
 	}
+	book.updates = nil
+}
+
+func (book *OrderBook) addOrder(order *Order) []*Trade {
+	return book.cascade(book.execute(order))
 }
 
-func (book *OrderBook) addOrder(order *Order) {
+// execute matches an order, or sets a stop order aside
+func (book *OrderBook) execute(order *Order) []*Trade {
 	var trades []*Trade
 
 	switch order.Type {
 	case Limit, FOK, IOC, PostOnly, Cancel:
+		if len(order.Peg) > 0 && !book.pegOrder(order) {
+			// nothing to peg to
+			trades = append(trades, book.cancelTrade(order))
+			break
+		}
 		trades, _ = book.handleOrder(order)
 	case Market:
 		trades, _ = book.handleMarketOrder(order)
+	case StopLimit:
+		book.stops.insert(order)
 	}
 
-	if len(trades) > 0 {
-		book.publishTrader.PublishTrades(trades...)
+	return trades
+}
+
+// cancelOrder removes a resting or waiting stop order and returns its cancel
+// marker, along with those of the other legs of its list. It returns nil if
+// the order is not in the book.
+func (book *OrderBook) cancelOrder(id string) []*Trade {
+	order := book.restingOrder(id)
+	if order == nil {
+		return nil
 	}
+
+	return book.cascade(book.cancelOrders([]*Order{order}))
 }
 
-func (book *OrderBook) cancelOrder(id string) {
-	order := book.askQueue.order(id)
-	if order != nil {
-		book.askQueue.removeOrder(order.Price, id)
-		return
+// massCancel removes a user's resting orders, oldest first, and returns a
+// cancel marker with the remaining size of each of them
+func (book *OrderBook) massCancel(userID int64, side Side) []*Trade {
+	var orders []*Order
+	if side != Sell {
+		orders = append(orders, book.bidQueue.userOrders(userID)...)
 	}
+	if side != Buy {
+		orders = append(orders, book.askQueue.userOrders(userID)...)
+	}
+	orders = append(orders, book.stops.userOrders(userID, side)...)
+	sortOrders(orders)
 
-	order = book.bidQueue.order(id)
-	if order != nil {
-		book.bidQueue.removeOrder(order.Price, id)
-		return
+	return book.cascade(book.cancelOrders(orders))
+}
+
+// cancelAll removes every resting and waiting stop order, oldest first, and
+// returns their cancel markers
+func (book *OrderBook) cancelAll() []*Trade {
+	orders := append(book.bidQueue.allOrders(), book.askQueue.allOrders()...)
+	orders = append(orders, book.stops.allOrders()...)
+	sortOrders(orders)
+
+	return book.cascade(book.cancelOrders(orders))
+}
+
+// cancelOrders removes copies of resting and waiting stop orders from the
+// book and returns a cancel marker with the remaining size of each
+func (book *OrderBook) cancelOrders(orders []*Order) []*Trade {
+	trades := make([]*Trade, 0, len(orders))
+	for _, order := range orders {
+		trades = append(trades, book.cancelTrade(order))
+		switch {
+		case order.Type == StopLimit:
+			book.stops.remove(order.ID)
+		case order.Side == Buy:
+			book.bidQueue.removeOrder(order.price, order.ID)
+		default:
+			book.askQueue.removeOrder(order.price, order.ID)
+		}
+	}
+
+	return trades
+}
+
+// restingOrder returns a copy of a resting or waiting stop order, or nil
+func (book *OrderBook) restingOrder(id string) *Order {
+	if order := book.bidQueue.order(id); order != nil {
+		return book.bidQueue.view(order)
+	}
+	if order := book.askQueue.order(id); order != nil {
+		return book.askQueue.view(order)
+	}
+	if order := book.stops.order(id); order != nil {
+		return book.stops.view(order)
+	}
+
+	return nil
+}
+
+// openOrders returns copies of a user's resting orders on both sides and
+// waiting stop orders, oldest first
+func (book *OrderBook) openOrders(userID int64) []*Order {
+	orders := append(book.bidQueue.userOrders(userID), book.askQueue.userOrders(userID)...)
+	orders = append(orders, book.stops.userOrders(userID, 0)...)
+	sortOrders(orders)
+
+	return orders
+}
+
+func sortOrders(orders []*Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		return older(orders[i], orders[j])
+	})
+}
+
+// older orders orders by creation time, then ID
+func older(a, b *Order) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID < b.ID
 	}
+	return a.CreatedAt.Before(b.CreatedAt)
 }
 
-func (book *OrderBook) depth(limit uint32) *Depth {
+func (book *OrderBook) depth(limit uint32, group decimal.Decimal) *Depth {
 	return &Depth{
-		Asks: book.askQueue.depth(limit),
-		Bids: book.bidQueue.depth(limit),
+		Asks: book.askQueue.groupedDepth(limit, group),
+		Bids: book.bidQueue.groupedDepth(limit, group),
 	}
 }
 
@@ -220,166 +782,56 @@ func (book *OrderBook) handleOrder(order *Order) ([]*Trade, error) {
 
 	trades := []*Trade{}
 
-	// ensure the order book can handle FOK order
+	// a FOK order is cancelled unless the orders it crosses can fill all of
+	// it, and an order with a minimum that crosses unless they fill that
+	// much at once
+	head := targetQueue.getHeadOrder()
+	need := order.minimum()
 	if order.Type == FOK {
+		need = order.size
+	} else if head == nil || !crosses(order, head) {
+		need = 0
+	}
+	if need > 0 && targetQueue.fillable(order) < need {
+		trades = append(trades, book.cancelTrade(order))
+		return trades, nil
+	}
 
-		el := targetQueue.depthList.Front()
-		orignalOrderSize := order.Size
-
-		for {
-			if el == nil {
-				trade := Trade{
-					MarketID:       order.MarketID,
-					TakerOrderID:   order.ID,
-					TakerOrderSide: order.Side,
-					TakerOrderType: order.Type,
-					TakerUserID:    order.UserID,
-					MakerOrderID:   order.ID,
-					MakerUserID:    order.UserID,
-					Price:          order.Price,
-					Size:           order.Size,
-					IsCancel:       true,
-					CreatedAt:      time.Now().UTC(),
-				}
-				trades = append(trades, &trade)
-				return trades, nil
-			}
-
-			unit, _ := el.Value.(*priceUnit)
-			tOrd, _ := unit.list.Front().Value.(*Order)
-
-			if order.Side == Buy && order.Price.GreaterThanOrEqual(tOrd.Price) && order.Size.GreaterThanOrEqual(unit.totalSize) ||
-				order.Side == Sell && order.Price.LessThanOrEqual(tOrd.Price) && order.Size.GreaterThanOrEqual(unit.totalSize) {
-				order.Size = order.Size.Sub(tOrd.Size)
-
-				if order.Size.Equal(decimal.Zero) {
-					order.Size = orignalOrderSize
-					break
-				}
-			}
-
-			if order.Size.LessThan(decimal.Zero) {
-				trade := Trade{
-					MarketID:       order.MarketID,
-					TakerOrderID:   order.ID,
-					TakerOrderSide: order.Side,
-					TakerOrderType: order.Type,
-					TakerUserID:    order.UserID,
-					MakerOrderID:   order.ID,
-					MakerUserID:    order.UserID,
-					Price:          order.Price,
-					Size:           order.Size,
-					IsCancel:       true,
-					CreatedAt:      time.Now().UTC(),
-				}
-				trades = append(trades, &trade)
-				return trades, nil
-			}
-
-			el = el.Next()
-		}
+	if order.Type == PostOnly && head != nil && crosses(order, head) {
+		trades = append(trades, book.cancelTrade(order))
+		return trades, nil
 	}
 
-	for {
-		tOrd := targetQueue.popHeadOrder()
-
-		if tOrd == nil {
-			switch order.Type {
-			case Limit, PostOnly:
-				myQueue.insertOrder(order, false)
-				return trades, nil
-			case IOC:
-				trade := Trade{
-					MarketID:       order.MarketID,
-					TakerOrderID:   order.ID,
-					TakerOrderSide: order.Side,
-					TakerOrderType: order.Type,
-					TakerUserID:    order.UserID,
-					MakerOrderID:   order.ID,
-					MakerUserID:    order.UserID,
-					Price:          order.Price,
-					Size:           order.Size,
-					IsCancel:       true,
-					CreatedAt:      time.Now().UTC(),
-				}
-				trades = append(trades, &trade)
-				return trades, nil
-			}
+	// resting orders that do not accept the match are passed over and keep
+	// their place
+	targetQueue.eachOrder(func(tOrd *Order) bool {
+		if !crosses(order, tOrd) {
+			return false
 		}
 
-		if order.Side == Buy && order.Price.LessThan(tOrd.Price) ||
-			order.Side == Sell && order.Price.GreaterThan(tOrd.Price) {
-			targetQueue.insertOrder(tOrd, true)
-
-			switch order.Type {
-			case Limit, PostOnly:
-				myQueue.insertOrder(order, false)
-				return trades, nil
-			case IOC:
-				trade := Trade{
-					MarketID:       order.MarketID,
-					TakerOrderID:   order.ID,
-					TakerOrderSide: order.Side,
-					TakerOrderType: order.Type,
-					TakerUserID:    order.UserID,
-					MakerOrderID:   order.ID,
-					MakerUserID:    order.UserID,
-					Price:          order.Price,
-					Size:           order.Size,
-					IsCancel:       true,
-					CreatedAt:      time.Now().UTC(),
-				}
-				trades = append(trades, &trade)
-				return trades, nil
-			}
+		lots := min(order.size, tOrd.size)
+		if !tOrd.accepts(lots) {
+			return true
 		}
 
-		if order.Type == PostOnly {
-			targetQueue.addOrder(tOrd)
-			trade := Trade{
-				MarketID:       order.MarketID,
-				TakerOrderID:   order.ID,
-				TakerOrderSide: order.Side,
-				TakerOrderType: order.Type,
-				TakerUserID:    order.UserID,
-				MakerOrderID:   order.ID,
-				MakerUserID:    order.UserID,
-				Price:          order.Price,
-				Size:           order.Size,
-				IsCancel:       true,
-				CreatedAt:      time.Now().UTC(),
-			}
-			trades = append(trades, &trade)
-			return trades, nil
+		trades = append(trades, book.fillTrade(order, tOrd, lots))
+		order.size -= lots
+		if lots == tOrd.size {
+			targetQueue.removeOrder(tOrd.price, tOrd.ID)
+		} else {
+			targetQueue.reduceOrder(tOrd, lots)
 		}
 
-		if order.Size.GreaterThanOrEqual(tOrd.Size) {
-			trade := Trade{
-				TakerOrderID: order.ID,
-				MakerOrderID: tOrd.ID,
-				Price:        tOrd.Price,
-				Size:         tOrd.Size,
-				CreatedAt:    time.Now().UTC(),
-			}
-			trades = append(trades, &trade)
-			order.Size = order.Size.Sub(tOrd.Size)
+		return order.size > 0
+	})
 
-			if order.Size.Equal(decimal.Zero) {
-				break
-			}
-		} else {
-			trade := Trade{
-				TakerOrderID: order.ID,
-				MakerOrderID: tOrd.ID,
-				Price:        tOrd.Price,
-				Size:         order.Size,
-				CreatedAt:    time.Now().UTC(),
-			}
-			trades = append(trades, &trade)
-			tOrd.Size = tOrd.Size.Sub(order.Size)
-			targetQueue.insertOrder(tOrd, true)
-
-			break
+	if order.size > 0 {
+		switch order.Type {
+		case Limit, PostOnly:
+			myQueue.insertOrder(order, false)
+		default:
+			// IOC, and FOK if the book changed under it
+			trades = append(trades, book.cancelTrade(order))
 		}
 	}
 
@@ -394,61 +846,121 @@ func (book *OrderBook) handleMarketOrder(order *Order) ([]*Trade, error) {
 
 	trades := []*Trade{}
 
-	for {
-		tOrd := targetQueue.popHeadOrder()
-
-		if tOrd == nil {
-			trade := Trade{
-				MarketID:       order.MarketID,
-				TakerOrderID:   order.ID,
-				TakerOrderSide: order.Side,
-				TakerOrderType: order.Type,
-				TakerUserID:    order.UserID,
-				MakerOrderID:   order.ID,
-				MakerUserID:    order.UserID,
-				Price:          order.Price,
-				Size:           order.Size,
-				IsCancel:       true,
-				CreatedAt:      time.Now().UTC(),
-			}
-			trades = append(trades, &trade)
-			return trades, nil
+	// a capped order stops once it traded MaxSize
+	capped, maxLots := order.size > 0, order.size
+
+	filled := false
+	targetQueue.eachOrder(func(tOrd *Order) bool {
+		lots := tOrd.size
+		if capped {
+			lots = min(lots, maxLots)
 		}
 
 		// The size of the market order is the total amount, not the quantity.
-		amount := tOrd.Price.Mul(tOrd.Size)
-
-		if order.Size.GreaterThanOrEqual(amount) {
-			trade := Trade{
-				TakerOrderID: order.ID,
-				MakerOrderID: tOrd.ID,
-				Price:        tOrd.Price,
-				Size:         tOrd.Size,
-				CreatedAt:    time.Now().UTC(),
-			}
-			trades = append(trades, &trade)
-			order.Size = order.Size.Sub(amount)
-			if order.Size.Equal(decimal.Zero) {
-				break
-			}
-		} else {
-			tSize := order.Size.Div(tOrd.Price)
-
-			trade := Trade{
-				TakerOrderID: order.ID,
-				MakerOrderID: tOrd.ID,
-				Price:        tOrd.Price,
-				Size:         tSize,
-				CreatedAt:    time.Now().UTC(),
+		amount := notional(tOrd.price, lots)
+		if order.amount.less(amount) {
+			// whatever is left is less than that at this price
+			lots = order.amount.div(tOrd.price)
+			if lots == 0 {
+				return false
 			}
-			trades = append(trades, &trade)
+			amount = notional(tOrd.price, lots)
+		}
 
-			tOrd.Size = tOrd.Size.Sub(tSize)
-			targetQueue.insertOrder(tOrd, true)
+		whole := lots == tOrd.size
+		if !whole && !tOrd.accepts(lots) {
+			return true
+		}
 
-			break
+		trades = append(trades, book.fillTrade(order, tOrd, lots))
+		order.amount = order.amount.sub(amount)
+		if whole {
+			targetQueue.removeOrder(tOrd.price, tOrd.ID)
+		} else {
+			targetQueue.reduceOrder(tOrd, lots)
+		}
+		if capped {
+			maxLots -= lots
 		}
+
+		filled = !whole || order.amount.isZero() || capped && maxLots == 0
+		return !filled
+	})
+
+	if !filled {
+		trades = append(trades, book.cancelTrade(order))
 	}
 
 	return trades, nil
 }
+
+// crosses reports whether a limit order can trade with a resting order
+func crosses(order *Order, resting *Order) bool {
+	if order.Side == Buy {
+		return order.price >= resting.price
+	}
+	return order.price <= resting.price
+}
+
+// minimum returns the fewest lots an order accepts in one match, or zero
+// for any. An all-or-none order only trades its whole remaining size, and a
+// minimum size no longer applies once less than it remains.
+func (order *Order) minimum() int64 {
+	if order.AllOrNone {
+		return order.size
+	}
+	return min(order.minSize, order.size)
+}
+
+// accepts reports whether a resting order may trade lots in one match
+func (order *Order) accepts(lots int64) bool {
+	return lots >= order.minimum()
+}
+
+func (order *Order) constrained() bool {
+	return order.AllOrNone || order.minSize > 0
+}
+
+// fillTrade is a fill of lots between a taker and a resting order at the
+// resting order's price
+func (book *OrderBook) fillTrade(order *Order, maker *Order, lots int64) *Trade {
+	book.lastPrice = maker.price
+	book.endList(order)
+	book.endList(maker)
+
+	return &Trade{
+		MarketID:           order.MarketID,
+		TakerOrderID:       order.ID,
+		TakerClientOrderID: order.ClientOrderID,
+		TakerOrderSide:     order.Side,
+		TakerOrderType:     order.Type,
+		TakerUserID:        order.UserID,
+		MakerOrderID:       maker.ID,
+		MakerClientOrderID: maker.ClientOrderID,
+		MakerUserID:        maker.UserID,
+		Price:              book.scale.price(maker.price),
+		Size:               book.scale.size(lots),
+		CreatedAt:          time.Now().UTC(),
+	}
+}
+
+// cancelTrade marks the unfilled rest of a taker order as cancelled
+func (book *OrderBook) cancelTrade(order *Order) *Trade {
+	book.endList(order)
+
+	return &Trade{
+		MarketID:           order.MarketID,
+		TakerOrderID:       order.ID,
+		TakerClientOrderID: order.ClientOrderID,
+		TakerOrderSide:     order.Side,
+		TakerOrderType:     order.Type,
+		TakerUserID:        order.UserID,
+		MakerOrderID:       order.ID,
+		MakerClientOrderID: order.ClientOrderID,
+		MakerUserID:        order.UserID,
+		Price:              order.Price,
+		Size:               book.scale.remaining(order),
+		IsCancel:           true,
+		CreatedAt:          time.Now().UTC(),
+	}
+}
@@ -0,0 +1,1222 @@
+package matching
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+)
+
+type OrderBookTestSuite struct {
+	suite.Suite
+}
+
+func TestOrderBookTestSuite(t *testing.T) {
+	orderBookTestSuite := &OrderBookTestSuite{}
+	suite.Run(t, orderBookTestSuite)
+}
+
+func (suite *OrderBookTestSuite) createTestOrderBook() *OrderBook {
+	ctx := context.Background()
+
+	publishTrader := NewMemoryPublishTrader()
+	orderBook := NewOrderBook(publishTrader)
+	go func() {
+		_ = orderBook.Start()
+	}()
+
+	orderBuy1 := &Order{
+		ID:    "buy-1",
+		Type:  Limit,
+		Side:  Buy,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(90),
+	}
+
+	err := orderBook.AddOrder(ctx, orderBuy1)
+	suite.NoError(err)
+
+	orderBuy2 := &Order{
+		ID:    "buy-2",
+		Type:  Limit,
+		Side:  Buy,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(80),
+	}
+
+	err = orderBook.AddOrder(ctx, orderBuy2)
+	suite.NoError(err)
+
+	orderBuy3 := &Order{
+		ID:    "buy-3",
+		Type:  Limit,
+		Side:  Buy,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(70),
+	}
+
+	err = orderBook.AddOrder(ctx, orderBuy3)
+	suite.NoError(err)
+
+	orderSell1 := &Order{
+		ID:    "sell-1",
+		Type:  Limit,
+		Side:  Sell,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(110),
+	}
+	err = orderBook.AddOrder(ctx, orderSell1)
+	suite.NoError(err)
+
+	orderSell2 := &Order{
+		ID:    "sell-2",
+		Type:  Limit,
+		Side:  Sell,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(120),
+	}
+	err = orderBook.AddOrder(ctx, orderSell2)
+	suite.NoError(err)
+
+	orderSell3 := &Order{
+		ID:    "sell-3",
+		Type:  Limit,
+		Side:  Sell,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(130),
+	}
+	err = orderBook.AddOrder(ctx, orderSell3)
+	suite.NoError(err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	return orderBook
+}
+
+func (suite *OrderBookTestSuite) TestLimitOrders() {
+	ctx := context.Background()
+
+	suite.Run("take all orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "buyAll",
+			Type:  Limit,
+			Side:  Buy,
+			Price: decimal.NewFromInt(1000),
+			Size:  decimal.NewFromInt(10),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 3)
+
+		suite.Equal(int64(0), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(4), testOrderBook.bidQueue.depthCount())
+
+	})
+
+	suite.Run("take some orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "mysell",
+			Type:  Limit,
+			Side:  Sell,
+			Size:  decimal.NewFromInt(5),
+			Price: decimal.NewFromInt(75),
+		}
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 2)
+
+		suite.Equal(int64(4), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(1), testOrderBook.bidQueue.depthCount())
+	})
+}
+
+func (suite *OrderBookTestSuite) TestMarketOrder() {
+	ctx := context.Background()
+
+	suite.Run("take all orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "buyAll",
+			Type:  Market,
+			Side:  Buy,
+			Price: decimal.NewFromInt(0),
+			Size:  decimal.NewFromInt(110).Add(decimal.NewFromInt(120)).Add(decimal.NewFromInt(130)),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 3)
+
+		suite.Equal(int64(0), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take some orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "mysell",
+			Type:  Market,
+			Side:  Sell,
+			Price: decimal.NewFromInt(0),
+			Size:  decimal.NewFromInt(90),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 1)
+
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(2), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("stop at max size", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:      "cappedSell",
+			Type:    Market,
+			Side:    Sell,
+			Price:   decimal.NewFromInt(0),
+			Size:    decimal.NewFromInt(1000),
+			MaxSize: decimal.RequireFromString("1.5"),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Require().Equal(2, memoryPublishTrader.Count())
+		suite.Equal("1", memoryPublishTrader.Get(0).Size.String())
+		suite.Equal("0.5", memoryPublishTrader.Get(1).Size.String())
+		suite.Equal("80", memoryPublishTrader.Get(1).Price.String())
+
+		suite.Equal(int64(2), testOrderBook.bidQueue.depthCount())
+		suite.Equal("0.5", testOrderBook.restingOrder("buy-2").Size.String())
+	})
+}
+
+func (suite *OrderBookTestSuite) TestPostOnlyOrder() {
+	ctx := context.Background()
+
+	suite.Run("place a post only order", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		buyAll := &Order{
+			ID:    "post_only",
+			Type:  PostOnly,
+			Side:  Buy,
+			Price: decimal.NewFromInt(100),
+			Size:  decimal.NewFromInt(1),
+		}
+
+		err := testOrderBook.AddOrder(ctx, buyAll)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 0)
+
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(4), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("fail to place a post only order", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		buyAll := &Order{
+			ID:    "post_only",
+			Type:  PostOnly,
+			Side:  Buy,
+			Price: decimal.NewFromInt(115),
+			Size:  decimal.NewFromInt(1),
+		}
+
+		err := testOrderBook.AddOrder(ctx, buyAll)
+		suite.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 1)
+
+		trade := memoryPublishTrader.Trades[0]
+		suite.Equal(true, trade.IsCancel)
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+}
+
+func (suite *OrderBookTestSuite) TestIOCOrder() {
+	ctx := context.Background()
+
+	suite.Run("no match any orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "ioc",
+			Type:  IOC,
+			Side:  Buy,
+			Price: decimal.NewFromInt(100),
+			Size:  decimal.NewFromInt(1),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 1)
+
+		trade := memoryPublishTrader.Trades[0]
+		suite.Equal(true, trade.IsCancel)
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take all orders with no error", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "ioc",
+			Type:  IOC,
+			Side:  Buy,
+			Price: decimal.NewFromInt(1000),
+			Size:  decimal.NewFromInt(3),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 3)
+
+		suite.Equal(int64(0), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take all orders and finish as `cancel`", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "ioc",
+			Type:  IOC,
+			Side:  Sell,
+			Price: decimal.NewFromInt(10),
+			Size:  decimal.NewFromInt(4),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 4)
+
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(0), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take some orders and finish as `cancel`", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "ioc",
+			Type:  IOC,
+			Side:  Buy,
+			Price: decimal.NewFromInt(115),
+			Size:  decimal.NewFromInt(2),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 2)
+
+		suite.Equal(int64(2), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+}
+
+func (suite *OrderBookTestSuite) TestFOKOrder() {
+	ctx := context.Background()
+
+	suite.Run("no match any orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "fok",
+			Type:  FOK,
+			Side:  Buy,
+			Price: decimal.NewFromInt(100),
+			Size:  decimal.NewFromInt(1),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 1)
+
+		trade := memoryPublishTrader.Get(0)
+		suite.Equal(true, trade.IsCancel)
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take all orders with no error", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "fok",
+			Type:  FOK,
+			Side:  Buy,
+			Price: decimal.NewFromInt(1000),
+			Size:  decimal.NewFromInt(3),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 3)
+
+		suite.Equal(int64(0), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take all orders and finish as `cancel`", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "fok",
+			Type:  FOK,
+			Side:  Sell,
+			Price: decimal.NewFromInt(10),
+			Size:  decimal.NewFromInt(4),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 1)
+
+		trade := memoryPublishTrader.Get(0)
+		suite.Equal(true, trade.IsCancel)
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+
+	suite.Run("take some orders and finish as `cancel`", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		order := &Order{
+			ID:    "ioc",
+			Type:  FOK,
+			Side:  Buy,
+			Price: decimal.NewFromInt(115),
+			Size:  decimal.NewFromInt(2),
+		}
+
+		err := testOrderBook.AddOrder(ctx, order)
+		suite.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.Equal(memoryPublishTrader.Count(), 1)
+
+		trade := memoryPublishTrader.Get(0)
+		suite.Equal(true, trade.IsCancel)
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+		suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+	})
+}
+
+func (suite *OrderBookTestSuite) TestAllOrNoneOrder() {
+	ctx := context.Background()
+
+	aon := func(size int64) *Order {
+		return &Order{
+			ID:        "aon",
+			Type:      Limit,
+			Side:      Sell,
+			Price:     decimal.NewFromInt(105),
+			Size:      decimal.NewFromInt(size),
+			AllOrNone: true,
+		}
+	}
+
+	suite.Run("skip a maker the taker cannot fill", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, aon(2)))
+
+		order := &Order{
+			ID:    "buy",
+			Type:  Limit,
+			Side:  Buy,
+			Price: decimal.NewFromInt(110),
+			Size:  decimal.NewFromInt(1),
+		}
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 1 }, time.Second, time.Millisecond)
+
+		trade := memoryPublishTrader.Get(0)
+		suite.Equal("sell-1", trade.MakerOrderID)
+		suite.Equal("110", trade.Price.String())
+
+		resting, err := testOrderBook.GetOrder("aon")
+		suite.NoError(err)
+		suite.Equal("2", resting.Size.String())
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+	})
+
+	suite.Run("fill a maker in full", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, aon(2)))
+
+		order := &Order{
+			ID:    "buy",
+			Type:  Limit,
+			Side:  Buy,
+			Price: decimal.NewFromInt(110),
+			Size:  decimal.NewFromInt(3),
+		}
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 2 }, time.Second, time.Millisecond)
+
+		suite.Equal("aon", memoryPublishTrader.Get(0).MakerOrderID)
+		suite.Equal("2", memoryPublishTrader.Get(0).Size.String())
+		suite.Equal("sell-1", memoryPublishTrader.Get(1).MakerOrderID)
+		suite.Equal(int64(2), testOrderBook.askQueue.depthCount())
+	})
+
+	suite.Run("keep time priority while skipped", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, aon(2)))
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:    "plain",
+			Type:  Limit,
+			Side:  Sell,
+			Price: decimal.NewFromInt(105),
+			Size:  decimal.NewFromInt(2),
+		}))
+
+		// the smaller taker passes over the older all-or-none order
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:    "small",
+			Type:  IOC,
+			Side:  Buy,
+			Price: decimal.NewFromInt(105),
+			Size:  decimal.NewFromInt(1),
+		}))
+		// the next one is large enough and reaches it first
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:    "large",
+			Type:  IOC,
+			Side:  Buy,
+			Price: decimal.NewFromInt(105),
+			Size:  decimal.NewFromInt(3),
+		}))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 3 }, time.Second, time.Millisecond)
+
+		suite.Equal("small", memoryPublishTrader.Get(0).TakerOrderID)
+		suite.Equal("plain", memoryPublishTrader.Get(0).MakerOrderID)
+		suite.Equal("large", memoryPublishTrader.Get(1).TakerOrderID)
+		suite.Equal("aon", memoryPublishTrader.Get(1).MakerOrderID)
+		suite.Equal("2", memoryPublishTrader.Get(1).Size.String())
+		suite.Equal("plain", memoryPublishTrader.Get(2).MakerOrderID)
+		suite.Equal("1", memoryPublishTrader.Get(2).Size.String())
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+	})
+
+	suite.Run("skip a maker for a market order", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, aon(2)))
+
+		// 110 buys only part of the all-or-none order, so it buys sell-1
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:   "market",
+			Type: Market,
+			Side: Buy,
+			Size: decimal.NewFromInt(110),
+		}))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 1 }, time.Second, time.Millisecond)
+
+		trade := memoryPublishTrader.Get(0)
+		suite.False(trade.IsCancel)
+		suite.Equal("sell-1", trade.MakerOrderID)
+		suite.Equal("1", trade.Size.String())
+
+		_, err := testOrderBook.GetOrder("aon")
+		suite.NoError(err)
+	})
+
+	suite.Run("cancel a FOK order that only an all-or-none maker could fill", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, aon(3)))
+
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:    "fok",
+			Type:  FOK,
+			Side:  Buy,
+			Price: decimal.NewFromInt(110),
+			Size:  decimal.NewFromInt(2),
+		}))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 1 }, time.Second, time.Millisecond)
+		suite.True(memoryPublishTrader.Get(0).IsCancel)
+		suite.Equal(int64(4), testOrderBook.askQueue.depthCount())
+
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:    "fok-all",
+			Type:  FOK,
+			Side:  Buy,
+			Price: decimal.NewFromInt(110),
+			Size:  decimal.NewFromInt(4),
+		}))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 3 }, time.Second, time.Millisecond)
+		suite.Equal("aon", memoryPublishTrader.Get(1).MakerOrderID)
+		suite.Equal("sell-1", memoryPublishTrader.Get(2).MakerOrderID)
+		suite.Equal(int64(2), testOrderBook.askQueue.depthCount())
+	})
+
+	suite.Run("cancel a taker that cannot fill in full", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+		order := &Order{
+			ID:        "aon-buy",
+			Type:      Limit,
+			Side:      Buy,
+			Price:     decimal.NewFromInt(110),
+			Size:      decimal.NewFromInt(2),
+			AllOrNone: true,
+		}
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 1 }, time.Second, time.Millisecond)
+		suite.True(memoryPublishTrader.Get(0).IsCancel)
+		suite.Equal("2", memoryPublishTrader.Get(0).Size.String())
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+
+		// below the asks it rests like any limit order
+		order = &Order{
+			ID:        "aon-rest",
+			Type:      Limit,
+			Side:      Buy,
+			Price:     decimal.NewFromInt(100),
+			Size:      decimal.NewFromInt(2),
+			AllOrNone: true,
+		}
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		resting, err := testOrderBook.GetOrder("aon-rest")
+		suite.NoError(err)
+		suite.True(resting.AllOrNone)
+	})
+
+	suite.Run("reject invalid orders", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		for _, order := range []*Order{
+			{ID: "aon-ioc", Type: IOC, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1), AllOrNone: true},
+			{ID: "aon-fok", Type: FOK, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1), AllOrNone: true},
+			{ID: "aon-min", Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(2), AllOrNone: true, MinSize: decimal.NewFromInt(1)},
+		} {
+			suite.ErrorIs(testOrderBook.AddOrder(ctx, order), ErrInvalidParam, order.ID)
+		}
+	})
+}
+
+func (suite *OrderBookTestSuite) TestMinSizeOrder() {
+	ctx := context.Background()
+
+	buy := func(id string, size int64) *Order {
+		return &Order{
+			ID:    id,
+			Type:  IOC,
+			Side:  Buy,
+			Price: decimal.NewFromInt(105),
+			Size:  decimal.NewFromInt(size),
+		}
+	}
+
+	suite.Run("only match at least the minimum", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:      "min",
+			Type:    Limit,
+			Side:    Sell,
+			Price:   decimal.NewFromInt(105),
+			Size:    decimal.NewFromInt(5),
+			MinSize: decimal.NewFromInt(2),
+		}))
+
+		// too small, passed over and cancelled
+		suite.NoError(testOrderBook.AddOrder(ctx, buy("buy-small", 1)))
+		// takes 2 of 5
+		suite.NoError(testOrderBook.AddOrder(ctx, buy("buy-min", 2)))
+		// takes 2 more, leaving 1
+		suite.NoError(testOrderBook.AddOrder(ctx, buy("buy-more", 2)))
+		// the minimum no longer applies to the last lot
+		suite.NoError(testOrderBook.AddOrder(ctx, buy("buy-rest", 1)))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 4 }, time.Second, time.Millisecond)
+
+		suite.True(memoryPublishTrader.Get(0).IsCancel)
+		suite.Equal("buy-small", memoryPublishTrader.Get(0).TakerOrderID)
+		for i, size := range []string{"2", "2", "1"} {
+			trade := memoryPublishTrader.Get(i + 1)
+			suite.False(trade.IsCancel)
+			suite.Equal("min", trade.MakerOrderID)
+			suite.Equal(size, trade.Size.String())
+		}
+
+		_, err := testOrderBook.GetOrder("min")
+		suite.ErrorIs(err, ErrOrderNotFound)
+	})
+
+	suite.Run("pass over to a worse price", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:      "min",
+			Type:    Limit,
+			Side:    Sell,
+			Price:   decimal.NewFromInt(105),
+			Size:    decimal.NewFromInt(5),
+			MinSize: decimal.NewFromInt(3),
+		}))
+
+		order := buy("buy", 2)
+		order.Type = Limit
+		order.Price = decimal.NewFromInt(120)
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 2 }, time.Second, time.Millisecond)
+
+		suite.Equal("sell-1", memoryPublishTrader.Get(0).MakerOrderID)
+		suite.Equal("sell-2", memoryPublishTrader.Get(1).MakerOrderID)
+
+		resting, err := testOrderBook.GetOrder("min")
+		suite.NoError(err)
+		suite.Equal("5", resting.Size.String())
+		suite.Equal("3", resting.MinSize.String())
+	})
+
+	suite.Run("count only accepted matches for FOK", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+		suite.NoError(testOrderBook.AddOrder(ctx, &Order{
+			ID:      "min",
+			Type:    Limit,
+			Side:    Sell,
+			Price:   decimal.NewFromInt(105),
+			Size:    decimal.NewFromInt(5),
+			MinSize: decimal.NewFromInt(3),
+		}))
+
+		// the level holds 5, but a 2 lot match is below its minimum
+		order := buy("fok", 2)
+		order.Type = FOK
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 1 }, time.Second, time.Millisecond)
+		suite.True(memoryPublishTrader.Get(0).IsCancel)
+
+		order = buy("fok-min", 3)
+		order.Type = FOK
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 2 }, time.Second, time.Millisecond)
+		suite.False(memoryPublishTrader.Get(1).IsCancel)
+		suite.Equal("3", memoryPublishTrader.Get(1).Size.String())
+	})
+
+	suite.Run("take at least the minimum or cancel", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+		// only 1 lot is offered up to 115
+		order := &Order{
+			ID:      "min-buy",
+			Type:    Limit,
+			Side:    Buy,
+			Price:   decimal.NewFromInt(115),
+			Size:    decimal.NewFromInt(3),
+			MinSize: decimal.NewFromInt(2),
+		}
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 1 }, time.Second, time.Millisecond)
+		suite.True(memoryPublishTrader.Get(0).IsCancel)
+		suite.Equal(int64(3), testOrderBook.askQueue.depthCount())
+
+		// up to 120 it gets 2 lots and rests with the third
+		order = &Order{
+			ID:      "min-buy-2",
+			Type:    Limit,
+			Side:    Buy,
+			Price:   decimal.NewFromInt(120),
+			Size:    decimal.NewFromInt(3),
+			MinSize: decimal.NewFromInt(2),
+		}
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 3 }, time.Second, time.Millisecond)
+		resting, err := testOrderBook.GetOrder("min-buy-2")
+		suite.NoError(err)
+		suite.Equal("1", resting.Size.String())
+		suite.Equal("120", testOrderBook.BookTicker().BidPrice.String())
+	})
+
+	suite.Run("reject invalid minimums", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		for _, order := range []*Order{
+			{ID: "min-market", Type: Market, Side: Buy, Size: decimal.NewFromInt(100), MinSize: decimal.NewFromInt(1)},
+			{ID: "min-large", Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1), MinSize: decimal.NewFromInt(2)},
+			{ID: "min-negative", Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1), MinSize: decimal.NewFromInt(-1)},
+			{ID: "min-fraction", Type: Limit, Side: Buy, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1), MinSize: decimal.New(1, -9)},
+		} {
+			suite.ErrorIs(testOrderBook.AddOrder(ctx, order), ErrInvalidParam, order.ID)
+		}
+	})
+}
+
+func (suite *OrderBookTestSuite) TestStopLimitOrder() {
+	ctx := context.Background()
+
+	testOrderBook := suite.createTestOrderBook()
+	memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+	order := &Order{
+		ID:        "stop",
+		Type:      StopLimit,
+		Side:      Buy,
+		StopPrice: decimal.NewFromInt(110),
+		Price:     decimal.NewFromInt(120),
+		Size:      decimal.NewFromInt(1),
+	}
+	suite.NoError(testOrderBook.AddOrder(ctx, order))
+
+	// nothing traded yet, so the stop waits outside the book
+	waiting, err := testOrderBook.GetOrder("stop")
+	suite.NoError(err)
+	suite.Equal(StopLimit, waiting.Type)
+	suite.Equal(0, memoryPublishTrader.Count())
+	suite.Equal(int64(3), testOrderBook.bidQueue.depthCount())
+
+	stopPrice := order.StopPrice
+	order.StopPrice = decimal.Zero
+	suite.ErrorIs(testOrderBook.AddOrder(ctx, order), ErrInvalidParam)
+	order.StopPrice = stopPrice
+
+	// a trade at 110 triggers it, and it takes the ask at 120
+	err = testOrderBook.AddOrder(ctx, &Order{
+		ID:    "lift",
+		Type:  Limit,
+		Side:  Buy,
+		Price: decimal.NewFromInt(110),
+		Size:  decimal.NewFromInt(1),
+	})
+	suite.NoError(err)
+
+	suite.Eventually(func() bool { return memoryPublishTrader.Count() == 2 }, time.Second, time.Millisecond)
+	trade := memoryPublishTrader.Get(1)
+	suite.Equal("stop", trade.TakerOrderID)
+	suite.Equal("sell-2", trade.MakerOrderID)
+	suite.Equal(int64(1), testOrderBook.askQueue.depthCount())
+
+	_, err = testOrderBook.GetOrder("stop")
+	suite.ErrorIs(err, ErrOrderNotFound)
+}
+
+func (suite *OrderBookTestSuite) TestCancelOrder() {
+	ctx := context.Background()
+
+	testOrderBook := suite.createTestOrderBook()
+
+	err := testOrderBook.CancelOrder(ctx, "sell-1")
+	suite.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal(int64(2), testOrderBook.askQueue.depthCount())
+
+	err = testOrderBook.CancelOrder(ctx, "buy-1")
+	suite.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal(int64(2), testOrderBook.bidQueue.depthCount())
+
+	err = testOrderBook.CancelOrder(ctx, "aaaaaa")
+	suite.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal(int64(2), testOrderBook.bidQueue.depthCount())
+}
+
+func (suite *OrderBookTestSuite) TestTimedOutQueryIsDropped() {
+	ctx := context.Background()
+
+	// the stages only run when the test steps them
+	book := NewOrderBook(NewMemoryPublishTrader())
+	order := &Order{ID: "resting", UserID: 7, Type: Limit, Side: Buy, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(90)}
+	suite.NoError(book.AddOrder(ctx, order))
+	book.runBatch(ringBatchSize)
+	suite.NotNil(book.restingOrder("resting"))
+
+	_, err := book.MassCancel(ctx, 7, 0)
+	suite.ErrorIs(err, ErrTimeout)
+
+	// the abandoned cancel must not run once the book catches up
+	book.runBatch(ringBatchSize)
+	suite.NotNil(book.restingOrder("resting"))
+	suite.Equal(uint64(1), book.sequenced)
+
+	// a query taken before its timeout is still answered
+	done := make(chan []string, 1)
+	go func() {
+		ids, err := book.MassCancel(ctx, 7, 0)
+		suite.NoError(err)
+		done <- ids
+	}()
+	suite.Eventually(func() bool { return book.ring.queued() == 1 }, time.Second, time.Millisecond)
+	book.journalStage(ringBatchSize)
+	time.Sleep(queryTimeout + 100*time.Millisecond)
+	book.matchStage(ringBatchSize)
+	suite.Equal([]string{"resting"}, <-done)
+}
+
+func (suite *OrderBookTestSuite) TestDepth() {
+	testOrderBook := suite.createTestOrderBook()
+
+	result, err := testOrderBook.Depth(5, decimal.Zero)
+	suite.NoError(err)
+
+	suite.Len(result.Asks, 3)
+	suite.Len(result.Bids, 3)
+
+	result, err = testOrderBook.Depth(2, decimal.Zero)
+	suite.NoError(err)
+
+	suite.Len(result.Asks, 2)
+	suite.Len(result.Bids, 2)
+
+	result, err = testOrderBook.Depth(5, decimal.NewFromInt(20))
+	suite.NoError(err)
+
+	suite.Len(result.Asks, 2)
+	suite.Equal("120", result.Asks[0].Price.String())
+	suite.Equal("2", result.Asks[0].Size.String())
+	suite.Len(result.Bids, 2)
+	suite.Equal("60", result.Bids[1].Price.String())
+	suite.Equal("3", result.Bids[1].CumulativeSize.String())
+
+	_, err = testOrderBook.Depth(5, decimal.NewFromInt(-1))
+	suite.ErrorIs(err, ErrInvalidParam)
+}
+
+func (suite *OrderBookTestSuite) TestBookTicker() {
+	ctx := context.Background()
+
+	testOrderBook := suite.createTestOrderBook()
+	memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+	ticker := testOrderBook.BookTicker()
+	suite.Equal("90", ticker.BidPrice.String())
+	suite.Equal("110", ticker.AskPrice.String())
+	suite.Equal("20", ticker.Spread.String())
+	suite.Equal(uint64(4), ticker.Sequence)
+	suite.Equal(ticker, memoryPublishTrader.LastBookTicker())
+	count := memoryPublishTrader.BookTickerCount()
+
+	// behind the top of book, no new ticker
+	err := testOrderBook.AddOrder(ctx, &Order{
+		ID:    "buy-4",
+		Type:  Limit,
+		Side:  Buy,
+		Size:  decimal.NewFromInt(1),
+		Price: decimal.NewFromInt(85),
+	})
+	suite.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal(count, memoryPublishTrader.BookTickerCount())
+
+	// joins the best bid, size changes
+	err = testOrderBook.AddOrder(ctx, &Order{
+		ID:    "buy-5",
+		Type:  Limit,
+		Side:  Buy,
+		Size:  decimal.NewFromInt(2),
+		Price: decimal.NewFromInt(90),
+	})
+	suite.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal(count+1, memoryPublishTrader.BookTickerCount())
+	ticker = memoryPublishTrader.LastBookTicker()
+	suite.Equal("3", ticker.BidSize.String())
+	suite.Equal(uint64(8), ticker.Sequence)
+
+	// cancelling the best ask moves the top of book
+	err = testOrderBook.CancelOrder(ctx, "sell-1")
+	suite.NoError(err)
+	time.Sleep(50 * time.Millisecond)
+	ticker = memoryPublishTrader.LastBookTicker()
+	suite.Equal("120", ticker.AskPrice.String())
+	suite.Equal("1", ticker.AskSize.String())
+	suite.Equal(ticker, testOrderBook.BookTicker())
+}
+
+func (suite *OrderBookTestSuite) TestHiddenOrder() {
+	ctx := context.Background()
+
+	testOrderBook := suite.createTestOrderBook()
+	memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+	// one hidden ask improves on the best ask, the other sits behind sell-1
+	for _, order := range []*Order{
+		{ID: "hidden-100", Type: Limit, Side: Sell, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(100), Hidden: true},
+		{ID: "hidden-110", Type: PostOnly, Side: Sell, Size: decimal.NewFromInt(1), Price: decimal.NewFromInt(110), Hidden: true},
+	} {
+		suite.NoError(testOrderBook.AddOrder(ctx, order))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	result, err := testOrderBook.Depth(5, decimal.Zero)
+	suite.NoError(err)
+	suite.Len(result.Asks, 3)
+	suite.Equal("110", result.Asks[0].Price.String())
+	suite.Equal("1", result.Asks[0].Size.String())
+
+	ticker := testOrderBook.BookTicker()
+	suite.Equal("110", ticker.AskPrice.String())
+	suite.Equal("1", ticker.AskSize.String())
+	suite.Equal(int64(4), testOrderBook.askQueue.depthCount())
+
+	order, err := testOrderBook.GetOrder("hidden-100")
+	suite.NoError(err)
+	suite.True(order.Hidden)
+
+	// a FOK counts hidden size, and at 110 the displayed order fills first
+	err = testOrderBook.AddOrder(ctx, &Order{
+		ID:    "fok",
+		Type:  FOK,
+		Side:  Buy,
+		Price: decimal.NewFromInt(110),
+		Size:  decimal.NewFromInt(3),
+	})
+	suite.NoError(err)
+	suite.Eventually(func() bool { return memoryPublishTrader.Count() == 3 }, time.Second, time.Millisecond)
+
+	var makers []string
+	for i := 0; i < 3; i++ {
+		trade := memoryPublishTrader.Get(i)
+		suite.False(trade.IsCancel)
+		makers = append(makers, trade.MakerOrderID)
+	}
+	suite.Equal([]string{"hidden-100", "sell-1", "hidden-110"}, makers)
+	suite.Equal(int64(2), testOrderBook.askQueue.depthCount())
+	suite.Equal("120", testOrderBook.BookTicker().AskPrice.String())
+}
+
+func (suite *OrderBookTestSuite) TestPeggedOrder() {
+	ctx := context.Background()
+
+	suite.Run("follow the best bid and the midpoint", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+		err := testOrderBook.AddOrder(ctx, &Order{
+			ID:        "peg-bid",
+			Type:      Limit,
+			Side:      Buy,
+			Size:      decimal.NewFromInt(1),
+			Peg:       PegPrimary,
+			PegOffset: decimal.NewFromInt(1),
+		})
+		suite.NoError(err)
+		err = testOrderBook.AddOrder(ctx, &Order{
+			ID:   "peg-mid",
+			Type: PostOnly,
+			Side: Sell,
+			Size: decimal.NewFromInt(1),
+			Peg:  PegMidpoint,
+		})
+		suite.NoError(err)
+
+		// pegged orders show in the book but are priced from the others
+		order, err := testOrderBook.GetOrder("peg-bid")
+		suite.NoError(err)
+		suite.Equal("91", order.Price.String())
+		order, err = testOrderBook.GetOrder("peg-mid")
+		suite.NoError(err)
+		suite.Equal("100", order.Price.String())
+		suite.Equal("91", testOrderBook.BookTicker().BidPrice.String())
+		suite.Equal(0, memoryPublishTrader.OrderUpdateCount())
+
+		suite.NoError(testOrderBook.CancelOrder(ctx, "buy-1"))
+		suite.Eventually(func() bool { return memoryPublishTrader.OrderUpdateCount() == 2 }, time.Second, time.Millisecond)
+
+		update := memoryPublishTrader.GetOrderUpdate(0)
+		suite.Equal("peg-bid", update.OrderID)
+		suite.Equal("81", update.Price.String())
+		suite.Equal("1", update.Size.String())
+		update = memoryPublishTrader.GetOrderUpdate(1)
+		suite.Equal("peg-mid", update.OrderID)
+		suite.Equal("95", update.Price.String())
+		suite.Equal(uint64(9), update.Sequence)
+
+		result, err := testOrderBook.Depth(1, decimal.Zero)
+		suite.NoError(err)
+		suite.Equal("81", result.Bids[0].Price.String())
+		suite.Equal("95", result.Asks[0].Price.String())
+		suite.Equal(1, memoryPublishTrader.Count())
+	})
+
+	suite.Run("stop at the limit", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+		err := testOrderBook.AddOrder(ctx, &Order{
+			ID:        "peg-bid",
+			Type:      Limit,
+			Side:      Buy,
+			Size:      decimal.NewFromInt(1),
+			Peg:       PegPrimary,
+			PegOffset: decimal.NewFromInt(5),
+			PegLimit:  decimal.NewFromInt(93),
+		})
+		suite.NoError(err)
+
+		order, err := testOrderBook.GetOrder("peg-bid")
+		suite.NoError(err)
+		suite.Equal("93", order.Price.String())
+
+		// a better bid moves the reference, the limit holds the order at 93
+		err = testOrderBook.AddOrder(ctx, &Order{
+			ID:    "buy-4",
+			Type:  Limit,
+			Side:  Buy,
+			Size:  decimal.NewFromInt(1),
+			Price: decimal.NewFromInt(92),
+		})
+		suite.NoError(err)
+		time.Sleep(50 * time.Millisecond)
+		suite.Equal(0, memoryPublishTrader.OrderUpdateCount())
+		suite.Equal("93", testOrderBook.BookTicker().BidPrice.String())
+	})
+
+	suite.Run("chase the opposite side", func() {
+		testOrderBook := suite.createTestOrderBook()
+		memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+		err := testOrderBook.AddOrder(ctx, &Order{
+			ID:   "peg-take",
+			Type: Limit,
+			Side: Buy,
+			Size: decimal.NewFromInt(2),
+			Peg:  PegOpposite,
+		})
+		suite.NoError(err)
+		suite.Eventually(func() bool { return memoryPublishTrader.Count() == 2 }, time.Second, time.Millisecond)
+
+		// it takes the best ask, then moves to the next one and takes it too
+		suite.Equal("sell-1", memoryPublishTrader.Get(0).MakerOrderID)
+		suite.Equal("sell-2", memoryPublishTrader.Get(1).MakerOrderID)
+		suite.Equal("120", memoryPublishTrader.Get(1).Price.String())
+		suite.Equal(1, memoryPublishTrader.OrderUpdateCount())
+		suite.Equal("120", memoryPublishTrader.GetOrderUpdate(0).Price.String())
+
+		_, err = testOrderBook.GetOrder("peg-take")
+		suite.ErrorIs(err, ErrOrderNotFound)
+	})
+
+	suite.Run("reject invalid pegs", func() {
+		testOrderBook := suite.createTestOrderBook()
+
+		for _, order := range []*Order{
+			{ID: "peg-ioc", Type: IOC, Side: Buy, Size: decimal.NewFromInt(1), Peg: PegPrimary},
+			{ID: "peg-bad", Type: Limit, Side: Buy, Size: decimal.NewFromInt(1), Peg: "last"},
+			{ID: "peg-limit", Type: Limit, Side: Buy, Size: decimal.NewFromInt(1), Peg: PegPrimary, PegLimit: decimal.NewFromInt(-1)},
+		} {
+			suite.ErrorIs(testOrderBook.AddOrder(ctx, order), ErrInvalidParam, order.ID)
+		}
+	})
+}
+
+func (suite *OrderBookTestSuite) TestClientOrderID() {
+	ctx := context.Background()
+
+	testOrderBook := suite.createTestOrderBook()
+	memoryPublishTrader, _ := testOrderBook.publishTrader.(*MemoryPublishTrader)
+
+	err := testOrderBook.AddOrder(ctx, &Order{
+		ID:            "maker",
+		ClientOrderID: "quote-1",
+		Type:          Limit,
+		Side:          Sell,
+		Size:          decimal.NewFromInt(1),
+		Price:         decimal.NewFromInt(100),
+	})
+	suite.NoError(err)
+
+	order, err := testOrderBook.GetOrder("maker")
+	suite.NoError(err)
+	suite.Equal("quote-1", order.ClientOrderID)
+
+	// both sides of a fill carry their client order IDs, and the cancelled
+	// rest of the IOC its own
+	err = testOrderBook.AddOrder(ctx, &Order{
+		ID:            "taker",
+		ClientOrderID: "hedge-7",
+		Type:          IOC,
+		Side:          Buy,
+		Size:          decimal.NewFromInt(2),
+		Price:         decimal.NewFromInt(100),
+	})
+	suite.NoError(err)
+	suite.Eventually(func() bool { return memoryPublishTrader.Count() == 2 }, time.Second, time.Millisecond)
+
+	fill := memoryPublishTrader.Get(0)
+	suite.False(fill.IsCancel)
+	suite.Equal("hedge-7", fill.TakerClientOrderID)
+	suite.Equal("quote-1", fill.MakerClientOrderID)
+
+	rest := memoryPublishTrader.Get(1)
+	suite.True(rest.IsCancel)
+	suite.Equal("hedge-7", rest.TakerClientOrderID)
+	suite.Equal("hedge-7", rest.MakerClientOrderID)
+}
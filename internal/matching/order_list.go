@@ -0,0 +1,129 @@
+package matching
+
+// listEnd records that a leg of an order list traded or left the book
+type listEnd struct {
+	listID  string
+	orderID string
+}
+
+// addList registers an order list and executes its legs. Stop legs are set
+// aside first, so a limit leg that trades right away cancels them.
+func (book *OrderBook) addList(orders []*Order) []*Trade {
+	listID := orders[0].ListID
+	if _, ok := book.lists[listID]; ok {
+		return nil
+	}
+
+	legs := make([]string, len(orders))
+	for i, order := range orders {
+		legs[i] = order.ID
+	}
+	book.lists[listID] = legs
+
+	var trades []*Trade
+	for _, order := range orders {
+		if order.Type == StopLimit {
+			trades = append(trades, book.execute(order)...)
+		}
+	}
+	for _, order := range orders {
+		if order.Type != StopLimit {
+			trades = append(trades, book.execute(order)...)
+		}
+	}
+
+	return book.cascade(trades)
+}
+
+// cancelList removes every leg of a list that is still in the book and
+// returns their cancel markers
+func (book *OrderBook) cancelList(listID string) []*Trade {
+	var orders []*Order
+	for _, id := range book.lists[listID] {
+		if order := book.restingOrder(id); order != nil {
+			orders = append(orders, order)
+		}
+	}
+
+	return book.cascade(book.cancelOrders(orders))
+}
+
+// cascade runs what the trades and cancellations of a command set off:
+// lists whose legs traded or left the book cancel their other legs, stop
+// orders the last trade price reached are executed, and pegged orders follow
+// the best bid and offer once no stop is left. Each of these may trade and
+// set off more. The outcomes are appended to trades.
+func (book *OrderBook) cascade(trades []*Trade) []*Trade {
+	for {
+		trades = append(trades, book.endLists()...)
+
+		stop := book.stops.triggered(book.lastPrice)
+		if stop == nil {
+			if !book.pegsMoved() {
+				return trades
+			}
+			trades = append(trades, book.repeg()...)
+			continue
+		}
+
+		// the other legs of its list are cancelled before it executes
+		book.endList(stop)
+		trades = append(trades, book.endLists()...)
+
+		stop.Type = Limit
+		trades = append(trades, book.execute(stop)...)
+	}
+}
+
+// endList notes that a leg of a live list traded or left the book
+func (book *OrderBook) endList(order *Order) {
+	if len(order.ListID) == 0 {
+		return
+	}
+	if _, ok := book.lists[order.ListID]; ok {
+		book.ended = append(book.ended, listEnd{listID: order.ListID, orderID: order.ID})
+	}
+}
+
+// endLists cancels the legs of every ended list except the leg that ended
+// it, which stays in the book if it only partially traded
+func (book *OrderBook) endLists() []*Trade {
+	var trades []*Trade
+	for i := 0; i < len(book.ended); i++ {
+		end := book.ended[i]
+		legs, ok := book.lists[end.listID]
+		if !ok {
+			continue
+		}
+		delete(book.lists, end.listID)
+
+		for _, id := range legs {
+			if id == end.orderID {
+				continue
+			}
+			if order := book.restingOrder(id); order != nil {
+				trades = append(trades, book.cancelOrders([]*Order{order})...)
+			}
+		}
+	}
+	book.ended = book.ended[:0]
+
+	return trades
+}
+
+// restoreLists rebuilds the live lists from the legs in a restored book. A
+// list with a single leg left has already ended.
+func (book *OrderBook) restoreLists(orders []*Order) {
+	legs := make(map[string][]string)
+	for _, order := range orders {
+		if len(order.ListID) > 0 {
+			legs[order.ListID] = append(legs[order.ListID], order.ID)
+		}
+	}
+
+	for listID, ids := range legs {
+		if len(ids) > 1 {
+			book.lists[listID] = ids
+		}
+	}
+}
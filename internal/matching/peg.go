@@ -0,0 +1,173 @@
+package matching
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// PegType is the price a pegged order follows
+type PegType string
+
+const (
+	PegPrimary  PegType = "primary"  // the best bid for a buy, the best ask for a sell
+	PegOpposite PegType = "opposite" // the best ask for a buy, the best bid for a sell
+	PegMidpoint PegType = "midpoint" // halfway between, rounded away from the other side
+)
+
+// valid reports whether orders of type typ can be pegged to p
+func (p PegType) valid(typ OrderType) bool {
+	switch p {
+	case PegPrimary, PegOpposite, PegMidpoint:
+		return typ == Limit || typ == PostOnly
+	}
+	return false
+}
+
+// OrderUpdate is published when the book moves a resting pegged order to a
+// new price. Size is the remaining size of the order.
+type OrderUpdate struct {
+	MarketID      string          `json:"market_id"`
+	OrderID       string          `json:"order_id"`
+	ClientOrderID string          `json:"client_order_id,omitempty"`
+	UserID        int64           `json:"user_id"`
+	Side          Side            `json:"side"`
+	Price         decimal.Decimal `json:"price"`
+	Size          decimal.Decimal `json:"size"`
+	Sequence      uint64          `json:"sequence"`
+	Time          time.Time       `json:"time"`
+}
+
+// references returns the best bid and ask in ticks that pegged orders are
+// priced from. Pegged orders do not count, so they cannot chase each other.
+func (book *OrderBook) references() [2]int64 {
+	return [2]int64{book.bidQueue.reference(), book.askQueue.reference()}
+}
+
+// pegPrice returns the price in ticks a pegged order should rest at: its
+// reference plus the offset, capped at its limit. It returns false when the
+// book has no reference for the order.
+func pegPrice(order *Order, ref [2]int64) (int64, bool) {
+	bid, ask := ref[0], ref[1]
+
+	var price int64
+	switch {
+	case order.Peg == PegMidpoint:
+		if bid == 0 || ask == 0 {
+			return 0, false
+		}
+		price = (bid + ask) / 2
+		if order.Side == Sell {
+			price = (bid + ask + 1) / 2
+		}
+	case (order.Peg == PegPrimary) == (order.Side == Buy):
+		price = bid
+	default:
+		price = ask
+	}
+	if price == 0 {
+		return 0, false
+	}
+
+	price += order.pegOffset
+	if order.pegLimit > 0 {
+		if order.Side == Buy {
+			price = min(price, order.pegLimit)
+		} else {
+			price = max(price, order.pegLimit)
+		}
+	}
+
+	return price, price > 0
+}
+
+// pegOrder prices a new pegged order from the book and tracks it while it
+// rests. It returns false if the book has nothing to peg it to.
+func (book *OrderBook) pegOrder(order *Order) bool {
+	price, ok := pegPrice(order, book.references())
+	if !ok {
+		return false
+	}
+
+	book.setPrice(order, price)
+	book.pegs[order.ID] = order
+	return true
+}
+
+// restorePeg tracks a pegged order loaded from a snapshot
+func (book *OrderBook) restorePeg(order *Order) {
+	if len(order.Peg) > 0 {
+		book.pegs[order.ID] = order
+	}
+}
+
+func (book *OrderBook) setPrice(order *Order, price int64) {
+	order.price = price
+	order.Price = book.scale.price(price)
+}
+
+// pegsMoved reports whether the references changed since the pegged orders
+// were last priced
+func (book *OrderBook) pegsMoved() bool {
+	return len(book.pegs) > 0 && book.references() != book.pegRef
+}
+
+// repeg reprices the resting pegged orders, oldest first. An order whose
+// price changed leaves its level and enters the book again at the new price,
+// behind the orders already there, so it may trade, or be cancelled if it
+// is PostOnly, when it now crosses. Orders without a reference stay where
+// they are.
+func (book *OrderBook) repeg() []*Trade {
+	ref := book.references()
+	book.pegRef = ref
+
+	orders := make([]*Order, 0, len(book.pegs))
+	for id, order := range book.pegs {
+		// traded or cancelled since the last pass
+		if book.pegQueue(order).order(id) != order {
+			delete(book.pegs, id)
+			continue
+		}
+		orders = append(orders, order)
+	}
+	sortOrders(orders)
+
+	var trades []*Trade
+	for _, order := range orders {
+		q := book.pegQueue(order)
+		if q.order(order.ID) != order {
+			continue
+		}
+
+		price, ok := pegPrice(order, ref)
+		if !ok || price == order.price {
+			continue
+		}
+
+		q.removeOrder(order.price, order.ID)
+		book.setPrice(order, price)
+		book.updates = append(book.updates, &OrderUpdate{
+			MarketID:      order.MarketID,
+			OrderID:       order.ID,
+			ClientOrderID: order.ClientOrderID,
+			UserID:        order.UserID,
+			Side:          order.Side,
+			Price:         order.Price,
+			Size:          book.scale.size(order.size),
+			Sequence:      book.sequence,
+			Time:          time.Now().UTC(),
+		})
+
+		executed, _ := book.handleOrder(order)
+		trades = append(trades, executed...)
+	}
+
+	return trades
+}
+
+func (book *OrderBook) pegQueue(order *Order) *queue {
+	if order.Side == Buy {
+		return book.bidQueue
+	}
+	return book.askQueue
+}
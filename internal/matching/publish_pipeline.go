@@ -0,0 +1,301 @@
+package matching
+
+import (
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a subscriber falls a full buffer
+// behind the engine
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the engine wait until the subscriber catches up.
+	// Use it for consumers that must see every event, such as settlement.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop lets the engine overwrite events the subscriber has not
+	// read yet. The subscriber skips to the oldest retained event and, if it
+	// implements Resyncer, is told how many events it missed.
+	OverflowDrop
+)
+
+// DefaultPublishBufferSize is the number of events a PublishPipeline retains
+const DefaultPublishBufferSize = 1 << 16
+
+// Resyncer is implemented by drop-policy subscribers that want to know when
+// they skipped events, e.g. to reload state from the database.
+type Resyncer interface {
+	Resync(missed uint64)
+}
+
+// publishEvent is one PublishTrades, PublishOrderUpdates or
+// PublishBookTicker call
+type publishEvent struct {
+	trades       []*Trade
+	orderUpdates []*OrderUpdate
+	bookTicker   *BookTicker
+}
+
+// PublishPipeline decouples the order books from slow consumers. Events are
+// written to a bounded ring buffer and every subscriber reads it from its own
+// goroutine with its own cursor, so a slow database write in one consumer
+// does not stall matching unless that consumer uses OverflowBlock and falls
+// a full buffer behind.
+type PublishPipeline struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	ring []publishEvent
+	mask uint64
+	head uint64 // sequence of the next event to write
+
+	subscribers []*pipelineSubscriber
+	started     bool
+	closed      bool
+	wg          sync.WaitGroup
+
+	blockedCount uint64
+	blockedTime  time.Duration
+}
+
+type pipelineSubscriber struct {
+	name      string
+	publisher PublishTrader
+	policy    OverflowPolicy
+	cursor    uint64 // sequence of the next event to read
+
+	delivered uint64
+	dropped   uint64
+	resyncs   uint64
+}
+
+// PipelineStats reports the progress of one subscriber
+type PipelineStats struct {
+	Name      string `json:"name"`
+	Policy    string `json:"policy"`
+	Cursor    uint64 `json:"cursor"`
+	Lag       uint64 `json:"lag"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	Resyncs   uint64 `json:"resyncs"`
+}
+
+// PublishPipelineStats reports buffer usage and the state of every subscriber
+type PublishPipelineStats struct {
+	Capacity     uint64          `json:"capacity"`
+	Published    uint64          `json:"published"`
+	BlockedCount uint64          `json:"blocked_count"`
+	BlockedTime  time.Duration   `json:"blocked_time_ns"`
+	Subscribers  []PipelineStats `json:"subscribers"`
+}
+
+// NewPublishPipeline creates a pipeline retaining at least size events; the
+// size is rounded up to a power of two.
+func NewPublishPipeline(size int) *PublishPipeline {
+	capacity := uint64(1)
+	for capacity < uint64(size) {
+		capacity <<= 1
+	}
+
+	p := &PublishPipeline{
+		ring: make([]publishEvent, capacity),
+		mask: capacity - 1,
+	}
+	p.notEmpty = sync.NewCond(&p.mu)
+	p.notFull = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// Subscribe registers a named consumer. Subscribers must be added before
+// Start; they receive events published after Start in order.
+func (p *PublishPipeline) Subscribe(name string, publisher PublishTrader, policy OverflowPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started {
+		panic("matching: Subscribe called after PublishPipeline.Start")
+	}
+
+	p.subscribers = append(p.subscribers, &pipelineSubscriber{
+		name:      name,
+		publisher: publisher,
+		policy:    policy,
+	})
+}
+
+// Start launches one goroutine per subscriber
+func (p *PublishPipeline) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started {
+		return
+	}
+	p.started = true
+
+	for _, sub := range p.subscribers {
+		p.wg.Add(1)
+		go p.consume(sub)
+	}
+}
+
+// Close stops accepting events and waits until every subscriber has drained
+// what was already published. Drop-policy subscribers may still skip events
+// they had fallen behind on.
+func (p *PublishPipeline) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// PublishTrades implements PublishTrader
+func (p *PublishPipeline) PublishTrades(trades ...*Trade) {
+	p.publish(publishEvent{trades: trades})
+}
+
+// PublishBookTicker implements BookTickerPublisher
+func (p *PublishPipeline) PublishBookTicker(ticker *BookTicker) {
+	p.publish(publishEvent{bookTicker: ticker})
+}
+
+// PublishOrderUpdates implements OrderUpdatePublisher
+func (p *PublishPipeline) PublishOrderUpdates(updates ...*OrderUpdate) {
+	p.publish(publishEvent{orderUpdates: updates})
+}
+
+func (p *PublishPipeline) publish(event publishEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	capacity := p.mask + 1
+	if p.head-p.slowestBlocking() >= capacity && !p.closed {
+		p.blockedCount++
+		start := time.Now()
+		for p.head-p.slowestBlocking() >= capacity && !p.closed {
+			p.notFull.Wait()
+		}
+		p.blockedTime += time.Since(start)
+	}
+
+	if p.closed {
+		return
+	}
+
+	p.ring[p.head&p.mask] = event
+	p.head++
+	p.notEmpty.Broadcast()
+}
+
+// slowestBlocking returns the lowest cursor among blocking subscribers, or
+// head if there are none. The caller must hold p.mu.
+func (p *PublishPipeline) slowestBlocking() uint64 {
+	slowest := p.head
+	for _, sub := range p.subscribers {
+		if sub.policy == OverflowBlock && sub.cursor < slowest {
+			slowest = sub.cursor
+		}
+	}
+	return slowest
+}
+
+// consume delivers events to one subscriber in batches of everything that
+// is available when it wakes up
+func (p *PublishPipeline) consume(sub *pipelineSubscriber) {
+	defer p.wg.Done()
+
+	capacity := p.mask + 1
+	batch := make([]publishEvent, 0, 64)
+	tickerPublisher, _ := sub.publisher.(BookTickerPublisher)
+	updatePublisher, _ := sub.publisher.(OrderUpdatePublisher)
+	resyncer, _ := sub.publisher.(Resyncer)
+
+	for {
+		p.mu.Lock()
+		for sub.cursor == p.head && !p.closed {
+			p.notEmpty.Wait()
+		}
+		if sub.cursor == p.head {
+			p.mu.Unlock()
+			return
+		}
+
+		var missed uint64
+		if p.head-sub.cursor > capacity {
+			missed = p.head - capacity - sub.cursor
+			sub.cursor += missed
+			sub.dropped += missed
+			sub.resyncs++
+		}
+
+		batch = batch[:0]
+		for seq := sub.cursor; seq != p.head; seq++ {
+			batch = append(batch, p.ring[seq&p.mask])
+		}
+		p.mu.Unlock()
+
+		if missed > 0 && resyncer != nil {
+			resyncer.Resync(missed)
+		}
+
+		for _, event := range batch {
+			if event.bookTicker != nil {
+				if tickerPublisher != nil {
+					tickerPublisher.PublishBookTicker(event.bookTicker)
+				}
+				continue
+			}
+			if event.orderUpdates != nil {
+				if updatePublisher != nil {
+					updatePublisher.PublishOrderUpdates(event.orderUpdates...)
+				}
+				continue
+			}
+			sub.publisher.PublishTrades(event.trades...)
+		}
+
+		p.mu.Lock()
+		sub.cursor += uint64(len(batch))
+		sub.delivered += uint64(len(batch))
+		p.notFull.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// Stats returns a snapshot of the buffer and subscriber metrics
+func (p *PublishPipeline) Stats() PublishPipelineStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := PublishPipelineStats{
+		Capacity:     p.mask + 1,
+		Published:    p.head,
+		BlockedCount: p.blockedCount,
+		BlockedTime:  p.blockedTime,
+		Subscribers:  make([]PipelineStats, 0, len(p.subscribers)),
+	}
+
+	for _, sub := range p.subscribers {
+		policy := "block"
+		if sub.policy == OverflowDrop {
+			policy = "drop"
+		}
+
+		stats.Subscribers = append(stats.Subscribers, PipelineStats{
+			Name:      sub.name,
+			Policy:    policy,
+			Cursor:    sub.cursor,
+			Lag:       p.head - sub.cursor,
+			Delivered: sub.delivered,
+			Dropped:   sub.dropped,
+			Resyncs:   sub.resyncs,
+		})
+	}
+
+	return stats
+}
@@ -0,0 +1,163 @@
+package matching
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+)
+
+type PublishPipelineTestSuite struct {
+	suite.Suite
+}
+
+func TestPublishPipelineTestSuite(t *testing.T) {
+	suite.Run(t, &PublishPipelineTestSuite{})
+}
+
+// gatedPublishTrader blocks every delivery until the gate is opened
+type gatedPublishTrader struct {
+	*MemoryPublishTrader
+	gate   chan struct{}
+	missed uint64
+	mu     sync.Mutex
+}
+
+func newGatedPublishTrader() *gatedPublishTrader {
+	return &gatedPublishTrader{
+		MemoryPublishTrader: NewMemoryPublishTrader(),
+		gate:                make(chan struct{}),
+	}
+}
+
+func (g *gatedPublishTrader) PublishTrades(trades ...*Trade) {
+	<-g.gate
+	g.MemoryPublishTrader.PublishTrades(trades...)
+}
+
+func (g *gatedPublishTrader) Resync(missed uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.missed += missed
+}
+
+func (g *gatedPublishTrader) Missed() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.missed
+}
+
+func pipelineTrade(id string) *Trade {
+	return &Trade{
+		MarketID:     "BTC-USDT",
+		TakerOrderID: id,
+		Price:        decimal.NewFromInt(100),
+		Size:         decimal.NewFromInt(1),
+	}
+}
+
+func (suite *PublishPipelineTestSuite) TestFanOut() {
+	pipeline := NewPublishPipeline(8)
+	first := NewMemoryPublishTrader()
+	second := NewMemoryPublishTrader()
+	pipeline.Subscribe("first", first, OverflowBlock)
+	pipeline.Subscribe("second", second, OverflowDrop)
+	pipeline.Start()
+
+	for _, id := range []string{"a", "b", "c"} {
+		pipeline.PublishTrades(pipelineTrade(id))
+	}
+	pipeline.PublishBookTicker(&BookTicker{MarketID: "BTC-USDT", Sequence: 1})
+	pipeline.Close()
+
+	for _, publisher := range []*MemoryPublishTrader{first, second} {
+		suite.Equal(3, publisher.Count())
+		suite.Equal("a", publisher.Get(0).TakerOrderID)
+		suite.Equal("c", publisher.Get(2).TakerOrderID)
+		suite.Equal(1, publisher.BookTickerCount())
+	}
+
+	stats := pipeline.Stats()
+	suite.Equal(uint64(8), stats.Capacity)
+	suite.Equal(uint64(4), stats.Published)
+	suite.Len(stats.Subscribers, 2)
+	suite.Equal("first", stats.Subscribers[0].Name)
+	suite.Equal(uint64(0), stats.Subscribers[0].Lag)
+	suite.Equal(uint64(4), stats.Subscribers[1].Delivered)
+}
+
+func (suite *PublishPipelineTestSuite) TestDropAndResync() {
+	pipeline := NewPublishPipeline(4)
+	slow := newGatedPublishTrader()
+	fast := NewMemoryPublishTrader()
+	pipeline.Subscribe("slow", slow, OverflowDrop)
+	pipeline.Subscribe("fast", fast, OverflowBlock)
+	pipeline.Start()
+
+	// the slow subscriber picks up the first event and stalls on it
+	pipeline.PublishTrades(pipelineTrade("0"))
+	time.Sleep(20 * time.Millisecond)
+
+	// the engine is never blocked by a drop-policy subscriber
+	done := make(chan struct{})
+	go func() {
+		for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+			pipeline.PublishTrades(pipelineTrade(id))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.FailNow("publisher blocked by a drop-policy subscriber")
+	}
+
+	close(slow.gate)
+	pipeline.Close()
+
+	// it delivered "0", skipped "1".."4" and resumed at the oldest retained event
+	suite.Equal(uint64(4), slow.Missed())
+	suite.Equal(5, slow.Count())
+	suite.Equal("0", slow.Get(0).TakerOrderID)
+	suite.Equal("5", slow.Get(1).TakerOrderID)
+	suite.Equal("8", slow.Get(4).TakerOrderID)
+	suite.Equal(9, fast.Count())
+
+	stats := pipeline.Stats()
+	suite.Equal(uint64(4), stats.Subscribers[0].Dropped)
+	suite.Equal(uint64(1), stats.Subscribers[0].Resyncs)
+}
+
+func (suite *PublishPipelineTestSuite) TestBlockWhenFull() {
+	pipeline := NewPublishPipeline(2)
+	slow := newGatedPublishTrader()
+	pipeline.Subscribe("slow", slow, OverflowBlock)
+	pipeline.Start()
+
+	done := make(chan struct{})
+	go func() {
+		for _, id := range []string{"0", "1", "2", "3"} {
+			pipeline.PublishTrades(pipelineTrade(id))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		suite.FailNow("publisher did not wait for a blocking subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(slow.gate)
+	<-done
+	pipeline.Close()
+
+	suite.Equal(4, slow.Count())
+	for i, id := range []string{"0", "1", "2", "3"} {
+		suite.Equal(id, slow.Get(i).TakerOrderID)
+	}
+	suite.Equal(uint64(1), pipeline.Stats().BlockedCount)
+}
@@ -6,14 +6,29 @@ type PublishTrader interface {
 	PublishTrades(...*Trade)
 }
 
+// BookTickerPublisher is implemented by publishers that also want the best
+// bid and offer whenever the top of an order book changes.
+type BookTickerPublisher interface {
+	PublishBookTicker(*BookTicker)
+}
+
+// OrderUpdatePublisher is implemented by publishers that also want to know
+// when the book moves a pegged order to a new price.
+type OrderUpdatePublisher interface {
+	PublishOrderUpdates(...*OrderUpdate)
+}
+
 type MemoryPublishTrader struct {
-	mu     sync.RWMutex
-	Trades []*Trade
+	mu           sync.RWMutex
+	Trades       []*Trade
+	BookTickers  []*BookTicker
+	OrderUpdates []*OrderUpdate
 }
 
 func NewMemoryPublishTrader() *MemoryPublishTrader {
 	return &MemoryPublishTrader{
-		Trades: make([]*Trade, 0),
+		Trades:      make([]*Trade, 0),
+		BookTickers: make([]*BookTicker, 0),
 	}
 }
 
@@ -23,6 +38,18 @@ func (m *MemoryPublishTrader) PublishTrades(trades ...*Trade) {
 	m.Trades = append(m.Trades, trades...)
 }
 
+func (m *MemoryPublishTrader) PublishBookTicker(ticker *BookTicker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.BookTickers = append(m.BookTickers, ticker)
+}
+
+func (m *MemoryPublishTrader) PublishOrderUpdates(updates ...*OrderUpdate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.OrderUpdates = append(m.OrderUpdates, updates...)
+}
+
 func (m *MemoryPublishTrader) Count() int {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -36,6 +63,35 @@ func (m *MemoryPublishTrader) Get(index int) *Trade {
 	return m.Trades[index]
 }
 
+func (m *MemoryPublishTrader) BookTickerCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.BookTickers)
+}
+
+func (m *MemoryPublishTrader) LastBookTicker() *BookTicker {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.BookTickers) == 0 {
+		return nil
+	}
+	return m.BookTickers[len(m.BookTickers)-1]
+}
+
+func (m *MemoryPublishTrader) OrderUpdateCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.OrderUpdates)
+}
+
+func (m *MemoryPublishTrader) GetOrderUpdate(index int) *OrderUpdate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.OrderUpdates[index]
+}
+
 type DiscardPublishTrader struct {
 }
 
@@ -46,3 +102,37 @@ func NewDiscardPublishTrader() *DiscardPublishTrader {
 func (p *DiscardPublishTrader) PublishTrades(trades ...*Trade) {
 
 }
+
+// MultiPublishTrader fans trades, book tickers and order updates out to
+// several publishers, in the order they were given.
+type MultiPublishTrader struct {
+	publishers []PublishTrader
+}
+
+func NewMultiPublishTrader(publishers ...PublishTrader) *MultiPublishTrader {
+	return &MultiPublishTrader{
+		publishers: publishers,
+	}
+}
+
+func (m *MultiPublishTrader) PublishTrades(trades ...*Trade) {
+	for _, publisher := range m.publishers {
+		publisher.PublishTrades(trades...)
+	}
+}
+
+func (m *MultiPublishTrader) PublishBookTicker(ticker *BookTicker) {
+	for _, publisher := range m.publishers {
+		if tickerPublisher, ok := publisher.(BookTickerPublisher); ok {
+			tickerPublisher.PublishBookTicker(ticker)
+		}
+	}
+}
+
+func (m *MultiPublishTrader) PublishOrderUpdates(updates ...*OrderUpdate) {
+	for _, publisher := range m.publishers {
+		if updatePublisher, ok := publisher.(OrderUpdatePublisher); ok {
+			updatePublisher.PublishOrderUpdates(updates...)
+		}
+	}
+}
@@ -13,63 +13,97 @@ type UpdateEvent struct {
 	Size  string `json:"size"`
 }
 
+// priceUnit is a price level. Hidden orders rest in their own list behind
+// the displayed ones and their size is kept out of totalSize, which is what
+// depth and the best bid and offer show. pegSize is the part of totalSize
+// displayed by pegged orders.
 type priceUnit struct {
-	totalSize decimal.Decimal
-	list      *list.List
+	totalSize   int64
+	list        *list.List
+	hiddenSize  int64
+	hidden      *list.List // created with the first hidden order
+	pegSize     int64
+	constrained int // orders with a minimum size or all-or-none
+}
+
+// resize adds lots, which may be negative, to the sizes an order counts
+// towards
+func (unit *priceUnit) resize(order *Order, lots int64) {
+	switch {
+	case order.Hidden:
+		unit.hiddenSize += lots
+	case len(order.Peg) > 0:
+		unit.totalSize += lots
+		unit.pegSize += lots
+	default:
+		unit.totalSize += lots
+	}
+}
+
+// head returns the order at the front of the level, displayed orders first
+func (unit *priceUnit) head() *Order {
+	el := unit.list.Front()
+	if el == nil {
+		el = unit.hidden.Front()
+	}
+	order, _ := el.Value.(*Order)
+	return order
+}
+
+func (unit *priceUnit) empty() bool {
+	return unit.list.Len() == 0 && (unit.hidden == nil || unit.hidden.Len() == 0)
 }
 
 type DepthItem struct {
-	ID    uint32
-	Price decimal.Decimal
-	Size  decimal.Decimal
+	ID                 uint32          `json:"id"`
+	Price              decimal.Decimal `json:"price"`
+	Size               decimal.Decimal `json:"size"`
+	Notional           decimal.Decimal `json:"notional"`
+	CumulativeSize     decimal.Decimal `json:"cumulative_size"`
+	CumulativeNotional decimal.Decimal `json:"cumulative_notional"`
 }
 
 type queue struct {
 	side        Side
+	scale       scale
 	totalOrders int64
 	depths      int64
 	depthList   *skiplist.SkipList
-	priceList   map[string]*skiplist.Element
+	priceList   map[int64]*skiplist.Element
 	orders      map[string]*list.Element
+	users       map[int64]map[string]*Order // resting orders by user
 }
 
 func NewBuyerQueue() *queue {
-	return &queue{
-		side: Buy,
-		depthList: skiplist.New(skiplist.GreaterThanFunc(func(lhs, rhs interface{}) int {
-			d1, _ := lhs.(decimal.Decimal)
-			d2, _ := rhs.(decimal.Decimal)
-
-			if d1.LessThan(d2) {
-				return 1
-			} else if d1.GreaterThan(d2) {
-				return -1
-			}
-
-			return 0
-		})),
-		priceList: make(map[string]*skiplist.Element),
-		orders:    make(map[string]*list.Element),
-	}
+	return newQueue(Buy, defaultScale)
 }
 
 func NewSellerQueue() *queue {
-	return &queue{
-		side: Sell,
-		depthList: skiplist.New(skiplist.GreaterThanFunc(func(lhs, rhs interface{}) int {
-			d1, _ := lhs.(decimal.Decimal)
-			d2, _ := rhs.(decimal.Decimal)
-
-			if d1.GreaterThan(d2) {
-				return 1
-			} else if d1.LessThan(d2) {
-				return -1
-			}
+	return newQueue(Sell, defaultScale)
+}
+
+// newQueue keys price levels by ticks, best price first
+func newQueue(side Side, scale scale) *queue {
+	better := func(lhs, rhs interface{}) int {
+		p1, _ := lhs.(int64)
+		p2, _ := rhs.(int64)
 
+		if p1 == p2 {
 			return 0
-		})),
-		priceList: make(map[string]*skiplist.Element),
+		}
+		if (side == Buy) == (p1 < p2) {
+			return 1
+		}
+		return -1
+	}
+
+	return &queue{
+		side:      side,
+		scale:     scale,
+		depthList: skiplist.New(skiplist.GreaterThanFunc(better)),
+		priceList: make(map[int64]*skiplist.Element),
 		orders:    make(map[string]*list.Element),
+		users:     make(map[int64]map[string]*Order),
 	}
 }
 
@@ -92,61 +126,117 @@ func (q *queue) order(id string) *Order {
 }
 
 func (q *queue) insertOrder(order *Order, isFront bool) {
-	el, ok := q.priceList[order.Price.String()]
-	if ok {
-		var orderElement *list.Element
-		unit, _ := el.Value.(*priceUnit)
-		if isFront {
-			orderElement = unit.list.PushFront(order)
-		} else {
-			orderElement = unit.list.PushBack(order)
-		}
+	q.indexUser(order)
 
-		unit.totalSize = unit.totalSize.Add(order.Size)
-		q.orders[order.ID] = orderElement
-
-		atomic.AddInt64(&q.totalOrders, 1)
+	var unit *priceUnit
+	if el, ok := q.priceList[order.price]; ok {
+		unit, _ = el.Value.(*priceUnit)
 	} else {
-		unit := priceUnit{
+		unit = &priceUnit{
 			list: list.New(),
 		}
+		q.priceList[order.price] = q.depthList.Set(order.price, unit)
+		atomic.AddInt64(&q.depths, 1)
+	}
 
-		orderElement := unit.list.PushFront(order)
-		unit.totalSize = order.Size
-
-		q.orders[order.ID] = orderElement
-
-		el := q.depthList.Set(order.Price, &unit)
-		q.priceList[order.Price.String()] = el
+	orders := unit.list
+	if order.Hidden {
+		if unit.hidden == nil {
+			unit.hidden = list.New()
+		}
+		orders = unit.hidden
+	}
+	unit.resize(order, order.size)
+	if order.constrained() {
+		unit.constrained++
+	}
 
-		atomic.AddInt64(&q.totalOrders, 1)
-		atomic.AddInt64(&q.depths, 1)
+	if isFront {
+		q.orders[order.ID] = orders.PushFront(order)
+	} else {
+		q.orders[order.ID] = orders.PushBack(order)
 	}
+	atomic.AddInt64(&q.totalOrders, 1)
 }
 
-func (q *queue) removeOrder(price decimal.Decimal, id string) {
-	skipElement, ok := q.priceList[price.String()]
+func (q *queue) removeOrder(price int64, id string) {
+	skipElement, ok := q.priceList[price]
 	if ok {
 		unit, _ := skipElement.Value.(*priceUnit)
 
 		orderElement, ok := q.orders[id]
-		order, _ := orderElement.Value.(*Order)
 		if ok {
-			unit.list.Remove(orderElement)
-			unit.totalSize = unit.totalSize.Sub(order.Size)
+			order, _ := orderElement.Value.(*Order)
+			if order.Hidden {
+				unit.hidden.Remove(orderElement)
+			} else {
+				unit.list.Remove(orderElement)
+			}
+			unit.resize(order, -order.size)
+			if order.constrained() {
+				unit.constrained--
+			}
 			delete(q.orders, id)
+			q.unindexUser(order)
 			atomic.AddInt64(&q.totalOrders, -1)
 		}
 
-		if unit.list.Len() == 0 {
+		if unit.empty() {
 			q.depthList.RemoveElement(skipElement)
-			delete(q.priceList, order.Price.String())
+			delete(q.priceList, price)
 			atomic.AddInt64(&q.depths, -1)
 		}
 
 	}
 }
 
+// reduceOrder takes lots off a resting order that stays in the book, keeping
+// its time priority
+func (q *queue) reduceOrder(order *Order, lots int64) {
+	el, ok := q.priceList[order.price]
+	if !ok {
+		return
+	}
+
+	unit, _ := el.Value.(*priceUnit)
+	unit.resize(order, -lots)
+	order.size -= lots
+}
+
+func (q *queue) indexUser(order *Order) {
+	orders, ok := q.users[order.UserID]
+	if !ok {
+		orders = make(map[string]*Order)
+		q.users[order.UserID] = orders
+	}
+	orders[order.ID] = order
+}
+
+func (q *queue) unindexUser(order *Order) {
+	orders := q.users[order.UserID]
+	delete(orders, order.ID)
+	if len(orders) == 0 {
+		delete(q.users, order.UserID)
+	}
+}
+
+// userOrders returns copies of the resting orders of a user
+func (q *queue) userOrders(userID int64) []*Order {
+	orders := make([]*Order, 0, len(q.users[userID]))
+	for _, order := range q.users[userID] {
+		orders = append(orders, q.view(order))
+	}
+
+	return orders
+}
+
+// view copies a resting order with Size set to its remaining size
+func (q *queue) view(order *Order) *Order {
+	copied := *order
+	copied.Size = q.scale.size(order.size)
+	return &copied
+}
+
 func (q *queue) getHeadOrder() *Order {
 	el := q.depthList.Front()
 	if el == nil {
@@ -154,15 +244,96 @@ func (q *queue) getHeadOrder() *Order {
 	}
 
 	unit, _ := el.Value.(*priceUnit)
-	order, _ := unit.list.Front().Value.(*Order)
-	return order
+	return unit.head()
+}
+
+// top returns the best displayed price of the queue in ticks and the total
+// lots displayed there. Levels holding only hidden orders are skipped.
+func (q *queue) top() (int64, int64) {
+	for el := q.depthList.Front(); el != nil; el = el.Next() {
+		unit, _ := el.Value.(*priceUnit)
+		if unit.totalSize > 0 {
+			price, _ := el.Key().(int64)
+			return price, unit.totalSize
+		}
+	}
+
+	return 0, 0
+}
+
+// eachOrder calls fn with the resting orders in priority order, best price
+// first and displayed before hidden orders within a price, until fn returns
+// false. fn may remove or reduce the order it is called with.
+func (q *queue) eachOrder(fn func(*Order) bool) {
+	for el := q.depthList.Front(); el != nil; {
+		next := el.Next()
+		unit, _ := el.Value.(*priceUnit)
+		for _, orders := range [2]*list.List{unit.list, unit.hidden} {
+			if orders == nil {
+				continue
+			}
+			for orderEl := orders.Front(); orderEl != nil; {
+				nextOrder := orderEl.Next()
+				order, _ := orderEl.Value.(*Order)
+				if !fn(order) {
+					return
+				}
+				orderEl = nextOrder
+			}
+		}
+		el = next
+	}
+}
+
+// fillable returns how many lots of a limit order the resting orders it
+// crosses would fill, leaving out those that would not accept their match
+func (q *queue) fillable(order *Order) int64 {
+	var filled int64
+	for el := q.depthList.Front(); el != nil && filled < order.size; el = el.Next() {
+		unit, _ := el.Value.(*priceUnit)
+		if !crosses(order, unit.head()) {
+			break
+		}
+		if unit.constrained == 0 {
+			filled += unit.totalSize + unit.hiddenSize
+			continue
+		}
+
+		for _, orders := range [2]*list.List{unit.list, unit.hidden} {
+			if orders == nil {
+				continue
+			}
+			for orderEl := orders.Front(); orderEl != nil && filled < order.size; orderEl = orderEl.Next() {
+				maker, _ := orderEl.Value.(*Order)
+				if lots := min(order.size-filled, maker.size); maker.accepts(lots) {
+					filled += lots
+				}
+			}
+		}
+	}
+
+	return min(filled, order.size)
+}
+
+// reference returns the best price in ticks displayed by orders that are
+// not pegged, which pegged orders are priced from, or zero
+func (q *queue) reference() int64 {
+	for el := q.depthList.Front(); el != nil; el = el.Next() {
+		unit, _ := el.Value.(*priceUnit)
+		if unit.totalSize > unit.pegSize {
+			price, _ := el.Key().(int64)
+			return price
+		}
+	}
+
+	return 0
 }
 
 func (q *queue) popHeadOrder() *Order {
 	ord := q.getHeadOrder()
 
 	if ord != nil {
-		q.removeOrder(ord.Price, ord.ID)
+		q.removeOrder(ord.price, ord.ID)
 	}
 
 	return ord
@@ -177,24 +348,74 @@ func (q *queue) depthCount() int64 {
 }
 
 func (q *queue) depth(limit uint32) []*DepthItem {
+	return q.groupedDepth(limit, decimal.Zero)
+}
+
+// groupedDepth buckets price levels into multiples of group, rounding bids
+// down and asks up. A zero group returns the raw price levels. Only displayed
+// sizes count, so levels holding only hidden orders are left out.
+func (q *queue) groupedDepth(limit uint32, group decimal.Decimal) []*DepthItem {
 	result := make([]*DepthItem, 0, limit)
+	groupTicks := q.scale.ticks(group)
 
-	el := q.depthList.Front()
+	var last *DepthItem
+	var lastPrice, cumSize int64
+	cumNotional := decimal.Zero
 
-	var i uint32 = 1
-	for i < limit && el != nil {
+	for el := q.depthList.Front(); el != nil; el = el.Next() {
 		unit, _ := el.Value.(*priceUnit)
-		order, _ := unit.list.Front().Value.(*Order)
-		d := DepthItem{
-			ID:    i,
-			Price: order.Price,
-			Size:  unit.totalSize,
+		if unit.totalSize == 0 {
+			continue
+		}
+		ticks, _ := el.Key().(int64)
+
+		price := q.bucketPrice(ticks, groupTicks)
+		size := q.scale.size(unit.totalSize)
+		notional := q.scale.price(ticks).Mul(size)
+		cumSize += unit.totalSize
+		cumNotional = cumNotional.Add(notional)
+
+		if last != nil && lastPrice == price {
+			last.Size = last.Size.Add(size)
+			last.Notional = last.Notional.Add(notional)
+			last.CumulativeSize = q.scale.size(cumSize)
+			last.CumulativeNotional = cumNotional
+			continue
 		}
 
-		result = append(result, &d)
+		if uint32(len(result)) >= limit {
+			break
+		}
 
-		el = el.Next()
+		last = &DepthItem{
+			ID:                 uint32(len(result)) + 1,
+			Price:              q.scale.price(price),
+			Size:               size,
+			Notional:           notional,
+			CumulativeSize:     q.scale.size(cumSize),
+			CumulativeNotional: cumNotional,
+		}
+		lastPrice = price
+		result = append(result, last)
 	}
 
 	return result
 }
+
+func (q *queue) bucketPrice(price int64, group int64) int64 {
+	if group <= 1 {
+		return price
+	}
+
+	rem := price % group
+	if rem == 0 {
+		return price
+	}
+
+	floor := price - rem
+	if q.side == Buy {
+		return floor
+	}
+
+	return floor + group
+}
@@ -10,29 +10,29 @@ import (
 func TestBuyerQueue(t *testing.T) {
 	q := NewBuyerQueue()
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "101",
 		Price: decimal.NewFromInt(10),
 		Size:  decimal.NewFromInt(10),
-	}, false)
+	}), false)
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "201",
 		Price: decimal.NewFromInt(20),
 		Size:  decimal.NewFromInt(10),
-	}, false)
+	}), false)
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "301",
 		Price: decimal.NewFromInt(30),
 		Size:  decimal.NewFromInt(10),
-	}, false)
+	}), false)
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "202",
 		Price: decimal.NewFromInt(20),
 		Size:  decimal.NewFromInt(100),
-	}, false)
+	}), false)
 
 	assert.Equal(t, int64(4), q.orderCount())
 
@@ -51,7 +51,7 @@ func TestBuyerQueue(t *testing.T) {
 	assert.Equal(t, "20", ord.Price.String())
 	assert.Equal(t, "10", ord.Size.String())
 	ord.Size = decimal.NewFromInt(2)
-	q.insertOrder(ord, true)
+	q.insertOrder(prepared(ord), true)
 
 	ord = q.popHeadOrder()
 	assert.Equal(t, "201", ord.ID)
@@ -72,29 +72,29 @@ func TestBuyerQueue(t *testing.T) {
 func TestSellerQueue(t *testing.T) {
 	q := NewSellerQueue()
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "101",
 		Price: decimal.NewFromInt(10),
 		Size:  decimal.NewFromInt(10),
-	}, false)
+	}), false)
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "201",
 		Price: decimal.NewFromInt(20),
 		Size:  decimal.NewFromInt(10),
-	}, false)
+	}), false)
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "301",
 		Price: decimal.NewFromInt(30),
 		Size:  decimal.NewFromInt(10),
-	}, false)
+	}), false)
 
-	q.insertOrder(&Order{
+	q.insertOrder(prepared(&Order{
 		ID:    "202",
 		Price: decimal.NewFromInt(20),
 		Size:  decimal.NewFromInt(100),
-	}, false)
+	}), false)
 
 	assert.Equal(t, int64(4), q.orderCount())
 	depths := q.depth(25)
@@ -111,7 +111,7 @@ func TestSellerQueue(t *testing.T) {
 	assert.Equal(t, "20", ord.Price.String())
 	assert.Equal(t, "10", ord.Size.String())
 	ord.Size = decimal.NewFromInt(2)
-	q.insertOrder(ord, true)
+	q.insertOrder(prepared(ord), true)
 
 	ord = q.popHeadOrder()
 	assert.Equal(t, "201", ord.ID)
@@ -129,3 +129,61 @@ func TestSellerQueue(t *testing.T) {
 	assert.Equal(t, int64(0), q.orderCount())
 
 }
+
+func TestGroupedDepth(t *testing.T) {
+	bids := NewBuyerQueue()
+	asks := NewSellerQueue()
+
+	for i, price := range []string{"10.05", "10.12", "10.19", "10.31"} {
+		bids.insertOrder(prepared(&Order{
+			ID:    "bid-" + price,
+			Side:  Buy,
+			Price: decimal.RequireFromString(price),
+			Size:  decimal.NewFromInt(int64(i + 1)),
+		}), false)
+
+		asks.insertOrder(prepared(&Order{
+			ID:    "ask-" + price,
+			Side:  Sell,
+			Price: decimal.RequireFromString(price),
+			Size:  decimal.NewFromInt(int64(i + 1)),
+		}), false)
+	}
+
+	depths := bids.groupedDepth(10, decimal.RequireFromString("0.1"))
+	assert.Len(t, depths, 3)
+	assert.Equal(t, "10.3", depths[0].Price.String())
+	assert.Equal(t, "4", depths[0].Size.String())
+	assert.Equal(t, "10.1", depths[1].Price.String())
+	assert.Equal(t, "5", depths[1].Size.String())
+	assert.Equal(t, "9", depths[1].CumulativeSize.String())
+	assert.Equal(t, "10", depths[2].Price.String())
+	assert.Equal(t, "10", depths[2].CumulativeSize.String())
+	assert.Equal(t, "102.1", depths[2].CumulativeNotional.String())
+
+	depths = asks.groupedDepth(10, decimal.RequireFromString("0.1"))
+	assert.Len(t, depths, 3)
+	assert.Equal(t, "10.1", depths[0].Price.String())
+	assert.Equal(t, "1", depths[0].Size.String())
+	assert.Equal(t, "10.2", depths[1].Price.String())
+	assert.Equal(t, "5", depths[1].Size.String())
+	assert.Equal(t, "10.4", depths[2].Price.String())
+
+	depths = asks.groupedDepth(1, decimal.NewFromInt(1))
+	assert.Len(t, depths, 1)
+	assert.Equal(t, "11", depths[0].Price.String())
+	assert.Equal(t, "10", depths[0].Size.String())
+	assert.Equal(t, "102.1", depths[0].Notional.String())
+
+	depths = bids.depth(2)
+	assert.Len(t, depths, 2)
+	assert.Equal(t, uint32(2), depths[1].ID)
+}
+
+// prepared converts an order to ticks and lots as the order book would
+func prepared(order *Order) *Order {
+	if err := defaultScale.prepare(order); err != nil {
+		panic(err)
+	}
+	return order
+}
@@ -0,0 +1,226 @@
+package matching
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ringBatchSize is how many commands a stage consumes before publishing its
+// cursor to the next stage
+const ringBatchSize = 256
+
+// ringSlot is one pre-allocated entry of a commandRing. published holds the
+// ring sequence of the command once its producer has finished writing it.
+// The other fields are filled in by the stages as the command moves through.
+type ringSlot struct {
+	published atomic.Uint64
+	cmd       command
+	sequence  uint64         // book sequence, assigned by the journal stage
+	trades    []*Trade       // filled by the match stage
+	updates   []*OrderUpdate // filled by the match stage when pegged orders moved
+	ticker    *BookTicker    // filled by the match stage when the top changed
+}
+
+// commandRing carries the commands of an order book through three stages
+// that read the same sequence in order: the journal records a command, the
+// match stage applies it, and the publish stage hands its events to the
+// publisher. Each stage consumes everything available in one batch and only
+// then advances its cursor, so the stages run concurrently without locks.
+// A slot is reused once the publish stage has released it.
+//
+// Producers claim sequences with a CAS, so API handlers on many goroutines
+// can feed the ring; a full ring fails the claim instead of blocking.
+type commandRing struct {
+	slots []ringSlot
+	mask  uint64
+
+	claimed   atomic.Uint64 // last sequence handed to a producer
+	journaled atomic.Uint64
+	matched   atomic.Uint64
+	released  atomic.Uint64
+
+	// each stage parks on its channel when it has caught up
+	journalWake chan struct{}
+	matchWake   chan struct{}
+	publishWake chan struct{}
+}
+
+// newCommandRing rounds size up to a power of two
+func newCommandRing(size int) *commandRing {
+	capacity := 1
+	for capacity < size {
+		capacity <<= 1
+	}
+
+	return &commandRing{
+		slots:       make([]ringSlot, capacity),
+		mask:        uint64(capacity - 1),
+		journalWake: make(chan struct{}, 1),
+		matchWake:   make(chan struct{}, 1),
+		publishWake: make(chan struct{}, 1),
+	}
+}
+
+func (r *commandRing) slot(seq uint64) *ringSlot {
+	return &r.slots[seq&r.mask]
+}
+
+// claim reserves the next sequence, failing if the ring is full
+func (r *commandRing) claim() (uint64, bool) {
+	for {
+		current := r.claimed.Load()
+		next := current + 1
+		if next-r.released.Load() > uint64(len(r.slots)) {
+			return 0, false
+		}
+		if r.claimed.CompareAndSwap(current, next) {
+			return next, true
+		}
+	}
+}
+
+// publish makes a claimed command visible to the journal stage
+func (r *commandRing) publish(seq uint64, cmd command) {
+	slot := r.slot(seq)
+	slot.cmd = cmd
+	slot.published.Store(seq)
+	notify(r.journalWake)
+}
+
+// available returns the last published sequence after cursor, up to max
+// commands ahead. Producers may publish out of order, so it stops at the
+// first gap.
+func (r *commandRing) available(cursor uint64, max int) uint64 {
+	end := cursor
+	for n := 0; n < max; n++ {
+		if r.slot(end+1).published.Load() != end+1 {
+			break
+		}
+		end++
+	}
+
+	return end
+}
+
+// queued is the number of claimed commands not yet released
+func (r *commandRing) queued() int {
+	return int(r.claimed.Load() - r.released.Load())
+}
+
+func notify(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// journalStage assigns book sequences to the next batch of commands and
+// records them before they are applied. The batch is flushed to disk before
+// the match stage sees it, so no command is acknowledged before it is
+// durable.
+func (book *OrderBook) journalStage(max int) int {
+	ring := book.ring
+	from := ring.journaled.Load()
+	to := ring.available(from, max)
+	if to == from {
+		return 0
+	}
+
+	for seq := from + 1; seq <= to; seq++ {
+		slot := ring.slot(seq)
+		if !slot.cmd.take() {
+			// the caller timed out waiting, drop the command
+			slot.cmd = command{}
+			continue
+		}
+		switch slot.cmd.typ {
+		case commandAddOrder:
+			book.sequenced++
+			slot.sequence = book.sequenced
+			book.record(&JournalEntry{Sequence: slot.sequence, Type: journalAdd, Order: slot.cmd.order})
+		case commandCancelOrder:
+			book.sequenced++
+			slot.sequence = book.sequenced
+			book.record(&JournalEntry{Sequence: slot.sequence, Type: journalCancel, OrderID: slot.cmd.orderID})
+		case commandAddList:
+			book.sequenced++
+			slot.sequence = book.sequenced
+			book.record(&JournalEntry{Sequence: slot.sequence, Type: journalAddList, Orders: slot.cmd.orders})
+		case commandCancelList:
+			book.sequenced++
+			slot.sequence = book.sequenced
+			book.record(&JournalEntry{Sequence: slot.sequence, Type: journalCancelList, ListID: slot.cmd.listID})
+		case commandMassCancel:
+			book.sequenced++
+			slot.sequence = book.sequenced
+			book.record(&JournalEntry{Sequence: slot.sequence, Type: journalMassCancel, UserID: slot.cmd.userID, Side: slot.cmd.side})
+		case commandCancelAll:
+			book.sequenced++
+			slot.sequence = book.sequenced
+			book.record(&JournalEntry{Sequence: slot.sequence, Type: journalCancelAll})
+		}
+	}
+	book.flushJournal()
+
+	ring.journaled.Store(to)
+	notify(ring.matchWake)
+	return int(to - from)
+}
+
+// matchStage applies the next batch of journaled commands to the book
+func (book *OrderBook) matchStage(max int) int {
+	ring := book.ring
+	from := ring.matched.Load()
+	to := min(ring.journaled.Load(), from+uint64(max))
+	if to == from {
+		return 0
+	}
+
+	for seq := from + 1; seq <= to; seq++ {
+		book.process(ring.slot(seq))
+	}
+
+	ring.matched.Store(to)
+	notify(ring.publishWake)
+	return int(to - from)
+}
+
+// publishStage hands the events of the next batch of matched commands to
+// the publisher and releases their slots
+func (book *OrderBook) publishStage(max int) int {
+	ring := book.ring
+	from := ring.released.Load()
+	to := min(ring.matched.Load(), from+uint64(max))
+	if to == from {
+		return 0
+	}
+
+	for seq := from + 1; seq <= to; seq++ {
+		slot := ring.slot(seq)
+		book.publish(slot.trades, slot.updates, slot.ticker)
+
+		slot.cmd = command{}
+		slot.trades = nil
+		slot.updates = nil
+		slot.ticker = nil
+	}
+
+	ring.released.Store(to)
+	return int(to - from)
+}
+
+// runStage runs one stage on its own goroutine until the book is stopped and
+// the stage has consumed every claimed command
+func (book *OrderBook) runStage(wg *sync.WaitGroup, wake chan struct{}, cursor *atomic.Uint64, stage func(int) int) {
+	defer wg.Done()
+
+	for {
+		if stage(ringBatchSize) > 0 {
+			continue
+		}
+		if book.stopping.Load() && cursor.Load() == book.ring.claimed.Load() {
+			return
+		}
+		<-wake
+	}
+}
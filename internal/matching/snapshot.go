@@ -0,0 +1,146 @@
+package matching
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Snapshot is the full resting state of an order book. Orders are listed
+// best price first and in time priority within a price.
+type Snapshot struct {
+	MarketID  string          `json:"market_id"`
+	Sequence  uint64          `json:"sequence"`
+	Bids      []*Order        `json:"bids"`
+	Asks      []*Order        `json:"asks"`
+	Stops     []*Order        `json:"stops,omitempty"` // waiting stop orders in trigger order
+	LastPrice decimal.Decimal `json:"last_price"`      // stop orders trigger off the last trade
+	Time      time.Time       `json:"time"`
+}
+
+// SnapshotStore keeps the latest snapshot of every market
+type SnapshotStore interface {
+	Save(snapshot *Snapshot) error
+	// Load returns nil without error if the market has no snapshot
+	Load(marketID string) (*Snapshot, error)
+}
+
+// FileSnapshotStore stores one JSON file per market in a directory
+type FileSnapshotStore struct {
+	dir string
+}
+
+// NewFileSnapshotStore creates the directory if needed
+func NewFileSnapshotStore(dir string) (*FileSnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &FileSnapshotStore{dir: dir}, nil
+}
+
+func (s *FileSnapshotStore) path(marketID string) string {
+	return filepath.Join(s.dir, marketID+".json")
+}
+
+func (s *FileSnapshotStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a torn snapshot
+	tmp := s.path(snapshot.MarketID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(snapshot.MarketID))
+}
+
+func (s *FileSnapshotStore) Load(marketID string) (*Snapshot, error) {
+	data, err := os.ReadFile(s.path(marketID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// snapshot captures the book. It must run on the book's goroutine or after
+// the book has stopped.
+func (book *OrderBook) snapshot() *Snapshot {
+	return &Snapshot{
+		MarketID:  book.marketID,
+		Sequence:  book.sequence,
+		Bids:      book.bidQueue.allOrders(),
+		Asks:      book.askQueue.allOrders(),
+		Stops:     book.stops.allOrders(),
+		LastPrice: book.scale.price(book.lastPrice),
+		Time:      time.Now().UTC(),
+	}
+}
+
+// restore loads a snapshot into an empty book
+func (book *OrderBook) restore(snapshot *Snapshot) error {
+	for _, order := range snapshot.Bids {
+		if err := book.scale.prepareResting(order); err != nil {
+			return err
+		}
+		book.bidQueue.insertOrder(order, false)
+		book.restorePeg(order)
+	}
+	for _, order := range snapshot.Asks {
+		if err := book.scale.prepareResting(order); err != nil {
+			return err
+		}
+		book.askQueue.insertOrder(order, false)
+		book.restorePeg(order)
+	}
+	for _, order := range snapshot.Stops {
+		if err := book.scale.prepareResting(order); err != nil {
+			return err
+		}
+		book.stops.insert(order)
+	}
+
+	orders := append(append(snapshot.Bids, snapshot.Asks...), snapshot.Stops...)
+	book.restoreLists(orders)
+	book.lastPrice = book.scale.ticks(snapshot.LastPrice)
+	book.sequence = snapshot.Sequence
+
+	return nil
+}
+
+// allOrders returns a copy of every resting order with its remaining size,
+// best price first and in priority within a price, displayed orders before
+// hidden ones
+func (q *queue) allOrders() []*Order {
+	orders := make([]*Order, 0, q.orderCount())
+	for el := q.depthList.Front(); el != nil; el = el.Next() {
+		unit, _ := el.Value.(*priceUnit)
+		for orderEl := unit.list.Front(); orderEl != nil; orderEl = orderEl.Next() {
+			order, _ := orderEl.Value.(*Order)
+			orders = append(orders, q.view(order))
+		}
+		if unit.hidden == nil {
+			continue
+		}
+		for orderEl := unit.hidden.Front(); orderEl != nil; orderEl = orderEl.Next() {
+			order, _ := orderEl.Value.(*Order)
+			orders = append(orders, q.view(order))
+		}
+	}
+
+	return orders
+}
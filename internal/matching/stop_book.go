@@ -0,0 +1,114 @@
+package matching
+
+import "sort"
+
+// stopBook holds stop orders until the last trade price reaches their stop
+// price: buy stops trigger at or above it and sell stops at or below it.
+// Each side is kept in trigger order, in time priority within a stop price.
+type stopBook struct {
+	scale  scale
+	buys   []*Order // lowest stop first
+	sells  []*Order // highest stop first
+	orders map[string]*Order
+}
+
+func newStopBook(scale scale) *stopBook {
+	return &stopBook{
+		scale:  scale,
+		orders: make(map[string]*Order),
+	}
+}
+
+func (s *stopBook) insert(order *Order) {
+	side := &s.sells
+	after := func(other *Order) bool { return other.stop < order.stop }
+	if order.Side == Buy {
+		side = &s.buys
+		after = func(other *Order) bool { return other.stop > order.stop }
+	}
+
+	i := sort.Search(len(*side), func(i int) bool { return after((*side)[i]) })
+	*side = append(*side, nil)
+	copy((*side)[i+1:], (*side)[i:])
+	(*side)[i] = order
+
+	s.orders[order.ID] = order
+}
+
+func (s *stopBook) order(id string) *Order {
+	return s.orders[id]
+}
+
+func (s *stopBook) remove(id string) {
+	order, ok := s.orders[id]
+	if !ok {
+		return
+	}
+	delete(s.orders, id)
+
+	side := &s.sells
+	if order.Side == Buy {
+		side = &s.buys
+	}
+	for i, other := range *side {
+		if other == order {
+			*side = append((*side)[:i], (*side)[i+1:]...)
+			return
+		}
+	}
+}
+
+// triggered removes and returns the next stop order the last trade price
+// has reached, or nil. When both sides are reached the older order goes
+// first.
+func (s *stopBook) triggered(lastPrice int64) *Order {
+	if lastPrice == 0 {
+		return nil
+	}
+
+	var next *Order
+	if len(s.buys) > 0 && s.buys[0].stop <= lastPrice {
+		next = s.buys[0]
+	}
+	if len(s.sells) > 0 && s.sells[0].stop >= lastPrice && (next == nil || older(s.sells[0], next)) {
+		next = s.sells[0]
+	}
+
+	if next != nil {
+		s.remove(next.ID)
+	}
+	return next
+}
+
+// userOrders returns copies of the stop orders of a user, optionally only on
+// one side
+func (s *stopBook) userOrders(userID int64, side Side) []*Order {
+	orders := make([]*Order, 0)
+	for _, order := range s.orders {
+		if order.UserID == userID && (side == 0 || order.Side == side) {
+			orders = append(orders, s.view(order))
+		}
+	}
+
+	return orders
+}
+
+// allOrders returns a copy of every stop order, buys then sells, in trigger
+// order
+func (s *stopBook) allOrders() []*Order {
+	orders := make([]*Order, 0, len(s.orders))
+	for _, order := range s.buys {
+		orders = append(orders, s.view(order))
+	}
+	for _, order := range s.sells {
+		orders = append(orders, s.view(order))
+	}
+
+	return orders
+}
+
+func (s *stopBook) view(order *Order) *Order {
+	copied := *order
+	copied.Size = s.scale.size(order.size)
+	return &copied
+}
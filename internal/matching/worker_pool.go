@@ -0,0 +1,74 @@
+package matching
+
+import "sync"
+
+// workerBatchSize is how many commands a worker processes for one order book
+// before giving other books a turn
+const workerBatchSize = 64
+
+// workerPool runs many order books on a fixed number of goroutines. A book
+// is queued when it receives a command while idle and is processed by at most
+// one worker at a time, so commands of a market are still handled in order.
+type workerPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	ready  []*OrderBook
+	closed bool
+}
+
+func newWorkerPool(workers int) *workerPool {
+	pool := &workerPool{}
+	pool.cond = sync.NewCond(&pool.mu)
+
+	for i := 0; i < workers; i++ {
+		go pool.run()
+	}
+
+	return pool
+}
+
+// schedule queues a book unless it is already queued or running
+func (pool *workerPool) schedule(book *OrderBook) {
+	if !book.scheduled.CompareAndSwap(false, true) {
+		return
+	}
+
+	pool.mu.Lock()
+	pool.ready = append(pool.ready, book)
+	pool.mu.Unlock()
+	pool.cond.Signal()
+}
+
+// close lets the workers exit once no book is queued
+func (pool *workerPool) close() {
+	pool.mu.Lock()
+	pool.closed = true
+	pool.mu.Unlock()
+	pool.cond.Broadcast()
+}
+
+func (pool *workerPool) run() {
+	for {
+		pool.mu.Lock()
+		for len(pool.ready) == 0 && !pool.closed {
+			pool.cond.Wait()
+		}
+		if len(pool.ready) == 0 {
+			pool.mu.Unlock()
+			return
+		}
+		book := pool.ready[0]
+		pool.ready[0] = nil
+		pool.ready = pool.ready[1:]
+		pool.mu.Unlock()
+
+		book.runBatch(workerBatchSize)
+
+		// commands that arrived after the batch, or a stop, must not be
+		// stranded
+		book.scheduled.Store(false)
+		if book.pending() || (book.stopping.Load() && !book.finished.Load()) {
+			pool.schedule(book)
+		}
+	}
+}
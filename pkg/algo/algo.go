@@ -0,0 +1,460 @@
+// Package algo executes large parent orders as a series of smaller child
+// orders. TWAP orders spread their size evenly over their duration and VWAP
+// orders follow the volume the market usually trades in the same window,
+// both optionally capped to a share of the volume actually traded.
+package algo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/settlement"
+	wsocket "bixor-engine/pkg/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultTickInterval is how often the service looks for due slices
+	DefaultTickInterval = time.Second
+
+	// placeTimeout bounds one child order submission or cancellation
+	placeTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNotFound is returned for algo orders that do not exist or belong to
+	// another user
+	ErrNotFound = errors.New("algo order not found")
+	// ErrNotRunning is returned when pausing an algo order that is not
+	// running, resuming one that is not paused, or cancelling one that has
+	// finished
+	ErrNotRunning = errors.New("algo order is not in a state that allows this")
+
+	errHalted = errors.New("trading is halted")
+)
+
+// Service schedules the child orders of running algo orders. Algo orders and
+// their progress live in the algo_orders table, so they pick up where they
+// left off after a restart.
+type Service struct {
+	db     *gorm.DB
+	engine *matching.MatchingEngine
+	hub    *wsocket.WebSocketHub
+	klines VolumeSource
+	risk   *risk.Checker
+	tick   time.Duration
+
+	// serialises slicing with the pause, resume and cancel controls
+	mu       sync.Mutex
+	profiles map[string]*volumeProfile
+}
+
+// New creates an algo service. The kline store provides the volume curve of
+// VWAP orders and the participation cap; the hub and risk checker are
+// optional.
+func New(db *gorm.DB, engine *matching.MatchingEngine, hub *wsocket.WebSocketHub, klines VolumeSource, checker *risk.Checker) *Service {
+	return &Service{
+		db:       db,
+		engine:   engine,
+		hub:      hub,
+		klines:   klines,
+		risk:     checker,
+		tick:     DefaultTickInterval,
+		profiles: make(map[string]*volumeProfile),
+	}
+}
+
+// Create saves a new algo order and schedules its first slice for its
+// start. The caller validates the order against its market.
+func (s *Service) Create(algo *models.AlgoOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	algo.Status = models.AlgoOrderStatusRunning
+	algo.NextSliceAt = algo.StartAt
+	if err := s.db.Create(algo).Error; err != nil {
+		return err
+	}
+
+	s.broadcast(algo)
+	return nil
+}
+
+// Pause stops slicing an algo order and cancels its working children. The
+// time it stays paused is added to its schedule on Resume.
+func (s *Service) Pause(userID uint, id string) (*models.AlgoOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	algo, err := s.load(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if algo.Status != models.AlgoOrderStatusRunning {
+		return nil, ErrNotRunning
+	}
+
+	now := time.Now()
+	s.cancelChildren(algo)
+	algo.Status = models.AlgoOrderStatusPaused
+	algo.PausedAt = &now
+	return algo, s.save(algo)
+}
+
+// PauseAll pauses a user's running algo orders, or only those placed
+// through apiKeyID when it is set, cancels their working children and
+// returns their IDs. The reason tells the user why they stopped.
+func (s *Service) PauseAll(userID uint, apiKeyID string, reason string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := s.db.Where("user_id = ? AND status = ?", userID, models.AlgoOrderStatusRunning)
+	if apiKeyID != "" {
+		query = query.Where("api_key_id = ?", apiKeyID)
+	}
+
+	var algos []models.AlgoOrder
+	if err := query.Find(&algos).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	paused := make([]string, 0, len(algos))
+	for i := range algos {
+		algo := &algos[i]
+		s.cancelChildren(algo)
+		algo.Status = models.AlgoOrderStatusPaused
+		algo.PausedAt = &now
+		algo.Reason = reason
+		if err := s.save(algo); err != nil {
+			return paused, err
+		}
+		paused = append(paused, algo.ID)
+	}
+	return paused, nil
+}
+
+// Resume continues a paused algo order. Its schedule moves back by the time
+// it was paused, so it does not rush to catch up.
+func (s *Service) Resume(userID uint, id string) (*models.AlgoOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	algo, err := s.load(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if algo.Status != models.AlgoOrderStatusPaused {
+		return nil, ErrNotRunning
+	}
+
+	now := time.Now()
+	if algo.PausedAt != nil {
+		paused := now.Sub(*algo.PausedAt)
+		algo.StartAt = algo.StartAt.Add(paused)
+		algo.EndAt = algo.EndAt.Add(paused)
+	}
+	algo.Status = models.AlgoOrderStatusRunning
+	algo.PausedAt = nil
+	algo.Reason = ""
+	algo.NextSliceAt = now
+	return algo, s.save(algo)
+}
+
+// Cancel stops an algo order for good and cancels its working children
+func (s *Service) Cancel(userID uint, id string) (*models.AlgoOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	algo, err := s.load(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if algo.Status != models.AlgoOrderStatusRunning && algo.Status != models.AlgoOrderStatusPaused {
+		return nil, ErrNotRunning
+	}
+
+	s.cancelChildren(algo)
+	algo.Status = models.AlgoOrderStatusCancelled
+	algo.PausedAt = nil
+	return algo, s.save(algo)
+}
+
+// Run places the slices of running algo orders as they fall due, until ctx
+// is done
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.runDue(now)
+		}
+	}
+}
+
+func (s *Service) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []models.AlgoOrder
+	err := s.db.Where("status = ? AND next_slice_at <= ?", models.AlgoOrderStatusRunning, now).
+		Order("next_slice_at").
+		Find(&due).Error
+	if err != nil {
+		logrus.Errorf("Failed to load due algo orders: %v", err)
+		return
+	}
+
+	for i := range due {
+		if err := s.step(&due[i], now); err != nil {
+			logrus.Errorf("Failed to run algo order %s: %v", due[i].ID, err)
+		}
+	}
+}
+
+// step brings an algo order up to date with its schedule: it finishes the
+// order once it filled or its time is up, and otherwise places a child for
+// whatever the schedule expects to have traded by the end of the slice that
+// is neither filled nor working yet
+func (s *Service) step(algo *models.AlgoOrder, now time.Time) error {
+	var market models.Market
+	if err := s.db.Where("id = ?", algo.MarketID).First(&market).Error; err != nil {
+		return err
+	}
+
+	filled, working, err := s.progress(algo.ID)
+	if err != nil {
+		return err
+	}
+	algo.FilledSize = filled
+
+	interval := time.Duration(algo.SliceInterval) * time.Second
+	switch {
+	case !filled.LessThan(algo.Size):
+		algo.Status = models.AlgoOrderStatusCompleted
+		s.dropProfile(algo.ID)
+	case working.IsPositive() && (algo.ChildType == models.OrderTypeLimit || !now.Before(algo.EndAt)):
+		// a limit child only works during its own slice, and the order
+		// only ends once its children did; check back once they are
+		// cancelled and settled
+		s.cancelChildren(algo)
+		algo.NextSliceAt = now.Add(s.tick)
+	case !now.Before(algo.EndAt):
+		algo.Status = models.AlgoOrderStatusExpired
+		s.dropProfile(algo.ID)
+	default:
+		sliceEnd := now.Add(interval)
+		if sliceEnd.After(algo.EndAt) {
+			sliceEnd = algo.EndAt
+		}
+
+		target, err := s.target(algo, sliceEnd)
+		if err != nil {
+			return err
+		}
+		size := target.Sub(filled).Sub(working)
+		if size, err = s.participation(algo, size, now); err != nil {
+			return err
+		}
+		size = size.Truncate(int32(market.SizePrecision))
+
+		if size.IsPositive() {
+			err := s.placeChild(algo, &market, size)
+			var rejection *risk.Rejection
+			switch {
+			case errors.Is(err, settlement.ErrInsufficientBalance):
+				algo.Status = models.AlgoOrderStatusFailed
+				algo.Reason = "Insufficient balance"
+			case errors.Is(err, errHalted):
+				algo.Status = models.AlgoOrderStatusPaused
+				algo.PausedAt = &now
+				algo.Reason = "Trading is halted"
+			case errors.As(err, &rejection):
+				// try again with the next slice
+				algo.Reason = rejection.Message
+			case err != nil:
+				logrus.Warnf("Algo order %s skipped a slice: %v", algo.ID, err)
+			default:
+				algo.Reason = ""
+			}
+		}
+		algo.NextSliceAt = sliceEnd
+	}
+
+	return s.save(algo)
+}
+
+// progress returns the filled size of an algo order's children and the
+// size they still work
+func (s *Service) progress(algoID string) (decimal.Decimal, decimal.Decimal, error) {
+	var children []models.Order
+	err := s.db.Select("id", "status", "filled_size", "remaining_size").
+		Where("algo_id = ?", algoID).
+		Find(&children).Error
+	if err != nil {
+		return decimal.Zero, decimal.Zero, err
+	}
+
+	filled, working := decimal.Zero, decimal.Zero
+	for _, child := range children {
+		filled = filled.Add(child.FilledSize)
+		if child.Status == models.OrderStatusPending || child.Status == models.OrderStatusOpen {
+			working = working.Add(child.RemainingSize)
+		}
+	}
+	return filled, working, nil
+}
+
+// placeChild holds the funds of a child order, saves it and submits it to
+// the engine
+func (s *Service) placeChild(algo *models.AlgoOrder, market *models.Market, size decimal.Decimal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), placeTimeout)
+	defer cancel()
+
+	order := &models.Order{
+		ID:       fmt.Sprintf("%s-%d", algo.ID, algo.Slices+1),
+		UserID:   algo.UserID,
+		MarketID: algo.MarketID,
+		Side:     algo.Side,
+		Type:     algo.ChildType,
+		Status:   models.OrderStatusPending,
+		Price:    algo.Price,
+		Size:     size,
+		APIKeyID: algo.APIKeyID,
+		AlgoID:   algo.ID,
+	}
+
+	if s.risk != nil {
+		halt, err := s.risk.Halted(ctx, order.UserID, order.APIKeyID, order.MarketID)
+		if err != nil {
+			return err
+		}
+		if halt != nil {
+			return errHalted
+		}
+		if err := s.risk.Check(ctx, order, market); err != nil {
+			return err
+		}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := settlement.Hold(tx, order, market); err != nil {
+			return err
+		}
+		return tx.Create(order).Error
+	})
+	if err != nil {
+		return err
+	}
+	algo.Slices++
+
+	if s.engine == nil {
+		logrus.Warnf("No matching engine available, algo child %s remains pending", order.ID)
+		return nil
+	}
+
+	err = s.engine.AddOrder(ctx, &matching.Order{
+		ID:        order.ID,
+		MarketID:  order.MarketID,
+		Side:      matching.Side(order.Side),
+		Price:     order.Price,
+		Size:      order.Size,
+		Type:      matching.OrderType(order.Type),
+		UserID:    int64(order.UserID),
+		CreatedAt: time.Now(),
+		MaxSize:   settlement.MaxSize(order),
+	})
+	if err != nil {
+		failErr := s.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&models.Order{}).Where("id = ?", order.ID).
+				Update("status", models.OrderStatusFailed).Error
+			if err != nil {
+				return err
+			}
+			return settlement.Release(tx, order.ID)
+		})
+		if failErr != nil {
+			logrus.Errorf("Failed to release algo child %s: %v", order.ID, failErr)
+		}
+		return err
+	}
+
+	algo.SentSize = algo.SentSize.Add(size)
+
+	// settlement may already have filled the child
+	order.Status = models.OrderStatusOpen
+	s.db.Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, models.OrderStatusPending).
+		Update("status", models.OrderStatusOpen)
+	if s.hub != nil {
+		s.hub.BroadcastUserOrderUpdate(order.UserID, order)
+	}
+	return nil
+}
+
+// cancelChildren asks the engine to cancel an algo order's working
+// children. Settlement records the cancellations and releases their holds.
+func (s *Service) cancelChildren(algo *models.AlgoOrder) {
+	if s.engine == nil {
+		return
+	}
+
+	var ids []string
+	err := s.db.Model(&models.Order{}).
+		Where("algo_id = ? AND status IN ?", algo.ID, []models.OrderStatus{models.OrderStatusPending, models.OrderStatusOpen}).
+		Pluck("id", &ids).Error
+	if err != nil {
+		logrus.Errorf("Failed to load children of algo order %s: %v", algo.ID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), placeTimeout)
+	defer cancel()
+
+	for _, id := range ids {
+		if err := s.engine.CancelOrder(ctx, algo.MarketID, id); err != nil {
+			logrus.Errorf("Failed to cancel algo child %s: %v", id, err)
+		}
+	}
+}
+
+// load returns a user's algo order
+func (s *Service) load(userID uint, id string) (*models.AlgoOrder, error) {
+	var algo models.AlgoOrder
+	err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&algo).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &algo, nil
+}
+
+// save writes an algo order's progress and pushes it to its owner
+func (s *Service) save(algo *models.AlgoOrder) error {
+	if err := s.db.Save(algo).Error; err != nil {
+		return err
+	}
+
+	s.broadcast(algo)
+	return nil
+}
+
+func (s *Service) broadcast(algo *models.AlgoOrder) {
+	if s.hub != nil {
+		s.hub.BroadcastUserAlgoOrderUpdate(algo.UserID, algo)
+	}
+}
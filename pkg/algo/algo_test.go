@@ -0,0 +1,160 @@
+package algo
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database/databasetest"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/settlement"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+type AlgoTestSuite struct {
+	suite.Suite
+	db      *gorm.DB
+	engine  *matching.MatchingEngine
+	checker *risk.Checker
+	service *Service
+	user    models.User
+}
+
+func TestAlgoTestSuite(t *testing.T) {
+	suite.Run(t, new(AlgoTestSuite))
+}
+
+// setup gives the running test its own database, engine and algo service,
+// with a trader who has quote funds
+func (suite *AlgoTestSuite) setup() {
+	suite.db = databasetest.Open(suite.T())
+
+	suite.user = models.User{Email: "trader@example.com", Username: "trader", Role: models.RoleTrader, IsActive: true, IsVerified: true}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+	suite.Require().NoError(suite.db.Create(&models.Market{ID: testMarket, BaseAsset: "BTC", QuoteAsset: "USDT", IsActive: true, PricePrecision: 2, SizePrecision: 4}).Error)
+	suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.user.ID, Asset: "USDT", Available: decimal.NewFromInt(1000)}).Error)
+
+	suite.engine = matching.NewMatchingEngine(settlement.New(suite.db, nil))
+	suite.Require().NoError(suite.engine.RegisterMarket(matching.MarketConfig{ID: testMarket, PricePrecision: 2, SizePrecision: 4}))
+	suite.Require().NoError(suite.engine.Start(context.Background()))
+	engine := suite.engine
+	suite.T().Cleanup(func() { _, _ = engine.Stop(context.Background()) })
+
+	suite.checker = risk.New(suite.db, nil, nil)
+	suite.service = New(suite.db, suite.engine, nil, volumes{}, suite.checker)
+}
+
+// create saves a running TWAP buy of 1 at 100 over the hour around now
+func (suite *AlgoTestSuite) create(now time.Time) *models.AlgoOrder {
+	algo := &models.AlgoOrder{
+		ID:            "a",
+		UserID:        suite.user.ID,
+		MarketID:      testMarket,
+		Side:          models.OrderSideBuy,
+		Strategy:      models.AlgoStrategyTWAP,
+		ChildType:     models.OrderTypeLimit,
+		Status:        models.AlgoOrderStatusRunning,
+		Size:          decimal.NewFromInt(1),
+		Price:         decimal.NewFromInt(100),
+		SliceInterval: 60,
+		StartAt:       now.Add(-30 * time.Minute),
+		EndAt:         now.Add(30 * time.Minute),
+		NextSliceAt:   now,
+	}
+	suite.Require().NoError(suite.db.Create(algo).Error)
+	return algo
+}
+
+func (suite *AlgoTestSuite) TestStep() {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		setup  func(algo *models.AlgoOrder)
+		status models.AlgoOrderStatus
+		reason string
+		child  string // size of the child placed, if any
+	}{
+		{
+			name:   "places what the schedule is behind by the end of the slice",
+			status: models.AlgoOrderStatusRunning,
+			child:  "0.5166",
+		},
+		{
+			name: "completes once its children filled the size",
+			setup: func(algo *models.AlgoOrder) {
+				suite.Require().NoError(suite.db.Create(&models.Order{
+					ID:         "a-1",
+					UserID:     suite.user.ID,
+					MarketID:   testMarket,
+					Side:       models.OrderSideBuy,
+					Type:       models.OrderTypeLimit,
+					Status:     models.OrderStatusFilled,
+					Price:      decimal.NewFromInt(100),
+					Size:       decimal.NewFromInt(1),
+					FilledSize: decimal.NewFromInt(1),
+					AlgoID:     algo.ID,
+				}).Error)
+			},
+			status: models.AlgoOrderStatusCompleted,
+		},
+		{
+			name: "expires at the end of its window",
+			setup: func(algo *models.AlgoOrder) {
+				algo.StartAt, algo.EndAt = now.Add(-time.Hour), now
+			},
+			status: models.AlgoOrderStatusExpired,
+		},
+		{
+			name: "pauses while trading is halted",
+			setup: func(algo *models.AlgoOrder) {
+				_, _, err := suite.checker.ActivateKillSwitch(context.Background(), models.KillSwitchUser, strconv.FormatUint(uint64(suite.user.ID), 10), "test", 1)
+				suite.Require().NoError(err)
+			},
+			status: models.AlgoOrderStatusPaused,
+			reason: "Trading is halted",
+		},
+		{
+			name: "fails when the balance cannot hold a child",
+			setup: func(algo *models.AlgoOrder) {
+				suite.Require().NoError(suite.db.Model(&models.Balance{}).Where("user_id = ?", suite.user.ID).Update("available", decimal.NewFromInt(10)).Error)
+			},
+			status: models.AlgoOrderStatusFailed,
+			reason: "Insufficient balance",
+		},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			algo := suite.create(now)
+			if tt.setup != nil {
+				tt.setup(algo)
+			}
+
+			suite.Require().NoError(suite.service.step(algo, now))
+
+			var saved models.AlgoOrder
+			suite.Require().NoError(suite.db.Where("id = ?", algo.ID).First(&saved).Error)
+			suite.Equal(tt.status, saved.Status)
+			suite.Equal(tt.reason, saved.Reason)
+			suite.Equal(tt.status == models.AlgoOrderStatusPaused, saved.PausedAt != nil)
+
+			var children []models.Order
+			suite.Require().NoError(suite.db.Where("algo_id = ? AND status <> ?", algo.ID, models.OrderStatusFilled).Find(&children).Error)
+			if tt.child == "" {
+				suite.Empty(children)
+				return
+			}
+			suite.Require().Len(children, 1)
+			suite.Equal(tt.child, children[0].Size.String())
+			suite.Equal(models.OrderStatusOpen, children[0].Status)
+			suite.Equal(1, saved.Slices)
+			suite.True(saved.NextSliceAt.Equal(now.Add(time.Minute)), saved.NextSliceAt.String())
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package algo
+
+import (
+	"time"
+
+	"bixor-engine/pkg/marketdata"
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+)
+
+// vwapLookbackDays is how many previous days the volume curve of a VWAP
+// order averages
+const vwapLookbackDays = 7
+
+// VolumeSource returns traded volume as candles, as the kline store does
+type VolumeSource interface {
+	Query(marketID string, interval marketdata.Interval, start, end time.Time, limit int) ([]models.Kline, error)
+}
+
+// volumeProfile is the volume a market usually trades in each minute of an
+// algo order's window, summed over the same window on previous days
+type volumeProfile struct {
+	start   time.Time
+	minutes []decimal.Decimal
+	total   decimal.Decimal
+}
+
+// target returns how much of an algo order its schedule expects to have
+// traded by t
+func (s *Service) target(algo *models.AlgoOrder, t time.Time) (decimal.Decimal, error) {
+	share := twapShare(algo, t)
+	if algo.Strategy == models.AlgoStrategyVWAP {
+		profile, err := s.profile(algo)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		// without any history the curve is flat
+		if profile.total.IsPositive() {
+			share = profile.share(t)
+		}
+	}
+
+	return algo.Size.Mul(share), nil
+}
+
+// twapShare is the elapsed share of an algo order's window at t
+func twapShare(algo *models.AlgoOrder, t time.Time) decimal.Decimal {
+	window := algo.EndAt.Sub(algo.StartAt)
+	elapsed := t.Sub(algo.StartAt)
+	if window <= 0 || elapsed >= window {
+		return decimal.NewFromInt(1)
+	}
+	if elapsed <= 0 {
+		return decimal.Zero
+	}
+
+	return decimal.NewFromInt(int64(elapsed)).Div(decimal.NewFromInt(int64(window)))
+}
+
+// share is the part of the usual volume traded between the start of the
+// window and t, counting the minute t falls in pro rata
+func (p *volumeProfile) share(t time.Time) decimal.Decimal {
+	elapsed := t.Sub(p.start)
+	if elapsed <= 0 {
+		return decimal.Zero
+	}
+
+	done := decimal.Zero
+	whole := int(elapsed / time.Minute)
+	for i := 0; i < whole && i < len(p.minutes); i++ {
+		done = done.Add(p.minutes[i])
+	}
+	if whole < len(p.minutes) {
+		part := decimal.NewFromInt(int64(elapsed % time.Minute)).Div(decimal.NewFromInt(int64(time.Minute)))
+		done = done.Add(p.minutes[whole].Mul(part))
+	}
+
+	return decimal.Min(done.Div(p.total), decimal.NewFromInt(1))
+}
+
+// profile returns the volume curve of a VWAP order, building it from the
+// kline store the first time and again whenever a pause moved its window
+func (s *Service) profile(algo *models.AlgoOrder) (*volumeProfile, error) {
+	if profile, ok := s.profiles[algo.ID]; ok && profile.start.Equal(algo.StartAt) {
+		return profile, nil
+	}
+
+	window := algo.EndAt.Sub(algo.StartAt)
+	n := int((window + time.Minute - 1) / time.Minute)
+	profile := &volumeProfile{
+		start:   algo.StartAt,
+		minutes: make([]decimal.Decimal, n),
+	}
+	for i := range profile.minutes {
+		profile.minutes[i] = decimal.Zero
+	}
+
+	for day := 1; day <= vwapLookbackDays; day++ {
+		from := algo.StartAt.Add(-time.Duration(day) * 24 * time.Hour)
+		candles, err := s.klines.Query(algo.MarketID, marketdata.Interval1m, from, from.Add(window), n+1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candle := range candles {
+			i := int(candle.OpenTime.Sub(from) / time.Minute)
+			if i >= 0 && i < n {
+				profile.minutes[i] = profile.minutes[i].Add(candle.Volume)
+				profile.total = profile.total.Add(candle.Volume)
+			}
+		}
+	}
+
+	s.profiles[algo.ID] = profile
+	return profile, nil
+}
+
+func (s *Service) dropProfile(algoID string) {
+	delete(s.profiles, algoID)
+}
+
+// participation caps the size of a slice to the order's share of the volume
+// the market traded over the last slice interval
+func (s *Service) participation(algo *models.AlgoOrder, size decimal.Decimal, now time.Time) (decimal.Decimal, error) {
+	if !algo.ParticipationRate.IsPositive() || !size.IsPositive() {
+		return size, nil
+	}
+
+	interval := time.Duration(algo.SliceInterval) * time.Second
+	from := now.Add(-interval)
+	candles, err := s.klines.Query(algo.MarketID, marketdata.Interval1m, from.Truncate(time.Minute), now, int(interval/time.Minute)+2)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	volume := decimal.Zero
+	for _, candle := range candles {
+		volume = volume.Add(candle.Volume)
+	}
+
+	return decimal.Min(size, volume.Mul(algo.ParticipationRate)), nil
+}
@@ -0,0 +1,181 @@
+package algo
+
+import (
+	"testing"
+	"time"
+
+	"bixor-engine/pkg/marketdata"
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+)
+
+const testMarket = "BTC-USDT"
+
+// volumes serves candles from memory
+type volumes []models.Kline
+
+func (v volumes) Query(marketID string, interval marketdata.Interval, start, end time.Time, limit int) ([]models.Kline, error) {
+	var candles []models.Kline
+	for _, candle := range v {
+		if candle.MarketID == marketID && candle.Interval == string(interval) && !candle.OpenTime.Before(start) && candle.OpenTime.Before(end) {
+			candles = append(candles, candle)
+		}
+	}
+	if len(candles) > limit {
+		candles = candles[:limit]
+	}
+	return candles, nil
+}
+
+// minute is a one minute candle of volume opening at t
+func minute(t time.Time, volume int64) models.Kline {
+	return models.Kline{
+		MarketID: testMarket,
+		Interval: string(marketdata.Interval1m),
+		OpenTime: t,
+		Volume:   decimal.NewFromInt(volume),
+	}
+}
+
+type ScheduleTestSuite struct {
+	suite.Suite
+	start time.Time
+}
+
+func TestScheduleTestSuite(t *testing.T) {
+	suite.Run(t, new(ScheduleTestSuite))
+}
+
+func (suite *ScheduleTestSuite) SetupTest() {
+	suite.start = time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+}
+
+func (suite *ScheduleTestSuite) TestTWAPShare() {
+	algo := &models.AlgoOrder{StartAt: suite.start, EndAt: suite.start.Add(time.Hour)}
+
+	tests := []struct {
+		name  string
+		algo  *models.AlgoOrder
+		at    time.Duration
+		share string
+	}{
+		{"before the start", algo, -time.Minute, "0"},
+		{"at the start", algo, 0, "0"},
+		{"a quarter in", algo, 15 * time.Minute, "0.25"},
+		{"half way", algo, 30 * time.Minute, "0.5"},
+		{"at the end", algo, time.Hour, "1"},
+		{"after the end", algo, 2 * time.Hour, "1"},
+		{"an empty window", &models.AlgoOrder{StartAt: suite.start, EndAt: suite.start}, -time.Minute, "1"},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			share := twapShare(tt.algo, suite.start.Add(tt.at))
+			suite.True(share.Equal(decimal.RequireFromString(tt.share)), share.String())
+		})
+	}
+}
+
+func (suite *ScheduleTestSuite) TestVolumeProfileShare() {
+	profile := &volumeProfile{start: suite.start, total: decimal.NewFromInt(8)}
+	for _, volume := range []int64{1, 3, 0, 4} {
+		profile.minutes = append(profile.minutes, decimal.NewFromInt(volume))
+	}
+
+	tests := []struct {
+		name  string
+		at    time.Duration
+		share string
+	}{
+		{"before the start", -time.Minute, "0"},
+		{"half of the first minute", 30 * time.Second, "0.0625"},
+		{"the first minute", time.Minute, "0.125"},
+		{"half of the second minute", 90 * time.Second, "0.3125"},
+		{"through a quiet minute", 3 * time.Minute, "0.5"},
+		{"the whole window", 4 * time.Minute, "1"},
+		{"after the window", 10 * time.Minute, "1"},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			share := profile.share(suite.start.Add(tt.at))
+			suite.True(share.Equal(decimal.RequireFromString(tt.share)), share.String())
+		})
+	}
+}
+
+func (suite *ScheduleTestSuite) TestVWAPTarget() {
+	day := 24 * time.Hour
+	service := New(nil, nil, nil, volumes{
+		minute(suite.start.Add(-day), 2),
+		minute(suite.start.Add(-2*day+time.Minute), 4),
+		// outside the window
+		minute(suite.start.Add(-day+3*time.Minute), 100),
+		minute(suite.start.Add(-8*day), 100),
+	}, nil)
+	algo := &models.AlgoOrder{
+		ID:       "vwap",
+		MarketID: testMarket,
+		Strategy: models.AlgoStrategyVWAP,
+		Size:     decimal.NewFromInt(6),
+		StartAt:  suite.start,
+		EndAt:    suite.start.Add(3 * time.Minute),
+	}
+
+	tests := []struct {
+		at     time.Duration
+		target string
+	}{
+		{0, "0"},
+		{time.Minute, "2"},
+		{2 * time.Minute, "6"},
+		{3 * time.Minute, "6"},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.at.String(), func() {
+			target, err := service.target(algo, suite.start.Add(tt.at))
+			suite.Require().NoError(err)
+			suite.True(target.Round(8).Equal(decimal.RequireFromString(tt.target)), target.String())
+		})
+	}
+
+	// without history the curve is flat
+	algo.ID, algo.StartAt, algo.EndAt = "flat", suite.start.Add(30*day), suite.start.Add(30*day+4*time.Minute)
+	target, err := service.target(algo, algo.StartAt.Add(time.Minute))
+	suite.Require().NoError(err)
+	suite.True(target.Equal(decimal.RequireFromString("1.5")), target.String())
+}
+
+func (suite *ScheduleTestSuite) TestParticipationCap() {
+	now := suite.start.Add(10 * time.Minute)
+	service := New(nil, nil, nil, volumes{
+		minute(now.Add(-3*time.Minute), 4),
+		minute(now.Add(-time.Minute), 6),
+		// before the last slice interval
+		minute(now.Add(-10*time.Minute), 100),
+	}, nil)
+
+	tests := []struct {
+		name string
+		rate string
+		size string
+		want string
+	}{
+		{"no cap", "0", "5", "5"},
+		{"capped to the share of the volume", "0.1", "5", "1"},
+		{"below the cap", "0.5", "2", "2"},
+		{"at most the volume", "1", "50", "10"},
+		{"nothing to place", "0.1", "0", "0"},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			algo := &models.AlgoOrder{
+				MarketID:          testMarket,
+				ParticipationRate: decimal.RequireFromString(tt.rate),
+				SliceInterval:     300,
+			}
+			size, err := service.participation(algo, decimal.RequireFromString(tt.size), now)
+			suite.Require().NoError(err)
+			suite.True(size.Equal(decimal.RequireFromString(tt.want)), size.String())
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bixor-engine/pkg/algo"
+	"bixor-engine/pkg/database"
+	"bixor-engine/pkg/middleware"
+	"bixor-engine/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// Limits of an algo order's schedule
+const (
+	minAlgoDuration      = time.Minute
+	maxAlgoDuration      = 24 * time.Hour
+	minAlgoSliceInterval = 5 * time.Second
+	defaultSliceInterval = time.Minute
+)
+
+// CreateAlgoOrder starts a TWAP or VWAP algo order that slices size into
+// child orders at the limit price over duration seconds. Each slice may be
+// capped to participation_rate of the volume the market traded since the
+// previous one. Funds are held per child order, not for the whole size.
+func CreateAlgoOrder(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	service := GetAlgoService()
+	if service == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Algo orders are not available"})
+		return
+	}
+
+	var req struct {
+		MarketID          string `json:"market_id" binding:"required"`
+		Side              int8   `json:"side" binding:"required"`
+		Strategy          string `json:"strategy" binding:"required"`
+		Size              string `json:"size" binding:"required"`
+		Price             string `json:"price" binding:"required"`
+		Duration          int64  `json:"duration" binding:"required"` // seconds
+		SliceInterval     int64  `json:"slice_interval"`              // seconds
+		ParticipationRate string `json:"participation_rate"`
+		ChildType         string `json:"child_type"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var market models.Market
+	if err := database.GetDB().Where("id = ? AND is_active = ?", req.MarketID, true).First(&market).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid market"})
+		return
+	}
+	if req.Side != 1 && req.Side != 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order side (1=buy, 2=sell)"})
+		return
+	}
+
+	strategy := models.AlgoStrategy(req.Strategy)
+	if strategy != models.AlgoStrategyTWAP && strategy != models.AlgoStrategyVWAP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid strategy (twap or vwap)"})
+		return
+	}
+
+	childType := models.OrderTypeIOC
+	if req.ChildType != "" {
+		childType = models.OrderType(req.ChildType)
+	}
+	if childType != models.OrderTypeIOC && childType != models.OrderTypeLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid child order type (ioc or limit)"})
+		return
+	}
+
+	size := models.DecimalFromString(req.Size)
+	price := models.DecimalFromString(req.Price)
+	if !size.IsPositive() || !size.Equal(size.Truncate(int32(market.SizePrecision))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Size must be positive with at most %d decimals", market.SizePrecision)})
+		return
+	}
+	if !price.IsPositive() || !price.Equal(price.Truncate(int32(market.PricePrecision))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Price must be positive with at most %d decimals", market.PricePrecision)})
+		return
+	}
+
+	participation := decimal.Zero
+	if req.ParticipationRate != "" {
+		participation = models.DecimalFromString(req.ParticipationRate)
+		if !participation.IsPositive() || participation.GreaterThan(decimal.NewFromInt(1)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Participation rate must be above 0 and at most 1"})
+			return
+		}
+	}
+
+	duration := time.Duration(req.Duration) * time.Second
+	if duration < minAlgoDuration || duration > maxAlgoDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Duration must be between %d and %d seconds", int64(minAlgoDuration.Seconds()), int64(maxAlgoDuration.Seconds()))})
+		return
+	}
+	interval := defaultSliceInterval
+	if req.SliceInterval != 0 {
+		interval = time.Duration(req.SliceInterval) * time.Second
+	}
+	if interval < minAlgoSliceInterval || interval > duration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Slice interval must be between %d seconds and the duration", int64(minAlgoSliceInterval.Seconds()))})
+		return
+	}
+
+	// children append a dash and their number to the algo order ID
+	now := time.Now()
+	order := models.AlgoOrder{
+		ID:                generateOrderID(),
+		UserID:            user.ID,
+		MarketID:          market.ID,
+		Side:              models.OrderSide(req.Side),
+		Strategy:          strategy,
+		ChildType:         childType,
+		Size:              size,
+		Price:             price,
+		ParticipationRate: participation,
+		SliceInterval:     int64(interval.Seconds()),
+		StartAt:           now,
+		EndAt:             now.Add(duration),
+	}
+
+	if value, ok := c.Get("api_key"); ok {
+		if apiKey, ok := value.(*models.APIKey); ok {
+			order.APIKeyID = apiKey.KeyID
+		}
+	}
+
+	if err := service.Create(&order); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create algo order"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data":    order,
+	})
+}
+
+// GetAlgoOrders returns the user's algo orders, newest first
+func GetAlgoOrders(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := database.GetDB().Where("user_id = ?", user.ID)
+	if marketID := c.Query("market_id"); marketID != "" {
+		query = query.Where("market_id = ?", marketID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var orders []models.AlgoOrder
+	if err := query.Order("created_at DESC").Find(&orders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch algo orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    orders,
+	})
+}
+
+// GetAlgoOrder returns an algo order with its child orders
+func GetAlgoOrder(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var order models.AlgoOrder
+	err := database.GetDB().
+		Preload("Orders", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Where("id = ? AND user_id = ?", c.Param("algoId"), user.ID).
+		First(&order).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Algo order not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    order,
+	})
+}
+
+// PauseAlgoOrder stops slicing an algo order and cancels its working
+// children until it is resumed
+func PauseAlgoOrder(c *gin.Context) {
+	controlAlgoOrder(c, (*algo.Service).Pause)
+}
+
+// ResumeAlgoOrder continues a paused algo order, moving its schedule back by
+// the time it was paused
+func ResumeAlgoOrder(c *gin.Context) {
+	controlAlgoOrder(c, (*algo.Service).Resume)
+}
+
+// CancelAlgoOrder stops an algo order and cancels its working children
+func CancelAlgoOrder(c *gin.Context) {
+	controlAlgoOrder(c, (*algo.Service).Cancel)
+}
+
+// controlAlgoOrder applies a pause, resume or cancel to the user's algo
+// order named in the path
+func controlAlgoOrder(c *gin.Context, control func(*algo.Service, uint, string) (*models.AlgoOrder, error)) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	service := GetAlgoService()
+	if service == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Algo orders are not available"})
+		return
+	}
+
+	order, err := control(service, user.ID, c.Param("algoId"))
+	switch {
+	case errors.Is(err, algo.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Algo order not found"})
+		return
+	case errors.Is(err, algo.ErrNotRunning):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Algo order cannot be changed in its current status"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update algo order"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    order,
+	})
+}
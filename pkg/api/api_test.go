@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/auth"
+	"bixor-engine/pkg/database/databasetest"
+	"bixor-engine/pkg/middleware"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/settlement"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+const (
+	testMarket    = "BTC-USDT"
+	testAPIKey    = "test-key"
+	testAPISecret = "test-secret"
+
+	// how long to wait for settlement, and how often to look
+	timeout = 2 * time.Second
+	tick    = 10 * time.Millisecond
+)
+
+// tradingTestSuite runs handlers against a test database and a matching
+// engine whose trades are settled into it. It has a verified trader with
+// an API key and quote funds, and an admin.
+type tradingTestSuite struct {
+	suite.Suite
+	db      *gorm.DB
+	engine  *matching.MatchingEngine
+	checker *risk.Checker
+	router  *gin.Engine
+	trader  models.User
+	admin   models.User
+	token   string
+}
+
+func (suite *tradingTestSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	suite.db = databasetest.Open(suite.T())
+
+	suite.trader = models.User{Email: "trader@example.com", Username: "trader", Role: models.RoleTrader, IsActive: true, IsVerified: true}
+	suite.admin = models.User{Email: "admin@example.com", Username: "admin", Role: models.RoleAdmin, IsActive: true, IsVerified: true}
+	suite.Require().NoError(suite.db.Create(&suite.trader).Error)
+	suite.Require().NoError(suite.db.Create(&suite.admin).Error)
+
+	secretHash := sha256.Sum256([]byte(testAPISecret))
+	suite.Require().NoError(suite.db.Create(&models.APIKey{
+		UserID:     suite.trader.ID,
+		Name:       "bot",
+		KeyID:      testAPIKey,
+		SecretHash: hex.EncodeToString(secretHash[:]),
+		IsActive:   true,
+	}).Error)
+
+	suite.Require().NoError(suite.db.Create(&models.Market{
+		ID:             testMarket,
+		BaseAsset:      "BTC",
+		QuoteAsset:     "USDT",
+		IsActive:       true,
+		PricePrecision: 2,
+		SizePrecision:  4,
+	}).Error)
+	suite.Require().NoError(suite.db.Create(&models.Balance{
+		UserID:    suite.trader.ID,
+		Asset:     "USDT",
+		Available: decimal.NewFromInt(100000),
+	}).Error)
+
+	suite.engine = matching.NewMatchingEngine(settlement.New(suite.db, nil))
+	suite.Require().NoError(suite.engine.RegisterMarket(matching.MarketConfig{ID: testMarket, PricePrecision: 2, SizePrecision: 4}))
+	suite.Require().NoError(suite.engine.Start(context.Background()))
+	SetTradingHandlers(NewTradingHandlers(suite.engine, nil))
+
+	suite.checker = risk.New(suite.db, nil, nil)
+	SetRiskChecker(suite.checker)
+
+	jwtService := auth.NewJWTService("test-secret", time.Hour, time.Hour)
+	tokens, err := jwtService.GenerateTokenPair(&suite.trader)
+	suite.Require().NoError(err)
+	suite.token = tokens.AccessToken
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtService, suite.db)
+	suite.router = gin.New()
+	orders := suite.router.Group("/orders", authMiddleware.TradingAuth(), middleware.RequireVerified())
+	orders.POST("", CreateOrder)
+	orders.GET("", GetOrders)
+	orders.DELETE("/:orderId", CancelOrder)
+	orders.POST("/batch", PlaceBatchOrders)
+	orders.DELETE("/batch", CancelBatchOrders)
+	orders.POST("/cancel-after", CancelAfter)
+
+	admin := suite.router.Group("/admin", func(c *gin.Context) { c.Set("user", &suite.admin) })
+	admin.POST("/kill-switches", ActivateKillSwitch)
+}
+
+func (suite *tradingTestSuite) TearDownTest() {
+	_, err := suite.engine.Stop(context.Background())
+	suite.NoError(err)
+
+	SetTradingHandlers(nil)
+	SetRiskChecker(nil)
+}
+
+// withAPIKey signs a request with the trader's API key
+func withAPIKey(req *http.Request) {
+	req.Header.Set("X-API-Key", testAPIKey)
+	req.Header.Set("X-API-Secret", testAPISecret)
+}
+
+// withToken signs a request with the trader's JWT
+func (suite *tradingTestSuite) withToken(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+suite.token)
+}
+
+// request sends a JSON request through the router and decodes the response
+// into out, if given
+func (suite *tradingTestSuite) request(method, path string, body interface{}, sign func(*http.Request), out interface{}) int {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		suite.Require().NoError(err)
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if sign != nil {
+		sign(req)
+	}
+
+	recorder := httptest.NewRecorder()
+	suite.router.ServeHTTP(recorder, req)
+
+	if out != nil {
+		suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), out), recorder.Body.String())
+	}
+	return recorder.Code
+}
+
+// order loads an order as it is stored
+func (suite *tradingTestSuite) order(id string) models.Order {
+	var order models.Order
+	suite.Require().NoError(suite.db.Where("id = ?", id).First(&order).Error)
+	return order
+}
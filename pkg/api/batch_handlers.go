@@ -0,0 +1,391 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database"
+	"bixor-engine/pkg/middleware"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/settlement"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxBatchSize is the most orders or IDs one batch request takes
+	maxBatchSize = 50
+
+	// batchItemsPerWeight is how many items of a batch count as one request
+	// against the trading rate limit
+	batchItemsPerWeight = 5
+)
+
+// BatchItemResult is the outcome of one item of a batch request. Index is
+// the position of the item in the request.
+type BatchItemResult struct {
+	Index         int              `json:"index"`
+	Success       bool             `json:"success"`
+	OrderID       string           `json:"order_id,omitempty"`
+	ClientOrderID string           `json:"client_order_id,omitempty"`
+	Order         *models.Order    `json:"order,omitempty"`
+	Error         string           `json:"error,omitempty"`
+	Message       string           `json:"message,omitempty"`
+	Reason        interface{}      `json:"reason,omitempty"`
+	Details       ValidationErrors `json:"details,omitempty"`
+}
+
+func (r *BatchItemResult) fail(message string) {
+	r.Success = false
+	r.Error = message
+}
+
+// BatchWeight is the rate limit weight of a batch request: one request per
+// batchItemsPerWeight orders or IDs, rounded up. It peeks at the body and
+// leaves it for the handler.
+func BatchWeight(c *gin.Context) int {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return 1
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		Orders         []json.RawMessage `json:"orders"`
+		OrderIDs       []string          `json:"order_ids"`
+		ClientOrderIDs []string          `json:"client_order_ids"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return 1
+	}
+
+	items := len(req.Orders) + len(req.OrderIDs) + len(req.ClientOrderIDs)
+	return max((items+batchItemsPerWeight-1)/batchItemsPerWeight, 1)
+}
+
+// PlaceBatchOrders places up to maxBatchSize orders at once. In request
+// order, each order is validated, risk checked and has its funds held, then
+// the saved ones are submitted to the engine. The response has one result
+// per order, so some may be placed while others are rejected.
+func PlaceBatchOrders(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		Orders []CreateOrderRequest `json:"orders" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Orders) == 0 || len(req.Orders) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A batch takes between 1 and %d orders", maxBatchSize)})
+		return
+	}
+
+	var apiKeyID string
+	if value, ok := c.Get("api_key"); ok {
+		if apiKey, ok := value.(*models.APIKey); ok {
+			apiKeyID = apiKey.KeyID
+		}
+	}
+
+	results := make([]BatchItemResult, len(req.Orders))
+	orders := make([]*models.Order, len(req.Orders))
+	markets := make(map[string]*models.Market)
+	for i, item := range req.Orders {
+		results[i] = BatchItemResult{Index: i, ClientOrderID: item.ClientOrderID}
+
+		order, errs := buildBatchOrder(item, user.ID, apiKeyID, markets)
+		if len(errs) > 0 {
+			results[i].fail("Validation failed")
+			results[i].Details = errs
+			continue
+		}
+
+		if status, rejection := orderHaltRejection(c.Request.Context(), order); status != 0 {
+			results[i].fail(fmt.Sprint(rejection["error"]))
+			results[i].Reason = rejection["reason"]
+			continue
+		}
+		orders[i] = order
+	}
+
+	// The orders are held and saved in one transaction, each under its own
+	// savepoint so that a failed one leaves the others. They are checked
+	// one after the other, so the risk checks of later orders count the
+	// earlier ones as open.
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		for i, order := range orders {
+			if order == nil {
+				continue
+			}
+			market := markets[order.MarketID]
+
+			if status, rejection := orderLimitRejection(c.Request.Context(), tx, order, market); status != 0 {
+				orders[i] = nil
+				results[i].fail(fmt.Sprint(rejection["error"]))
+				results[i].Reason = rejection["reason"]
+				continue
+			}
+
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				if err := checkClientOrderID(tx, user.ID, order.ClientOrderID); err != nil {
+					return err
+				}
+				if err := settlement.Hold(tx, order, market); err != nil {
+					return err
+				}
+				return tx.Create(order).Error
+			})
+			if err == nil {
+				continue
+			}
+
+			orders[i] = nil
+			switch {
+			case errors.Is(err, settlement.ErrInsufficientBalance):
+				results[i].fail("Insufficient balance")
+			case clientOrderIDTaken(tx, order, err):
+				results[i].fail("An open order already uses this client_order_id")
+			default:
+				logrus.Errorf("Failed to create batch order for user %d: %v", user.ID, err)
+				results[i].fail("Failed to create order")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Failed to create batch orders for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create orders"})
+		return
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	for i, order := range orders {
+		if order == nil {
+			continue
+		}
+
+		submitBatchOrder(tradingHandlers, order, &results[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    results,
+	})
+}
+
+// buildBatchOrder validates one order of a batch against its market, which
+// it loads into markets, and returns the order to place
+func buildBatchOrder(item CreateOrderRequest, userID uint, apiKeyID string, markets map[string]*models.Market) (*models.Order, ValidationErrors) {
+	validator := NewValidator()
+	validator.ValidateMarketID("market_id", item.MarketID)
+	validator.ValidateOrderSide("side", item.Side)
+	if !orderTypes[item.Type] {
+		validator.AddError("type", "invalid order type (valid types: market, limit, ioc, fok, post_only)")
+	}
+	price := validator.ValidatePrice("price", item.Price, item.Type != "market")
+	size := validator.ValidateSize("size", item.Size)
+	validator.ValidateClientOrderID("client_order_id", item.ClientOrderID)
+	if validator.HasErrors() {
+		return nil, validator.GetErrors()
+	}
+
+	market, ok := markets[item.MarketID]
+	if !ok {
+		market = &models.Market{}
+		if err := database.GetDB().Where("id = ? AND is_active = ?", item.MarketID, true).First(market).Error; err != nil {
+			validator.AddError("market_id", "invalid market")
+			return nil, validator.GetErrors()
+		}
+		markets[item.MarketID] = market
+	}
+
+	// The matching engine works in whole ticks and lots of the market
+	if !price.Equal(price.Truncate(int32(market.PricePrecision))) {
+		validator.AddError("price", fmt.Sprintf("price supports at most %d decimals", market.PricePrecision))
+	}
+	if item.Type != "market" && !size.Equal(size.Truncate(int32(market.SizePrecision))) {
+		validator.AddError("size", fmt.Sprintf("size supports at most %d decimals", market.SizePrecision))
+	}
+	if validator.HasErrors() {
+		return nil, validator.GetErrors()
+	}
+
+	return &models.Order{
+		ID:            generateOrderID(),
+		UserID:        userID,
+		ClientOrderID: item.ClientOrderID,
+		MarketID:      item.MarketID,
+		Side:          models.OrderSide(item.Side),
+		Type:          models.OrderType(item.Type),
+		Status:        models.OrderStatusPending,
+		Price:         price,
+		Size:          size,
+		APIKeyID:      apiKeyID,
+	}, nil
+}
+
+// submitBatchOrder submits a saved batch order to the engine and records
+// the outcome in result
+func submitBatchOrder(tradingHandlers *TradingHandlers, order *models.Order, result *BatchItemResult) {
+	result.OrderID = order.ID
+	result.Order = order
+	result.Success = true
+
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		logrus.Warn("No matching engine available, order remains pending")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := tradingHandlers.engine.AddOrder(ctx, &matching.Order{
+		ID:            order.ID,
+		MarketID:      order.MarketID,
+		Side:          matching.Side(order.Side),
+		Price:         order.Price,
+		Size:          order.Size,
+		Type:          matching.OrderType(order.Type),
+		UserID:        int64(order.UserID),
+		CreatedAt:     time.Now(),
+		MaxSize:       settlement.MaxSize(order),
+		ClientOrderID: order.ClientOrderID,
+	})
+	if err != nil {
+		if err := failOrder(order.ID); err != nil {
+			logrus.Errorf("Failed to release order %s: %v", order.ID, err)
+		}
+		logrus.Errorf("Failed to submit batch order to matching engine: %v", err)
+
+		result.Order = nil
+		switch {
+		case errors.Is(err, matching.ErrOverloaded):
+			result.fail("Market is overloaded, retry later")
+		case errors.Is(err, matching.ErrInvalidParam):
+			result.fail("Invalid order price or size")
+		default:
+			result.fail("Failed to submit order to matching engine")
+		}
+		return
+	}
+
+	// settlement may already have recorded fills for the order
+	order.Status = models.OrderStatusOpen
+	database.GetDB().Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, models.OrderStatusPending).
+		Update("status", models.OrderStatusOpen)
+
+	if tradingHandlers.hub != nil {
+		tradingHandlers.hub.BroadcastUserOrderUpdate(order.UserID, order)
+	}
+}
+
+// CancelBatchOrders cancels up to maxBatchSize of the user's orders, named
+// by order_ids and client_order_ids. The response has one result per ID,
+// the order IDs first.
+func CancelBatchOrders(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		OrderIDs       []string `json:"order_ids"`
+		ClientOrderIDs []string `json:"client_order_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	count := len(req.OrderIDs) + len(req.ClientOrderIDs)
+	if count == 0 || count > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A batch takes between 1 and %d order IDs", maxBatchSize)})
+		return
+	}
+
+	results := make([]BatchItemResult, 0, count)
+	var sent []*models.Order
+	for _, id := range req.OrderIDs {
+		result := BatchItemResult{Index: len(results), OrderID: id}
+
+		var order models.Order
+		err := database.GetDB().Where("id = ? AND user_id = ?", id, user.ID).First(&order).Error
+		if cancelBatchOrder(user.ID, &order, err, &result) {
+			sent = append(sent, &order)
+		}
+		results = append(results, result)
+	}
+	for _, id := range req.ClientOrderIDs {
+		result := BatchItemResult{Index: len(results), ClientOrderID: id}
+
+		// the newest order with the ID, as for GetOrderByClientID
+		var order models.Order
+		err := database.GetDB().
+			Where("user_id = ? AND client_order_id = ?", user.ID, id).
+			Order("created_at DESC").
+			First(&order).Error
+		if cancelBatchOrder(user.ID, &order, err, &result) {
+			sent = append(sent, &order)
+		}
+		results = append(results, result)
+	}
+
+	// settlement finishes what the engine cancelled, all within one wait
+	if err := awaitSettled(sent...); err != nil && !errors.Is(err, errCancelRequested) {
+		logrus.Errorf("Failed to load cancelled orders of user %d: %v", user.ID, err)
+	}
+	for i := range results {
+		order := results[i].Order
+		if order != nil && (order.Status == models.OrderStatusOpen || order.Status == models.OrderStatusPending) {
+			results[i].Message = "Cancellation requested"
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    results,
+	})
+}
+
+// cancelBatchOrder cancels an order loaded for a batch cancel, unless
+// loading it failed with loadErr, and records the outcome in result. It
+// reports whether the engine was asked to cancel the order, which leaves
+// settlement to finish it.
+func cancelBatchOrder(userID uint, order *models.Order, loadErr error, result *BatchItemResult) bool {
+	if loadErr != nil {
+		result.fail("Order not found")
+		return false
+	}
+	result.OrderID = order.ID
+	result.ClientOrderID = order.ClientOrderID
+
+	sent, err := requestCancel(userID, order)
+	switch {
+	case errors.Is(err, errNotCancellable):
+		result.fail("Order cannot be cancelled")
+	case errors.Is(err, matching.ErrOverloaded):
+		result.fail("Market is overloaded, retry later")
+	case err != nil:
+		logrus.Errorf("Failed to cancel order %s: %v", order.ID, err)
+		result.fail("Failed to cancel order")
+	default:
+		result.Success = true
+		result.Order = order
+	}
+	return sent && err == nil
+}
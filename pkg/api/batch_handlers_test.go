@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"bixor-engine/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+type BatchOrdersTestSuite struct {
+	tradingTestSuite
+}
+
+func TestBatchOrdersTestSuite(t *testing.T) {
+	suite.Run(t, new(BatchOrdersTestSuite))
+}
+
+func (suite *BatchOrdersTestSuite) TestPartialFailure() {
+	suite.Require().NoError(suite.db.Create(&models.RiskLimit{UserID: suite.trader.ID, MaxOpenOrders: 2}).Error)
+
+	buy := func(size string) gin.H {
+		return gin.H{"market_id": testMarket, "side": 1, "type": "limit", "price": "100", "size": size}
+	}
+	orders := []gin.H{
+		buy("1"),
+		{"market_id": testMarket, "side": 3, "type": "limit", "price": "100", "size": "1"},
+		buy("10000"),
+		buy("1"),
+		buy("1"),
+	}
+
+	var response struct{ Data []BatchItemResult }
+	suite.Require().Equal(http.StatusOK, suite.request(http.MethodPost, "/orders/batch", gin.H{"orders": orders}, suite.withToken, &response))
+	suite.Require().Len(response.Data, len(orders))
+
+	tests := []struct {
+		name    string
+		success bool
+		error   string
+		reason  interface{}
+	}{
+		{"placed", true, "", nil},
+		{"invalid", false, "Validation failed", nil},
+		{"insufficient balance", false, "Insufficient balance", nil},
+		{"placed up to the open order limit", true, "", nil},
+		{"counts the orders placed before it", false, "At most 2 open orders are allowed in " + testMarket, "max_open_orders"},
+	}
+	for i, tt := range tests {
+		suite.Run(tt.name, func() {
+			result := response.Data[i]
+			suite.Equal(i, result.Index)
+			suite.Equal(tt.success, result.Success)
+			suite.Equal(tt.error, result.Error)
+			suite.Equal(tt.reason, result.Reason)
+			if tt.success {
+				suite.Equal(models.OrderStatusOpen, suite.order(result.OrderID).Status)
+			} else {
+				suite.Empty(result.OrderID)
+			}
+		})
+	}
+
+	// only the placed orders hold funds
+	var balance models.Balance
+	suite.Require().NoError(suite.db.Where("user_id = ? AND asset = ?", suite.trader.ID, "USDT").First(&balance).Error)
+	suite.True(balance.Locked.Equal(decimal.NewFromInt(200)), balance.Locked.String())
+	suite.True(balance.Available.Equal(decimal.NewFromInt(99800)), balance.Available.String())
+}
+
+func (suite *BatchOrdersTestSuite) TestClientOrderIDs() {
+	order := func(clientOrderID string) gin.H {
+		return gin.H{"market_id": testMarket, "side": 1, "type": "limit", "price": "100", "size": "1", "client_order_id": clientOrderID}
+	}
+	orders := []gin.H{order("a"), order("a"), order("b"), order("")}
+
+	var response struct{ Data []BatchItemResult }
+	suite.Require().Equal(http.StatusOK, suite.request(http.MethodPost, "/orders/batch", gin.H{"orders": orders}, suite.withToken, &response))
+	suite.Require().Len(response.Data, len(orders))
+
+	ids := map[string]bool{}
+	for i, result := range response.Data {
+		if i == 1 {
+			suite.False(result.Success)
+			suite.Equal("An open order already uses this client_order_id", result.Error)
+			continue
+		}
+		suite.True(result.Success, result.Error)
+		ids[result.OrderID] = true
+	}
+	suite.Len(ids, 3)
+}
+
+func (suite *BatchOrdersTestSuite) TestDuplicateOrderIDIsNotAClientOrderIDConflict() {
+	newOrder := func(id, clientOrderID string) *models.Order {
+		return &models.Order{
+			ID:            id,
+			UserID:        suite.trader.ID,
+			ClientOrderID: clientOrderID,
+			MarketID:      testMarket,
+			Side:          models.OrderSideBuy,
+			Type:          models.OrderTypeLimit,
+			Status:        models.OrderStatusOpen,
+			Price:         decimal.NewFromInt(100),
+			Size:          decimal.NewFromInt(1),
+		}
+	}
+	suite.Require().NoError(suite.db.Create(newOrder("taken", "a")).Error)
+
+	clash := newOrder("taken", "b")
+	err := suite.db.Create(clash).Error
+	suite.Require().ErrorIs(err, gorm.ErrDuplicatedKey)
+	suite.False(clientOrderIDTaken(suite.db, clash, err))
+
+	reused := newOrder("other", "a")
+	err = suite.db.Create(reused).Error
+	suite.Require().ErrorIs(err, gorm.ErrDuplicatedKey)
+	suite.True(clientOrderIDTaken(suite.db, reused, err))
+}
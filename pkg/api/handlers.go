@@ -2,33 +2,89 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/algo"
 	"bixor-engine/pkg/cache"
 	"bixor-engine/pkg/database"
+	"bixor-engine/pkg/deadman"
+	"bixor-engine/pkg/marketdata"
 	"bixor-engine/pkg/middleware"
 	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/scheduler"
+	"bixor-engine/pkg/settlement"
 	wsocket "bixor-engine/pkg/websocket"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 // TradingHandlers contains trading-related handlers with matching engine
 type TradingHandlers struct {
-	engine *matching.MatchingEngine
-	hub    *wsocket.WebSocketHub
+	engine  *matching.MatchingEngine
+	hub     *wsocket.WebSocketHub
+	deadman *deadman.Switch
 }
 
 // NewTradingHandlers creates new trading handlers
 func NewTradingHandlers(engine *matching.MatchingEngine, hub *wsocket.WebSocketHub) *TradingHandlers {
-	return &TradingHandlers{
+	handlers := &TradingHandlers{
 		engine: engine,
 		hub:    hub,
 	}
+	handlers.deadman = deadman.New(handlers.cancelUserOrders)
+
+	return handlers
+}
+
+// cancelUserOrders pulls a user's orders in every market, or only those
+// placed through apiKeyID when it is set. Running algo orders are paused
+// first, so they place no new children, then scheduled and resting orders
+// are cancelled.
+func (h *TradingHandlers) cancelUserOrders(ctx context.Context, userID uint, apiKeyID string) ([]string, error) {
+	if service := GetAlgoService(); service != nil {
+		paused, err := service.PauseAll(userID, apiKeyID, "Dead man's switch fired")
+		if err != nil {
+			return nil, err
+		}
+		if len(paused) > 0 {
+			logrus.Infof("Dead man's switch paused %d algo orders of user %d", len(paused), userID)
+		}
+	}
+
+	var cancelled []string
+	if service := GetOrderScheduler(); service != nil {
+		var err error
+		if apiKeyID != "" {
+			cancelled, err = service.CancelAPIKey(userID, apiKeyID)
+		} else {
+			cancelled, err = service.CancelAll(userID, "", 0)
+		}
+		if err != nil {
+			return cancelled, err
+		}
+	}
+
+	if h.engine == nil {
+		return cancelled, nil
+	}
+	var resting []string
+	var err error
+	if apiKeyID != "" {
+		resting, err = cancelAPIKeyOrders(ctx, h.engine, apiKeyID)
+	} else {
+		resting, err = h.engine.MassCancel(ctx, int64(userID), "", 0)
+	}
+	return append(cancelled, resting...), err
 }
 
 var upgrader = websocket.Upgrader{
@@ -39,6 +95,12 @@ var upgrader = websocket.Upgrader{
 
 var globalWSHub *wsocket.WebSocketHub
 var globalTradingHandlers *TradingHandlers
+var globalKlines *marketdata.Klines
+var globalStats *marketdata.Stats
+var globalPublishPipeline *matching.PublishPipeline
+var globalRiskChecker *risk.Checker
+var globalAlgoService *algo.Service
+var globalOrderScheduler *scheduler.Service
 
 // GetWebSocketHub returns the global WebSocket hub instance
 func GetWebSocketHub() *wsocket.WebSocketHub {
@@ -58,6 +120,66 @@ func SetTradingHandlers(handlers *TradingHandlers) {
 	globalTradingHandlers = handlers
 }
 
+// GetKlineStore returns the global kline aggregator
+func GetKlineStore() *marketdata.Klines {
+	return globalKlines
+}
+
+// SetKlineStore sets the global kline aggregator
+func SetKlineStore(klines *marketdata.Klines) {
+	globalKlines = klines
+}
+
+// GetStatsStore returns the global 24h statistics aggregator
+func GetStatsStore() *marketdata.Stats {
+	return globalStats
+}
+
+// SetStatsStore sets the global 24h statistics aggregator
+func SetStatsStore(stats *marketdata.Stats) {
+	globalStats = stats
+}
+
+// GetPublishPipeline returns the global engine event pipeline
+func GetPublishPipeline() *matching.PublishPipeline {
+	return globalPublishPipeline
+}
+
+// SetPublishPipeline sets the global engine event pipeline
+func SetPublishPipeline(pipeline *matching.PublishPipeline) {
+	globalPublishPipeline = pipeline
+}
+
+// GetRiskChecker returns the global pre-trade risk checker
+func GetRiskChecker() *risk.Checker {
+	return globalRiskChecker
+}
+
+// SetRiskChecker sets the global pre-trade risk checker
+func SetRiskChecker(checker *risk.Checker) {
+	globalRiskChecker = checker
+}
+
+// GetAlgoService returns the global algo order service
+func GetAlgoService() *algo.Service {
+	return globalAlgoService
+}
+
+// SetAlgoService sets the global algo order service
+func SetAlgoService(service *algo.Service) {
+	globalAlgoService = service
+}
+
+// GetOrderScheduler returns the global scheduled order service
+func GetOrderScheduler() *scheduler.Service {
+	return globalOrderScheduler
+}
+
+// SetOrderScheduler sets the global scheduled order service
+func SetOrderScheduler(service *scheduler.Service) {
+	globalOrderScheduler = service
+}
+
 // Market Handlers
 
 // GetMarkets returns all available trading markets
@@ -91,41 +213,83 @@ func GetMarket(c *gin.Context) {
 	})
 }
 
-// GetOrderBook returns order book depth for a market
+// GetOrderBook returns order book depth for a market straight from the matching engine
 func GetOrderBook(c *gin.Context) {
 	marketID := c.Param("marketId")
 	limitStr := c.DefaultQuery("limit", "50")
 	
 	limit, err := strconv.ParseUint(limitStr, 10, 32)
-	if err != nil {
+	if err != nil || limit == 0 || limit > 1000 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
 		return
 	}
 
-	// Try to get from cache first
-	var depth interface{}
-	if err := cache.GetOrderBookDepth(marketID, &depth); err == nil {
-		c.JSON(http.StatusOK, gin.H{
-			"success": true,
-			"data":    depth,
-			"limit":   limit, // Include limit in response
-		})
+	// Optional price grouping tick, e.g. 0.1, 1, 10
+	group := decimal.Zero
+	if groupStr := c.Query("group"); groupStr != "" {
+		group, err = decimal.NewFromString(groupStr)
+		if err != nil || !group.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group parameter"})
+			return
+		}
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Matching engine not available"})
+		return
+	}
+
+	depth, err := tradingHandlers.engine.Depth(marketID, uint32(limit), group)
+	if errors.Is(err, matching.ErrMarketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Market not found"})
+		return
+	}
+	if errors.Is(err, matching.ErrOverloaded) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later"})
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to get order book depth for %s: %v", marketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order book"})
 		return
 	}
 
-	// If not in cache, return empty order book
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
 			"market_id": marketID,
-			"bids":      []interface{}{},
-			"asks":      []interface{}{},
+			"bids":      depth.Bids,
+			"asks":      depth.Asks,
+			"group":     group,
+			"limit":     limit,
 			"timestamp": time.Now().Unix(),
-			"limit":     limit, // Include limit in response
 		},
 	})
 }
 
+// GetBookTicker returns the best bid and offer for a market
+func GetBookTicker(c *gin.Context) {
+	marketID := c.Param("marketId")
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Matching engine not available"})
+		return
+	}
+
+	ticker := tradingHandlers.engine.BookTicker(marketID)
+	if ticker == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Market not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    ticker,
+	})
+}
+
 // GetTrades returns recent trades for a market
 func GetTrades(c *gin.Context) {
 	marketID := c.Param("marketId")
@@ -152,48 +316,139 @@ func GetTrades(c *gin.Context) {
 	})
 }
 
-// GetMarketStats returns market statistics
+// GetMarketStats returns rolling 24h statistics for a market
 func GetMarketStats(c *gin.Context) {
 	marketID := c.Param("marketId")
-	
-	var marketData models.MarketData
-	if err := database.GetDB().Where("market_id = ?", marketID).First(&marketData).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Market data not found"})
+
+	stats := GetStatsStore()
+	if stats == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market statistics not available"})
+		return
+	}
+
+	var market models.Market
+	if err := database.GetDB().Where("id = ?", marketID).First(&market).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Market not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    stats.Get(marketID, time.Now()),
+	})
+}
+
+// GetTickers returns rolling 24h statistics for all active markets
+func GetTickers(c *gin.Context) {
+	stats := GetStatsStore()
+	if stats == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market statistics not available"})
 		return
 	}
 
+	var markets []models.Market
+	if err := database.GetDB().Where("is_active = ?", true).Order("id").Find(&markets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch markets"})
+		return
+	}
+
+	now := time.Now()
+	tickers := make([]marketdata.MarketStats, 0, len(markets))
+	for _, market := range markets {
+		tickers = append(tickers, stats.Get(market.ID, now))
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"data":    marketData,
+		"data":    tickers,
 	})
 }
 
 // GetKlines returns candlestick data
 func GetKlines(c *gin.Context) {
 	marketID := c.Param("marketId")
-	interval := c.DefaultQuery("interval", "1m")
 	limitStr := c.DefaultQuery("limit", "100")
-	
+
+	interval, ok := marketdata.ParseInterval(c.DefaultQuery("interval", "1m"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval parameter"})
+		return
+	}
+
 	limit, err := strconv.Atoi(limitStr)
-	if err != nil {
+	if err != nil || limit < 1 || limit > 1000 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
 		return
 	}
 
-	// For now, return empty klines (would implement OHLCV logic here)
+	var start, end time.Time
+	if startStr := c.Query("start"); startStr != "" {
+		seconds, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start parameter"})
+			return
+		}
+		start = time.Unix(seconds, 0).UTC()
+	}
+	if endStr := c.Query("end"); endStr != "" {
+		seconds, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end parameter"})
+			return
+		}
+		end = time.Unix(seconds, 0).UTC()
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must not be before start"})
+		return
+	}
+
+	klines := GetKlineStore()
+	if klines == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Kline service not available"})
+		return
+	}
+
+	candles, err := klines.Query(marketID, interval, start, end, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch klines"})
+		return
+	}
+
+	rows := make([][]interface{}, 0, len(candles))
+	for _, candle := range candles {
+		rows = append(rows, []interface{}{
+			candle.OpenTime.Unix(),
+			candle.Open.String(),
+			candle.High.String(),
+			candle.Low.String(),
+			candle.Close.String(),
+			candle.Volume.String(),
+		})
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
 			"market_id": marketID,
 			"interval":  interval,
 			"limit":     limit,
-			"klines":    []interface{}{},
+			"klines":    rows,
 		},
 	})
 }
 
 // Order Handlers
 
+// orderTypes are the order types the API places in the engine
+var orderTypes = map[string]bool{
+	"market":    true,
+	"limit":     true,
+	"ioc":       true,
+	"fok":       true,
+	"post_only": true,
+}
+
 // CreateOrder creates a new trading order
 func CreateOrder(c *gin.Context) {
 	// Get authenticated user from context
@@ -204,11 +459,19 @@ func CreateOrder(c *gin.Context) {
 	}
 
 	var req struct {
-		MarketID string `json:"market_id" binding:"required"`
-		Side     int8   `json:"side" binding:"required"`
-		Type     string `json:"type" binding:"required"`
-		Price    string `json:"price"`
-		Size     string `json:"size" binding:"required"`
+		MarketID      string     `json:"market_id" binding:"required"`
+		Side          int8       `json:"side" binding:"required"`
+		Type          string     `json:"type" binding:"required"`
+		Price         string     `json:"price"`
+		Size          string     `json:"size" binding:"required"`
+		Hidden        bool       `json:"hidden"`
+		Peg           string     `json:"peg"`
+		PegOffset     string     `json:"peg_offset"`
+		PegLimit      string     `json:"peg_limit"`
+		MinSize       string     `json:"min_size"`
+		AllOrNone     bool       `json:"all_or_none"`
+		ActivateAt    *time.Time `json:"activate_at"`
+		ClientOrderID string     `json:"client_order_id"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -216,6 +479,22 @@ func CreateOrder(c *gin.Context) {
 		return
 	}
 
+	validator := NewValidator()
+	validator.ValidateClientOrderID("client_order_id", req.ClientOrderID)
+	if !orderTypes[req.Type] {
+		validator.AddError("type", "invalid order type (valid types: market, limit, ioc, fok, post_only)")
+	}
+	if validator.HasErrors() {
+		SendValidationErrors(c, validator.GetErrors())
+		return
+	}
+
+	// Only orders that can rest in the book can be hidden
+	if req.Hidden && req.Type != "limit" && req.Type != "post_only" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only limit and post_only orders can be hidden"})
+		return
+	}
+
 	// Validate market exists
 	var market models.Market
 	if err := database.GetDB().Where("id = ? AND is_active = ?", req.MarketID, true).First(&market).Error; err != nil {
@@ -232,8 +511,33 @@ func CreateOrder(c *gin.Context) {
 	// Validate order price for limit orders
 	price := models.DecimalFromString(req.Price)
 	size := models.DecimalFromString(req.Size)
+
+	// The engine prices pegged orders from the book. Until then their price
+	// is the limit, which sizes the hold of a buy.
+	peg := models.OrderPeg(req.Peg)
+	pegOffset := models.DecimalFromString(req.PegOffset)
+	pegLimit := models.DecimalFromString(req.PegLimit)
+	if peg != "" {
+		if peg != models.OrderPegPrimary && peg != models.OrderPegOpposite && peg != models.OrderPegMidpoint {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid peg (primary, opposite or midpoint)"})
+			return
+		}
+		if req.Type != "limit" && req.Type != "post_only" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only limit and post_only orders can be pegged"})
+			return
+		}
+		if pegLimit.IsNegative() || req.Side == 1 && !pegLimit.IsPositive() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Pegged buy orders need a positive peg_limit"})
+			return
+		}
+		if !pegOffset.Equal(pegOffset.Truncate(int32(market.PricePrecision))) || !pegLimit.Equal(pegLimit.Truncate(int32(market.PricePrecision))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Peg offset and limit support at most %d decimals", market.PricePrecision)})
+			return
+		}
+		price = pegLimit
+	}
 	
-	if req.Type == "limit" && price.IsZero() {
+	if req.Type == "limit" && price.IsZero() && peg == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Price required for limit orders"})
 		return
 	}
@@ -243,26 +547,43 @@ func CreateOrder(c *gin.Context) {
 		return
 	}
 
-	// Check user balance before creating order
-	if req.Side == 1 { // Buy order - check quote asset balance
-		var balance models.Balance
-		requiredAmount := price.Mul(size)
-		if err := database.GetDB().Where("user_id = ? AND asset = ?", user.ID, market.QuoteAsset).First(&balance).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+	// The matching engine works in whole ticks and lots of the market
+	if !price.Equal(price.Truncate(int32(market.PricePrecision))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Price supports at most %d decimals", market.PricePrecision)})
+		return
+	}
+	if req.Type != "market" && !size.Equal(size.Truncate(int32(market.SizePrecision))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Size supports at most %d decimals", market.SizePrecision)})
+		return
+	}
+
+	// Resting orders may only accept matches of a minimum size, or of all
+	// that remains of them
+	minSize := models.DecimalFromString(req.MinSize)
+	if req.AllOrNone || !minSize.IsZero() {
+		if req.Type != "limit" && req.Type != "post_only" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only limit and post_only orders can have a minimum size or be all-or-none"})
 			return
 		}
-		if balance.Available.LessThan(requiredAmount) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+		if req.AllOrNone && !minSize.IsZero() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "An order cannot have both min_size and all_or_none"})
 			return
 		}
-	} else { // Sell order - check base asset balance
-		var balance models.Balance
-		if err := database.GetDB().Where("user_id = ? AND asset = ?", user.ID, market.BaseAsset).First(&balance).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+		if minSize.IsNegative() || minSize.GreaterThan(size) || !minSize.Equal(minSize.Truncate(int32(market.SizePrecision))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Minimum size must be at most the size with at most %d decimals", market.SizePrecision)})
 			return
 		}
-		if balance.Available.LessThan(size) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+	}
+
+	// Scheduled orders wait until activate_at with their funds held
+	if req.ActivateAt != nil {
+		if GetOrderScheduler() == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Scheduled orders are not available"})
+			return
+		}
+		now := time.Now()
+		if !req.ActivateAt.After(now) || req.ActivateAt.After(now.Add(maxScheduleAhead)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Activation time must be in the future and at most %d days ahead", int(maxScheduleAhead.Hours()/24))})
 			return
 		}
 	}
@@ -270,35 +591,85 @@ func CreateOrder(c *gin.Context) {
 	// Create order using authenticated user ID
 	orderID := generateOrderID()
 	order := models.Order{
-		ID:       orderID,
-		UserID:   user.ID,
-		MarketID: req.MarketID,
-		Side:     models.OrderSide(req.Side),
-		Type:     models.OrderType(req.Type),
-		Status:   models.OrderStatusPending,
-		Price:    price,
-		Size:     size,
-	}
-
-	// Save order to database first
-	if err := database.GetDB().Create(&order).Error; err != nil {
+		ID:            orderID,
+		UserID:        user.ID,
+		MarketID:      req.MarketID,
+		Side:          models.OrderSide(req.Side),
+		Type:          models.OrderType(req.Type),
+		Status:        models.OrderStatusPending,
+		Price:         price,
+		Size:          size,
+		Hidden:        req.Hidden,
+		Peg:           peg,
+		PegOffset:     pegOffset,
+		PegLimit:      pegLimit,
+		MinSize:       minSize,
+		AllOrNone:     req.AllOrNone,
+		ClientOrderID: req.ClientOrderID,
+	}
+	if req.ActivateAt != nil {
+		order.Status = models.OrderStatusScheduled
+		order.ActivateAt = req.ActivateAt
+	}
+
+	if value, ok := c.Get("api_key"); ok {
+		if apiKey, ok := value.(*models.APIKey); ok {
+			order.APIKeyID = apiKey.KeyID
+		}
+	}
+
+	if !checkOrderRisk(c, &order, &market) {
+		return
+	}
+
+	// Lock the funds the order may spend and save it in one transaction, so
+	// concurrent orders cannot spend the same balance
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := checkClientOrderID(tx, user.ID, order.ClientOrderID); err != nil {
+			return err
+		}
+		if err := settlement.Hold(tx, &order, &market); err != nil {
+			return err
+		}
+		return tx.Create(&order).Error
+	})
+	if errors.Is(err, settlement.ErrInsufficientBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+		return
+	}
+	if clientOrderIDTaken(database.GetDB(), &order, err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "An open order already uses this client_order_id"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
 		return
 	}
 
 	// Get trading handlers
 	tradingHandlers := GetTradingHandlers()
-	if tradingHandlers != nil && tradingHandlers.engine != nil {
+	if order.Status == models.OrderStatusScheduled {
+		// The scheduler submits the order once it falls due
+		GetWebSocketHub().BroadcastUserOrderUpdate(user.ID, order)
+	} else if tradingHandlers != nil && tradingHandlers.engine != nil {
 		// Convert to matching engine order format
 		matchingOrder := &matching.Order{
-			ID:        orderID,
-			MarketID:  req.MarketID,
-			Side:      matching.Side(req.Side),
-			Price:     price,
-			Size:      size,
-			Type:      matching.OrderType(req.Type),
-			UserID:    int64(user.ID),
-			CreatedAt: time.Now(),
+			ID:            orderID,
+			MarketID:      req.MarketID,
+			Side:          matching.Side(req.Side),
+			Price:         price,
+			Size:          size,
+			Type:          matching.OrderType(req.Type),
+			UserID:        int64(user.ID),
+			CreatedAt:     time.Now(),
+			Hidden:        req.Hidden,
+			Peg:           matching.PegType(peg),
+			PegOffset:     pegOffset,
+			PegLimit:      pegLimit,
+			MinSize:       minSize,
+			AllOrNone:     req.AllOrNone,
+			MaxSize:       settlement.MaxSize(&order),
+			ClientOrderID: req.ClientOrderID,
 		}
 
 		// Submit order to matching engine
@@ -307,17 +678,29 @@ func CreateOrder(c *gin.Context) {
 		
 		if err := tradingHandlers.engine.AddOrder(ctx, matchingOrder); err != nil {
 			// If matching engine fails, mark order as failed but don't delete it
-			order.Status = models.OrderStatusFailed
-			database.GetDB().Save(&order)
+			if err := failOrder(orderID); err != nil {
+				logrus.Errorf("Failed to release order %s: %v", orderID, err)
+			}
 			
 			logrus.Errorf("Failed to submit order to matching engine: %v", err)
+			if errors.Is(err, matching.ErrOverloaded) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later"})
+				return
+			}
+			if errors.Is(err, matching.ErrInvalidParam) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order price or size"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit order to matching engine"})
 			return
 		}
 
-		// Update order status to open
+		// Update order status to open. Only the status column is written
+		// since settlement may already have recorded fills for this order.
 		order.Status = models.OrderStatusOpen
-		database.GetDB().Save(&order)
+		database.GetDB().Model(&models.Order{}).
+			Where("id = ? AND status = ?", orderID, models.OrderStatusPending).
+			Update("status", models.OrderStatusOpen)
 
 		// Broadcast order update to user via WebSocket
 		if tradingHandlers.hub != nil {
@@ -334,6 +717,116 @@ func CreateOrder(c *gin.Context) {
 	})
 }
 
+// openOrderStatuses are the statuses of orders that may still trade
+var openOrderStatuses = []models.OrderStatus{models.OrderStatusScheduled, models.OrderStatusPending, models.OrderStatusOpen}
+
+// errDuplicateClientOrderID is returned when a user reuses the client order
+// ID of one of their open orders
+var errDuplicateClientOrderID = errors.New("duplicate client order ID")
+
+// checkClientOrderID fails with errDuplicateClientOrderID if one of the
+// user's open orders already carries clientOrderID. A unique index backs it
+// up against concurrent submissions.
+func checkClientOrderID(tx *gorm.DB, userID uint, clientOrderID string) error {
+	if clientOrderID == "" {
+		return nil
+	}
+
+	var count int64
+	err := tx.Model(&models.Order{}).
+		Where("user_id = ? AND client_order_id = ? AND status IN ?", userID, clientOrderID, openOrderStatuses).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDuplicateClientOrderID
+	}
+	return nil
+}
+
+// clientOrderIDTaken reports whether err, returned while saving order,
+// means another open order uses its client_order_id. Unique violations do
+// not name the index, so one on the primary key is told apart by looking
+// for such an order.
+func clientOrderIDTaken(db *gorm.DB, order *models.Order, err error) bool {
+	if errors.Is(err, errDuplicateClientOrderID) {
+		return true
+	}
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return false
+	}
+	return errors.Is(checkClientOrderID(db, order.UserID, order.ClientOrderID), errDuplicateClientOrderID)
+}
+
+// maxScheduleAhead is how far ahead an order may be scheduled
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+// checkOrderRisk runs the kill switches, then the pre-trade risk limits, on
+// a new order. It responds with the rejection and returns false if the
+// order may not be placed.
+func checkOrderRisk(c *gin.Context, order *models.Order, market *models.Market) bool {
+	status, rejection := orderRiskRejection(c.Request.Context(), order, market)
+	if status != 0 {
+		c.JSON(status, rejection)
+		return false
+	}
+	return true
+}
+
+// orderRiskRejection runs the kill switches, then the pre-trade risk
+// limits, on a new order. It returns the status and body of the rejection,
+// or 0 if the order may be placed.
+func orderRiskRejection(ctx context.Context, order *models.Order, market *models.Market) (int, gin.H) {
+	if status, rejection := orderHaltRejection(ctx, order); status != 0 {
+		return status, rejection
+	}
+	return orderLimitRejection(ctx, database.GetDB(), order, market)
+}
+
+// orderHaltRejection runs the kill switches on a new order
+func orderHaltRejection(ctx context.Context, order *models.Order) (int, gin.H) {
+	checker := GetRiskChecker()
+	if checker == nil {
+		return 0, nil
+	}
+
+	halt, err := checker.Halted(ctx, order.UserID, order.APIKeyID, order.MarketID)
+	if err != nil {
+		logrus.Errorf("Failed to check kill switches for user %d: %v", order.UserID, err)
+		return http.StatusInternalServerError, gin.H{"error": "Failed to run risk checks"}
+	}
+	if halt != nil {
+		return http.StatusForbidden, gin.H{"error": "Trading is halted", "reason": "kill_switch", "scope": halt.Scope}
+	}
+	return 0, nil
+}
+
+// orderLimitRejection runs the pre-trade risk limits on a new order,
+// reading through tx
+func orderLimitRejection(ctx context.Context, tx *gorm.DB, order *models.Order, market *models.Market) (int, gin.H) {
+	checker := GetRiskChecker()
+	if checker == nil {
+		return 0, nil
+	}
+
+	err := checker.CheckTx(ctx, tx, order, market)
+	var rejection *risk.Rejection
+	if errors.As(err, &rejection) {
+		status := http.StatusBadRequest
+		if rejection.Reason == risk.ReasonOrderRate {
+			status = http.StatusTooManyRequests
+		}
+		return status, gin.H{"error": rejection.Message, "reason": rejection.Reason}
+	}
+	if err != nil {
+		logrus.Errorf("Failed to run risk checks for user %d: %v", order.UserID, err)
+		return http.StatusInternalServerError, gin.H{"error": "Failed to run risk checks"}
+	}
+
+	return 0, nil
+}
+
 // GetOrders returns user's orders
 func GetOrders(c *gin.Context) {
 	// Get authenticated user from context
@@ -345,6 +838,11 @@ func GetOrders(c *gin.Context) {
 
 	marketID := c.Query("market_id")
 	status := c.Query("status")
+
+	if c.Query("source") == "engine" {
+		getEngineOpenOrders(c, user.ID, marketID)
+		return
+	}
 	
 	// Always filter by authenticated user ID
 	query := database.GetDB().Model(&models.Order{}).Where("user_id = ?", user.ID)
@@ -357,6 +855,11 @@ func GetOrders(c *gin.Context) {
 		query = query.Where("status = ?", status)
 	}
 
+	// every order that carried the ID, as it may be reused once one finished
+	if clientOrderID := c.Query("client_order_id"); clientOrderID != "" {
+		query = query.Where("client_order_id = ?", clientOrderID)
+	}
+
 	var orders []models.Order
 	if err := query.Order("created_at DESC").Find(&orders).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch orders"})
@@ -386,12 +889,113 @@ func GetOrder(c *gin.Context) {
 		return
 	}
 
+	showOrder(c, &order)
+}
+
+// GetOrderByClientID returns the user's order with a client order ID. Once
+// an order finished its client order ID may be reused, so this is the
+// newest order that carried it.
+func GetOrderByClientID(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	order, ok := findOrderByClientID(c, user.ID)
+	if !ok {
+		return
+	}
+
+	showOrder(c, order)
+}
+
+// findOrderByClientID loads the newest of the user's orders with the client
+// order ID in the path. It responds 404 and returns false if there is none.
+func findOrderByClientID(c *gin.Context, userID uint) (*models.Order, bool) {
+	var order models.Order
+	err := database.GetDB().
+		Where("user_id = ? AND client_order_id = ?", userID, c.Param("clientOrderId")).
+		Order("created_at DESC").
+		First(&order).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return nil, false
+	}
+	return &order, true
+}
+
+// showOrder responds with an order, or with the engine's view of it when
+// asked for source=engine
+func showOrder(c *gin.Context, order *models.Order) {
+	if c.Query("source") == "engine" {
+		getEngineOrder(c, order.MarketID, order.ID)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    order,
+	})
+}
+
+// getEngineOrder responds with the matching engine's view of a resting
+// order, which is useful when the database and the book disagree
+func getEngineOrder(c *gin.Context, marketID string, orderID string) {
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Matching engine not available"})
+		return
+	}
+
+	order, err := tradingHandlers.engine.GetOrder(marketID, orderID)
+	if errors.Is(err, matching.ErrOrderNotFound) || errors.Is(err, matching.ErrMarketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order is not resting in the matching engine"})
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to get order %s from the matching engine: %v", orderID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to query the matching engine"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data":    order,
 	})
 }
 
+// getEngineOpenOrders responds with a user's resting orders in a market as
+// the matching engine holds them
+func getEngineOpenOrders(c *gin.Context, userID uint, marketID string) {
+	if marketID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "market_id is required with source=engine"})
+		return
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Matching engine not available"})
+		return
+	}
+
+	orders, err := tradingHandlers.engine.OpenOrders(marketID, int64(userID))
+	if errors.Is(err, matching.ErrMarketNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Market not found"})
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to get open orders for %s from the matching engine: %v", marketID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to query the matching engine"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    orders,
+	})
+}
+
 // CancelOrder cancels an order
 func CancelOrder(c *gin.Context) {
 	// Get authenticated user from context
@@ -409,70 +1013,392 @@ func CancelOrder(c *gin.Context) {
 		return
 	}
 
-	if order.Status != models.OrderStatusOpen && order.Status != models.OrderStatusPending {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Order cannot be cancelled"})
+	cancelOrder(c, user.ID, &order)
+}
+
+// CancelOrderByClientID cancels the user's order with a client order ID
+func CancelOrderByClientID(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	order, ok := findOrderByClientID(c, user.ID)
+	if !ok {
 		return
 	}
 
-	// Get trading handlers and cancel from matching engine first
+	cancelOrder(c, user.ID, order)
+}
+
+// cancelOrder cancels one of the user's orders and responds with its final
+// state, or with 202 and its current state if the cancellation is still
+// being settled
+func cancelOrder(c *gin.Context, userID uint, order *models.Order) {
+	if err := cancelUserOrder(userID, order); err != nil {
+		respondCancelError(c, err, order)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    order,
+	})
+}
+
+// errNotCancellable is returned when cancelling an order that finished
+var errNotCancellable = errors.New("order cannot be cancelled")
+
+// cancelUserOrder cancels one of the user's orders and updates order to its
+// final state. It fails with errCancelRequested if the engine accepted the
+// cancellation but settlement has not recorded it yet.
+func cancelUserOrder(userID uint, order *models.Order) error {
+	sent, err := requestCancel(userID, order)
+	if err != nil || !sent {
+		return err
+	}
+	return awaitSettled(order)
+}
+
+// requestCancel cancels one of the user's orders. Orders outside the engine,
+// including open ones it no longer holds, are cancelled right away and updated to their final state; for the others
+// it reports that the engine was asked to cancel them and settlement will
+// finish them.
+func requestCancel(userID uint, order *models.Order) (bool, error) {
+	orderID := order.ID
+
+	// Scheduled orders never reached the engine. One activated since it
+	// was loaded is cancelled like any other.
+	if service := GetOrderScheduler(); service != nil && order.Status == models.OrderStatusScheduled {
+		cancelled, err := service.Cancel(userID, orderID)
+		switch {
+		case err == nil:
+			*order = *cancelled
+			return false, nil
+		case errors.Is(err, scheduler.ErrNotScheduled):
+			if err := database.GetDB().Where("id = ?", orderID).First(order).Error; err != nil {
+				return false, err
+			}
+		default:
+			return false, err
+		}
+	}
+
+	if order.Status != models.OrderStatusOpen && order.Status != models.OrderStatusPending {
+		return false, errNotCancellable
+	}
+
+	// The engine cancels the order, including a pending one it is about to
+	// receive, and settlement records the cancellation and releases the
+	// hold once the engine applied it, after any fill that came first
+	statuses := []models.OrderStatus{models.OrderStatusOpen, models.OrderStatusPending}
 	tradingHandlers := GetTradingHandlers()
-	if tradingHandlers != nil && tradingHandlers.engine != nil && order.Status == models.OrderStatusOpen {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		
-		if err := tradingHandlers.engine.CancelOrder(ctx, order.MarketID, orderID); err != nil {
-			logrus.Errorf("Failed to cancel order in matching engine: %v", err)
-			// Continue with database cancellation even if matching engine fails
+	if tradingHandlers != nil && tradingHandlers.engine != nil {
+		engine := tradingHandlers.engine
+		_, err := engine.GetOrder(order.MarketID, orderID)
+		if !errors.Is(err, matching.ErrOrderNotFound) || order.Status != models.OrderStatusOpen {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := engine.CancelOrder(ctx, order.MarketID, orderID); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+
+		// An open order the engine no longer holds gets no cancel event.
+		// Settlement first gets to record what the engine last did with
+		// it, and whatever is still open afterwards is cancelled here.
+		if err := awaitSettled(order); !errors.Is(err, errCancelRequested) {
+			return false, err
 		}
+		statuses = []models.OrderStatus{models.OrderStatusOpen}
 	}
 
-	// Update order status in database
+	// No engine holds the order, so it is cancelled in the database alone
 	now := time.Now()
-	order.Status = models.OrderStatusCancelled
-	order.CancelledAt = &now
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Order{}).
+			Where("id = ? AND status IN ?", orderID, statuses).
+			Updates(map[string]interface{}{
+				"status":       models.OrderStatusCancelled,
+				"cancelled_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		// An order settlement finished meanwhile keeps its final state
+		if result.RowsAffected > 0 {
+			if err := settlement.Release(tx, orderID); err != nil {
+				return err
+			}
+		}
+		return tx.Where("id = ?", orderID).First(order).Error
+	})
+	if err != nil {
+		return false, err
+	}
 
-	if err := database.GetDB().Save(&order).Error; err != nil {
+	GetWebSocketHub().BroadcastUserOrderUpdate(userID, order)
+	return false, nil
+}
+
+// cancelSettleTimeout is how long a cancellation waits for settlement to
+// record the engine's cancel
+const cancelSettleTimeout = 2 * time.Second
+
+// errCancelRequested is returned when the engine accepted a cancellation
+// that settlement has not recorded within cancelSettleTimeout. The order is
+// updated over the WebSocket once it has.
+var errCancelRequested = errors.New("cancellation requested")
+
+// awaitSettled waits until settlement finished the given orders, which the
+// engine was asked to cancel, and reloads them. It fails with
+// errCancelRequested if one is still open after cancelSettleTimeout.
+func awaitSettled(orders ...*models.Order) error {
+	deadline := time.Now().Add(cancelSettleTimeout)
+	for {
+		settled := true
+		for _, order := range orders {
+			if err := database.GetDB().Where("id = ?", order.ID).First(order).Error; err != nil {
+				return err
+			}
+			if order.Status == models.OrderStatusOpen || order.Status == models.OrderStatusPending {
+				settled = false
+			}
+		}
+		if settled {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errCancelRequested
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// respondCancelError maps a failed cancellation to its response
+func respondCancelError(c *gin.Context, err error, data interface{}) {
+	switch {
+	case errors.Is(err, errNotCancellable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Order cannot be cancelled"})
+	case errors.Is(err, errCancelRequested):
+		c.JSON(http.StatusAccepted, gin.H{
+			"success": true,
+			"message": "Cancellation requested",
+			"data":    data,
+		})
+	case errors.Is(err, matching.ErrOverloaded):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later"})
+	case errors.Is(err, matching.ErrEngineNotRunning):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Trading is unavailable, retry later"})
+	default:
+		logrus.Errorf("Failed to cancel order: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order"})
+	}
+}
+
+// CancelAllOrders cancels a user's open orders, optionally only in one market
+// (market_id) or on one side (side=1 buy, side=2 sell). The engine cancels
+// each market's resting orders atomically; settlement then marks them
+// cancelled, releases their holds and pushes the order updates. Scheduled
+// orders are cancelled as well.
+func CancelAllOrders(c *gin.Context) {
+	// Get authenticated user from context
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	marketID := c.Query("market_id")
+	var side matching.Side
+	switch c.Query("side") {
+	case "":
+	case "1":
+		side = matching.Buy
+	case "2":
+		side = matching.Sell
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order side (1=buy, 2=sell)"})
 		return
 	}
 
-	// Broadcast order update to user via WebSocket
-	if tradingHandlers != nil && tradingHandlers.hub != nil {
-		tradingHandlers.hub.BroadcastUserOrderUpdate(user.ID, order)
+	scheduled := make([]string, 0)
+	if service := GetOrderScheduler(); service != nil {
+		var err error
+		scheduled, err = service.CancelAll(user.ID, marketID, models.OrderSide(side))
+		if err != nil {
+			logrus.Errorf("Failed to cancel scheduled orders of user %d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel orders", "data": scheduled})
+			return
+		}
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		cancelled, err := cancelStoredOrders(user.ID, marketID, side)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel orders"})
+			return
+		}
+
+		cancelled = append(scheduled, cancelled...)
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "Orders cancelled",
+			"count":   len(cancelled),
+			"data":    cancelled,
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cancelled, err := tradingHandlers.engine.MassCancel(ctx, int64(user.ID), marketID, side)
+	cancelled = append(scheduled, cancelled...)
+	if err != nil {
+		logrus.Errorf("Failed to mass cancel orders of user %d: %v", user.ID, err)
+		switch {
+		case errors.Is(err, matching.ErrMarketNotFound):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid market"})
+		case errors.Is(err, matching.ErrOverloaded):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later", "data": cancelled})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel orders", "data": cancelled})
+		}
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"data":    order,
+		"message": "Orders cancelled",
+		"count":   len(cancelled),
+		"data":    cancelled,
 	})
 }
 
-// CancelAllOrders cancels all open orders for a user
-func CancelAllOrders(c *gin.Context) {
-	// Get authenticated user from context
+// cancelStoredOrders cancels a user's open orders in the database alone,
+// for when no matching engine runs, and returns their IDs
+func cancelStoredOrders(userID uint, marketID string, side matching.Side) ([]string, error) {
+	var orders []models.Order
+	cancelled := make([]string, 0)
+
+	now := time.Now()
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("user_id = ? AND status IN ?", userID, []models.OrderStatus{models.OrderStatusOpen, models.OrderStatusPending})
+		if marketID != "" {
+			query = query.Where("market_id = ?", marketID)
+		}
+		if side != 0 {
+			query = query.Where("side = ?", side)
+		}
+		if err := query.Find(&orders).Error; err != nil {
+			return err
+		}
+
+		for i := range orders {
+			order := &orders[i]
+			if err := tx.Model(order).Updates(map[string]interface{}{
+				"status":       models.OrderStatusCancelled,
+				"cancelled_at": now,
+			}).Error; err != nil {
+				return err
+			}
+			if err := settlement.Release(tx, order.ID); err != nil {
+				return err
+			}
+			order.Hold = decimal.Zero
+			cancelled = append(cancelled, order.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hub := GetWebSocketHub()
+	for _, order := range orders {
+		hub.BroadcastUserOrderUpdate(order.UserID, order)
+	}
+
+	return cancelled, nil
+}
+
+// failOrder marks an order the engine refused as failed and unlocks its
+// funds
+func failOrder(orderID string) error {
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Order{}).Where("id = ?", orderID).
+			Update("status", models.OrderStatusFailed).Error
+		if err != nil {
+			return err
+		}
+		return settlement.Release(tx, orderID)
+	})
+}
+
+// maxCancelAfter is the longest countdown CancelAfter accepts
+const maxCancelAfter = time.Hour
+
+// CancelAfter arms a dead man's switch: unless it is called again within
+// timeout seconds, all of the user's open orders are cancelled. Requests
+// signed with an API key count down per key, so each key heartbeats on its
+// own by repeating the call, and only cancel the orders placed through that
+// key. A timeout of 0 disarms the countdown.
+func CancelAfter(c *gin.Context) {
 	user, exists := middleware.GetUserFromContext(c)
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	now := time.Now()
-	result := database.GetDB().Model(&models.Order{}).
-		Where("user_id = ? AND status IN (?)", user.ID, []string{"open", "pending"}).
-		Updates(map[string]interface{}{
-			"status":       models.OrderStatusCancelled,
-			"cancelled_at": now,
-		})
+	var req struct {
+		Timeout *int `json:"timeout" binding:"required"` // seconds
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	timeout := time.Duration(*req.Timeout) * time.Second
+	if timeout < 0 || timeout > maxCancelAfter {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Timeout must be between 0 and %d seconds", int(maxCancelAfter.Seconds()))})
+		return
+	}
 
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel orders"})
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Matching engine not available"})
 		return
 	}
 
+	session, apiKeyID := deadman.UserSession(user.ID), ""
+	if value, ok := c.Get("api_key"); ok {
+		if apiKey, ok := value.(*models.APIKey); ok {
+			session, apiKeyID = deadman.APIKeySession(apiKey.KeyID), apiKey.KeyID
+		}
+	}
+
+	if timeout == 0 {
+		tradingHandlers.deadman.Disarm(session)
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    gin.H{"session": session, "armed": false},
+		})
+		return
+	}
+
+	deadline := tradingHandlers.deadman.Arm(session, user.ID, apiKeyID, timeout)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"message": "Orders cancelled",
-		"count":   result.RowsAffected,
+		"data": gin.H{
+			"session":  session,
+			"armed":    true,
+			"timeout":  *req.Timeout,
+			"deadline": deadline.UTC(),
+		},
 	})
 }
 
@@ -615,19 +1541,90 @@ func GetMetrics(c *gin.Context) {
 	database.GetDB().Model(&models.Order{}).Count(&orderCount)
 	database.GetDB().Model(&models.Trade{}).Count(&tradeCount)
 
+	data := gin.H{
+		"users":  userCount,
+		"orders": orderCount,
+		"trades": tradeCount,
+		"uptime": time.Now().Format(time.RFC3339),
+	}
+
+	// Engine event consumers and how far behind they are
+	if pipeline := GetPublishPipeline(); pipeline != nil {
+		data["publishers"] = pipeline.Stats()
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
+		"data":    data,
+	})
+}
+
+// RebuildKlines recomputes a market's candles from the trades table
+func RebuildKlines(c *gin.Context) {
+	var req struct {
+		MarketID string `json:"market_id" binding:"required"`
+		From     int64  `json:"from" binding:"required"`
+		To       int64  `json:"to"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	from := time.Unix(req.From, 0).UTC()
+	to := time.Now().UTC()
+	if req.To != 0 {
+		to = time.Unix(req.To, 0).UTC()
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+		return
+	}
+
+	klines := GetKlineStore()
+	if klines == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Kline service not available"})
+		return
+	}
+
+	// Rebuilding can scan a large part of the trades table, so run it in the background
+	go func() {
+		rebuilt, err := klines.Rebuild(context.Background(), req.MarketID, from, to)
+		if err != nil {
+			logrus.Errorf("Kline rebuild for %s failed after %d candles: %v", req.MarketID, rebuilt, err)
+			return
+		}
+		logrus.Infof("Rebuilt %d klines for %s", rebuilt, req.MarketID)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"message": "Kline rebuild started",
 		"data": gin.H{
-			"users":  userCount,
-			"orders": orderCount,
-			"trades": tradeCount,
-			"uptime": time.Now().Format(time.RFC3339),
+			"market_id": req.MarketID,
+			"from":      from.Unix(),
+			"to":        to.Unix(),
 		},
 	})
 }
 
 // Helper functions
 
+// lastOrderID is the last ID generateOrderID handed out
+var lastOrderID atomic.Int64
+
+// generateOrderID returns the current time in nanoseconds, moved past the
+// last ID so that orders placed in a tight loop get distinct IDs
 func generateOrderID() string {
-	return strconv.FormatInt(time.Now().UnixNano(), 10)
-} 
\ No newline at end of file
+	for {
+		last := lastOrderID.Load()
+		id := time.Now().UnixNano()
+		if id <= last {
+			id = last + 1
+		}
+		if lastOrderID.CompareAndSwap(last, id) {
+			return strconv.FormatInt(id, 10)
+		}
+	}
+}
\ No newline at end of file
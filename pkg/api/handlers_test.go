@@ -0,0 +1,171 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"bixor-engine/pkg/algo"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/scheduler"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+)
+
+type OrdersTestSuite struct {
+	tradingTestSuite
+}
+
+func TestOrdersTestSuite(t *testing.T) {
+	suite.Run(t, new(OrdersTestSuite))
+}
+
+func (suite *OrdersTestSuite) TestGetOrdersByClientOrderID() {
+	// the ID "reused" was freed by the cancelled order and taken again
+	now := time.Now()
+	for i, order := range []models.Order{
+		{ID: "cancelled", ClientOrderID: "reused", Status: models.OrderStatusCancelled},
+		{ID: "open", ClientOrderID: "reused", Status: models.OrderStatusOpen},
+		{ID: "other", ClientOrderID: "other", Status: models.OrderStatusOpen},
+		{ID: "unnamed", Status: models.OrderStatusOpen},
+	} {
+		order.UserID, order.MarketID, order.Side, order.Type = suite.trader.ID, testMarket, models.OrderSideBuy, models.OrderTypeLimit
+		order.Price, order.Size = decimal.NewFromInt(100), decimal.NewFromInt(1)
+		order.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		suite.Require().NoError(suite.db.Create(&order).Error)
+	}
+
+	tests := []struct {
+		clientOrderID string
+		ids           []string
+	}{
+		{"reused", []string{"open", "cancelled"}},
+		{"other", []string{"other"}},
+		{"unknown", []string{}},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.clientOrderID, func() {
+			var response struct{ Data []models.Order }
+			suite.Require().Equal(http.StatusOK, suite.request(http.MethodGet, "/orders?client_order_id="+tt.clientOrderID, nil, suite.withToken, &response))
+
+			ids := []string{}
+			for _, order := range response.Data {
+				ids = append(ids, order.ID)
+			}
+			suite.Equal(tt.ids, ids)
+		})
+	}
+}
+
+func (suite *OrdersTestSuite) TestCreateOrderRejectsUnknownTypes() {
+	for _, orderType := range []string{"stop", "stop_limit", "trailing"} {
+		suite.Run(orderType, func() {
+			order := gin.H{"market_id": testMarket, "side": 1, "type": orderType, "price": "100", "size": "1"}
+			suite.Equal(http.StatusBadRequest, suite.request(http.MethodPost, "/orders", order, suite.withToken, nil))
+		})
+	}
+
+	var count int64
+	suite.Require().NoError(suite.db.Model(&models.Order{}).Count(&count).Error)
+	suite.Zero(count)
+}
+
+func (suite *OrdersTestSuite) TestCancelOrderTheEngineDoesNotHold() {
+	// an open order with its funds held that never reached the book
+	hold := decimal.NewFromInt(100)
+	order := models.Order{
+		ID:       "lost",
+		UserID:   suite.trader.ID,
+		MarketID: testMarket,
+		Side:     models.OrderSideBuy,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusOpen,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(1),
+		Hold:     hold,
+	}
+	suite.Require().NoError(suite.db.Create(&order).Error)
+	suite.Require().NoError(suite.db.Model(&models.Balance{}).
+		Where("user_id = ? AND asset = ?", suite.trader.ID, "USDT").
+		Updates(map[string]interface{}{"available": decimal.NewFromInt(100000).Sub(hold), "locked": hold}).Error)
+
+	var response struct{ Data models.Order }
+	suite.Require().Equal(http.StatusOK, suite.request(http.MethodDelete, "/orders/lost", nil, suite.withToken, &response))
+	suite.Equal(models.OrderStatusCancelled, response.Data.Status)
+
+	suite.True(suite.order("lost").Hold.IsZero())
+	var balance models.Balance
+	suite.Require().NoError(suite.db.Where("user_id = ? AND asset = ?", suite.trader.ID, "USDT").First(&balance).Error)
+	suite.True(balance.Available.Equal(decimal.NewFromInt(100000)), balance.Available.String())
+	suite.True(balance.Locked.IsZero(), balance.Locked.String())
+}
+
+type CancelAfterTestSuite struct {
+	tradingTestSuite
+}
+
+func TestCancelAfterTestSuite(t *testing.T) {
+	suite.Run(t, new(CancelAfterTestSuite))
+}
+
+func (suite *CancelAfterTestSuite) TestAPIKeyCountdownCancelsOnlyItsOrders() {
+	order := gin.H{"market_id": testMarket, "side": 1, "type": "limit", "price": "100", "size": "1"}
+
+	var viaKey, viaToken struct{ Data models.Order }
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/orders", order, withAPIKey, &viaKey))
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/orders", order, suite.withToken, &viaToken))
+
+	var armed struct{ Data map[string]interface{} }
+	suite.Require().Equal(http.StatusOK, suite.request(http.MethodPost, "/orders/cancel-after", gin.H{"timeout": 1}, withAPIKey, &armed))
+	suite.Equal("api_key:"+testAPIKey, armed.Data["session"])
+
+	suite.Eventually(func() bool {
+		return suite.order(viaKey.Data.ID).Status == models.OrderStatusCancelled
+	}, time.Second+timeout, tick)
+	suite.True(suite.order(viaKey.Data.ID).Hold.IsZero())
+	suite.Equal(models.OrderStatusOpen, suite.order(viaToken.Data.ID).Status)
+}
+
+func (suite *CancelAfterTestSuite) TestCountdownPausesAlgosAndCancelsScheduledOrders() {
+	SetAlgoService(algo.New(suite.db, suite.engine, nil, nil, nil))
+	SetOrderScheduler(scheduler.New(suite.db, suite.engine, nil, nil))
+	suite.T().Cleanup(func() {
+		SetAlgoService(nil)
+		SetOrderScheduler(nil)
+	})
+
+	now := time.Now()
+	algos := []models.AlgoOrder{
+		{ID: "via-key", APIKeyID: testAPIKey},
+		{ID: "via-token"},
+	}
+	for i := range algos {
+		algo := &algos[i]
+		algo.UserID, algo.MarketID, algo.Side, algo.Strategy, algo.ChildType = suite.trader.ID, testMarket, models.OrderSideBuy, models.AlgoStrategyTWAP, models.OrderTypeLimit
+		algo.Status, algo.Size, algo.Price, algo.SliceInterval = models.AlgoOrderStatusRunning, decimal.NewFromInt(1), decimal.NewFromInt(100), 60
+		algo.StartAt, algo.EndAt, algo.NextSliceAt = now, now.Add(time.Hour), now.Add(time.Hour)
+		suite.Require().NoError(suite.db.Create(algo).Error)
+	}
+
+	scheduled := gin.H{"market_id": testMarket, "side": 1, "type": "limit", "price": "100", "size": "1", "activate_at": now.Add(time.Hour)}
+	var viaKey, viaToken struct{ Data models.Order }
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/orders", scheduled, withAPIKey, &viaKey))
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/orders", scheduled, suite.withToken, &viaToken))
+	suite.Require().Equal(models.OrderStatusScheduled, viaKey.Data.Status)
+
+	suite.Require().Equal(http.StatusOK, suite.request(http.MethodPost, "/orders/cancel-after", gin.H{"timeout": 1}, withAPIKey, nil))
+
+	suite.Eventually(func() bool {
+		return suite.order(viaKey.Data.ID).Status == models.OrderStatusCancelled
+	}, time.Second+timeout, tick)
+	suite.True(suite.order(viaKey.Data.ID).Hold.IsZero())
+	suite.Equal(models.OrderStatusScheduled, suite.order(viaToken.Data.ID).Status)
+
+	var paused, running models.AlgoOrder
+	suite.Require().NoError(suite.db.Where("id = ?", "via-key").First(&paused).Error)
+	suite.Require().NoError(suite.db.Where("id = ?", "via-token").First(&running).Error)
+	suite.Equal(models.AlgoOrderStatusPaused, paused.Status)
+	suite.NotNil(paused.PausedAt)
+	suite.Equal(models.AlgoOrderStatusRunning, running.Status)
+}
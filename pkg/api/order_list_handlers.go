@@ -0,0 +1,632 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database"
+	"bixor-engine/pkg/middleware"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/settlement"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// CreateOCOOrder places a one-cancels-other list: a take-profit limit leg
+// at price and a stop-loss leg that becomes a limit order at
+// stop_limit_price once a trade reaches stop_price. When either leg trades
+// or triggers, the engine cancels the other in the same step. Both legs
+// share one hold, sized for the costlier leg.
+func CreateOCOOrder(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		MarketID       string `json:"market_id" binding:"required"`
+		Side           int8   `json:"side" binding:"required"`
+		Size           string `json:"size" binding:"required"`
+		Price          string `json:"price" binding:"required"`
+		StopPrice      string `json:"stop_price" binding:"required"`
+		StopLimitPrice string `json:"stop_limit_price" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var market models.Market
+	if err := database.GetDB().Where("id = ? AND is_active = ?", req.MarketID, true).First(&market).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid market"})
+		return
+	}
+	if req.Side != 1 && req.Side != 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order side (1=buy, 2=sell)"})
+		return
+	}
+
+	size := models.DecimalFromString(req.Size)
+	price := models.DecimalFromString(req.Price)
+	stopPrice := models.DecimalFromString(req.StopPrice)
+	stopLimitPrice := models.DecimalFromString(req.StopLimitPrice)
+
+	if !size.IsPositive() || !size.Equal(size.Truncate(int32(market.SizePrecision))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Size must be positive with at most %d decimals", market.SizePrecision)})
+		return
+	}
+	for _, p := range []decimal.Decimal{price, stopPrice, stopLimitPrice} {
+		if !p.IsPositive() || !p.Equal(p.Truncate(int32(market.PricePrecision))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Prices must be positive with at most %d decimals", market.PricePrecision)})
+			return
+		}
+	}
+
+	// the take profit sits on the far side of the stop, and neither leg
+	// may fire the moment it is placed
+	side := models.OrderSide(req.Side)
+	if side == models.OrderSideSell && !price.GreaterThan(stopPrice) || side == models.OrderSideBuy && !price.LessThan(stopPrice) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The limit price must be above the stop price of a sell and below that of a buy"})
+		return
+	}
+	if stats := GetStatsStore(); stats != nil {
+		last := stats.Get(market.ID, time.Now()).LastPrice
+		if last.IsPositive() && (side == models.OrderSideSell && (!last.LessThan(price) || !last.GreaterThan(stopPrice)) ||
+			side == models.OrderSideBuy && (!last.GreaterThan(price) || !last.LessThan(stopPrice))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The last price %s must lie between the limit and stop prices", last)})
+			return
+		}
+	}
+
+	// the legs append a digit to the list ID, so they cannot collide with
+	// other order IDs
+	listID := generateOrderID()
+	list := models.OrderList{
+		ID:       listID,
+		UserID:   user.ID,
+		MarketID: market.ID,
+		Type:     models.OrderListTypeOCO,
+		Status:   models.OrderListStatusOpen,
+	}
+	limit := &models.Order{
+		ID:       listID + "1",
+		UserID:   user.ID,
+		MarketID: market.ID,
+		Side:     side,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusPending,
+		Price:    price,
+		Size:     size,
+		ListID:   listID,
+	}
+	stop := &models.Order{
+		ID:        listID + "2",
+		UserID:    user.ID,
+		MarketID:  market.ID,
+		Side:      side,
+		Type:      models.OrderTypeStopLimit,
+		Status:    models.OrderStatusPending,
+		Price:     stopLimitPrice,
+		StopPrice: stopPrice,
+		Size:      size,
+		ListID:    listID,
+	}
+	legs := []*models.Order{limit, stop}
+
+	if value, ok := c.Get("api_key"); ok {
+		if apiKey, ok := value.(*models.APIKey); ok {
+			limit.APIKeyID, stop.APIKeyID = apiKey.KeyID, apiKey.KeyID
+		}
+	}
+
+	for _, leg := range legs {
+		if !checkOrderRisk(c, leg, &market) {
+			return
+		}
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := settlement.HoldList(tx, legs, &market); err != nil {
+			return err
+		}
+		if err := tx.Create(&list).Error; err != nil {
+			return err
+		}
+		return tx.Create(legs).Error
+	})
+	if errors.Is(err, settlement.ErrInsufficientBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order list"})
+		return
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers != nil && tradingHandlers.engine != nil {
+		now := time.Now()
+		engineLegs := make([]*matching.Order, len(legs))
+		for i, leg := range legs {
+			engineLegs[i] = &matching.Order{
+				ID:        leg.ID,
+				MarketID:  leg.MarketID,
+				Side:      matching.Side(leg.Side),
+				Price:     leg.Price,
+				Size:      leg.Size,
+				Type:      matching.OrderType(leg.Type),
+				UserID:    int64(user.ID),
+				CreatedAt: now,
+				StopPrice: leg.StopPrice,
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := tradingHandlers.engine.AddOCO(ctx, listID, engineLegs[0], engineLegs[1]); err != nil {
+			if err := failOrderList(listID, legs); err != nil {
+				logrus.Errorf("Failed to release order list %s: %v", listID, err)
+			}
+
+			logrus.Errorf("Failed to submit order list to matching engine: %v", err)
+			if errors.Is(err, matching.ErrOverloaded) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later"})
+				return
+			}
+			if errors.Is(err, matching.ErrInvalidParam) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order prices or size"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit order list to matching engine"})
+			return
+		}
+
+		// settlement may already have filled or cancelled a leg
+		database.GetDB().Model(&models.Order{}).
+			Where("list_id = ? AND status = ?", listID, models.OrderStatusPending).
+			Update("status", models.OrderStatusOpen)
+	} else {
+		logrus.Warn("No matching engine available, order list remains pending")
+	}
+
+	database.GetDB().Preload("Orders").Where("id = ?", listID).First(&list)
+	if tradingHandlers != nil && tradingHandlers.hub != nil {
+		for _, leg := range list.Orders {
+			tradingHandlers.hub.BroadcastUserOrderUpdate(user.ID, leg)
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data":    list,
+	})
+}
+
+// CreateBracketOrder places a bracket: an entry limit order at price whose
+// fills each open a one-cancels-other list on the other side, sized for the
+// filled quantity, with a take-profit leg at take_profit_price and a
+// stop-loss leg at stop_limit_price triggered at stop_price. Cancelling the
+// bracket before the entry fills cancels all of it.
+func CreateBracketOrder(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		MarketID        string `json:"market_id" binding:"required"`
+		Side            int8   `json:"side" binding:"required"`
+		Size            string `json:"size" binding:"required"`
+		Price           string `json:"price" binding:"required"`
+		TakeProfitPrice string `json:"take_profit_price" binding:"required"`
+		StopPrice       string `json:"stop_price" binding:"required"`
+		StopLimitPrice  string `json:"stop_limit_price" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var market models.Market
+	if err := database.GetDB().Where("id = ? AND is_active = ?", req.MarketID, true).First(&market).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid market"})
+		return
+	}
+	if req.Side != 1 && req.Side != 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order side (1=buy, 2=sell)"})
+		return
+	}
+
+	size := models.DecimalFromString(req.Size)
+	price := models.DecimalFromString(req.Price)
+	takeProfitPrice := models.DecimalFromString(req.TakeProfitPrice)
+	stopPrice := models.DecimalFromString(req.StopPrice)
+	stopLimitPrice := models.DecimalFromString(req.StopLimitPrice)
+
+	if !size.IsPositive() || !size.Equal(size.Truncate(int32(market.SizePrecision))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Size must be positive with at most %d decimals", market.SizePrecision)})
+		return
+	}
+	for _, p := range []decimal.Decimal{price, takeProfitPrice, stopPrice, stopLimitPrice} {
+		if !p.IsPositive() || !p.Equal(p.Truncate(int32(market.PricePrecision))) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Prices must be positive with at most %d decimals", market.PricePrecision)})
+			return
+		}
+	}
+
+	// the take profit closes in profit and the stop at a loss relative to
+	// the entry
+	side := models.OrderSide(req.Side)
+	if side == models.OrderSideBuy && (!takeProfitPrice.GreaterThan(price) || !stopPrice.LessThan(price)) ||
+		side == models.OrderSideSell && (!takeProfitPrice.LessThan(price) || !stopPrice.GreaterThan(price)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The entry price must lie between the take-profit and stop prices"})
+		return
+	}
+
+	// the entry appends a digit to the bracket ID and the child lists a
+	// dash and their number, so none of them collide with other IDs
+	listID := generateOrderID()
+	list := models.OrderList{
+		ID:              listID,
+		UserID:          user.ID,
+		MarketID:        market.ID,
+		Type:            models.OrderListTypeBracket,
+		Status:          models.OrderListStatusOpen,
+		TakeProfitPrice: takeProfitPrice,
+		StopPrice:       stopPrice,
+		StopLimitPrice:  stopLimitPrice,
+	}
+	entry := models.Order{
+		ID:       listID + "0",
+		UserID:   user.ID,
+		MarketID: market.ID,
+		Side:     side,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusPending,
+		Price:    price,
+		Size:     size,
+		ListID:   listID,
+	}
+
+	if value, ok := c.Get("api_key"); ok {
+		if apiKey, ok := value.(*models.APIKey); ok {
+			entry.APIKeyID = apiKey.KeyID
+		}
+	}
+
+	if !checkOrderRisk(c, &entry, &market) {
+		return
+	}
+
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := settlement.Hold(tx, &entry, &market); err != nil {
+			return err
+		}
+		if err := tx.Create(&list).Error; err != nil {
+			return err
+		}
+		return tx.Create(&entry).Error
+	})
+	if errors.Is(err, settlement.ErrInsufficientBalance) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order list"})
+		return
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers != nil && tradingHandlers.engine != nil {
+		// the entry is a plain order in the engine; settlement opens the
+		// child lists as it fills
+		matchingOrder := &matching.Order{
+			ID:        entry.ID,
+			MarketID:  entry.MarketID,
+			Side:      matching.Side(entry.Side),
+			Price:     entry.Price,
+			Size:      entry.Size,
+			Type:      matching.OrderType(entry.Type),
+			UserID:    int64(user.ID),
+			CreatedAt: time.Now(),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := tradingHandlers.engine.AddOrder(ctx, matchingOrder); err != nil {
+			if err := failOrderList(listID, []*models.Order{&entry}); err != nil {
+				logrus.Errorf("Failed to release order list %s: %v", listID, err)
+			}
+
+			logrus.Errorf("Failed to submit bracket entry to matching engine: %v", err)
+			if errors.Is(err, matching.ErrOverloaded) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later"})
+				return
+			}
+			if errors.Is(err, matching.ErrInvalidParam) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order price or size"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit order to matching engine"})
+			return
+		}
+
+		// settlement may already have filled the entry
+		database.GetDB().Model(&models.Order{}).
+			Where("id = ? AND status = ?", entry.ID, models.OrderStatusPending).
+			Update("status", models.OrderStatusOpen)
+	} else {
+		logrus.Warn("No matching engine available, bracket entry remains pending")
+	}
+
+	database.GetDB().Preload("Orders").Preload("Lists.Orders").Where("id = ?", listID).First(&list)
+	if tradingHandlers != nil && tradingHandlers.hub != nil {
+		for _, leg := range list.Orders {
+			tradingHandlers.hub.BroadcastUserOrderUpdate(user.ID, leg)
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data":    list,
+	})
+}
+
+// GetOrderLists returns the user's order lists with their legs and, for
+// brackets, the lists their fills opened, newest first
+func GetOrderLists(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	query := database.GetDB().Preload("Orders").Preload("Lists.Orders").Where("user_id = ?", user.ID)
+	if marketID := c.Query("market_id"); marketID != "" {
+		query = query.Where("market_id = ?", marketID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var lists []models.OrderList
+	if err := query.Order("created_at DESC").Find(&lists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order lists"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    lists,
+	})
+}
+
+// GetOrderList returns an order list with its legs and child lists
+func GetOrderList(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var list models.OrderList
+	err := database.GetDB().Preload("Orders").Preload("Lists.Orders").
+		Where("id = ? AND user_id = ?", c.Param("listId"), user.ID).
+		First(&list).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order list not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    list,
+	})
+}
+
+// CancelOrderList cancels every open leg of an order list in one step. A
+// bracket is cancelled with its entry order and the lists its fills opened.
+func CancelOrderList(c *gin.Context) {
+	user, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	listID := c.Param("listId")
+
+	var list models.OrderList
+	if err := database.GetDB().Where("id = ? AND user_id = ?", listID, user.ID).First(&list).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order list not found"})
+		return
+	}
+	if list.Status != models.OrderListStatusOpen && list.Status != models.OrderListStatusExecuting {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Order list cannot be cancelled"})
+		return
+	}
+
+	openStatuses := []models.OrderStatus{models.OrderStatusOpen, models.OrderStatusPending}
+
+	listIDs := []string{listID}
+	if list.Type == models.OrderListTypeBracket {
+		var children []string
+		err := database.GetDB().Model(&models.OrderList{}).
+			Where("parent_id = ? AND status IN ?", listID, []models.OrderListStatus{models.OrderListStatusOpen, models.OrderListStatusExecuting}).
+			Pluck("id", &children).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order list"})
+			return
+		}
+		listIDs = append(listIDs, children...)
+	}
+
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		cancelStoredOrderList(c, &list, listIDs)
+		return
+	}
+
+	var legs []*models.Order
+	err := database.GetDB().Where("list_id IN ? AND status IN ?", listIDs, openStatuses).
+		Order("id").
+		Find(&legs).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order list"})
+		return
+	}
+
+	// The engine cancels the legs and settlement records the cancellations,
+	// releases their hold and updates the lists as it applies them
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the engine knows a bracket's entry only as a plain order
+	engineLists := listIDs
+	if list.Type == models.OrderListTypeBracket {
+		for _, leg := range legs {
+			if leg.ListID != listID {
+				continue
+			}
+			if err := tradingHandlers.engine.CancelOrder(ctx, list.MarketID, leg.ID); err != nil {
+				respondCancelListError(c, err)
+				return
+			}
+		}
+		engineLists = listIDs[1:]
+	}
+	for _, id := range engineLists {
+		if err := tradingHandlers.engine.CancelOrderList(ctx, list.MarketID, id); err != nil {
+			respondCancelListError(c, err)
+			return
+		}
+	}
+
+	settleErr := awaitSettled(legs...)
+	if settleErr != nil && !errors.Is(settleErr, errCancelRequested) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order list"})
+		return
+	}
+
+	err = database.GetDB().Preload("Orders").Preload("Lists.Orders").Where("id = ?", listID).First(&list).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order list"})
+		return
+	}
+
+	if settleErr != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"success": true,
+			"message": "Cancellation requested",
+			"data":    list,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    list,
+	})
+}
+
+// respondCancelListError maps an order list cancellation the engine refused
+// to its response
+func respondCancelListError(c *gin.Context, err error) {
+	logrus.Errorf("Failed to cancel order list in matching engine: %v", err)
+	switch {
+	case errors.Is(err, matching.ErrOverloaded):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Market is overloaded, retry later"})
+	case errors.Is(err, matching.ErrEngineNotRunning):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Trading is unavailable, retry later"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order list"})
+	}
+}
+
+// cancelStoredOrderList cancels the open legs of the given lists in the
+// database alone, for when no matching engine runs, and responds with list
+func cancelStoredOrderList(c *gin.Context, list *models.OrderList, listIDs []string) {
+	openStatuses := []models.OrderStatus{models.OrderStatusOpen, models.OrderStatusPending}
+
+	// Update the legs in the database and unlock their shared hold
+	now := time.Now()
+	err := database.GetDB().Transaction(func(tx *gorm.DB) error {
+		var legs []models.Order
+		err := tx.Where("list_id IN ? AND status IN ?", listIDs, openStatuses).
+			Order("id").
+			Find(&legs).Error
+		if err != nil {
+			return err
+		}
+
+		for _, leg := range legs {
+			err := tx.Model(&models.Order{}).Where("id = ?", leg.ID).Updates(map[string]interface{}{
+				"status":       models.OrderStatusCancelled,
+				"cancelled_at": now,
+			}).Error
+			if err != nil {
+				return err
+			}
+			if err := settlement.Release(tx, leg.ID); err != nil {
+				return err
+			}
+		}
+
+		// a list opened by a bracket fill also moves its bracket
+		updated := listIDs
+		if list.ParentID != "" {
+			updated = append(updated, list.ParentID)
+		}
+		for _, id := range updated {
+			if err := settlement.UpdateOrderList(tx, id); err != nil {
+				return err
+			}
+		}
+		return tx.Preload("Orders").Preload("Lists.Orders").Where("id = ?", list.ID).First(list).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel order list"})
+		return
+	}
+
+	hub := GetWebSocketHub()
+	for _, leg := range list.Orders {
+		hub.BroadcastUserOrderUpdate(list.UserID, leg)
+	}
+	for _, child := range list.Lists {
+		for _, leg := range child.Orders {
+			hub.BroadcastUserOrderUpdate(list.UserID, leg)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    list,
+	})
+}
+
+// failOrderList marks the legs of a list the engine refused as failed and
+// unlocks their hold
+func failOrderList(listID string, legs []*models.Order) error {
+	return database.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Order{}).Where("list_id = ?", listID).
+			Update("status", models.OrderStatusFailed).Error
+		if err != nil {
+			return err
+		}
+		for _, leg := range legs {
+			if err := settlement.Release(tx, leg.ID); err != nil {
+				return err
+			}
+		}
+		return settlement.UpdateOrderList(tx, listID)
+	})
+}
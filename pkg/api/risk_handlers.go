@@ -0,0 +1,369 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database"
+	"bixor-engine/pkg/middleware"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+)
+
+// GetRiskLimits lists the configured risk limit rows, optionally filtered by
+// user_id and market_id
+func GetRiskLimits(c *gin.Context) {
+	query := database.GetDB().Order("user_id, market_id")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if marketID, ok := c.GetQuery("market_id"); ok {
+		query = query.Where("market_id = ?", marketID)
+	}
+
+	var limits []models.RiskLimit
+	if err := query.Find(&limits).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch risk limits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    limits,
+	})
+}
+
+// GetEffectiveRiskLimits returns the limits that apply to a user in a market
+// once every matching row is merged
+func GetEffectiveRiskLimits(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Query("user_id"), 10, 64)
+	if err != nil || c.Query("market_id") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id and market_id are required"})
+		return
+	}
+
+	checker := GetRiskChecker()
+	if checker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Risk checks not available"})
+		return
+	}
+
+	limits, err := checker.Limits(uint(userID), c.Query("market_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch risk limits"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    limits,
+	})
+}
+
+// SetRiskLimit creates or replaces the limit row of a scope. Omit user_id
+// for every user and market_id for every market; zero leaves a limit unset.
+func SetRiskLimit(c *gin.Context) {
+	admin, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		UserID             uint   `json:"user_id"`
+		MarketID           string `json:"market_id"`
+		MaxOrderNotional   string `json:"max_order_notional"`
+		MaxOpenOrders      int    `json:"max_open_orders"`
+		MaxPosition        string `json:"max_position"`
+		MaxOrdersPerSecond int    `json:"max_orders_per_second"`
+		PriceBand          string `json:"price_band"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+
+	limit := models.RiskLimit{
+		UserID:             req.UserID,
+		MarketID:           req.MarketID,
+		MaxOpenOrders:      req.MaxOpenOrders,
+		MaxOrdersPerSecond: req.MaxOrdersPerSecond,
+		UpdatedBy:          admin.ID,
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *decimal.Decimal
+	}{
+		{"max_order_notional", req.MaxOrderNotional, &limit.MaxOrderNotional},
+		{"max_position", req.MaxPosition, &limit.MaxPosition},
+		{"price_band", req.PriceBand, &limit.PriceBand},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := decimal.NewFromString(field.value)
+		if err != nil || value.IsNegative() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + field.name})
+			return
+		}
+		*field.dest = value
+	}
+	if limit.MaxOpenOrders < 0 || limit.MaxOrdersPerSecond < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limits must not be negative"})
+		return
+	}
+
+	if limit.MarketID != "" {
+		var market models.Market
+		if err := database.GetDB().Where("id = ?", limit.MarketID).First(&market).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid market"})
+			return
+		}
+	}
+
+	err := database.GetDB().Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "market_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"max_order_notional", "max_open_orders", "max_position",
+			"max_orders_per_second", "price_band", "updated_by", "updated_at",
+		}),
+	}).Create(&limit).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save risk limit"})
+		return
+	}
+
+	database.GetDB().Where("user_id = ? AND market_id = ?", limit.UserID, limit.MarketID).First(&limit)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    limit,
+	})
+}
+
+// DeleteRiskLimit removes a limit row
+func DeleteRiskLimit(c *gin.Context) {
+	result := database.GetDB().Delete(&models.RiskLimit{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete risk limit"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Risk limit not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Risk limit deleted",
+	})
+}
+
+// GetKillSwitches lists kill switch activations, newest first. Pass
+// active=true for the switches that currently halt trading.
+func GetKillSwitches(c *gin.Context) {
+	checker := GetRiskChecker()
+	if checker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Risk checks not available"})
+		return
+	}
+
+	switches, err := checker.KillSwitches(c.Request.Context(), c.Query("active") == "true")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch kill switches"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    switches,
+	})
+}
+
+// ActivateKillSwitch halts new orders in a scope, then cancels the open
+// orders in it
+func ActivateKillSwitch(c *gin.Context) {
+	admin, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var req struct {
+		Scope  string `json:"scope" binding:"required"`
+		Target string `json:"target"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": err.Error()})
+		return
+	}
+	if err := validateKillSwitchTarget(req.Scope, req.Target); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	checker := GetRiskChecker()
+	if checker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Risk checks not available"})
+		return
+	}
+
+	killSwitch, created, err := checker.ActivateKillSwitch(c.Request.Context(), req.Scope, req.Target, req.Reason, admin.ID)
+	if err != nil {
+		logrus.Errorf("Failed to activate %s kill switch %q: %v", req.Scope, req.Target, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate kill switch"})
+		return
+	}
+	if !created {
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "Kill switch already active",
+			"data":    killSwitch,
+		})
+		return
+	}
+	logrus.Warnf("Kill switch %d activated by admin %d: %s %q (%s)",
+		killSwitch.ID, admin.ID, killSwitch.Scope, killSwitch.Target, killSwitch.Reason)
+
+	// new orders are already refused, so nothing can rest behind the cancel
+	cancelled, err := cancelKillSwitchOrders(c.Request.Context(), killSwitch)
+	if recordErr := checker.RecordCancelled(c.Request.Context(), killSwitch, len(cancelled)); recordErr != nil {
+		logrus.Errorf("Failed to record cancellations of kill switch %d: %v", killSwitch.ID, recordErr)
+	}
+	if err != nil {
+		logrus.Errorf("Kill switch %d failed to cancel orders after %d: %v", killSwitch.ID, len(cancelled), err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Kill switch is active but cancelling open orders failed",
+			"data":  killSwitch,
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"message": "Kill switch activated",
+		"data":    killSwitch,
+	})
+}
+
+// ReleaseKillSwitch lets a halted scope trade again
+func ReleaseKillSwitch(c *gin.Context) {
+	admin, exists := middleware.GetUserFromContext(c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kill switch ID"})
+		return
+	}
+
+	checker := GetRiskChecker()
+	if checker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Risk checks not available"})
+		return
+	}
+
+	killSwitch, err := checker.ReleaseKillSwitch(c.Request.Context(), uint(id), admin.ID)
+	if errors.Is(err, risk.ErrKillSwitchNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Kill switch not found or already released"})
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to release kill switch %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release kill switch"})
+		return
+	}
+	logrus.Warnf("Kill switch %d released by admin %d: %s %q", killSwitch.ID, admin.ID, killSwitch.Scope, killSwitch.Target)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Kill switch released",
+		"data":    killSwitch,
+	})
+}
+
+// validateKillSwitchTarget checks that the target of a scope exists
+func validateKillSwitchTarget(scope, target string) error {
+	db := database.GetDB()
+
+	switch scope {
+	case models.KillSwitchGlobal:
+		return nil
+	case models.KillSwitchUser:
+		if err := db.Where("id = ?", target).First(&models.User{}).Error; err != nil {
+			return errors.New("Unknown user")
+		}
+	case models.KillSwitchAPIKey:
+		if err := db.Where("key_id = ?", target).First(&models.APIKey{}).Error; err != nil {
+			return errors.New("Unknown API key")
+		}
+	case models.KillSwitchMarket:
+		if err := db.Where("id = ?", target).First(&models.Market{}).Error; err != nil {
+			return errors.New("Unknown market")
+		}
+	default:
+		return errors.New("Invalid scope (user, api_key, market or global)")
+	}
+
+	return nil
+}
+
+// cancelKillSwitchOrders cancels the open orders in a kill switch's scope in
+// the engine. Settlement marks them cancelled and releases their holds.
+func cancelKillSwitchOrders(ctx context.Context, killSwitch *models.KillSwitch) ([]string, error) {
+	tradingHandlers := GetTradingHandlers()
+	if tradingHandlers == nil || tradingHandlers.engine == nil {
+		return nil, nil
+	}
+	engine := tradingHandlers.engine
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	switch killSwitch.Scope {
+	case models.KillSwitchGlobal:
+		return engine.CancelAll(ctx, "")
+	case models.KillSwitchMarket:
+		return engine.CancelAll(ctx, killSwitch.Target)
+	case models.KillSwitchUser:
+		userID, err := strconv.ParseInt(killSwitch.Target, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return engine.MassCancel(ctx, userID, "", 0)
+	}
+	return cancelAPIKeyOrders(ctx, engine, killSwitch.Target)
+}
+
+// cancelAPIKeyOrders cancels the open orders placed through an API key. The
+// engine does not know API keys, so they are cancelled one by one.
+func cancelAPIKeyOrders(ctx context.Context, engine *matching.MatchingEngine, keyID string) ([]string, error) {
+	var orders []models.Order
+	err := database.GetDB().
+		Where("api_key_id = ? AND status IN ?", keyID, []models.OrderStatus{models.OrderStatusOpen, models.OrderStatusPending}).
+		Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	cancelled := make([]string, 0, len(orders))
+	for _, order := range orders {
+		if err := engine.CancelOrder(ctx, order.MarketID, order.ID); err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, order.ID)
+	}
+	return cancelled, nil
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"bixor-engine/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type KillSwitchTestSuite struct {
+	tradingTestSuite
+}
+
+func TestKillSwitchTestSuite(t *testing.T) {
+	suite.Run(t, new(KillSwitchTestSuite))
+}
+
+func (suite *KillSwitchTestSuite) TestAPIKeySwitchBlocksAndCancels() {
+	order := gin.H{"market_id": testMarket, "side": 1, "type": "limit", "price": "100", "size": "1"}
+
+	var placed struct{ Data models.Order }
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/orders", order, withAPIKey, &placed))
+	suite.Equal(testAPIKey, placed.Data.APIKeyID)
+
+	var viaToken struct{ Data models.Order }
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/orders", order, suite.withToken, &viaToken))
+	suite.Empty(viaToken.Data.APIKeyID)
+
+	var activated struct{ Data models.KillSwitch }
+	body := gin.H{"scope": models.KillSwitchAPIKey, "target": testAPIKey, "reason": "runaway bot"}
+	suite.Require().Equal(http.StatusCreated, suite.request(http.MethodPost, "/admin/kill-switches", body, nil, &activated))
+	suite.Equal(1, activated.Data.Cancelled)
+
+	// settlement cancels the key's order and releases its hold
+	suite.Eventually(func() bool {
+		return suite.order(placed.Data.ID).Status == models.OrderStatusCancelled
+	}, timeout, tick)
+	suite.True(suite.order(placed.Data.ID).Hold.IsZero())
+	suite.Equal(models.OrderStatusOpen, suite.order(viaToken.Data.ID).Status)
+
+	tests := []struct {
+		name   string
+		sign   func(*http.Request)
+		status int
+	}{
+		{"the key is halted", withAPIKey, http.StatusForbidden},
+		{"the user's JWT still trades", suite.withToken, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			var response map[string]interface{}
+			suite.Equal(tt.status, suite.request(http.MethodPost, "/orders", order, tt.sign, &response))
+			if tt.status == http.StatusForbidden {
+				suite.Equal("kill_switch", response["reason"])
+				suite.Equal(models.KillSwitchAPIKey, response["scope"])
+			}
+		})
+	}
+}
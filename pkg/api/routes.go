@@ -27,6 +27,7 @@ func SetupRoutes(router *gin.Engine, engine *matching.MatchingEngine, cfg *confi
 	authMiddleware := middleware.NewAuthMiddleware(jwtService, database.GetDB())
 	rateLimitMiddleware := middleware.NewRateLimitMiddleware(redisCache, database.GetDB())
 	sessionMiddleware := middleware.NewSessionMiddleware(database.GetDB())
+	idempotencyMiddleware := middleware.NewIdempotencyMiddleware(redisCache, database.GetDB())
 	
 	// Initialize auth handlers
 	authHandlers := NewAuthHandlers(
@@ -42,6 +43,9 @@ func SetupRoutes(router *gin.Engine, engine *matching.MatchingEngine, cfg *confi
 	tradingHandlers := NewTradingHandlers(engine, hub)
 	SetTradingHandlers(tradingHandlers)
 
+	// Pull a user's orders when a cancel-on-disconnect connection drops
+	hub.SetDisconnectHandler(tradingHandlers.deadman.Trigger)
+
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -71,6 +75,7 @@ func SetupRoutes(router *gin.Engine, engine *matching.MatchingEngine, cfg *confi
 		// Protected authentication endpoints (auth required)
 		authProtected := v1.Group("/auth")
 		authProtected.Use(authMiddleware.JWTAuth())
+		authProtected.Use(idempotencyMiddleware.Idempotent())
 		{
 			authProtected.POST("/logout", authHandlers.Logout)
 			authProtected.GET("/profile", authHandlers.GetProfile)
@@ -86,27 +91,76 @@ func SetupRoutes(router *gin.Engine, engine *matching.MatchingEngine, cfg *confi
 		markets.Use(rateLimitMiddleware.PublicRateLimit())
 		{
 			markets.GET("", GetMarkets)
+			markets.GET("/tickers", GetTickers)
 			markets.GET("/:marketId", GetMarket)
 			markets.GET("/:marketId/orderbook", GetOrderBook)
+			markets.GET("/:marketId/ticker/book", GetBookTicker)
 			markets.GET("/:marketId/trades", GetTrades)
 			markets.GET("/:marketId/stats", GetMarketStats)
 			markets.GET("/:marketId/klines", GetKlines)
 		}
 
-		// Order endpoints (require authentication and verification)
+		// Order endpoints (require authentication and verification). Trading
+		// endpoints accept API keys as well as JWTs.
 		orders := v1.Group("/orders")
-		orders.Use(authMiddleware.JWTAuth())
+		orders.Use(authMiddleware.TradingAuth())
 		orders.Use(middleware.RequireVerified())
 		orders.Use(rateLimitMiddleware.TradingRateLimit())
+		orders.Use(idempotencyMiddleware.Idempotent())
 		{
 			orders.POST("", CreateOrder)
 			orders.GET("", GetOrders)
+			orders.POST("/oco", CreateOCOOrder)
+			orders.POST("/bracket", CreateBracketOrder)
+			orders.GET("/lists", GetOrderLists)
+			orders.GET("/lists/:listId", GetOrderList)
+			orders.DELETE("/lists/:listId", CancelOrderList)
+			orders.GET("/by-client-id/:clientOrderId", GetOrderByClientID)
+			orders.DELETE("/by-client-id/:clientOrderId", CancelOrderByClientID)
 			orders.GET("/:orderId", GetOrder)
 			orders.DELETE("/:orderId", CancelOrder)
 			orders.DELETE("", CancelAllOrders)
 			orders.GET("/history", GetOrderHistory)
 		}
 
+		// Batch endpoints count against the trading rate limit by the number
+		// of orders they carry
+		batch := v1.Group("/orders/batch")
+		batch.Use(authMiddleware.TradingAuth())
+		batch.Use(middleware.RequireVerified())
+		batch.Use(rateLimitMiddleware.WeightedTradingRateLimit(BatchWeight))
+		batch.Use(idempotencyMiddleware.Idempotent())
+		{
+			batch.POST("", PlaceBatchOrders)
+			batch.DELETE("", CancelBatchOrders)
+		}
+
+		// Algo order endpoints, sliced into child orders by the algo service
+		algoOrders := v1.Group("/algo-orders")
+		algoOrders.Use(authMiddleware.TradingAuth())
+		algoOrders.Use(middleware.RequireVerified())
+		algoOrders.Use(rateLimitMiddleware.TradingRateLimit())
+		algoOrders.Use(idempotencyMiddleware.Idempotent())
+		{
+			algoOrders.POST("", CreateAlgoOrder)
+			algoOrders.GET("", GetAlgoOrders)
+			algoOrders.GET("/:algoId", GetAlgoOrder)
+			algoOrders.POST("/:algoId/pause", PauseAlgoOrder)
+			algoOrders.POST("/:algoId/resume", ResumeAlgoOrder)
+			algoOrders.DELETE("/:algoId", CancelAlgoOrder)
+		}
+
+		// API keys count down on the dead man's switch separately from the
+		// user's JWT sessions
+		cancelAfter := v1.Group("/orders/cancel-after")
+		cancelAfter.Use(authMiddleware.TradingAuth())
+		cancelAfter.Use(middleware.RequireVerified())
+		cancelAfter.Use(rateLimitMiddleware.TradingRateLimit())
+		cancelAfter.Use(idempotencyMiddleware.Idempotent())
+		{
+			cancelAfter.POST("", CancelAfter)
+		}
+
 		// User endpoints (require authentication and verified accounts)
 		users := v1.Group("/users")
 		users.Use(authMiddleware.JWTAuth())
@@ -129,10 +183,19 @@ func SetupRoutes(router *gin.Engine, engine *matching.MatchingEngine, cfg *confi
 	admin := router.Group("/admin")
 	admin.Use(authMiddleware.JWTAuth())
 	admin.Use(middleware.RequireAdmin())
+	admin.Use(idempotencyMiddleware.Idempotent())
 	{
 		admin.GET("/health/database", CheckDatabaseHealth)
 		admin.GET("/health/redis", CheckRedisHealth)
 		admin.GET("/metrics", GetMetrics)
+		admin.POST("/klines/rebuild", RebuildKlines)
+		admin.GET("/risk/limits", GetRiskLimits)
+		admin.GET("/risk/limits/effective", GetEffectiveRiskLimits)
+		admin.PUT("/risk/limits", SetRiskLimit)
+		admin.DELETE("/risk/limits/:id", DeleteRiskLimit)
+		admin.GET("/kill-switches", GetKillSwitches)
+		admin.POST("/kill-switches", ActivateKillSwitch)
+		admin.DELETE("/kill-switches/:id", ReleaseKillSwitch)
 		// TODO: Implement these admin handlers
 		// admin.GET("/users", GetAllUsers)
 		// admin.POST("/users/:userId/verify", VerifyUser)
@@ -15,6 +15,7 @@ var (
 	emailRegex    = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 	usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,50}$`)
 	marketIDRegex = regexp.MustCompile(`^[A-Z]{3,10}-[A-Z]{3,10}$`)
+	clientOrderIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,64}$`)
 )
 
 // ValidationError represents a validation error
@@ -196,6 +197,17 @@ func (v *Validator) ValidateOrderType(field, orderType string) {
 	v.AddError(field, fmt.Sprintf("invalid order type (valid types: %s)", strings.Join(validTypes, ", ")))
 }
 
+// ValidateClientOrderID validates an optional client order ID
+func (v *Validator) ValidateClientOrderID(field, clientOrderID string) {
+	if clientOrderID == "" {
+		return
+	}
+
+	if !clientOrderIDRegex.MatchString(clientOrderID) {
+		v.AddError(field, "client order ID must be at most 64 letters, numbers, periods, colons, underscores or hyphens")
+	}
+}
+
 // ValidatePrice validates a price
 func (v *Validator) ValidatePrice(field, priceStr string, required bool) decimal.Decimal {
 	if priceStr == "" {
@@ -358,15 +370,17 @@ func ValidateCreateOrderRequest(req CreateOrderRequest) ValidationErrors {
 	priceRequired := req.Type == "limit" || req.Type == "stop_limit"
 	validator.ValidatePrice("price", req.Price, priceRequired)
 	validator.ValidateSize("size", req.Size)
+	validator.ValidateClientOrderID("client_order_id", req.ClientOrderID)
 	
 	return validator.GetErrors()
 }
 
 // Request structs with validation tags
 type CreateOrderRequest struct {
-	MarketID string `json:"market_id"`
-	Side     int8   `json:"side"`
-	Type     string `json:"type"`
-	Price    string `json:"price"`
-	Size     string `json:"size"`
+	MarketID      string `json:"market_id"`
+	Side          int8   `json:"side"`
+	Type          string `json:"type"`
+	Price         string `json:"price"`
+	Size          string `json:"size"`
+	ClientOrderID string `json:"client_order_id"`
 } 
\ No newline at end of file
@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"github.com/sirupsen/logrus"
+)
+
+// Record is one line of the audit trail
+type Record struct {
+	Event    string          `json:"event"` // fill or cancel
+	Recorded time.Time       `json:"recorded_at"`
+	Trade    *matching.Trade `json:"trade"`
+}
+
+// Trail writes every engine fill and cancellation to an append-only stream
+// of JSON lines
+type Trail struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// NewTrail creates a new audit trail writing to w
+func NewTrail(w io.Writer) *Trail {
+	return &Trail{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// PublishTrades implements matching.PublishTrader
+func (t *Trail) PublishTrades(trades ...*matching.Trade) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().UTC()
+	encoder := json.NewEncoder(t.w)
+	for _, trade := range trades {
+		event := "fill"
+		if trade.IsCancel {
+			event = "cancel"
+		}
+
+		if err := encoder.Encode(Record{Event: event, Recorded: now, Trade: trade}); err != nil {
+			logrus.Errorf("Failed to write audit record for order %s: %v", trade.TakerOrderID, err)
+		}
+	}
+
+	if err := t.w.Flush(); err != nil {
+		logrus.Errorf("Failed to flush audit trail: %v", err)
+	}
+}
@@ -99,15 +99,17 @@ func (r *RedisCache) Set(key string, value interface{}, expiration time.Duration
 
 // Cache keys constants
 const (
-	KeyOrderBookDepth = "orderbook:depth:%s"          // orderbook:depth:BTC-USDT
-	KeyMarketData     = "market:data:%s"              // market:data:BTC-USDT
-	KeyUserBalances   = "user:balances:%d"            // user:balances:123
-	KeyRecentTrades   = "trades:recent:%s"            // trades:recent:BTC-USDT
-	KeyMarketStats    = "market:stats:%s"             // market:stats:BTC-USDT
-	KeyOrderBookFull  = "orderbook:full:%s"           // orderbook:full:BTC-USDT
-	KeyUserOrders     = "user:orders:%d"              // user:orders:123
-	KeyTradingPairs   = "trading:pairs"               // trading:pairs
-	KeyKlineData      = "kline:%s:%s"                 // kline:BTC-USDT:1m
+	KeyOrderBookDepth = "orderbook:depth:%s"       // orderbook:depth:BTC-USDT
+	KeyMarketData     = "market:data:%s"           // market:data:BTC-USDT
+	KeyUserBalances   = "user:balances:%d"         // user:balances:123
+	KeyRecentTrades   = "trades:recent:%s"         // trades:recent:BTC-USDT
+	KeyMarketStats    = "market:stats:%s"          // market:stats:BTC-USDT
+	KeyOrderBookFull  = "orderbook:full:%s"        // orderbook:full:BTC-USDT
+	KeyUserOrders     = "user:orders:%d"           // user:orders:123
+	KeyTradingPairs   = "trading:pairs"            // trading:pairs
+	KeyKlineData      = "kline:%s:%s"              // kline:BTC-USDT:1m
+	KeyOrderRate      = "risk:order_rate:%d:%s:%d" // risk:order_rate:123:BTC-USDT:1700000000
+	KeyKillSwitch     = "risk:kill_switch:%s:%s"   // risk:kill_switch:market:BTC-USDT
 )
 
 // Cache expiration times
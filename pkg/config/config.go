@@ -78,6 +78,12 @@ type TradingConfig struct {
 	MaxOrderSize       string
 	OrderBookDepth     int
 	CandlestickRetention time.Duration
+	PublisherBufferSize  int
+	OrderInboxSize       int
+	MatchingWorkers      int
+	AuditLogPath         string
+	JournalPath          string
+	SnapshotDir          string
 }
 
 func Load() (*Config, error) {
@@ -142,6 +148,12 @@ func Load() (*Config, error) {
 			MaxOrderSize:         getEnv("MAX_ORDER_SIZE", "1000000"),
 			OrderBookDepth:       getIntEnv("ORDER_BOOK_DEPTH", 100),
 			CandlestickRetention: getDurationEnv("CANDLESTICK_RETENTION", 30*24*time.Hour),
+			PublisherBufferSize:  getIntEnv("PUBLISHER_BUFFER_SIZE", 65536),
+			OrderInboxSize:       getIntEnv("ORDER_INBOX_SIZE", 10000),
+			MatchingWorkers:      getIntEnv("MATCHING_WORKERS", 0),
+			AuditLogPath:         getEnv("AUDIT_LOG_PATH", "audit.log"),
+			JournalPath:          getEnv("JOURNAL_PATH", "data/journal.log"),
+			SnapshotDir:          getEnv("SNAPSHOT_DIR", "data/snapshots"),
 		},
 	}
 
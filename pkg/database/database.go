@@ -20,7 +20,8 @@ func Initialize(cfg *config.Config) error {
 	dsn := cfg.GetDatabaseURL()
 	
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger:         logger.Default.LogMode(logger.Info),
+		TranslateError: true, // unique violations become gorm.ErrDuplicatedKey
 	})
 	if err != nil {
 		return fmt.Errorf("failed to connect to database: %w", err)
@@ -58,14 +59,20 @@ func AutoMigrate() error {
 		&models.Balance{},
 		&models.Market{},
 		&models.Order{},
+		&models.OrderList{},
+		&models.AlgoOrder{},
 		&models.Trade{},
 		&models.MarketData{},
+		&models.Kline{},
+		&models.RiskLimit{},
+		&models.KillSwitch{},
 		// Auth models
 		&models.UserSession{},
 		&models.APIKey{},
 		&models.TwoFactorAuth{},
 		&models.LoginAttempt{},
 		&models.RateLimit{},
+		&models.IdempotencyKey{},
 		&models.UserPassword{},
 	)
 	if err != nil {
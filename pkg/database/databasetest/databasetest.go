@@ -0,0 +1,51 @@
+// Package databasetest opens throwaway databases for tests. Each is an
+// in-memory SQLite database with the full schema, installed as database.DB
+// for the length of one test.
+package databasetest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"bixor-engine/pkg/database"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open creates a migrated database for t and makes it database.DB until t
+// ends. It holds a single connection, so code that starts a transaction must
+// not query outside it before the transaction ends.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", name)), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql.DB: %v", err)
+	}
+	// SQLite has a single writer, and one connection keeps the in-memory
+	// database alive until Close
+	sqlDB.SetMaxOpenConns(1)
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		sqlDB.Close()
+	})
+
+	if err := database.AutoMigrate(); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+	return db
+}
@@ -0,0 +1,121 @@
+// Package deadman pulls a user's open orders when the session that placed
+// them stops proving it is alive: a WebSocket connection that opted in drops,
+// or a countdown armed through the API is not refreshed in time.
+package deadman
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cancelTimeout bounds one mass cancellation
+const cancelTimeout = 5 * time.Second
+
+// CancelFunc cancels the open orders of a user and returns their IDs. With an
+// API key it cancels only the orders placed through that key.
+type CancelFunc func(ctx context.Context, userID uint, apiKeyID string) ([]string, error)
+
+// Switch holds one countdown per session. A session is whatever refreshes
+// the countdown: an API key, or a user for JWT sessions.
+type Switch struct {
+	cancel CancelFunc
+
+	mu     sync.Mutex
+	timers map[string]*countdown
+}
+
+type countdown struct {
+	userID   uint
+	apiKeyID string
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// New creates a switch that fires through cancel
+func New(cancel CancelFunc) *Switch {
+	return &Switch{
+		cancel: cancel,
+		timers: make(map[string]*countdown),
+	}
+}
+
+// UserSession names the countdown of a user's JWT sessions
+func UserSession(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// APIKeySession names the countdown of an API key
+func APIKeySession(keyID string) string {
+	return "api_key:" + keyID
+}
+
+// Arm starts or restarts the countdown of a session and returns when it
+// fires. Calling it again before then is the session's heartbeat. A session
+// armed with an API key only pulls the orders of that key.
+func (s *Switch) Arm(session string, userID uint, apiKeyID string, timeout time.Duration) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.timers[session]; ok {
+		current.timer.Stop()
+	}
+
+	armed := &countdown{
+		userID:   userID,
+		apiKeyID: apiKeyID,
+		deadline: time.Now().Add(timeout),
+	}
+	armed.timer = time.AfterFunc(timeout, func() { s.expire(session, armed) })
+	s.timers[session] = armed
+
+	return armed.deadline
+}
+
+// Disarm stops the countdown of a session and reports whether one was armed
+func (s *Switch) Disarm(session string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.timers[session]
+	if !ok {
+		return false
+	}
+	current.timer.Stop()
+	delete(s.timers, session)
+
+	return true
+}
+
+// Trigger cancels a user's orders right away, for sessions that are known to
+// be gone
+func (s *Switch) Trigger(userID uint) {
+	go s.fire("disconnect", userID, "")
+}
+
+// expire fires a countdown unless it was re-armed or disarmed meanwhile
+func (s *Switch) expire(session string, expired *countdown) {
+	s.mu.Lock()
+	if s.timers[session] != expired {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.timers, session)
+	s.mu.Unlock()
+
+	s.fire(session, expired.userID, expired.apiKeyID)
+}
+
+func (s *Switch) fire(reason string, userID uint, apiKeyID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	cancelled, err := s.cancel(ctx, userID, apiKeyID)
+	if err != nil {
+		logrus.Errorf("Dead man's switch (%s) failed to cancel orders of user %d: %v", reason, userID, err)
+	}
+	logrus.Infof("Dead man's switch (%s) cancelled %d orders of user %d", reason, len(cancelled), userID)
+}
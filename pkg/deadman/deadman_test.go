@@ -0,0 +1,93 @@
+package deadman
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// how long to wait for a countdown to fire, and how often to look
+const (
+	timeout = time.Second
+	tick    = 5 * time.Millisecond
+)
+
+type call struct {
+	userID   uint
+	apiKeyID string
+}
+
+type DeadmanTestSuite struct {
+	suite.Suite
+	deadman *Switch
+
+	mu    sync.Mutex
+	calls []call
+}
+
+func TestDeadmanTestSuite(t *testing.T) {
+	suite.Run(t, new(DeadmanTestSuite))
+}
+
+func (suite *DeadmanTestSuite) SetupTest() {
+	suite.calls = nil
+	suite.deadman = New(func(ctx context.Context, userID uint, apiKeyID string) ([]string, error) {
+		suite.mu.Lock()
+		defer suite.mu.Unlock()
+		suite.calls = append(suite.calls, call{userID, apiKeyID})
+		return nil, nil
+	})
+}
+
+func (suite *DeadmanTestSuite) fired() []call {
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	return append([]call(nil), suite.calls...)
+}
+
+func (suite *DeadmanTestSuite) TestFiresOnceOnExpiry() {
+	suite.deadman.Arm(APIKeySession("key"), 7, "key", 20*time.Millisecond)
+
+	suite.Eventually(func() bool { return len(suite.fired()) > 0 }, timeout, tick)
+	time.Sleep(100 * time.Millisecond)
+	suite.Equal([]call{{7, "key"}}, suite.fired())
+
+	// the countdown is gone once it fired
+	suite.False(suite.deadman.Disarm(APIKeySession("key")))
+}
+
+func (suite *DeadmanTestSuite) TestDoesNotFireAfterDisarm() {
+	suite.deadman.Arm(UserSession(7), 7, "", 50*time.Millisecond)
+	suite.True(suite.deadman.Disarm(UserSession(7)))
+	suite.False(suite.deadman.Disarm(UserSession(7)))
+
+	time.Sleep(150 * time.Millisecond)
+	suite.Empty(suite.fired())
+}
+
+func (suite *DeadmanTestSuite) TestRearmPostponesExpiry() {
+	suite.deadman.Arm(UserSession(7), 7, "", 100*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	suite.deadman.Arm(UserSession(7), 7, "", 200*time.Millisecond)
+
+	// past the first deadline, before the second
+	time.Sleep(80 * time.Millisecond)
+	suite.Empty(suite.fired())
+
+	suite.Eventually(func() bool { return len(suite.fired()) > 0 }, timeout, tick)
+	time.Sleep(100 * time.Millisecond)
+	suite.Equal([]call{{7, ""}}, suite.fired())
+}
+
+func (suite *DeadmanTestSuite) TestSessionsCountDownSeparately() {
+	suite.deadman.Arm(APIKeySession("a"), 7, "a", 20*time.Millisecond)
+	suite.deadman.Arm(APIKeySession("b"), 7, "b", time.Hour)
+	suite.T().Cleanup(func() { suite.deadman.Disarm(APIKeySession("b")) })
+
+	suite.Eventually(func() bool { return len(suite.fired()) > 0 }, timeout, tick)
+	time.Sleep(50 * time.Millisecond)
+	suite.Equal([]call{{7, "a"}}, suite.fired())
+}
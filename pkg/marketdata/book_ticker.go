@@ -0,0 +1,133 @@
+package marketdata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/models"
+	wsocket "bixor-engine/pkg/websocket"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DefaultBookTickerFlushInterval is how often best bid/offer changes are
+// written to the market_data table and Redis
+const DefaultBookTickerFlushInterval = time.Second
+
+// BookTickers consumes best bid/offer events from the matching engine. Every
+// change is pushed to WebSocket subscribers immediately, while the
+// market_data row and the Redis market data cache are refreshed in batches so
+// that the order book goroutine never waits on the database.
+type BookTickers struct {
+	db            *gorm.DB
+	hub           *wsocket.WebSocketHub
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	latest map[string]*matching.BookTicker
+	dirty  map[string]bool
+	rows   map[string]*models.MarketData
+}
+
+// NewBookTickers creates a new best bid/offer consumer
+func NewBookTickers(db *gorm.DB, hub *wsocket.WebSocketHub) *BookTickers {
+	return &BookTickers{
+		db:            db,
+		hub:           hub,
+		flushInterval: DefaultBookTickerFlushInterval,
+		latest:        make(map[string]*matching.BookTicker),
+		dirty:         make(map[string]bool),
+		rows:          make(map[string]*models.MarketData),
+	}
+}
+
+// PublishTrades implements matching.PublishTrader; trades are not used here
+func (b *BookTickers) PublishTrades(trades ...*matching.Trade) {}
+
+// PublishBookTicker implements matching.BookTickerPublisher
+func (b *BookTickers) PublishBookTicker(ticker *matching.BookTicker) {
+	if b.hub != nil {
+		b.hub.BroadcastBookTicker(ticker.MarketID, ticker)
+	}
+
+	b.mu.Lock()
+	b.latest[ticker.MarketID] = ticker
+	b.dirty[ticker.MarketID] = true
+	b.mu.Unlock()
+}
+
+// Run flushes best bid/offer changes until the context is cancelled
+func (b *BookTickers) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.flush()
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+// flush writes changed markets to the database and refreshes the Redis cache
+// for every market seen so far, so quiet markets don't expire from it
+func (b *BookTickers) flush() {
+	b.mu.Lock()
+	changed := make([]*matching.BookTicker, 0, len(b.dirty))
+	for marketID := range b.dirty {
+		changed = append(changed, b.latest[marketID])
+	}
+	b.dirty = make(map[string]bool)
+	b.mu.Unlock()
+
+	for _, ticker := range changed {
+		if err := b.saveMarketData(ticker); err != nil {
+			logrus.Errorf("Failed to update market data for %s: %v", ticker.MarketID, err)
+		}
+	}
+
+	b.mu.Lock()
+	rows := make([]*models.MarketData, 0, len(b.rows))
+	for _, row := range b.rows {
+		rows = append(rows, row)
+	}
+	b.mu.Unlock()
+
+	for _, row := range rows {
+		if err := cache.CacheMarketData(row.MarketID, row); err != nil {
+			logrus.Errorf("Failed to cache market data for %s: %v", row.MarketID, err)
+		}
+	}
+}
+
+// saveMarketData upserts the best bid/offer columns of a market_data row
+func (b *BookTickers) saveMarketData(ticker *matching.BookTicker) error {
+	if b.db == nil {
+		return nil
+	}
+
+	var row models.MarketData
+	err := b.db.Where(models.MarketData{MarketID: ticker.MarketID}).
+		Assign(map[string]interface{}{
+			"best_bid":   ticker.BidPrice,
+			"best_ask":   ticker.AskPrice,
+			"spread":     ticker.Spread,
+			"updated_at": ticker.Time,
+		}).
+		FirstOrCreate(&row).Error
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.rows[ticker.MarketID] = &row
+	b.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,415 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/models"
+	wsocket "bixor-engine/pkg/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Interval is a candlestick resolution
+type Interval string
+
+const (
+	Interval1m  Interval = "1m"
+	Interval5m  Interval = "5m"
+	Interval15m Interval = "15m"
+	Interval1h  Interval = "1h"
+	Interval4h  Interval = "4h"
+	Interval1d  Interval = "1d"
+	Interval1w  Interval = "1w"
+)
+
+// Intervals lists every maintained interval, shortest first
+var Intervals = []Interval{Interval1m, Interval5m, Interval15m, Interval1h, Interval4h, Interval1d, Interval1w}
+
+var intervalDurations = map[Interval]time.Duration{
+	Interval1m:  time.Minute,
+	Interval5m:  5 * time.Minute,
+	Interval15m: 15 * time.Minute,
+	Interval1h:  time.Hour,
+	Interval4h:  4 * time.Hour,
+	Interval1d:  24 * time.Hour,
+	Interval1w:  7 * 24 * time.Hour,
+}
+
+// ParseInterval validates an interval string such as "15m"
+func ParseInterval(value string) (Interval, bool) {
+	interval := Interval(value)
+	_, ok := intervalDurations[interval]
+	return interval, ok
+}
+
+// Duration returns the length of a candle
+func (i Interval) Duration() time.Duration {
+	return intervalDurations[i]
+}
+
+// OpenTime returns the start of the candle containing t. Candles are aligned
+// to UTC; weekly candles start on Monday.
+func (i Interval) OpenTime(t time.Time) time.Time {
+	return t.UTC().Truncate(i.Duration())
+}
+
+const (
+	// DefaultKlineFlushInterval is how often closed candles are persisted and
+	// open candles are pushed to Redis
+	DefaultKlineFlushInterval = time.Second
+
+	klinePruneInterval = time.Hour
+	klineRebuildBatch  = 1000
+)
+
+// Klines aggregates engine fills into OHLCV candles for every interval in
+// Intervals. Open candles live in memory and Redis; closed candles are
+// persisted to the klines table in batches by Run.
+type Klines struct {
+	db            *gorm.DB
+	hub           *wsocket.WebSocketHub
+	retention     time.Duration
+	flushInterval time.Duration
+
+	mu     sync.Mutex
+	open   map[string]map[Interval]*models.Kline
+	dirty  map[*models.Kline]bool
+	closed []*models.Kline
+}
+
+// NewKlines creates a new kline aggregator. Closed candles older than
+// retention are pruned; a zero retention keeps them forever.
+func NewKlines(db *gorm.DB, hub *wsocket.WebSocketHub, retention time.Duration) *Klines {
+	return &Klines{
+		db:            db,
+		hub:           hub,
+		retention:     retention,
+		flushInterval: DefaultKlineFlushInterval,
+		open:          make(map[string]map[Interval]*models.Kline),
+		dirty:         make(map[*models.Kline]bool),
+	}
+}
+
+// PublishTrades implements matching.PublishTrader
+func (k *Klines) PublishTrades(trades ...*matching.Trade) {
+	updated := make([]models.Kline, 0, len(Intervals))
+
+	k.mu.Lock()
+	for _, trade := range trades {
+		if trade.IsCancel || len(trade.MarketID) == 0 {
+			continue
+		}
+
+		updated = append(updated, k.apply(trade.MarketID, trade.Price, trade.Size, trade.CreatedAt)...)
+	}
+	k.mu.Unlock()
+
+	if k.hub == nil {
+		return
+	}
+
+	for i := range updated {
+		candle := &updated[i]
+		k.hub.BroadcastKline(candle.MarketID, candle.Interval, candle)
+	}
+}
+
+// apply folds one fill into the open candles of a market and returns copies
+// of the updated candles. The caller must hold k.mu.
+func (k *Klines) apply(marketID string, price, size decimal.Decimal, at time.Time) []models.Kline {
+	candles, ok := k.open[marketID]
+	if !ok {
+		candles = make(map[Interval]*models.Kline, len(Intervals))
+		k.open[marketID] = candles
+	}
+
+	updated := make([]models.Kline, 0, len(Intervals))
+	for _, interval := range Intervals {
+		openTime := interval.OpenTime(at)
+
+		candle := candles[interval]
+		if candle != nil && openTime.After(candle.OpenTime) {
+			k.closed = append(k.closed, candle)
+			delete(k.dirty, candle)
+			candle = nil
+		}
+
+		if candle == nil {
+			candle = newKline(marketID, interval, openTime, price)
+			candles[interval] = candle
+		}
+
+		addToKline(candle, price, size)
+		k.dirty[candle] = true
+		updated = append(updated, *candle)
+	}
+
+	return updated
+}
+
+func newKline(marketID string, interval Interval, openTime time.Time, price decimal.Decimal) *models.Kline {
+	return &models.Kline{
+		MarketID:    marketID,
+		Interval:    string(interval),
+		OpenTime:    openTime,
+		CloseTime:   openTime.Add(interval.Duration()),
+		Open:        price,
+		High:        price,
+		Low:         price,
+		Close:       price,
+		Volume:      decimal.Zero,
+		QuoteVolume: decimal.Zero,
+	}
+}
+
+func addToKline(candle *models.Kline, price, size decimal.Decimal) {
+	if price.GreaterThan(candle.High) {
+		candle.High = price
+	}
+	if price.LessThan(candle.Low) {
+		candle.Low = price
+	}
+	candle.Close = price
+	candle.Volume = candle.Volume.Add(size)
+	candle.QuoteVolume = candle.QuoteVolume.Add(price.Mul(size))
+	candle.TradeCount++
+}
+
+// Run persists closed candles and refreshes open ones in Redis until the
+// context is cancelled
+func (k *Klines) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.flushInterval)
+	defer ticker.Stop()
+
+	prune := time.NewTicker(klinePruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			k.flush(time.Now())
+			return
+		case now := <-ticker.C:
+			k.flush(now)
+		case now := <-prune.C:
+			k.prune(now)
+		}
+	}
+}
+
+// flush closes candles whose window has ended, writes closed candles to the
+// database and caches the open ones
+func (k *Klines) flush(now time.Time) {
+	k.mu.Lock()
+	for _, candles := range k.open {
+		for interval, candle := range candles {
+			if !candle.CloseTime.After(now) {
+				k.closed = append(k.closed, candle)
+				delete(k.dirty, candle)
+				delete(candles, interval)
+			}
+		}
+	}
+
+	closed := k.closed
+	k.closed = nil
+
+	open := make([]models.Kline, 0, len(k.dirty))
+	for candle := range k.dirty {
+		open = append(open, *candle)
+	}
+	k.dirty = make(map[*models.Kline]bool)
+	k.mu.Unlock()
+
+	if len(closed) > 0 {
+		if err := k.save(closed); err != nil {
+			logrus.Errorf("Failed to persist %d klines: %v", len(closed), err)
+
+			// keep them for the next flush
+			k.mu.Lock()
+			k.closed = append(closed, k.closed...)
+			k.mu.Unlock()
+		}
+	}
+
+	for i := range open {
+		candle := &open[i]
+		key := fmt.Sprintf(cache.KeyKlineData, candle.MarketID, candle.Interval)
+		if err := cache.Set(key, candle, cache.ExpireKlineData); err != nil {
+			logrus.Errorf("Failed to cache kline %s: %v", key, err)
+		}
+	}
+}
+
+// save upserts candles on (market_id, interval, open_time)
+func (k *Klines) save(candles []*models.Kline) error {
+	if k.db == nil {
+		return nil
+	}
+
+	return k.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "market_id"}, {Name: "interval"}, {Name: "open_time"}},
+		DoUpdates: clause.AssignmentColumns([]string{"close_time", "open", "high", "low", "close", "volume", "quote_volume", "trade_count", "updated_at"}),
+	}).CreateInBatches(candles, 500).Error
+}
+
+// prune deletes closed candles older than the configured retention
+func (k *Klines) prune(now time.Time) {
+	if k.db == nil || k.retention <= 0 {
+		return
+	}
+
+	result := k.db.Where("close_time < ?", now.Add(-k.retention)).Delete(&models.Kline{})
+	if result.Error != nil {
+		logrus.Errorf("Failed to prune klines: %v", result.Error)
+		return
+	}
+
+	if result.RowsAffected > 0 {
+		logrus.Infof("Pruned %d klines older than %s", result.RowsAffected, k.retention)
+	}
+}
+
+// Query returns up to limit candles ordered by open time. With a start time
+// the earliest candles from start are returned, otherwise the latest ones up
+// to end. Zero times leave that side of the range open.
+func (k *Klines) Query(marketID string, interval Interval, start, end time.Time, limit int) ([]models.Kline, error) {
+	byOpenTime := make(map[int64]models.Kline)
+
+	if k.db != nil {
+		query := k.db.Where(&models.Kline{MarketID: marketID, Interval: string(interval)})
+		if !start.IsZero() {
+			query = query.Where("open_time >= ?", start)
+		}
+		if !end.IsZero() {
+			query = query.Where("open_time <= ?", end)
+		}
+		if start.IsZero() {
+			query = query.Order("open_time DESC")
+		} else {
+			query = query.Order("open_time ASC")
+		}
+
+		var rows []models.Kline
+		if err := query.Limit(limit).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			byOpenTime[row.OpenTime.Unix()] = row
+		}
+	}
+
+	// candles that are still open or not persisted yet
+	inRange := func(candle *models.Kline) bool {
+		return candle.MarketID == marketID && candle.Interval == string(interval) &&
+			(start.IsZero() || !candle.OpenTime.Before(start)) &&
+			(end.IsZero() || !candle.OpenTime.After(end))
+	}
+
+	k.mu.Lock()
+	for _, candle := range k.closed {
+		if inRange(candle) {
+			byOpenTime[candle.OpenTime.Unix()] = *candle
+		}
+	}
+	if candle, ok := k.open[marketID][interval]; ok && inRange(candle) {
+		byOpenTime[candle.OpenTime.Unix()] = *candle
+	}
+	k.mu.Unlock()
+
+	result := make([]models.Kline, 0, len(byOpenTime))
+	for _, candle := range byOpenTime {
+		result = append(result, candle)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].OpenTime.Before(result[j].OpenTime)
+	})
+
+	if len(result) > limit {
+		if start.IsZero() {
+			result = result[len(result)-limit:]
+		} else {
+			result = result[:limit]
+		}
+	}
+
+	return result, nil
+}
+
+// Rebuild recomputes every interval for a market from the trades table. The
+// range is widened to whole weeks so that no candle is rebuilt from a partial
+// window; candles that are still open are left to the live aggregation.
+func (k *Klines) Rebuild(ctx context.Context, marketID string, from, to time.Time) (int, error) {
+	if k.db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+
+	now := time.Now().UTC()
+	from = Interval1w.OpenTime(from)
+	to = Interval1w.OpenTime(to).Add(Interval1w.Duration())
+	if to.After(now) {
+		to = now
+	}
+
+	candles := make(map[Interval]*models.Kline, len(Intervals))
+	finished := make([]*models.Kline, 0)
+	rebuilt := 0
+
+	flushFinished := func() error {
+		if len(finished) == 0 {
+			return nil
+		}
+		if err := k.save(finished); err != nil {
+			return err
+		}
+		rebuilt += len(finished)
+		finished = finished[:0]
+		return nil
+	}
+
+	// trades are paged by primary key, which follows execution order
+	var batch []models.Trade
+	err := k.db.WithContext(ctx).
+		Where("market_id = ? AND created_at >= ? AND created_at < ?", marketID, from, to).
+		FindInBatches(&batch, klineRebuildBatch, func(tx *gorm.DB, _ int) error {
+			for _, trade := range batch {
+				for _, interval := range Intervals {
+					openTime := interval.OpenTime(trade.CreatedAt)
+
+					candle := candles[interval]
+					if candle != nil && openTime.After(candle.OpenTime) {
+						finished = append(finished, candle)
+						candle = nil
+					}
+					if candle == nil {
+						candle = newKline(marketID, interval, openTime, trade.Price)
+						candles[interval] = candle
+					}
+
+					addToKline(candle, trade.Price, trade.Size)
+				}
+			}
+
+			return flushFinished()
+		}).Error
+	if err != nil {
+		return rebuilt, err
+	}
+
+	for _, candle := range candles {
+		if !candle.CloseTime.After(to) {
+			finished = append(finished, candle)
+		}
+	}
+
+	return rebuilt, flushFinished()
+}
@@ -0,0 +1,229 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/database/databasetest"
+	"bixor-engine/pkg/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+const testMarket = "BTC-USDT"
+
+type KlinesTestSuite struct {
+	suite.Suite
+	db     *gorm.DB
+	klines *Klines
+
+	// a Monday
+	monday time.Time
+}
+
+func TestKlinesTestSuite(t *testing.T) {
+	suite.Run(t, new(KlinesTestSuite))
+}
+
+func (suite *KlinesTestSuite) SetupTest() {
+	suite.db = databasetest.Open(suite.T())
+	suite.klines = NewKlines(suite.db, nil, 0)
+	suite.monday = time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+
+	// open candles are cached; nothing listens there
+	client := cache.RedisClient
+	cache.RedisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:0", MaxRetries: -1, DialTimeout: 10 * time.Millisecond})
+	suite.T().Cleanup(func() {
+		cache.RedisClient.Close()
+		cache.RedisClient = client
+	})
+}
+
+func (suite *KlinesTestSuite) trade(at time.Time, price, size int64) *matching.Trade {
+	return &matching.Trade{
+		MarketID:  testMarket,
+		Price:     decimal.NewFromInt(price),
+		Size:      decimal.NewFromInt(size),
+		CreatedAt: at,
+	}
+}
+
+func (suite *KlinesTestSuite) persisted(interval Interval) []models.Kline {
+	var candles []models.Kline
+	suite.Require().NoError(suite.db.Where("market_id = ? AND interval = ?", testMarket, string(interval)).Order("open_time").Find(&candles).Error)
+	return candles
+}
+
+func (suite *KlinesTestSuite) TestOpenTime() {
+	at := time.Date(2026, 1, 8, 14, 34, 56, 0, time.UTC) // a Thursday
+
+	tests := []struct {
+		interval Interval
+		at       time.Time
+		open     time.Time
+	}{
+		{Interval1m, at, time.Date(2026, 1, 8, 14, 34, 0, 0, time.UTC)},
+		{Interval5m, at, time.Date(2026, 1, 8, 14, 30, 0, 0, time.UTC)},
+		{Interval15m, at, time.Date(2026, 1, 8, 14, 30, 0, 0, time.UTC)},
+		{Interval1h, at, time.Date(2026, 1, 8, 14, 0, 0, 0, time.UTC)},
+		{Interval4h, at, time.Date(2026, 1, 8, 12, 0, 0, 0, time.UTC)},
+		{Interval1d, at, time.Date(2026, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{Interval1d, at.In(time.FixedZone("UTC+9", 9*3600)), time.Date(2026, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{Interval1w, at, suite.monday},
+		{Interval1w, suite.monday, suite.monday},
+		{Interval1w, suite.monday.Add(-time.Nanosecond), suite.monday.AddDate(0, 0, -7)},
+		{Interval1w, suite.monday.AddDate(0, 0, 7).Add(-time.Second), suite.monday},
+		{Interval1w, time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		suite.Run(fmt.Sprintf("%s at %s", tt.interval, tt.at.Format(time.RFC3339Nano)), func() {
+			open := tt.interval.OpenTime(tt.at)
+			suite.True(open.Equal(tt.open), open.String())
+			suite.Equal(time.UTC, open.Location())
+		})
+	}
+}
+
+func (suite *KlinesTestSuite) TestClosingAndPersisting() {
+	start := suite.monday.Add(12 * time.Hour)
+	suite.klines.PublishTrades(
+		suite.trade(start.Add(10*time.Second), 100, 1),
+		suite.trade(start.Add(50*time.Second), 105, 2),
+	)
+	// a fill in the next minute closes the first one
+	suite.klines.PublishTrades(suite.trade(start.Add(65*time.Second), 95, 1))
+
+	suite.klines.flush(start.Add(90 * time.Second))
+	candles := suite.persisted(Interval1m)
+	suite.Require().Len(candles, 1)
+	candle := candles[0]
+	suite.True(candle.OpenTime.Equal(start))
+	suite.True(candle.CloseTime.Equal(start.Add(time.Minute)))
+	suite.Equal("100", candle.Open.String())
+	suite.Equal("105", candle.High.String())
+	suite.Equal("100", candle.Low.String())
+	suite.Equal("105", candle.Close.String())
+	suite.Equal("3", candle.Volume.String())
+	suite.Equal("310", candle.QuoteVolume.String())
+	suite.Equal(int64(2), candle.TradeCount)
+	suite.Empty(suite.persisted(Interval5m))
+
+	// the second minute closes once its window has passed
+	suite.klines.flush(start.Add(2 * time.Minute))
+	suite.Len(suite.persisted(Interval1m), 2)
+	suite.Empty(suite.persisted(Interval5m))
+
+	// the 5m candle spans all three fills
+	suite.klines.flush(start.Add(5 * time.Minute))
+	candles = suite.persisted(Interval5m)
+	suite.Require().Len(candles, 1)
+	suite.Equal("105", candles[0].High.String())
+	suite.Equal("95", candles[0].Low.String())
+	suite.Equal("95", candles[0].Close.String())
+	suite.Equal("4", candles[0].Volume.String())
+	suite.Equal(int64(3), candles[0].TradeCount)
+}
+
+func (suite *KlinesTestSuite) TestQueryPaging() {
+	// ten persisted minutes and an open one after them
+	var candles []*models.Kline
+	for i := 0; i < 10; i++ {
+		candles = append(candles, newKline(testMarket, Interval1m, suite.monday.Add(time.Duration(i)*time.Minute), decimal.NewFromInt(int64(100+i))))
+	}
+	suite.Require().NoError(suite.klines.save(candles))
+	suite.klines.PublishTrades(suite.trade(suite.monday.Add(10*time.Minute), 110, 1))
+
+	minute := func(i int) time.Time { return suite.monday.Add(time.Duration(i) * time.Minute) }
+	tests := []struct {
+		name       string
+		start, end time.Time
+		limit      int
+		minutes    []int
+	}{
+		{"the earliest from start", minute(2), time.Time{}, 3, []int{2, 3, 4}},
+		{"the latest up to end", time.Time{}, minute(8), 3, []int{6, 7, 8}},
+		{"the latest including the open candle", time.Time{}, time.Time{}, 2, []int{9, 10}},
+		{"between start and end", minute(8), minute(10), 10, []int{8, 9, 10}},
+		{"past the last candle", minute(11), time.Time{}, 10, []int{}},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			result, err := suite.klines.Query(testMarket, Interval1m, tt.start, tt.end, tt.limit)
+			suite.Require().NoError(err)
+
+			minutes := []int{}
+			for _, candle := range result {
+				minutes = append(minutes, int(candle.OpenTime.Sub(suite.monday)/time.Minute))
+			}
+			suite.Equal(tt.minutes, minutes)
+		})
+	}
+}
+
+func (suite *KlinesTestSuite) TestRebuild() {
+	// one fill a minute from Monday midnight, more than one batch of them
+	n := klineRebuildBatch + 5
+	trades := make([]models.Trade, 0, n+1)
+	for i := 0; i < n; i++ {
+		trades = append(trades, models.Trade{
+			MarketID:     testMarket,
+			TakerOrderID: "taker",
+			MakerOrderID: "maker",
+			Price:        decimal.NewFromInt(int64(100 + i%10)),
+			Size:         decimal.NewFromInt(1),
+			TakerSide:    models.OrderSideBuy,
+			CreatedAt:    suite.monday.Add(time.Duration(i)*time.Minute + time.Second),
+		})
+	}
+	trades = append(trades, models.Trade{MarketID: "ETH-USDT", TakerOrderID: "taker", MakerOrderID: "maker", Price: decimal.NewFromInt(1), Size: decimal.NewFromInt(1), TakerSide: models.OrderSideBuy, CreatedAt: suite.monday})
+	suite.Require().NoError(suite.db.CreateInBatches(trades, 500).Error)
+
+	// a stale candle is overwritten
+	stale := newKline(testMarket, Interval1m, suite.monday, decimal.NewFromInt(1))
+	stale.Volume = decimal.NewFromInt(999)
+	suite.Require().NoError(suite.klines.save([]*models.Kline{stale}))
+
+	// the range widens to the whole week
+	rebuilt, err := suite.klines.Rebuild(context.Background(), testMarket, suite.monday.Add(36*time.Hour), suite.monday.Add(36*time.Hour))
+	suite.Require().NoError(err)
+
+	hours := (n + 59) / 60
+	counts := map[Interval]int{
+		Interval1m:  n,
+		Interval5m:  (n + 4) / 5,
+		Interval15m: (n + 14) / 15,
+		Interval1h:  hours,
+		Interval4h:  (hours + 3) / 4,
+		Interval1d:  1,
+		Interval1w:  1,
+	}
+	total := 0
+	for interval, count := range counts {
+		suite.Len(suite.persisted(interval), count, "%s candles", interval)
+		total += count
+	}
+	suite.Equal(total, rebuilt)
+
+	first := suite.persisted(Interval1m)[0]
+	suite.Equal("1", first.Volume.String())
+	suite.Equal("100", first.Open.String())
+
+	hour := suite.persisted(Interval1h)[0]
+	suite.Equal("60", hour.Volume.String())
+	suite.Equal("100", hour.Low.String())
+	suite.Equal("109", hour.High.String())
+
+	week := suite.persisted(Interval1w)[0]
+	suite.True(week.OpenTime.Equal(suite.monday))
+	suite.Equal(int64(n), week.TradeCount)
+
+	var other int64
+	suite.Require().NoError(suite.db.Model(&models.Kline{}).Where("market_id <> ?", testMarket).Count(&other).Error)
+	suite.Zero(other)
+}
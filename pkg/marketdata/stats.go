@@ -0,0 +1,333 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/models"
+	wsocket "bixor-engine/pkg/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// StatsWindow is the length of the rolling statistics window
+	StatsWindow = 24 * time.Hour
+
+	// DefaultStatsFlushInterval is how often statistics are persisted to
+	// market_data, cached and published
+	DefaultStatsFlushInterval = 5 * time.Second
+
+	statsBucketSize = time.Minute
+	statsLoadBatch  = 1000
+)
+
+var hundred = decimal.NewFromInt(100)
+
+// MarketStats is a rolling 24h summary of a market's trades
+type MarketStats struct {
+	MarketID           string          `json:"market_id"`
+	OpenPrice          decimal.Decimal `json:"open_24h"`
+	HighPrice          decimal.Decimal `json:"high_24h"`
+	LowPrice           decimal.Decimal `json:"low_24h"`
+	LastPrice          decimal.Decimal `json:"last_price"`
+	PriceChange        decimal.Decimal `json:"price_change"`
+	PriceChangePercent decimal.Decimal `json:"price_change_percent"`
+	Volume             decimal.Decimal `json:"volume_24h"`       // base asset
+	QuoteVolume        decimal.Decimal `json:"quote_volume_24h"` // quote asset
+	TradeCount         int64           `json:"trade_count"`
+	Timestamp          time.Time       `json:"timestamp"`
+}
+
+// statsBucket aggregates the trades of one minute
+type statsBucket struct {
+	minute      time.Time
+	open        decimal.Decimal
+	high        decimal.Decimal
+	low         decimal.Decimal
+	volume      decimal.Decimal
+	quoteVolume decimal.Decimal
+	count       int64
+}
+
+// statsWindow holds a market's minute buckets in ascending order, plus the
+// last traded price, which outlives the window
+type statsWindow struct {
+	buckets   []*statsBucket
+	lastPrice decimal.Decimal
+	lastTime  time.Time
+}
+
+// Stats maintains rolling 24h statistics per market from engine fills. The
+// window moves in one-minute steps, so a trade leaves it between 24h and
+// 24h+1m after execution.
+type Stats struct {
+	db            *gorm.DB
+	hub           *wsocket.WebSocketHub
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*statsWindow
+	dirty   map[string]bool
+}
+
+// NewStats creates a new rolling statistics aggregator
+func NewStats(db *gorm.DB, hub *wsocket.WebSocketHub) *Stats {
+	return &Stats{
+		db:            db,
+		hub:           hub,
+		flushInterval: DefaultStatsFlushInterval,
+		windows:       make(map[string]*statsWindow),
+		dirty:         make(map[string]bool),
+	}
+}
+
+// PublishTrades implements matching.PublishTrader
+func (s *Stats) PublishTrades(trades ...*matching.Trade) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, trade := range trades {
+		if trade.IsCancel || len(trade.MarketID) == 0 {
+			continue
+		}
+
+		s.apply(trade.MarketID, trade.Price, trade.Size, trade.CreatedAt)
+	}
+}
+
+// apply adds one fill to a market's window. The caller must hold s.mu.
+func (s *Stats) apply(marketID string, price, size decimal.Decimal, at time.Time) {
+	window, ok := s.windows[marketID]
+	if !ok {
+		window = &statsWindow{}
+		s.windows[marketID] = window
+	}
+
+	minute := at.UTC().Truncate(statsBucketSize)
+
+	// fills arrive in order, so the bucket is almost always the last one
+	i := len(window.buckets)
+	for i > 0 && window.buckets[i-1].minute.After(minute) {
+		i--
+	}
+
+	var bucket *statsBucket
+	if i > 0 && window.buckets[i-1].minute.Equal(minute) {
+		bucket = window.buckets[i-1]
+	} else {
+		bucket = &statsBucket{
+			minute:      minute,
+			open:        price,
+			high:        price,
+			low:         price,
+			volume:      decimal.Zero,
+			quoteVolume: decimal.Zero,
+		}
+		window.buckets = append(window.buckets, nil)
+		copy(window.buckets[i+1:], window.buckets[i:])
+		window.buckets[i] = bucket
+	}
+
+	if price.GreaterThan(bucket.high) {
+		bucket.high = price
+	}
+	if price.LessThan(bucket.low) {
+		bucket.low = price
+	}
+	bucket.volume = bucket.volume.Add(size)
+	bucket.quoteVolume = bucket.quoteVolume.Add(price.Mul(size))
+	bucket.count++
+
+	if !at.Before(window.lastTime) {
+		window.lastPrice = price
+		window.lastTime = at
+	}
+
+	s.dirty[marketID] = true
+}
+
+// Get returns the statistics of a market as of now. Markets without any
+// trades yet return zero values.
+func (s *Stats) Get(marketID string, now time.Time) MarketStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	window, ok := s.windows[marketID]
+	if !ok {
+		return emptyMarketStats(marketID, now)
+	}
+
+	return window.stats(marketID, now)
+}
+
+func emptyMarketStats(marketID string, now time.Time) MarketStats {
+	return MarketStats{
+		MarketID:           marketID,
+		OpenPrice:          decimal.Zero,
+		HighPrice:          decimal.Zero,
+		LowPrice:           decimal.Zero,
+		LastPrice:          decimal.Zero,
+		PriceChange:        decimal.Zero,
+		PriceChangePercent: decimal.Zero,
+		Volume:             decimal.Zero,
+		QuoteVolume:        decimal.Zero,
+		Timestamp:          now,
+	}
+}
+
+// stats summarizes the buckets that overlap the 24h window ending at now
+func (w *statsWindow) stats(marketID string, now time.Time) MarketStats {
+	result := emptyMarketStats(marketID, now)
+	result.LastPrice = w.lastPrice
+
+	cutoff := now.Add(-StatsWindow)
+	first := true
+	for _, bucket := range w.buckets {
+		if !bucket.minute.Add(statsBucketSize).After(cutoff) || bucket.minute.After(now) {
+			continue
+		}
+
+		if first {
+			result.OpenPrice = bucket.open
+			result.HighPrice = bucket.high
+			result.LowPrice = bucket.low
+			first = false
+		} else {
+			if bucket.high.GreaterThan(result.HighPrice) {
+				result.HighPrice = bucket.high
+			}
+			if bucket.low.LessThan(result.LowPrice) {
+				result.LowPrice = bucket.low
+			}
+		}
+
+		result.Volume = result.Volume.Add(bucket.volume)
+		result.QuoteVolume = result.QuoteVolume.Add(bucket.quoteVolume)
+		result.TradeCount += bucket.count
+	}
+
+	// no trades in the window: the market is flat at its last price
+	if first {
+		result.OpenPrice = w.lastPrice
+		result.HighPrice = w.lastPrice
+		result.LowPrice = w.lastPrice
+		return result
+	}
+
+	result.PriceChange = result.LastPrice.Sub(result.OpenPrice)
+	if !result.OpenPrice.IsZero() {
+		result.PriceChangePercent = result.PriceChange.Div(result.OpenPrice).Mul(hundred).Round(4)
+	}
+
+	return result
+}
+
+// evict drops buckets that have left the window. The caller must hold s.mu.
+func (s *Stats) evict(now time.Time) {
+	cutoff := now.Add(-StatsWindow)
+	for marketID, window := range s.windows {
+		i := 0
+		for i < len(window.buckets) && !window.buckets[i].minute.Add(statsBucketSize).After(cutoff) {
+			i++
+		}
+		if i == 0 {
+			continue
+		}
+
+		window.buckets = append(window.buckets[:0], window.buckets[i:]...)
+
+		// the window changed even though nothing traded
+		s.dirty[marketID] = true
+	}
+}
+
+// Load seeds the windows from the trades table so statistics survive a
+// restart. It should run before the engine starts publishing fills.
+func (s *Stats) Load(ctx context.Context, now time.Time) error {
+	if s.db == nil {
+		return nil
+	}
+
+	var batch []models.Trade
+	return s.db.WithContext(ctx).
+		Where("created_at >= ?", now.Add(-StatsWindow).Truncate(statsBucketSize)).
+		FindInBatches(&batch, statsLoadBatch, func(tx *gorm.DB, _ int) error {
+			s.mu.Lock()
+			for _, trade := range batch {
+				s.apply(trade.MarketID, trade.Price, trade.Size, trade.CreatedAt)
+			}
+			s.mu.Unlock()
+			return nil
+		}).Error
+}
+
+// Run periodically persists, caches and publishes statistics until the
+// context is cancelled
+func (s *Stats) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush(time.Now())
+			return
+		case now := <-ticker.C:
+			s.flush(now)
+		}
+	}
+}
+
+// flush handles every market whose window changed since the last flush
+func (s *Stats) flush(now time.Time) {
+	s.mu.Lock()
+	s.evict(now)
+	changed := make([]MarketStats, 0, len(s.dirty))
+	for marketID := range s.dirty {
+		changed = append(changed, s.windows[marketID].stats(marketID, now))
+	}
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+
+	for i := range changed {
+		stats := &changed[i]
+
+		if err := s.saveMarketData(stats); err != nil {
+			logrus.Errorf("Failed to update market stats for %s: %v", stats.MarketID, err)
+		}
+
+		key := fmt.Sprintf(cache.KeyMarketStats, stats.MarketID)
+		if err := cache.Set(key, stats, cache.ExpireMarketStats); err != nil {
+			logrus.Errorf("Failed to cache market stats for %s: %v", stats.MarketID, err)
+		}
+
+		if s.hub != nil {
+			s.hub.BroadcastMarketStats(stats.MarketID, stats)
+		}
+	}
+}
+
+// saveMarketData upserts the 24h columns of a market_data row
+func (s *Stats) saveMarketData(stats *MarketStats) error {
+	if s.db == nil {
+		return nil
+	}
+
+	var row models.MarketData
+	return s.db.Where(models.MarketData{MarketID: stats.MarketID}).
+		Assign(map[string]interface{}{
+			"price":      stats.LastPrice,
+			"volume_24h": stats.Volume,
+			"high_24h":   stats.HighPrice,
+			"low_24h":    stats.LowPrice,
+			"change_24h": stats.PriceChangePercent,
+			"updated_at": stats.Timestamp,
+		}).
+		FirstOrCreate(&row).Error
+}
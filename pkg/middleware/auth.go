@@ -131,6 +131,22 @@ func (am *AuthMiddleware) APIKeyAuth() gin.HandlerFunc {
 	}
 }
 
+// TradingAuth middleware authenticates with an API key when the request
+// carries one and with a JWT otherwise, so orders placed through a key are
+// attributed to it
+func (am *AuthMiddleware) TradingAuth() gin.HandlerFunc {
+	jwtAuth := am.JWTAuth()
+	apiKeyAuth := am.APIKeyAuth()
+
+	return func(c *gin.Context) {
+		if c.GetHeader("X-API-Key") != "" {
+			apiKeyAuth(c)
+			return
+		}
+		jwtAuth(c)
+	}
+}
+
 // OptionalAuth middleware that allows both authenticated and unauthenticated access
 func (am *AuthMiddleware) OptionalAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
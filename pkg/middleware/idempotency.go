@@ -0,0 +1,280 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/models"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// IdempotencyKeyHeader is the request header that makes a mutating request
+// safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	// idempotencyTTL is how long the response to a key is replayed
+	idempotencyTTL = 24 * time.Hour
+
+	// idempotencyLockTTL frees a key whose first request never finished,
+	// e.g. because the server stopped while handling it
+	idempotencyLockTTL = time.Minute
+
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotentResponse is what is stored for a key: the request it was first
+// used with and, once that finished, the response to replay
+type idempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	StatusCode  int    `json:"status_code"` // 0 while the first request is in flight
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// IdempotencyMiddleware replays the stored response to a repeated request
+// with the same Idempotency-Key, so a client can retry an order placement
+// after a timeout without placing it twice
+type IdempotencyMiddleware struct {
+	cache *cache.RedisCache
+	db    *gorm.DB
+}
+
+// NewIdempotencyMiddleware creates a new idempotency middleware
+func NewIdempotencyMiddleware(cache *cache.RedisCache, db *gorm.DB) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		cache: cache,
+		db:    db,
+	}
+}
+
+// Idempotent honours the Idempotency-Key header of POST, PUT, PATCH and
+// DELETE requests. Keys are scoped to the authenticated user, so it runs
+// after authentication. A repeated key with the same method, path and body
+// gets the first response again; one with a different request is rejected
+// with 422, and one whose first request is still running with 409. Server
+// errors are not stored, so the request can be retried.
+func (im *IdempotencyMiddleware) Idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idempotencyKey := c.GetHeader(IdempotencyKeyHeader)
+		if idempotencyKey == "" || !isMutating(c.Request.Method) {
+			c.Next()
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength)})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := fmt.Sprintf("idempotency:%s:%s", idempotencyScope(c), idempotencyKey)
+		fingerprint := requestFingerprint(c.Request, body)
+
+		previous, useRedis, err := im.claim(key, fingerprint)
+		if err != nil {
+			// As with rate limiting, the request goes ahead rather than
+			// failing because the store is unavailable
+			c.Next()
+			return
+		}
+
+		if previous != nil {
+			switch {
+			case previous.Fingerprint != fingerprint:
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			case previous.StatusCode == 0:
+				c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(previous.StatusCode, previous.ContentType, previous.Body)
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		if recorder.Status() >= http.StatusInternalServerError {
+			im.release(key, useRedis)
+			return
+		}
+		im.save(key, useRedis, &idempotentResponse{
+			Fingerprint: fingerprint,
+			StatusCode:  recorder.Status(),
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		})
+	}
+}
+
+// claim marks key as in flight for the request with fingerprint. It returns
+// the stored record instead if the key was used before, and whether Redis
+// holds the key; the database is used when Redis is unavailable.
+func (im *IdempotencyMiddleware) claim(key, fingerprint string) (*idempotentResponse, bool, error) {
+	// Try Redis first for better performance
+	if im.cache != nil {
+		previous, err := im.claimRedis(key, fingerprint)
+		if err == nil {
+			return previous, true, nil
+		}
+		// If Redis fails, fall back to database
+	}
+
+	previous, err := im.claimDB(key, fingerprint)
+	return previous, false, err
+}
+
+// claimRedis claims key in Redis
+func (im *IdempotencyMiddleware) claimRedis(key, fingerprint string) (*idempotentResponse, error) {
+	client, ctx := im.cache.Client(), im.cache.Context()
+
+	data, err := json.Marshal(&idempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := client.SetNX(ctx, key, data, idempotencyLockTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	stored, err := client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// it expired in between, so treat it as still in flight
+		return &idempotentResponse{Fingerprint: fingerprint}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var previous idempotentResponse
+	if err := json.Unmarshal(stored, &previous); err != nil {
+		return nil, err
+	}
+	return &previous, nil
+}
+
+// claimDB claims key in the database
+func (im *IdempotencyMiddleware) claimDB(key, fingerprint string) (*idempotentResponse, error) {
+	now := time.Now()
+
+	// Clean up an expired record of the key
+	im.db.Where("key = ? AND expires_at < ?", key, now).Delete(&models.IdempotencyKey{})
+
+	err := im.db.Create(&models.IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+		ExpiresAt:   now.Add(idempotencyLockTTL),
+	}).Error
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, err
+	}
+
+	var record models.IdempotencyKey
+	if err := im.db.Where("key = ?", key).First(&record).Error; err != nil {
+		return nil, err
+	}
+	return &idempotentResponse{
+		Fingerprint: record.Fingerprint,
+		StatusCode:  record.StatusCode,
+		ContentType: record.ContentType,
+		Body:        record.Body,
+	}, nil
+}
+
+// save stores the response to replay for key
+func (im *IdempotencyMiddleware) save(key string, useRedis bool, response *idempotentResponse) {
+	if useRedis {
+		data, err := json.Marshal(response)
+		if err == nil {
+			im.cache.Client().Set(im.cache.Context(), key, data, idempotencyTTL)
+		}
+		return
+	}
+
+	im.db.Model(&models.IdempotencyKey{}).Where("key = ?", key).Updates(map[string]interface{}{
+		"status_code":  response.StatusCode,
+		"content_type": response.ContentType,
+		"body":         response.Body,
+		"expires_at":   time.Now().Add(idempotencyTTL),
+	})
+}
+
+// release frees key so the request can be retried
+func (im *IdempotencyMiddleware) release(key string, useRedis bool) {
+	if useRedis {
+		im.cache.Client().Del(im.cache.Context(), key)
+		return
+	}
+
+	im.db.Where("key = ?", key).Delete(&models.IdempotencyKey{})
+}
+
+// idempotencyScope keeps the keys of different users apart
+func idempotencyScope(c *gin.Context) string {
+	if userID, exists := c.Get("user_id"); exists {
+		return fmt.Sprintf("user:%v", userID)
+	}
+	return c.ClientIP()
+}
+
+// requestFingerprint identifies a request by its method, path, query and
+// body
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(r.URL.RequestURI()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// responseRecorder keeps a copy of the response body as it is written
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
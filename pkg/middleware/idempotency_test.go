@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bixor-engine/pkg/database/databasetest"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+// IdempotencyTestSuite runs the middleware without Redis, on its database
+// fallback
+type IdempotencyTestSuite struct {
+	suite.Suite
+	router *gin.Engine
+
+	mu     sync.Mutex
+	calls  int
+	status int
+	block  chan struct{} // holds the handler while set
+}
+
+func TestIdempotencyTestSuite(t *testing.T) {
+	suite.Run(t, new(IdempotencyTestSuite))
+}
+
+// setup gives the running test its own database and a handler that counts
+// its calls
+func (suite *IdempotencyTestSuite) setup() {
+	gin.SetMode(gin.TestMode)
+	db := databasetest.Open(suite.T())
+	suite.calls, suite.status, suite.block = 0, http.StatusCreated, nil
+
+	suite.router = gin.New()
+	suite.router.POST("/orders", func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-User"))
+	}, NewIdempotencyMiddleware(nil, db).Idempotent(), func(c *gin.Context) {
+		suite.mu.Lock()
+		suite.calls++
+		calls, status, block := suite.calls, suite.status, suite.block
+		suite.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+		c.JSON(status, gin.H{"call": calls})
+	})
+}
+
+type idempotentRequest struct {
+	user string
+	key  string
+	body string
+}
+
+func (suite *IdempotencyTestSuite) send(req idempotentRequest) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(req.body))
+	r.Header.Set("X-User", req.user)
+	if req.key != "" {
+		r.Header.Set(IdempotencyKeyHeader, req.key)
+	}
+
+	recorder := httptest.NewRecorder()
+	suite.router.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func (suite *IdempotencyTestSuite) TestRepeatedKey() {
+	first := idempotentRequest{user: "1", key: "key", body: `{"size":"1"}`}
+
+	tests := []struct {
+		name     string
+		firstErr bool
+		second   idempotentRequest
+		status   int
+		body     string
+		replayed bool
+		calls    int
+	}{
+		{"the same request is replayed", false, first, http.StatusCreated, `{"call":1}`, true, 1},
+		{"a different body is rejected", false, idempotentRequest{user: "1", key: "key", body: `{"size":"2"}`}, http.StatusUnprocessableEntity, "", false, 1},
+		{"another user's key is separate", false, idempotentRequest{user: "2", key: "key", body: first.body}, http.StatusCreated, `{"call":2}`, false, 2},
+		{"another key is separate", false, idempotentRequest{user: "1", key: "other", body: first.body}, http.StatusCreated, `{"call":2}`, false, 2},
+		{"requests without a key always run", false, idempotentRequest{user: "1", body: first.body}, http.StatusCreated, `{"call":2}`, false, 2},
+		{"server errors are not stored", true, first, http.StatusCreated, `{"call":2}`, false, 2},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			if tt.firstErr {
+				suite.status = http.StatusInternalServerError
+			}
+			suite.send(first)
+			suite.status = http.StatusCreated
+
+			response := suite.send(tt.second)
+			suite.Equal(tt.status, response.Code)
+			if tt.body != "" {
+				suite.JSONEq(tt.body, response.Body.String())
+			}
+			suite.Equal(tt.replayed, response.Header().Get("Idempotent-Replayed") == "true")
+			suite.Equal(tt.calls, suite.calls)
+		})
+	}
+}
+
+func (suite *IdempotencyTestSuite) TestInFlight() {
+	suite.setup()
+	request := idempotentRequest{user: "1", key: "key", body: `{"size":"1"}`}
+
+	suite.block = make(chan struct{})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- suite.send(request) }()
+	suite.Eventually(func() bool {
+		suite.mu.Lock()
+		defer suite.mu.Unlock()
+		return suite.calls == 1
+	}, time.Second, 10*time.Millisecond)
+
+	suite.Equal(http.StatusConflict, suite.send(request).Code)
+
+	close(suite.block)
+	suite.Equal(http.StatusCreated, (<-done).Code)
+
+	// once it finished, the first response is replayed
+	response := suite.send(request)
+	suite.Equal(http.StatusCreated, response.Code)
+	suite.Equal("true", response.Header().Get("Idempotent-Replayed"))
+	suite.Equal(1, suite.calls)
+}
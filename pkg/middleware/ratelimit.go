@@ -15,11 +15,12 @@ import (
 
 // RateLimitConfig holds rate limiting configuration
 type RateLimitConfig struct {
-	Requests   int           // Number of requests
-	Window     time.Duration // Time window
+	Requests   int                         // Number of requests
+	Window     time.Duration               // Time window
 	KeyFunc    func(c *gin.Context) string // Function to generate rate limit key
-	Message    string        // Error message to return
-	StatusCode int           // HTTP status code to return
+	Message    string                      // Error message to return
+	StatusCode int                         // HTTP status code to return
+	Weight     func(c *gin.Context) int    // Requests one call counts as, 1 if nil
 }
 
 // Default rate limiting configurations
@@ -83,15 +84,28 @@ func (rl *RateLimitMiddleware) TradingRateLimit() gin.HandlerFunc {
 	return rl.RateLimit(TradingRateLimit)
 }
 
+// WeightedTradingRateLimit creates a rate limiting middleware for trading
+// endpoints that do the work of several requests, such as batches. Each call
+// counts as weight requests against the same limit as TradingRateLimit.
+func (rl *RateLimitMiddleware) WeightedTradingRateLimit(weight func(c *gin.Context) int) gin.HandlerFunc {
+	config := TradingRateLimit
+	config.Weight = weight
+	return rl.RateLimit(config)
+}
+
 // RateLimit creates a rate limiting middleware with the given configuration
 func (rl *RateLimitMiddleware) RateLimit(config RateLimitConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		key := config.KeyFunc(c)
 		rateLimitKey := fmt.Sprintf("rate_limit:%s", key)
+		weight := 1
+		if config.Weight != nil {
+			weight = max(config.Weight(c), 1)
+		}
 		
 		// Try Redis first for better performance
 		if rl.cache != nil {
-			allowed, err := rl.checkRateLimitRedis(rateLimitKey, config)
+			allowed, err := rl.checkRateLimitRedis(rateLimitKey, config, weight)
 			if err == nil {
 				if !allowed {
 					c.JSON(config.StatusCode, gin.H{"error": config.Message})
@@ -105,7 +119,7 @@ func (rl *RateLimitMiddleware) RateLimit(config RateLimitConfig) gin.HandlerFunc
 		}
 		
 		// Fallback to database rate limiting
-		allowed, err := rl.checkRateLimitDB(key, config)
+		allowed, err := rl.checkRateLimitDB(key, config, weight)
 		if err != nil {
 			// If rate limiting fails, we'll allow the request but log the error
 			// This ensures the service doesn't become unavailable due to rate limiting issues
@@ -124,7 +138,7 @@ func (rl *RateLimitMiddleware) RateLimit(config RateLimitConfig) gin.HandlerFunc
 }
 
 // checkRateLimitRedis checks rate limiting using Redis
-func (rl *RateLimitMiddleware) checkRateLimitRedis(key string, config RateLimitConfig) (bool, error) {
+func (rl *RateLimitMiddleware) checkRateLimitRedis(key string, config RateLimitConfig, weight int) (bool, error) {
 	// Use Redis sliding window counter
 	now := time.Now().Unix()
 	expiredTime := now - int64(config.Window.Seconds())
@@ -142,15 +156,19 @@ func (rl *RateLimitMiddleware) checkRateLimitRedis(key string, config RateLimitC
 	}
 	
 	// Check if limit exceeded
-	if count >= int64(config.Requests) {
+	if count+int64(weight) > int64(config.Requests) {
 		return false, nil
 	}
 	
-	// Add current request
-	err = rl.cache.Client().ZAdd(rl.cache.Context(), key, &redis.Z{
-		Score:  float64(now),
-		Member: fmt.Sprintf("%d-%d", now, time.Now().UnixNano()),
-	}).Err()
+	// Add current request, once per unit of weight
+	members := make([]*redis.Z, weight)
+	for i := range members {
+		members[i] = &redis.Z{
+			Score:  float64(now),
+			Member: fmt.Sprintf("%d-%d-%d", now, time.Now().UnixNano(), i),
+		}
+	}
+	err = rl.cache.Client().ZAdd(rl.cache.Context(), key, members...).Err()
 	if err != nil {
 		return false, err
 	}
@@ -165,7 +183,7 @@ func (rl *RateLimitMiddleware) checkRateLimitRedis(key string, config RateLimitC
 }
 
 // checkRateLimitDB checks rate limiting using database
-func (rl *RateLimitMiddleware) checkRateLimitDB(key string, config RateLimitConfig) (bool, error) {
+func (rl *RateLimitMiddleware) checkRateLimitDB(key string, config RateLimitConfig, weight int) (bool, error) {
 	now := time.Now()
 	windowStart := now.Add(-config.Window)
 	
@@ -178,10 +196,14 @@ func (rl *RateLimitMiddleware) checkRateLimitDB(key string, config RateLimitConf
 	
 	if result.Error != nil {
 		if result.Error == gorm.ErrRecordNotFound {
+			if weight > config.Requests {
+				return false, nil
+			}
+
 			// Create new rate limit record
 			rateLimit = models.RateLimit{
 				Key:         key,
-				Count:       1,
+				Count:       weight,
 				WindowStart: now,
 			}
 			if err := rl.db.Create(&rateLimit).Error; err != nil {
@@ -193,12 +215,12 @@ func (rl *RateLimitMiddleware) checkRateLimitDB(key string, config RateLimitConf
 	}
 	
 	// Check if rate limit is exceeded
-	if rateLimit.Count >= config.Requests {
+	if rateLimit.Count+weight > config.Requests {
 		return false, nil
 	}
 	
 	// Increment count
-	rateLimit.Count++
+	rateLimit.Count += weight
 	if err := rl.db.Save(&rateLimit).Error; err != nil {
 		return false, err
 	}
@@ -85,6 +85,20 @@ type RateLimit struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// IdempotencyKey is the stored outcome of a request sent with an
+// Idempotency-Key header, used when Redis is unavailable
+type IdempotencyKey struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Key         string    `gorm:"size:320;unique;not null" json:"key"`   // user scope and header value
+	Fingerprint string    `gorm:"size:64;not null" json:"fingerprint"`   // hash of the method, path and body
+	StatusCode  int       `gorm:"not null;default:0" json:"status_code"` // 0 while the first request is in flight
+	ContentType string    `gorm:"size:128" json:"content_type"`
+	Body        []byte    `json:"-"`
+	ExpiresAt   time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
 // UserPassword represents user password hashes
 type UserPassword struct {
 	ID           uint      `gorm:"primaryKey" json:"id"`
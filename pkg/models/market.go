@@ -44,6 +44,24 @@ type MarketData struct {
 	Market Market `gorm:"foreignKey:MarketID" json:"-"`
 }
 
+// Kline represents an OHLCV candlestick built from executed trades
+type Kline struct {
+	ID          uint            `gorm:"primaryKey" json:"-"`
+	MarketID    string          `gorm:"not null;uniqueIndex:idx_klines_market_interval_open" json:"market_id"`
+	Interval    string          `gorm:"not null;size:4;uniqueIndex:idx_klines_market_interval_open" json:"interval"`
+	OpenTime    time.Time       `gorm:"not null;uniqueIndex:idx_klines_market_interval_open" json:"open_time"`
+	CloseTime   time.Time       `gorm:"not null;index" json:"close_time"`
+	Open        decimal.Decimal `gorm:"type:decimal(20,8);not null" json:"open"`
+	High        decimal.Decimal `gorm:"type:decimal(20,8);not null" json:"high"`
+	Low         decimal.Decimal `gorm:"type:decimal(20,8);not null" json:"low"`
+	Close       decimal.Decimal `gorm:"type:decimal(20,8);not null" json:"close"`
+	Volume      decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"volume"`       // base asset
+	QuoteVolume decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"quote_volume"` // quote asset
+	TradeCount  int64           `gorm:"default:0" json:"trade_count"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
 // TableName methods
 func (Market) TableName() string     { return "markets" }
-func (MarketData) TableName() string { return "market_data" } 
\ No newline at end of file
+func (MarketData) TableName() string { return "market_data" }
+func (Kline) TableName() string      { return "klines" }
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// RiskLimit holds pre-trade limits. A zero UserID applies the row to every
+// user and an empty MarketID to every market. Each limit is taken from the
+// most specific row that sets it, in the order user and market, user,
+// market, global. Zero values leave a limit unset.
+type RiskLimit struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	UserID   uint   `gorm:"not null;default:0;uniqueIndex:idx_risk_limits_scope" json:"user_id"`
+	MarketID string `gorm:"not null;default:'';uniqueIndex:idx_risk_limits_scope" json:"market_id"`
+
+	// MaxOrderNotional caps price times size of one order in the quote
+	// asset. Market orders are sized in the quote asset already.
+	MaxOrderNotional decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"max_order_notional"`
+	// MaxOpenOrders caps the pending and open orders of a user in a market
+	MaxOpenOrders int `gorm:"default:0" json:"max_open_orders"`
+	// MaxPosition caps the base asset a user would hold if every open buy
+	// in the market filled
+	MaxPosition decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"max_position"`
+	// MaxOrdersPerSecond caps how fast a user places orders in a market
+	MaxOrdersPerSecond int `gorm:"default:0" json:"max_orders_per_second"`
+	// PriceBand caps how far a limit price may be from the last trade, as a
+	// fraction of it (0.1 = 10%)
+	PriceBand decimal.Decimal `gorm:"type:decimal(10,4);default:0" json:"price_band"`
+
+	UpdatedBy uint      `json:"updated_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Kill switch scopes
+const (
+	KillSwitchUser   = "user"
+	KillSwitchAPIKey = "api_key"
+	KillSwitchMarket = "market"
+	KillSwitchGlobal = "global"
+)
+
+// KillSwitch is one activation of a kill switch and its release. While it is
+// active no new orders are accepted in its scope: a user ID, an API key ID,
+// a market ID, or everything for the global scope.
+type KillSwitch struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	Scope       string     `gorm:"not null;size:16;index:idx_kill_switches_scope" json:"scope"`
+	Target      string     `gorm:"not null;default:'';index:idx_kill_switches_scope" json:"target"`
+	Reason      string     `gorm:"type:text" json:"reason"`
+	Cancelled   int        `gorm:"default:0" json:"cancelled"` // orders cancelled on activation
+	ActivatedBy uint       `gorm:"not null" json:"activated_by"`
+	ActivatedAt time.Time  `gorm:"not null" json:"activated_at"`
+	ReleasedBy  *uint      `json:"released_by,omitempty"`
+	ReleasedAt  *time.Time `gorm:"index" json:"released_at,omitempty"`
+}
+
+// TableName methods
+func (RiskLimit) TableName() string  { return "risk_limits" }
+func (KillSwitch) TableName() string { return "kill_switches" }
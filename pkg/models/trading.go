@@ -11,6 +11,7 @@ import (
 type OrderStatus string
 
 const (
+	OrderStatusScheduled OrderStatus = "scheduled" // held until its activation time
 	OrderStatusPending   OrderStatus = "pending"
 	OrderStatusOpen      OrderStatus = "open"
 	OrderStatusFilled    OrderStatus = "filled"
@@ -23,11 +24,21 @@ const (
 type OrderType string
 
 const (
-	OrderTypeMarket   OrderType = "market"
-	OrderTypeLimit    OrderType = "limit"
-	OrderTypeIOC      OrderType = "ioc"
-	OrderTypeFOK      OrderType = "fok"
-	OrderTypePostOnly OrderType = "post_only"
+	OrderTypeMarket    OrderType = "market"
+	OrderTypeLimit     OrderType = "limit"
+	OrderTypeIOC       OrderType = "ioc"
+	OrderTypeFOK       OrderType = "fok"
+	OrderTypePostOnly  OrderType = "post_only"
+	OrderTypeStopLimit OrderType = "stop_limit"
+)
+
+// OrderPeg is the price a pegged order follows
+type OrderPeg string
+
+const (
+	OrderPegPrimary  OrderPeg = "primary"  // best bid for a buy, best ask for a sell
+	OrderPegOpposite OrderPeg = "opposite" // best ask for a buy, best bid for a sell
+	OrderPegMidpoint OrderPeg = "midpoint"
 )
 
 // OrderSide represents the side of an order
@@ -41,7 +52,8 @@ const (
 // Order represents a trading order
 type Order struct {
 	ID            string          `gorm:"primaryKey" json:"id"`
-	UserID        uint            `gorm:"not null;index" json:"user_id"`
+	UserID        uint            `gorm:"not null;index;uniqueIndex:idx_orders_open_client_order_id,priority:1" json:"user_id"`
+	ClientOrderID string          `gorm:"size:64;uniqueIndex:idx_orders_open_client_order_id,priority:2,where:client_order_id <> '' AND (status = 'scheduled' OR status = 'pending' OR status = 'open')" json:"client_order_id,omitempty"`
 	MarketID      string          `gorm:"not null;index" json:"market_id"`
 	Side          OrderSide       `gorm:"not null" json:"side"`
 	Type          OrderType       `gorm:"not null" json:"type"`
@@ -51,6 +63,18 @@ type Order struct {
 	FilledSize    decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"filled_size"`
 	RemainingSize decimal.Decimal `gorm:"type:decimal(20,8)" json:"remaining_size"`
 	Fee           decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"fee"`
+	StopPrice     decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"stop_price"` // stop_limit orders
+	Hold          decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"hold"`       // funds still locked for the order
+	APIKeyID      string          `gorm:"size:64;index" json:"api_key_id,omitempty"`      // key the order was placed with
+	ListID        string          `gorm:"size:64;index" json:"list_id,omitempty"`         // order list the order is a leg of
+	AlgoID        string          `gorm:"size:64;index" json:"algo_id,omitempty"`         // algo order the order is a slice of
+	Hidden        bool            `gorm:"default:false" json:"hidden,omitempty"`          // rests out of the public order book
+	Peg           OrderPeg        `gorm:"size:16" json:"peg,omitempty"`                   // the engine moves Price with the book
+	PegOffset     decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"peg_offset"` // added to the pegged price
+	PegLimit      decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"peg_limit"`  // price a pegged order never moves past
+	MinSize       decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"min_size"`   // smallest match the order accepts while resting
+	AllOrNone     bool            `gorm:"default:false" json:"all_or_none,omitempty"`     // the order only trades its whole remaining size
+	ActivateAt    *time.Time      `gorm:"index" json:"activate_at,omitempty"`             // scheduled orders go live at this time
 	CreatedAt     time.Time       `json:"created_at"`
 	UpdatedAt     time.Time       `json:"updated_at"`
 	FilledAt      *time.Time      `json:"filled_at,omitempty"`
@@ -62,6 +86,98 @@ type Order struct {
 	Trades []Trade `gorm:"foreignKey:TakerOrderID;foreignKey:MakerOrderID" json:"trades,omitempty"`
 }
 
+// OrderListType represents the kind of an order list
+type OrderListType string
+
+const (
+	OrderListTypeOCO     OrderListType = "oco"
+	OrderListTypeBracket OrderListType = "bracket" // an entry order whose fills open OCO lists
+)
+
+// OrderListStatus represents the status of an order list
+type OrderListStatus string
+
+const (
+	OrderListStatusOpen      OrderListStatus = "open"      // every leg is working
+	OrderListStatusExecuting OrderListStatus = "executing" // a leg traded or triggered and the others were cancelled
+	OrderListStatusDone      OrderListStatus = "done"
+	OrderListStatusCancelled OrderListStatus = "cancelled"
+	OrderListStatusFailed    OrderListStatus = "failed"
+)
+
+// OrderList links orders that cancel each other, such as the take-profit
+// and stop-loss legs of an OCO. A bracket holds a single entry order and
+// opens a child OCO list, with the prices it records, for each of its fills.
+type OrderList struct {
+	ID              string          `gorm:"primaryKey" json:"id"`
+	UserID          uint            `gorm:"not null;index" json:"user_id"`
+	MarketID        string          `gorm:"not null;index" json:"market_id"`
+	Type            OrderListType   `gorm:"not null" json:"type"`
+	Status          OrderListStatus `gorm:"not null;default:'open'" json:"status"`
+	ParentID        string          `gorm:"size:64;index" json:"parent_id,omitempty"`              // bracket whose fill opened the list
+	TakeProfitPrice decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"take_profit_price"` // brackets
+	StopPrice       decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"stop_price"`        // brackets
+	StopLimitPrice  decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"stop_limit_price"`  // brackets
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+
+	// Relationships. Orders outside a list and top-level lists have empty
+	// IDs, so there are no foreign key constraints.
+	Orders []Order     `gorm:"foreignKey:ListID;constraint:-" json:"orders,omitempty"`
+	Lists  []OrderList `gorm:"foreignKey:ParentID;constraint:-" json:"lists,omitempty"`
+}
+
+// AlgoStrategy represents how an algo order spreads its size over time
+type AlgoStrategy string
+
+const (
+	AlgoStrategyTWAP AlgoStrategy = "twap" // evenly over the duration
+	AlgoStrategyVWAP AlgoStrategy = "vwap" // following the market's usual volume curve
+)
+
+// AlgoOrderStatus represents the status of an algo order
+type AlgoOrderStatus string
+
+const (
+	AlgoOrderStatusRunning   AlgoOrderStatus = "running"
+	AlgoOrderStatusPaused    AlgoOrderStatus = "paused"
+	AlgoOrderStatusCompleted AlgoOrderStatus = "completed" // the whole size filled
+	AlgoOrderStatusExpired   AlgoOrderStatus = "expired"   // the duration ended before it filled
+	AlgoOrderStatusCancelled AlgoOrderStatus = "cancelled"
+	AlgoOrderStatusFailed    AlgoOrderStatus = "failed"
+)
+
+// AlgoOrder is a parent order that the algo service slices into child
+// orders at its limit price over its duration. Each child carries the algo
+// order's ID.
+type AlgoOrder struct {
+	ID                string          `gorm:"primaryKey" json:"id"`
+	UserID            uint            `gorm:"not null;index" json:"user_id"`
+	MarketID          string          `gorm:"not null;index" json:"market_id"`
+	Side              OrderSide       `gorm:"not null" json:"side"`
+	Strategy          AlgoStrategy    `gorm:"not null" json:"strategy"`
+	ChildType         OrderType       `gorm:"not null" json:"child_type"` // limit or ioc
+	Status            AlgoOrderStatus `gorm:"not null;default:'running';index" json:"status"`
+	Size              decimal.Decimal `gorm:"type:decimal(20,8);not null" json:"size"`
+	Price             decimal.Decimal `gorm:"type:decimal(20,8);not null" json:"price"`
+	ParticipationRate decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"participation_rate"` // share of market volume per slice, 0 for no cap
+	SliceInterval     int64           `gorm:"not null" json:"slice_interval"`                         // seconds
+	FilledSize        decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"filled_size"`
+	SentSize          decimal.Decimal `gorm:"type:decimal(20,8);default:0" json:"sent_size"`
+	Slices            int             `gorm:"default:0" json:"slices"` // child orders placed
+	APIKeyID          string          `gorm:"size:64" json:"api_key_id,omitempty"`
+	Reason            string          `json:"reason,omitempty"` // why it failed, paused itself or skipped a slice
+	StartAt           time.Time       `json:"start_at"`
+	EndAt             time.Time       `json:"end_at"`
+	NextSliceAt       time.Time       `gorm:"index" json:"next_slice_at"`
+	PausedAt          *time.Time      `json:"paused_at,omitempty"`
+	CreatedAt         time.Time       `json:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at"`
+
+	// Relationships
+	Orders []Order `gorm:"foreignKey:AlgoID;constraint:-" json:"orders,omitempty"`
+}
+
 // Trade represents a completed trade
 type Trade struct {
 	ID           uint            `gorm:"primaryKey" json:"id"`
@@ -94,5 +210,7 @@ func (o *Order) BeforeCreate(tx *gorm.DB) error {
 }
 
 // TableName methods
-func (Order) TableName() string { return "orders" }
-func (Trade) TableName() string { return "trades" } 
\ No newline at end of file
+func (Order) TableName() string     { return "orders" }
+func (OrderList) TableName() string { return "order_lists" }
+func (AlgoOrder) TableName() string { return "algo_orders" }
+func (Trade) TableName() string     { return "trades" }
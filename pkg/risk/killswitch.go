@@ -0,0 +1,181 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/models"
+	"gorm.io/gorm"
+)
+
+// ErrKillSwitchNotFound is returned when releasing a switch that is not active
+var ErrKillSwitchNotFound = errors.New("kill switch not found or already released")
+
+// ActivateKillSwitch records and raises a kill switch. Activating a scope
+// that is already halted returns the active switch and false.
+func (c *Checker) ActivateKillSwitch(ctx context.Context, scope, target, reason string, adminID uint) (*models.KillSwitch, bool, error) {
+	if scope == models.KillSwitchGlobal {
+		target = ""
+	}
+
+	var active models.KillSwitch
+	err := c.db.WithContext(ctx).
+		Where("scope = ? AND target = ? AND released_at IS NULL", scope, target).
+		First(&active).Error
+	if err == nil {
+		return &active, false, c.raise(ctx, &active)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	killSwitch := &models.KillSwitch{
+		Scope:       scope,
+		Target:      target,
+		Reason:      reason,
+		ActivatedBy: adminID,
+		ActivatedAt: time.Now().UTC(),
+	}
+	if err := c.db.WithContext(ctx).Create(killSwitch).Error; err != nil {
+		return nil, false, err
+	}
+
+	return killSwitch, true, c.raise(ctx, killSwitch)
+}
+
+// RecordCancelled stores how many orders an activation cancelled
+func (c *Checker) RecordCancelled(ctx context.Context, killSwitch *models.KillSwitch, cancelled int) error {
+	killSwitch.Cancelled = cancelled
+	return c.db.WithContext(ctx).Model(killSwitch).Update("cancelled", cancelled).Error
+}
+
+// ReleaseKillSwitch lowers an active kill switch and records who released it
+func (c *Checker) ReleaseKillSwitch(ctx context.Context, id uint, adminID uint) (*models.KillSwitch, error) {
+	now := time.Now().UTC()
+	result := c.db.WithContext(ctx).Model(&models.KillSwitch{}).
+		Where("id = ? AND released_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"released_by": adminID,
+			"released_at": now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrKillSwitchNotFound
+	}
+
+	var killSwitch models.KillSwitch
+	if err := c.db.WithContext(ctx).First(&killSwitch, id).Error; err != nil {
+		return nil, err
+	}
+	if c.cache != nil {
+		key := fmt.Sprintf(cache.KeyKillSwitch, killSwitch.Scope, killSwitch.Target)
+		if err := c.cache.Client().Del(ctx, key).Err(); err != nil {
+			return &killSwitch, err
+		}
+	}
+
+	return &killSwitch, nil
+}
+
+// KillSwitches lists kill switches, newest first
+func (c *Checker) KillSwitches(ctx context.Context, activeOnly bool) ([]models.KillSwitch, error) {
+	query := c.db.WithContext(ctx).Order("activated_at DESC")
+	if activeOnly {
+		query = query.Where("released_at IS NULL")
+	}
+
+	var switches []models.KillSwitch
+	err := query.Find(&switches).Error
+	return switches, err
+}
+
+// LoadKillSwitches copies the active switches from the database to Redis, so
+// a flushed or replaced Redis still halts what the database says is halted
+func (c *Checker) LoadKillSwitches(ctx context.Context) error {
+	switches, err := c.KillSwitches(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	for i := range switches {
+		if err := c.raise(ctx, &switches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Halted returns the active kill switch that blocks a new order, or nil.
+// It asks Redis and falls back to the database.
+func (c *Checker) Halted(ctx context.Context, userID uint, apiKeyID, marketID string) (*models.KillSwitch, error) {
+	scopes := [][2]string{
+		{models.KillSwitchGlobal, ""},
+		{models.KillSwitchMarket, marketID},
+		{models.KillSwitchUser, strconv.FormatUint(uint64(userID), 10)},
+	}
+	if apiKeyID != "" {
+		scopes = append(scopes, [2]string{models.KillSwitchAPIKey, apiKeyID})
+	}
+
+	if c.cache != nil {
+		keys := make([]string, len(scopes))
+		for i, scope := range scopes {
+			keys[i] = fmt.Sprintf(cache.KeyKillSwitch, scope[0], scope[1])
+		}
+
+		values, err := c.cache.Client().MGet(ctx, keys...).Result()
+		if err == nil {
+			for i, value := range values {
+				id, ok := value.(string)
+				if !ok {
+					continue
+				}
+				return c.killSwitch(ctx, id, scopes[i])
+			}
+			return nil, nil
+		}
+		// fall back to the database
+	}
+
+	query := c.db.WithContext(ctx).Where("released_at IS NULL")
+	condition := c.db.Where("scope = ? AND target = ?", scopes[0][0], scopes[0][1])
+	for _, scope := range scopes[1:] {
+		condition = condition.Or("scope = ? AND target = ?", scope[0], scope[1])
+	}
+
+	var killSwitch models.KillSwitch
+	err := query.Where(condition).Order("activated_at").First(&killSwitch).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &killSwitch, nil
+}
+
+// killSwitch loads the switch Redis pointed at. If the row cannot be read
+// the order is still blocked.
+func (c *Checker) killSwitch(ctx context.Context, id string, scope [2]string) (*models.KillSwitch, error) {
+	var killSwitch models.KillSwitch
+	if err := c.db.WithContext(ctx).Where("id = ?", id).First(&killSwitch).Error; err != nil {
+		return &models.KillSwitch{Scope: scope[0], Target: scope[1]}, nil
+	}
+	return &killSwitch, nil
+}
+
+// raise marks a switch's scope as halted in Redis
+func (c *Checker) raise(ctx context.Context, killSwitch *models.KillSwitch) error {
+	if c.cache == nil {
+		return nil
+	}
+
+	key := fmt.Sprintf(cache.KeyKillSwitch, killSwitch.Scope, killSwitch.Target)
+	return c.cache.Client().Set(ctx, key, strconv.FormatUint(uint64(killSwitch.ID), 10), 0).Err()
+}
@@ -0,0 +1,79 @@
+package risk
+
+import (
+	"context"
+	"strconv"
+
+	"bixor-engine/pkg/models"
+)
+
+func (suite *RiskTestSuite) TestHalted() {
+	tests := []struct {
+		name   string
+		scope  string
+		target func() string
+		halted bool
+	}{
+		{"a global switch halts everyone", models.KillSwitchGlobal, func() string { return "" }, true},
+		{"a market switch halts the market", models.KillSwitchMarket, func() string { return testMarket }, true},
+		{"another market's switch does not", models.KillSwitchMarket, func() string { return "ETH-USDT" }, false},
+		{"a user switch halts the user", models.KillSwitchUser, func() string { return strconv.FormatUint(uint64(suite.user.ID), 10) }, true},
+		{"another user's switch does not", models.KillSwitchUser, func() string { return strconv.FormatUint(uint64(suite.user.ID+1), 10) }, false},
+		{"an API key switch halts the key", models.KillSwitchAPIKey, func() string { return "key" }, true},
+		{"another key's switch does not", models.KillSwitchAPIKey, func() string { return "other" }, false},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			ctx := context.Background()
+
+			activated, created, err := suite.checker.ActivateKillSwitch(ctx, tt.scope, tt.target(), "test", 1)
+			suite.Require().NoError(err)
+			suite.True(created)
+
+			halt, err := suite.checker.Halted(ctx, suite.user.ID, "key", testMarket)
+			suite.Require().NoError(err)
+			if !tt.halted {
+				suite.Nil(halt)
+				return
+			}
+			suite.Require().NotNil(halt)
+			suite.Equal(activated.ID, halt.ID)
+
+			// releasing the switch lifts the halt
+			_, err = suite.checker.ReleaseKillSwitch(ctx, activated.ID, 1)
+			suite.Require().NoError(err)
+			halt, err = suite.checker.Halted(ctx, suite.user.ID, "key", testMarket)
+			suite.Require().NoError(err)
+			suite.Nil(halt)
+		})
+	}
+}
+
+func (suite *RiskTestSuite) TestActivateAndRelease() {
+	suite.setup()
+	ctx := context.Background()
+
+	first, created, err := suite.checker.ActivateKillSwitch(ctx, models.KillSwitchMarket, testMarket, "first", 1)
+	suite.Require().NoError(err)
+	suite.True(created)
+
+	// a halted scope keeps its active switch
+	again, created, err := suite.checker.ActivateKillSwitch(ctx, models.KillSwitchMarket, testMarket, "again", 2)
+	suite.Require().NoError(err)
+	suite.False(created)
+	suite.Equal(first.ID, again.ID)
+	suite.Equal("first", again.Reason)
+
+	released, err := suite.checker.ReleaseKillSwitch(ctx, first.ID, 2)
+	suite.Require().NoError(err)
+	suite.Require().NotNil(released.ReleasedBy)
+	suite.Equal(uint(2), *released.ReleasedBy)
+
+	_, err = suite.checker.ReleaseKillSwitch(ctx, first.ID, 2)
+	suite.ErrorIs(err, ErrKillSwitchNotFound)
+
+	active, err := suite.checker.KillSwitches(ctx, true)
+	suite.Require().NoError(err)
+	suite.Empty(active)
+}
@@ -0,0 +1,267 @@
+// Package risk runs pre-trade checks on orders before they reach the
+// matching engine. Limits are configured per user and per market in the
+// risk_limits table, and kill switches halt a user, an API key, a market or
+// all trading.
+package risk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"bixor-engine/pkg/cache"
+	"bixor-engine/pkg/marketdata"
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// Rejection reasons
+const (
+	ReasonOrderNotional = "max_order_notional"
+	ReasonOpenOrders    = "max_open_orders"
+	ReasonPosition      = "max_position"
+	ReasonOrderRate     = "max_order_rate"
+	ReasonPriceBand     = "price_band"
+)
+
+// Rejection is returned when an order breaches a limit
+type Rejection struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (r *Rejection) Error() string {
+	return r.Message
+}
+
+func reject(reason string, format string, args ...interface{}) *Rejection {
+	return &Rejection{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Checker evaluates orders against the configured limits
+type Checker struct {
+	db    *gorm.DB
+	cache *cache.RedisCache
+	stats *marketdata.Stats
+
+	// order rate counters for when Redis is unavailable
+	mu    sync.Mutex
+	rates map[string]*rateWindow
+}
+
+type rateWindow struct {
+	second int64
+	count  int
+}
+
+// New creates a checker. The cache and stats are optional: without Redis
+// order rates are counted in memory, and without stats the price band is
+// not checked.
+func New(db *gorm.DB, redisCache *cache.RedisCache, stats *marketdata.Stats) *Checker {
+	return &Checker{
+		db:    db,
+		cache: redisCache,
+		stats: stats,
+		rates: make(map[string]*rateWindow),
+	}
+}
+
+// Limits returns the limits that apply to a user in a market
+func (c *Checker) Limits(userID uint, marketID string) (models.RiskLimit, error) {
+	return loadLimits(c.db, userID, marketID)
+}
+
+func loadLimits(db *gorm.DB, userID uint, marketID string) (models.RiskLimit, error) {
+	var rows []models.RiskLimit
+	err := db.Where("user_id IN ? AND market_id IN ?", []uint{0, userID}, []string{"", marketID}).
+		Find(&rows).Error
+	if err != nil {
+		return models.RiskLimit{}, err
+	}
+
+	return merge(rows, userID, marketID), nil
+}
+
+// merge takes each limit from the most specific row that sets it
+func merge(rows []models.RiskLimit, userID uint, marketID string) models.RiskLimit {
+	specificity := func(row *models.RiskLimit) int {
+		rank := 0
+		if row.UserID == userID && userID != 0 {
+			rank += 2
+		}
+		if row.MarketID == marketID && marketID != "" {
+			rank++
+		}
+		return rank
+	}
+
+	limits := models.RiskLimit{UserID: userID, MarketID: marketID}
+	for rank := 0; rank <= 3; rank++ {
+		for i := range rows {
+			row := &rows[i]
+			if specificity(row) != rank {
+				continue
+			}
+			if row.MaxOrderNotional.IsPositive() {
+				limits.MaxOrderNotional = row.MaxOrderNotional
+			}
+			if row.MaxOpenOrders > 0 {
+				limits.MaxOpenOrders = row.MaxOpenOrders
+			}
+			if row.MaxPosition.IsPositive() {
+				limits.MaxPosition = row.MaxPosition
+			}
+			if row.MaxOrdersPerSecond > 0 {
+				limits.MaxOrdersPerSecond = row.MaxOrdersPerSecond
+			}
+			if row.PriceBand.IsPositive() {
+				limits.PriceBand = row.PriceBand
+			}
+		}
+	}
+
+	return limits
+}
+
+// Check evaluates a new order. It returns a *Rejection if the order breaches
+// a limit and any other error if the checks could not run. The order rate
+// is checked last, so rejected orders do not use up the user's rate.
+func (c *Checker) Check(ctx context.Context, order *models.Order, market *models.Market) error {
+	return c.CheckTx(ctx, c.db, order, market)
+}
+
+// CheckTx is Check reading through tx, so that orders saved earlier in the
+// transaction count towards the limits
+func (c *Checker) CheckTx(ctx context.Context, tx *gorm.DB, order *models.Order, market *models.Market) error {
+	limits, err := loadLimits(tx, order.UserID, order.MarketID)
+	if err != nil {
+		return err
+	}
+
+	lastPrice := decimal.Zero
+	if c.stats != nil {
+		lastPrice = c.stats.Get(order.MarketID, time.Now()).LastPrice
+	}
+
+	// pegged sells without a limit have no price to check yet
+	if limits.PriceBand.IsPositive() && order.Type != models.OrderTypeMarket && order.Price.IsPositive() && lastPrice.IsPositive() {
+		deviation := order.Price.Sub(lastPrice).Abs().Div(lastPrice)
+		if deviation.GreaterThan(limits.PriceBand) {
+			return reject(ReasonPriceBand, "Price %s is more than %s%% away from the last trade at %s",
+				order.Price, limits.PriceBand.Shift(2), lastPrice)
+		}
+	}
+
+	notional := order.Price.Mul(order.Size)
+	if order.Type == models.OrderTypeMarket {
+		notional = order.Size
+	}
+	if limits.MaxOrderNotional.IsPositive() && notional.GreaterThan(limits.MaxOrderNotional) {
+		return reject(ReasonOrderNotional, "Order notional %s exceeds the limit of %s %s",
+			notional, limits.MaxOrderNotional, market.QuoteAsset)
+	}
+
+	if limits.MaxOpenOrders > 0 {
+		var open int64
+		err := tx.WithContext(ctx).Model(&models.Order{}).
+			Where("user_id = ? AND market_id = ? AND status IN ?", order.UserID, order.MarketID, openStatuses).
+			Count(&open).Error
+		if err != nil {
+			return err
+		}
+		if open >= int64(limits.MaxOpenOrders) {
+			return reject(ReasonOpenOrders, "At most %d open orders are allowed in %s", limits.MaxOpenOrders, order.MarketID)
+		}
+	}
+
+	if limits.MaxPosition.IsPositive() && order.Side == models.OrderSideBuy {
+		position, err := positionAfter(ctx, tx, order, market, lastPrice)
+		if err != nil {
+			return err
+		}
+		if position.GreaterThan(limits.MaxPosition) {
+			return reject(ReasonPosition, "Order would take the %s position to %s, above the limit of %s",
+				market.BaseAsset, position, limits.MaxPosition)
+		}
+	}
+
+	if limits.MaxOrdersPerSecond > 0 {
+		count, err := c.countOrder(ctx, order.UserID, order.MarketID)
+		if err != nil {
+			return err
+		}
+		if count > limits.MaxOrdersPerSecond {
+			return reject(ReasonOrderRate, "At most %d orders per second are allowed in %s", limits.MaxOrdersPerSecond, order.MarketID)
+		}
+	}
+
+	return nil
+}
+
+// openStatuses include scheduled orders, which go live without another check
+var openStatuses = []models.OrderStatus{models.OrderStatusScheduled, models.OrderStatusPending, models.OrderStatusOpen}
+
+// positionAfter is the base asset a buyer would hold if the new order and
+// every open buy in the market filled. Market buys are sized in the quote
+// asset and are converted at the last trade price when there is one.
+func positionAfter(ctx context.Context, db *gorm.DB, order *models.Order, market *models.Market, lastPrice decimal.Decimal) (decimal.Decimal, error) {
+	var held struct{ Total decimal.Decimal }
+	err := db.WithContext(ctx).Model(&models.Balance{}).
+		Select("COALESCE(SUM(available + locked), 0) AS total").
+		Where("user_id = ? AND asset = ?", order.UserID, market.BaseAsset).
+		Scan(&held).Error
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	var buying struct{ Total decimal.Decimal }
+	err = db.WithContext(ctx).Model(&models.Order{}).
+		Select("COALESCE(SUM(remaining_size), 0) AS total").
+		Where("user_id = ? AND market_id = ? AND side = ? AND type <> ? AND status IN ?",
+			order.UserID, order.MarketID, models.OrderSideBuy, models.OrderTypeMarket, openStatuses).
+		Scan(&buying).Error
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	size := order.Size
+	if order.Type == models.OrderTypeMarket {
+		size = decimal.Zero
+		if lastPrice.IsPositive() {
+			size = order.Size.Div(lastPrice)
+		}
+	}
+
+	return held.Total.Add(buying.Total).Add(size), nil
+}
+
+// countOrder counts an order against the user's rate in the current second
+// and returns the count so far
+func (c *Checker) countOrder(ctx context.Context, userID uint, marketID string) (int, error) {
+	now := time.Now().Unix()
+
+	if c.cache != nil {
+		key := fmt.Sprintf(cache.KeyOrderRate, userID, marketID, now)
+		count, err := c.cache.Client().Incr(ctx, key).Result()
+		if err == nil {
+			c.cache.Client().Expire(ctx, key, 2*time.Second)
+			return int(count), nil
+		}
+		// fall back to counting in memory
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := fmt.Sprintf("%d:%s", userID, marketID)
+	window, ok := c.rates[key]
+	if !ok || window.second != now {
+		window = &rateWindow{second: now}
+		c.rates[key] = window
+	}
+	window.count++
+
+	return window.count, nil
+}
@@ -0,0 +1,204 @@
+package risk
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database/databasetest"
+	"bixor-engine/pkg/marketdata"
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+const testMarket = "BTC-USDT"
+
+type RiskTestSuite struct {
+	suite.Suite
+	db      *gorm.DB
+	stats   *marketdata.Stats
+	checker *Checker
+	market  models.Market
+	user    models.User
+}
+
+func TestRiskTestSuite(t *testing.T) {
+	suite.Run(t, new(RiskTestSuite))
+}
+
+// setup gives the running test its own database and checker, with a last
+// trade at 100
+func (suite *RiskTestSuite) setup() {
+	suite.db = databasetest.Open(suite.T())
+
+	suite.user = models.User{Email: "trader@example.com", Username: "trader", Role: models.RoleTrader, IsActive: true, IsVerified: true}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+	suite.market = models.Market{ID: testMarket, BaseAsset: "BTC", QuoteAsset: "USDT", IsActive: true, PricePrecision: 2, SizePrecision: 4}
+	suite.Require().NoError(suite.db.Create(&suite.market).Error)
+
+	suite.stats = marketdata.NewStats(suite.db, nil)
+	suite.stats.PublishTrades(&matching.Trade{MarketID: testMarket, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1), CreatedAt: time.Now()})
+	suite.checker = New(suite.db, nil, suite.stats)
+}
+
+func (suite *RiskTestSuite) limit(limit models.RiskLimit) {
+	suite.Require().NoError(suite.db.Create(&limit).Error)
+}
+
+// open saves a resting order of the user
+func (suite *RiskTestSuite) open(id string, side models.OrderSide, status models.OrderStatus) {
+	suite.Require().NoError(suite.db.Create(&models.Order{
+		ID:       id,
+		UserID:   suite.user.ID,
+		MarketID: testMarket,
+		Side:     side,
+		Type:     models.OrderTypeLimit,
+		Status:   status,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(1),
+	}).Error)
+}
+
+func (suite *RiskTestSuite) TestLimits() {
+	tests := []struct {
+		name     string
+		userID   func() uint
+		marketID string
+		notional int64
+		open     int
+		band     string
+	}{
+		{"the most specific row wins per limit", func() uint { return suite.user.ID }, testMarket, 500, 5, "0.05"},
+		{"another market falls back to the global row", func() uint { return suite.user.ID }, "ETH-USDT", 500, 10, "0"},
+		{"another user falls back to the market row", func() uint { return suite.user.ID + 1 }, testMarket, 1000, 5, "0"},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			suite.limit(models.RiskLimit{MaxOrderNotional: decimal.NewFromInt(1000), MaxOpenOrders: 10})
+			suite.limit(models.RiskLimit{MarketID: testMarket, MaxOpenOrders: 5})
+			suite.limit(models.RiskLimit{UserID: suite.user.ID, MaxOrderNotional: decimal.NewFromInt(500)})
+			suite.limit(models.RiskLimit{UserID: suite.user.ID, MarketID: testMarket, PriceBand: decimal.RequireFromString("0.05")})
+
+			limits, err := suite.checker.Limits(tt.userID(), tt.marketID)
+			suite.Require().NoError(err)
+			suite.Equal(tt.notional, limits.MaxOrderNotional.IntPart())
+			suite.Equal(tt.open, limits.MaxOpenOrders)
+			suite.Equal(tt.band, limits.PriceBand.String())
+		})
+	}
+}
+
+func (suite *RiskTestSuite) TestCheck() {
+	buy := &models.Order{Side: models.OrderSideBuy, Type: models.OrderTypeLimit, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1)}
+
+	tests := []struct {
+		name   string
+		limit  models.RiskLimit
+		setup  func()
+		order  *models.Order
+		reason string
+	}{
+		{
+			name:  "within every limit",
+			limit: models.RiskLimit{MaxOrderNotional: decimal.NewFromInt(1000), MaxOpenOrders: 2, MaxPosition: decimal.NewFromInt(5), PriceBand: decimal.RequireFromString("0.1"), MaxOrdersPerSecond: 5},
+			order: buy,
+		},
+		{
+			name:   "notional above the limit",
+			limit:  models.RiskLimit{MaxOrderNotional: decimal.NewFromInt(50)},
+			order:  buy,
+			reason: ReasonOrderNotional,
+		},
+		{
+			name:   "market orders are sized in notional",
+			limit:  models.RiskLimit{MaxOrderNotional: decimal.NewFromInt(50)},
+			order:  &models.Order{Side: models.OrderSideBuy, Type: models.OrderTypeMarket, Size: decimal.NewFromInt(60)},
+			reason: ReasonOrderNotional,
+		},
+		{
+			name:   "open orders at the limit",
+			limit:  models.RiskLimit{MaxOpenOrders: 1},
+			setup:  func() { suite.open("open", models.OrderSideSell, models.OrderStatusOpen) },
+			order:  buy,
+			reason: ReasonOpenOrders,
+		},
+		{
+			name:   "scheduled orders count as open",
+			limit:  models.RiskLimit{MaxOpenOrders: 1},
+			setup:  func() { suite.open("scheduled", models.OrderSideSell, models.OrderStatusScheduled) },
+			order:  buy,
+			reason: ReasonOpenOrders,
+		},
+		{
+			name:  "finished orders do not count",
+			limit: models.RiskLimit{MaxOpenOrders: 1},
+			setup: func() { suite.open("filled", models.OrderSideSell, models.OrderStatusFilled) },
+			order: buy,
+		},
+		{
+			name:  "position counts holdings and open buys",
+			limit: models.RiskLimit{MaxPosition: decimal.NewFromInt(2)},
+			setup: func() {
+				suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.user.ID, Asset: "BTC", Available: decimal.NewFromInt(1)}).Error)
+				suite.open("buy", models.OrderSideBuy, models.OrderStatusOpen)
+			},
+			order:  buy,
+			reason: ReasonPosition,
+		},
+		{
+			name:  "sells are not position limited",
+			limit: models.RiskLimit{MaxPosition: decimal.NewFromInt(2)},
+			setup: func() {
+				suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.user.ID, Asset: "BTC", Available: decimal.NewFromInt(3)}).Error)
+			},
+			order: &models.Order{Side: models.OrderSideSell, Type: models.OrderTypeLimit, Price: decimal.NewFromInt(100), Size: decimal.NewFromInt(1)},
+		},
+		{
+			name:   "price outside the band",
+			limit:  models.RiskLimit{PriceBand: decimal.RequireFromString("0.1")},
+			order:  &models.Order{Side: models.OrderSideBuy, Type: models.OrderTypeLimit, Price: decimal.NewFromInt(111), Size: decimal.NewFromInt(1)},
+			reason: ReasonPriceBand,
+		},
+		{
+			name:  "market orders skip the band",
+			limit: models.RiskLimit{PriceBand: decimal.RequireFromString("0.1")},
+			order: &models.Order{Side: models.OrderSideBuy, Type: models.OrderTypeMarket, Size: decimal.NewFromInt(500)},
+		},
+		{
+			name:  "order rate above the limit",
+			limit: models.RiskLimit{MaxOrdersPerSecond: 1},
+			setup: func() {
+				key := fmt.Sprintf("%d:%s", suite.user.ID, testMarket)
+				suite.checker.rates[key] = &rateWindow{second: time.Now().Unix(), count: 1}
+			},
+			order:  buy,
+			reason: ReasonOrderRate,
+		},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			suite.limit(tt.limit)
+			if tt.setup != nil {
+				tt.setup()
+			}
+
+			order := *tt.order
+			order.UserID, order.MarketID = suite.user.ID, testMarket
+			err := suite.checker.Check(context.Background(), &order, &suite.market)
+			if tt.reason == "" {
+				suite.NoError(err)
+				return
+			}
+
+			var rejection *Rejection
+			suite.Require().ErrorAs(err, &rejection)
+			suite.Equal(tt.reason, rejection.Reason)
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// Package scheduler holds orders submitted for a future time and submits
+// them to the matching engine once their activation time arrives. Their
+// funds are held from submission, so an activated order needs no second
+// balance check.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/settlement"
+	wsocket "bixor-engine/pkg/websocket"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultTickInterval is how often the scheduler looks for due orders
+	DefaultTickInterval = time.Second
+
+	// placeTimeout bounds one order submission
+	placeTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNotFound is returned for orders that do not exist or belong to
+	// another user
+	ErrNotFound = errors.New("order not found")
+	// ErrNotScheduled is returned when cancelling an order that has already
+	// been activated or finished
+	ErrNotScheduled = errors.New("order is not scheduled")
+)
+
+// Service activates scheduled orders. They wait in the orders table with
+// status scheduled, so they survive a restart, and orders that fell due
+// while the server was down are activated on the first tick.
+type Service struct {
+	db     *gorm.DB
+	engine *matching.MatchingEngine
+	hub    *wsocket.WebSocketHub
+	risk   *risk.Checker
+	tick   time.Duration
+
+	// serialises activation with cancellation, so an order is either
+	// cancelled while scheduled or submitted, never both
+	mu sync.Mutex
+}
+
+// New creates a scheduler. The hub and risk checker are optional.
+func New(db *gorm.DB, engine *matching.MatchingEngine, hub *wsocket.WebSocketHub, checker *risk.Checker) *Service {
+	return &Service{
+		db:     db,
+		engine: engine,
+		hub:    hub,
+		risk:   checker,
+		tick:   DefaultTickInterval,
+	}
+}
+
+// Cancel cancels a user's scheduled order and releases its hold. It returns
+// ErrNotScheduled once the order has been activated; the caller cancels it
+// like any other order then.
+func (s *Service) Cancel(userID uint, id string) (*models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var order models.Order
+	err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != models.OrderStatusScheduled {
+		return nil, ErrNotScheduled
+	}
+
+	if err := s.cancel(&order); err != nil {
+		return nil, err
+	}
+	s.broadcast(&order)
+	return &order, nil
+}
+
+// CancelAll cancels a user's scheduled orders, optionally only in one market
+// or on one side, and returns their IDs
+func (s *Service) CancelAll(userID uint, marketID string, side models.OrderSide) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := s.db.Where("user_id = ? AND status = ?", userID, models.OrderStatusScheduled)
+	if marketID != "" {
+		query = query.Where("market_id = ?", marketID)
+	}
+	if side != 0 {
+		query = query.Where("side = ?", side)
+	}
+
+	return s.cancelAll(query)
+}
+
+// CancelAPIKey cancels a user's scheduled orders placed through an API key
+// and returns their IDs
+func (s *Service) CancelAPIKey(userID uint, apiKeyID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cancelAll(s.db.Where("user_id = ? AND api_key_id = ? AND status = ?", userID, apiKeyID, models.OrderStatusScheduled))
+}
+
+// cancelAll cancels the scheduled orders query finds
+func (s *Service) cancelAll(query *gorm.DB) ([]string, error) {
+	var orders []models.Order
+	if err := query.Find(&orders).Error; err != nil {
+		return nil, err
+	}
+
+	cancelled := make([]string, 0, len(orders))
+	for i := range orders {
+		if err := s.cancel(&orders[i]); err != nil {
+			return cancelled, err
+		}
+		s.broadcast(&orders[i])
+		cancelled = append(cancelled, orders[i].ID)
+	}
+	return cancelled, nil
+}
+
+// Run activates scheduled orders as they fall due, until ctx is done
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.runDue(now)
+		}
+	}
+}
+
+func (s *Service) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []models.Order
+	err := s.db.Where("status = ? AND activate_at <= ?", models.OrderStatusScheduled, now).
+		Order("activate_at").
+		Find(&due).Error
+	if err != nil {
+		logrus.Errorf("Failed to load due scheduled orders: %v", err)
+		return
+	}
+
+	for i := range due {
+		if err := s.activate(&due[i]); err != nil {
+			logrus.Errorf("Failed to activate scheduled order %s: %v", due[i].ID, err)
+		}
+	}
+}
+
+// activate submits a due order to the engine. Orders of a user or market
+// that a kill switch halted in the meantime are cancelled instead, and
+// orders the engine cannot take because it stopped stay scheduled.
+func (s *Service) activate(order *models.Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), placeTimeout)
+	defer cancel()
+
+	if s.risk != nil {
+		halt, err := s.risk.Halted(ctx, order.UserID, order.APIKeyID, order.MarketID)
+		if err != nil {
+			return err
+		}
+		if halt != nil {
+			logrus.Infof("Cancelled scheduled order %s: trading is halted", order.ID)
+			if err := s.cancel(order); err != nil {
+				return err
+			}
+			s.broadcast(order)
+			return nil
+		}
+	}
+
+	result := s.db.Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, models.OrderStatusScheduled).
+		Update("status", models.OrderStatusPending)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	order.Status = models.OrderStatusPending
+
+	if s.engine == nil {
+		logrus.Warnf("No matching engine available, scheduled order %s remains pending", order.ID)
+		return nil
+	}
+
+	err := s.engine.AddOrder(ctx, &matching.Order{
+		ID:            order.ID,
+		MarketID:      order.MarketID,
+		Side:          matching.Side(order.Side),
+		Price:         order.Price,
+		Size:          order.Size,
+		Type:          matching.OrderType(order.Type),
+		UserID:        int64(order.UserID),
+		CreatedAt:     time.Now(),
+		StopPrice:     order.StopPrice,
+		Hidden:        order.Hidden,
+		Peg:           matching.PegType(order.Peg),
+		PegOffset:     order.PegOffset,
+		PegLimit:      order.PegLimit,
+		MinSize:       order.MinSize,
+		AllOrNone:     order.AllOrNone,
+		MaxSize:       settlement.MaxSize(order),
+		ClientOrderID: order.ClientOrderID,
+	})
+	if errors.Is(err, matching.ErrEngineNotRunning) {
+		// the engine is stopping; activate the order once it runs again
+		err := s.db.Model(&models.Order{}).
+			Where("id = ? AND status = ?", order.ID, models.OrderStatusPending).
+			Update("status", models.OrderStatusScheduled).Error
+		order.Status = models.OrderStatusScheduled
+		return err
+	}
+	if err != nil {
+		failErr := s.db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&models.Order{}).Where("id = ?", order.ID).
+				Update("status", models.OrderStatusFailed).Error
+			if err != nil {
+				return err
+			}
+			return settlement.Release(tx, order.ID)
+		})
+		if failErr != nil {
+			logrus.Errorf("Failed to release scheduled order %s: %v", order.ID, failErr)
+		}
+		order.Status = models.OrderStatusFailed
+		s.broadcast(order)
+		return err
+	}
+
+	// settlement may already have filled the order
+	order.Status = models.OrderStatusOpen
+	s.db.Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, models.OrderStatusPending).
+		Update("status", models.OrderStatusOpen)
+	s.broadcast(order)
+	return nil
+}
+
+// cancel marks a scheduled order cancelled and releases its hold
+func (s *Service) cancel(order *models.Order) error {
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Order{}).
+			Where("id = ? AND status = ?", order.ID, models.OrderStatusScheduled).
+			Updates(map[string]interface{}{
+				"status":       models.OrderStatusCancelled,
+				"cancelled_at": now,
+			}).Error
+		if err != nil {
+			return err
+		}
+		if err := settlement.Release(tx, order.ID); err != nil {
+			return err
+		}
+		return tx.Where("id = ?", order.ID).First(order).Error
+	})
+}
+
+func (s *Service) broadcast(order *models.Order) {
+	if s.hub != nil {
+		s.hub.BroadcastUserOrderUpdate(order.UserID, order)
+	}
+}
@@ -0,0 +1,180 @@
+package scheduler
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database/databasetest"
+	"bixor-engine/pkg/models"
+	"bixor-engine/pkg/risk"
+	"bixor-engine/pkg/settlement"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+const testMarket = "BTC-USDT"
+
+type SchedulerTestSuite struct {
+	suite.Suite
+	db        *gorm.DB
+	engine    *matching.MatchingEngine
+	checker   *risk.Checker
+	scheduler *Service
+	market    models.Market
+	user      models.User
+}
+
+func TestSchedulerTestSuite(t *testing.T) {
+	suite.Run(t, new(SchedulerTestSuite))
+}
+
+// setup gives the running test its own database, engine and scheduler, with
+// a trader who has quote funds
+func (suite *SchedulerTestSuite) setup() {
+	suite.db = databasetest.Open(suite.T())
+
+	suite.user = models.User{Email: "trader@example.com", Username: "trader", Role: models.RoleTrader, IsActive: true, IsVerified: true}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+	suite.market = models.Market{ID: testMarket, BaseAsset: "BTC", QuoteAsset: "USDT", IsActive: true, PricePrecision: 2, SizePrecision: 4}
+	suite.Require().NoError(suite.db.Create(&suite.market).Error)
+	suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.user.ID, Asset: "USDT", Available: decimal.NewFromInt(1000)}).Error)
+
+	suite.engine = matching.NewMatchingEngine(settlement.New(suite.db, nil))
+	suite.Require().NoError(suite.engine.RegisterMarket(matching.MarketConfig{ID: testMarket, PricePrecision: 2, SizePrecision: 4}))
+	suite.Require().NoError(suite.engine.Start(context.Background()))
+	engine := suite.engine
+	suite.T().Cleanup(func() {
+		// some tests stop the engine themselves
+		_, _ = engine.Stop(context.Background())
+	})
+
+	suite.checker = risk.New(suite.db, nil, nil)
+	suite.scheduler = New(suite.db, suite.engine, nil, suite.checker)
+}
+
+// schedule holds the funds of a buy of 1 at 100 and saves it to go live at
+// activateAt
+func (suite *SchedulerTestSuite) schedule(id string, activateAt time.Time) *models.Order {
+	order := &models.Order{
+		ID:         id,
+		UserID:     suite.user.ID,
+		MarketID:   testMarket,
+		Side:       models.OrderSideBuy,
+		Type:       models.OrderTypeLimit,
+		Status:     models.OrderStatusScheduled,
+		Price:      decimal.NewFromInt(100),
+		Size:       decimal.NewFromInt(1),
+		ActivateAt: &activateAt,
+	}
+	suite.Require().NoError(suite.db.Transaction(func(tx *gorm.DB) error {
+		if err := settlement.Hold(tx, order, &suite.market); err != nil {
+			return err
+		}
+		return tx.Create(order).Error
+	}))
+	return order
+}
+
+func (suite *SchedulerTestSuite) load(id string) models.Order {
+	var order models.Order
+	suite.Require().NoError(suite.db.Where("id = ?", id).First(&order).Error)
+	return order
+}
+
+func (suite *SchedulerTestSuite) TestActivation() {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		activateAt time.Time
+		setup      func()
+		status     models.OrderStatus
+		hold       int64
+		resting    int64
+	}{
+		{"a due order goes live", now.Add(-time.Second), nil, models.OrderStatusOpen, 100, 1},
+		{"a future order waits", now.Add(time.Minute), nil, models.OrderStatusScheduled, 100, 0},
+		{
+			name:       "a halted user's order is cancelled",
+			activateAt: now.Add(-time.Second),
+			setup: func() {
+				_, _, err := suite.checker.ActivateKillSwitch(context.Background(), models.KillSwitchUser, strconv.FormatUint(uint64(suite.user.ID), 10), "test", 1)
+				suite.Require().NoError(err)
+			},
+			status: models.OrderStatusCancelled,
+		},
+		{
+			name:       "an order stays scheduled while the engine is stopped",
+			activateAt: now.Add(-time.Second),
+			setup: func() {
+				_, err := suite.engine.Stop(context.Background())
+				suite.Require().NoError(err)
+			},
+			status: models.OrderStatusScheduled,
+			hold:   100,
+		},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			order := suite.schedule("scheduled", tt.activateAt)
+			if tt.setup != nil {
+				tt.setup()
+			}
+
+			suite.scheduler.runDue(now)
+
+			stored := suite.load(order.ID)
+			suite.Equal(tt.status, stored.Status)
+			suite.True(stored.Hold.Equal(decimal.NewFromInt(tt.hold)), stored.Hold.String())
+			if tt.status == models.OrderStatusOpen {
+				// depth is sequenced behind the order
+				depth, err := suite.engine.Depth(testMarket, 10, decimal.Zero)
+				suite.Require().NoError(err)
+				suite.Len(depth.Bids, int(tt.resting))
+			}
+		})
+	}
+}
+
+func (suite *SchedulerTestSuite) TestCancel() {
+	tests := []struct {
+		name   string
+		userID func() uint
+		status models.OrderStatus
+		err    error
+	}{
+		{"a scheduled order is cancelled", func() uint { return suite.user.ID }, models.OrderStatusCancelled, nil},
+		{"another user's order is not found", func() uint { return suite.user.ID + 1 }, models.OrderStatusScheduled, ErrNotFound},
+		{"an activated order is no longer scheduled", nil, models.OrderStatusOpen, ErrNotScheduled},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			order := suite.schedule("scheduled", time.Now().Add(-time.Second))
+
+			userID := suite.user.ID
+			if tt.userID != nil {
+				userID = tt.userID()
+			} else {
+				suite.scheduler.runDue(time.Now())
+			}
+
+			cancelled, err := suite.scheduler.Cancel(userID, order.ID)
+			suite.ErrorIs(err, tt.err)
+
+			stored := suite.load(order.ID)
+			suite.Equal(tt.status, stored.Status)
+			if tt.err == nil {
+				suite.Equal(models.OrderStatusCancelled, cancelled.Status)
+				suite.True(stored.Hold.IsZero())
+			} else {
+				suite.True(stored.Hold.Equal(decimal.NewFromInt(100)), stored.Hold.String())
+			}
+		})
+	}
+}
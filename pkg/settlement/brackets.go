@@ -0,0 +1,279 @@
+package settlement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// openBrackets opens a take-profit and stop-loss OCO list for every fill of
+// a bracket's entry order in trades. The children close what the fill moved:
+// the base a buy received after its fee, or the base a sell gave up. A list
+// whose hold the balance cannot cover is recorded as failed; the others are
+// returned to be placed once tx commits.
+func openBrackets(tx *gorm.DB, market *models.Market, trades []*matching.Trade) ([]*models.OrderList, error) {
+	ids := make([]string, 0, 2*len(trades))
+	for _, trade := range trades {
+		if !trade.IsCancel {
+			ids = append(ids, trade.TakerOrderID, trade.MakerOrderID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	brackets := tx.Model(&models.OrderList{}).Select("id").Where("type = ?", models.OrderListTypeBracket)
+
+	var entries []models.Order
+	err := tx.Select("id", "side", "api_key_id", "list_id").
+		Where("id IN ? AND list_id IN (?)", ids, brackets).
+		Find(&entries).Error
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	var lists []*models.OrderList
+	for _, trade := range trades {
+		if trade.IsCancel {
+			continue
+		}
+
+		for i := range entries {
+			entry := &entries[i]
+
+			var rate decimal.Decimal
+			switch entry.ID {
+			case trade.TakerOrderID:
+				rate = market.TakerFee
+			case trade.MakerOrderID:
+				rate = market.MakerFee
+			default:
+				continue
+			}
+
+			// buyers pay their fee in the base asset
+			size := trade.Size
+			if entry.Side == models.OrderSideBuy {
+				size = size.Sub(size.Mul(rate)).Truncate(int32(market.SizePrecision))
+			}
+
+			list, err := openBracketList(tx, market, entry, size)
+			if err != nil {
+				return nil, err
+			}
+			if list != nil && list.Status == models.OrderListStatusOpen {
+				lists = append(lists, list)
+			}
+		}
+	}
+
+	return lists, nil
+}
+
+// openBracketList creates the next child list of an entry order's bracket
+// with legs of size on the other side
+func openBracketList(tx *gorm.DB, market *models.Market, entry *models.Order, size decimal.Decimal) (*models.OrderList, error) {
+	if !size.IsPositive() {
+		return nil, nil
+	}
+
+	// the bracket row serialises the numbering of its children
+	var bracket models.OrderList
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", entry.ListID).First(&bracket).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := tx.Model(&models.OrderList{}).Where("parent_id = ?", bracket.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+
+	side := models.OrderSideSell
+	if entry.Side == models.OrderSideSell {
+		side = models.OrderSideBuy
+	}
+
+	listID := fmt.Sprintf("%s-%d", bracket.ID, count+1)
+	list := &models.OrderList{
+		ID:       listID,
+		UserID:   bracket.UserID,
+		MarketID: bracket.MarketID,
+		Type:     models.OrderListTypeOCO,
+		Status:   models.OrderListStatusOpen,
+		ParentID: bracket.ID,
+	}
+	takeProfit := &models.Order{
+		ID:       listID + "1",
+		UserID:   bracket.UserID,
+		MarketID: bracket.MarketID,
+		Side:     side,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusPending,
+		Price:    bracket.TakeProfitPrice,
+		Size:     size,
+		APIKeyID: entry.APIKeyID,
+		ListID:   listID,
+	}
+	stopLoss := &models.Order{
+		ID:        listID + "2",
+		UserID:    bracket.UserID,
+		MarketID:  bracket.MarketID,
+		Side:      side,
+		Type:      models.OrderTypeStopLimit,
+		Status:    models.OrderStatusPending,
+		Price:     bracket.StopLimitPrice,
+		StopPrice: bracket.StopPrice,
+		Size:      size,
+		APIKeyID:  entry.APIKeyID,
+		ListID:    listID,
+	}
+	legs := []*models.Order{takeProfit, stopLoss}
+
+	err = HoldList(tx, legs, market)
+	if errors.Is(err, ErrInsufficientBalance) {
+		logrus.Warnf("Bracket %s cannot hold list %s, recording it as failed", bracket.ID, listID)
+		list.Status = models.OrderListStatusFailed
+		for _, leg := range legs {
+			leg.Status = models.OrderStatusFailed
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(list).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(legs).Error; err != nil {
+		return nil, err
+	}
+
+	list.Orders = []models.Order{*takeProfit, *stopLoss}
+	return list, nil
+}
+
+// PlacePendingLists submits the child lists of brackets that are still
+// pending to the matching engine, such as those opened while it was stopped
+// or overloaded. It is called once the engine has started; lists the engine
+// recovered already are only marked open.
+func (s *Settlement) PlacePendingLists() error {
+	if s.engine == nil {
+		return nil
+	}
+
+	pending := s.db.Model(&models.Order{}).Select("list_id").
+		Where("list_id <> '' AND status = ?", models.OrderStatusPending)
+
+	var lists []*models.OrderList
+	err := s.db.Preload("Orders", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("parent_id <> '' AND status = ? AND id IN (?)", models.OrderListStatusOpen, pending).
+		Order("created_at").
+		Find(&lists).Error
+	if err != nil {
+		return err
+	}
+
+	submit := make([]*models.OrderList, 0, len(lists))
+	for _, list := range lists {
+		if len(list.Orders) != 2 {
+			continue
+		}
+		_, err := s.engine.GetOrder(list.MarketID, list.Orders[0].ID)
+		switch {
+		case errors.Is(err, matching.ErrOrderNotFound):
+			submit = append(submit, list)
+		case err != nil:
+			return err
+		default:
+			if err := s.openList(list); err != nil {
+				logrus.Errorf("Failed to open order list %s: %v", list.ID, err)
+			}
+		}
+	}
+
+	s.placeLists(submit)
+	return nil
+}
+
+// placeLists submits the child lists of brackets to the matching engine. A
+// list the engine refuses is failed and its hold released; one it cannot
+// take right now stays pending for PlacePendingLists.
+func (s *Settlement) placeLists(lists []*models.OrderList) {
+	for _, list := range lists {
+		if s.engine == nil {
+			logrus.Warnf("No matching engine available, order list %s remains pending", list.ID)
+			continue
+		}
+
+		now := time.Now()
+		legs := make([]*matching.Order, len(list.Orders))
+		for i, leg := range list.Orders {
+			legs[i] = &matching.Order{
+				ID:        leg.ID,
+				MarketID:  leg.MarketID,
+				Side:      matching.Side(leg.Side),
+				Price:     leg.Price,
+				Size:      leg.Size,
+				Type:      matching.OrderType(leg.Type),
+				UserID:    int64(leg.UserID),
+				CreatedAt: now,
+				StopPrice: leg.StopPrice,
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := s.engine.AddOCO(ctx, list.ID, legs[0], legs[1])
+		cancel()
+		if errors.Is(err, matching.ErrEngineNotRunning) || errors.Is(err, matching.ErrOverloaded) || errors.Is(err, matching.ErrTimeout) {
+			logrus.Warnf("Matching engine cannot take order list %s now, it remains pending: %v", list.ID, err)
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Failed to submit order list %s to matching engine: %v", list.ID, err)
+			if err := s.failList(list); err != nil {
+				logrus.Errorf("Failed to release order list %s: %v", list.ID, err)
+			}
+			continue
+		}
+
+		if err := s.openList(list); err != nil {
+			logrus.Errorf("Failed to open order list %s: %v", list.ID, err)
+		}
+	}
+}
+
+// openList marks the pending legs of a list the engine took as open
+func (s *Settlement) openList(list *models.OrderList) error {
+	return s.db.Model(&models.Order{}).
+		Where("list_id = ? AND status = ?", list.ID, models.OrderStatusPending).
+		Update("status", models.OrderStatusOpen).Error
+}
+
+// failList marks the legs of a list the engine refused as failed and
+// unlocks their hold
+func (s *Settlement) failList(list *models.OrderList) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Order{}).Where("list_id = ?", list.ID).
+			Update("status", models.OrderStatusFailed).Error
+		if err != nil {
+			return err
+		}
+		for _, leg := range list.Orders {
+			if err := Release(tx, leg.ID); err != nil {
+				return err
+			}
+		}
+		if err := UpdateOrderList(tx, list.ID); err != nil {
+			return err
+		}
+		return UpdateOrderList(tx, list.ParentID)
+	})
+}
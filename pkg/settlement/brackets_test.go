@@ -0,0 +1,220 @@
+package settlement
+
+import (
+	"context"
+	"strconv"
+
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// placeBracket places a bracket of the buyer with an entry buy of size at
+// 100, a take profit at 110 and a stop loss triggered at 90
+func (suite *SettlementTestSuite) placeBracket(id string, size int64) *models.Order {
+	list := &models.OrderList{
+		ID:              id,
+		UserID:          suite.buyer.ID,
+		MarketID:        testMarket,
+		Type:            models.OrderListTypeBracket,
+		Status:          models.OrderListStatusOpen,
+		TakeProfitPrice: decimal.NewFromInt(110),
+		StopPrice:       decimal.NewFromInt(90),
+		StopLimitPrice:  decimal.NewFromInt(89),
+	}
+	suite.Require().NoError(suite.db.Create(list).Error)
+
+	return suite.placeOrder(&models.Order{
+		ID:       id + "0",
+		UserID:   suite.buyer.ID,
+		MarketID: testMarket,
+		Side:     models.OrderSideBuy,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusPending,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.NewFromInt(size),
+		ListID:   id,
+	})
+}
+
+// sell has the seller take size from the book at 100
+func (suite *SettlementTestSuite) sell(id string, size string) {
+	suite.placeOrder(&models.Order{
+		ID:       id,
+		UserID:   suite.seller.ID,
+		MarketID: testMarket,
+		Side:     models.OrderSideSell,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusPending,
+		Price:    decimal.NewFromInt(100),
+		Size:     decimal.RequireFromString(size),
+	})
+}
+
+// openChildList opens the next child list of a bracket whose entry bought
+// size, without placing it in the engine
+func (suite *SettlementTestSuite) openChildList(size string) *models.OrderList {
+	suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.buyer.ID, Asset: "BTC", Available: decimal.NewFromInt(10)}).Error)
+	suite.Require().NoError(suite.db.Create(&models.OrderList{
+		ID:              "b",
+		UserID:          suite.buyer.ID,
+		MarketID:        testMarket,
+		Type:            models.OrderListTypeBracket,
+		Status:          models.OrderListStatusExecuting,
+		TakeProfitPrice: decimal.NewFromInt(110),
+		StopPrice:       decimal.NewFromInt(90),
+		StopLimitPrice:  decimal.NewFromInt(89),
+	}).Error)
+	entry := &models.Order{
+		ID:         "b0",
+		UserID:     suite.buyer.ID,
+		MarketID:   testMarket,
+		Side:       models.OrderSideBuy,
+		Type:       models.OrderTypeLimit,
+		Status:     models.OrderStatusFilled,
+		Price:      decimal.NewFromInt(100),
+		Size:       decimal.RequireFromString(size),
+		FilledSize: decimal.RequireFromString(size),
+		ListID:     "b",
+	}
+	suite.Require().NoError(suite.db.Create(entry).Error)
+
+	var list *models.OrderList
+	suite.Require().NoError(suite.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		list, err = openBracketList(tx, &suite.market, entry, decimal.RequireFromString(size))
+		return err
+	}))
+	return list
+}
+
+func (suite *SettlementTestSuite) TestBracketChildrenFollowFills() {
+	suite.setup()
+	suite.placeBracket("b", 2)
+
+	// the entry rests and pays the maker fee in the base asset it buys
+	fills := []struct {
+		size  string
+		child string
+	}{
+		{"0.5", "0.4995"},
+		{"1.5", "1.4985"},
+	}
+	for i, fill := range fills {
+		suite.sell("sell"+fill.size, fill.size)
+		listID := "b-" + strconv.Itoa(i+1)
+
+		suite.settled(listID+"1", models.OrderStatusOpen)
+		suite.settled(listID+"2", models.OrderStatusOpen)
+		list := suite.list(listID)
+		suite.Equal("b", list.ParentID)
+		suite.Equal(models.OrderListTypeOCO, list.Type)
+		suite.Require().Len(list.Orders, 2)
+
+		takeProfit, stopLoss := list.Orders[0], list.Orders[1]
+		for _, leg := range list.Orders {
+			suite.Equal(models.OrderSideSell, leg.Side)
+			suite.Equal(fill.child, leg.Size.String(), "size of %s", leg.ID)
+		}
+		suite.Equal(models.OrderTypeLimit, takeProfit.Type)
+		suite.Equal("110", takeProfit.Price.String())
+		suite.Equal(models.OrderTypeStopLimit, stopLoss.Type)
+		suite.Equal("90", stopLoss.StopPrice.String())
+		suite.Equal("89", stopLoss.Price.String())
+
+		_, err := suite.engine.GetOrder(testMarket, takeProfit.ID)
+		suite.NoError(err)
+	}
+
+	suite.settled("b0", models.OrderStatusFilled)
+	suite.Equal(models.OrderListStatusExecuting, suite.list("b").Status)
+
+	// the children hold what the entry bought
+	balance := suite.balance(suite.buyer, "BTC")
+	suite.True(balance.Locked.Equal(decimal.RequireFromString("1.998")), balance.Locked.String())
+	suite.True(balance.Available.IsZero(), balance.Available.String())
+}
+
+func (suite *SettlementTestSuite) TestCancelBracketBeforeFill() {
+	suite.setup()
+	suite.placeBracket("b", 1)
+	suite.Equal("100", suite.balance(suite.buyer, "USDT").Locked.String())
+
+	suite.Require().NoError(suite.engine.CancelOrder(context.Background(), testMarket, "b0"))
+	suite.settled("b0", models.OrderStatusCancelled)
+	suite.Eventually(func() bool { return suite.list("b").Status == models.OrderListStatusCancelled }, timeout, tick)
+
+	suite.True(suite.order("b0").Hold.IsZero())
+	balance := suite.balance(suite.buyer, "USDT")
+	suite.True(balance.Locked.IsZero(), balance.Locked.String())
+	suite.True(balance.Available.Equal(decimal.NewFromInt(10000)), balance.Available.String())
+
+	var children int64
+	suite.Require().NoError(suite.db.Model(&models.OrderList{}).Where("parent_id = ?", "b").Count(&children).Error)
+	suite.Zero(children)
+}
+
+func (suite *SettlementTestSuite) TestFailListReleasesHold() {
+	suite.setup()
+	list := suite.openChildList("1")
+	suite.Equal("1", suite.balance(suite.buyer, "BTC").Locked.String())
+
+	suite.Require().NoError(suite.settler.failList(list))
+
+	for _, leg := range suite.list(list.ID).Orders {
+		suite.Equal(models.OrderStatusFailed, leg.Status, "status of %s", leg.ID)
+		suite.True(leg.Hold.IsZero(), "hold of %s", leg.ID)
+	}
+	suite.Equal(models.OrderListStatusFailed, suite.list(list.ID).Status)
+	// the filled entry is all that is left of the bracket
+	suite.Equal(models.OrderListStatusDone, suite.list("b").Status)
+
+	balance := suite.balance(suite.buyer, "BTC")
+	suite.True(balance.Locked.IsZero(), balance.Locked.String())
+	suite.True(balance.Available.Equal(decimal.NewFromInt(10)), balance.Available.String())
+}
+
+func (suite *SettlementTestSuite) TestPendingLists() {
+	suite.Run("a stopped engine leaves the list pending", func() {
+		suite.setup()
+		list := suite.openChildList("1")
+		_, err := suite.engine.Stop(context.Background())
+		suite.Require().NoError(err)
+
+		suite.settler.placeLists([]*models.OrderList{list})
+
+		for _, leg := range suite.list(list.ID).Orders {
+			suite.Equal(models.OrderStatusPending, leg.Status, "status of %s", leg.ID)
+		}
+		suite.Equal(models.OrderListStatusOpen, suite.list(list.ID).Status)
+		suite.Equal("1", suite.balance(suite.buyer, "BTC").Locked.String())
+	})
+
+	suite.Run("pending lists are placed once the engine runs", func() {
+		suite.setup()
+		list := suite.openChildList("1")
+
+		suite.Require().NoError(suite.settler.PlacePendingLists())
+
+		for _, leg := range suite.list(list.ID).Orders {
+			suite.Equal(models.OrderStatusOpen, leg.Status, "status of %s", leg.ID)
+			_, err := suite.engine.GetOrder(testMarket, leg.ID)
+			suite.NoError(err, "leg %s", leg.ID)
+		}
+	})
+
+	suite.Run("a list the engine holds already is only marked open", func() {
+		suite.setup()
+		list := suite.openChildList("1")
+		suite.Require().NoError(suite.engine.AddOCO(context.Background(), list.ID, engineOrder(&list.Orders[0]), engineOrder(&list.Orders[1])))
+
+		suite.Require().NoError(suite.settler.PlacePendingLists())
+
+		for _, leg := range suite.list(list.ID).Orders {
+			suite.Equal(models.OrderStatusOpen, leg.Status, "status of %s", leg.ID)
+		}
+		open, err := suite.engine.OpenOrders(testMarket, int64(suite.buyer.ID))
+		suite.Require().NoError(err)
+		suite.Len(open, 2)
+	})
+}
@@ -0,0 +1,234 @@
+package settlement
+
+import (
+	"errors"
+
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInsufficientBalance is returned when the available balance cannot cover
+// an order's hold
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// HoldAmount returns the asset and amount an order locks while it is open.
+// Limit buys lock price times size of the quote asset and market buys their
+// quote size. Sells lock their base size, except market sells: they are
+// sized in the quote asset, so their base cost is unknown up front. Hold
+// locks the seller's whole available base balance for them instead, and
+// MaxSize caps what they trade at that.
+func HoldAmount(order *models.Order, market *models.Market) (string, decimal.Decimal) {
+	switch {
+	case order.Side == models.OrderSideBuy && order.Type == models.OrderTypeMarket:
+		return market.QuoteAsset, order.Size
+	case order.Side == models.OrderSideBuy:
+		return market.QuoteAsset, order.Price.Mul(order.Size)
+	case order.Type == models.OrderTypeMarket:
+		return market.BaseAsset, decimal.Zero
+	default:
+		return market.BaseAsset, order.Size
+	}
+}
+
+// Hold moves an order's hold from the available to the locked balance and
+// records it on the order. It runs before the order is created, in the same
+// transaction, and fails with ErrInsufficientBalance instead of letting the
+// balance go negative.
+func Hold(tx *gorm.DB, order *models.Order, market *models.Market) error {
+	asset, amount := HoldAmount(order, market)
+	if isMarketSell(order) {
+		var err error
+		if amount, err = sellableBalance(tx, order.UserID, asset, market); err != nil {
+			return err
+		}
+	}
+	if !amount.IsPositive() {
+		return nil
+	}
+
+	result := tx.Model(&models.Balance{}).
+		Where("user_id = ? AND asset = ? AND available >= ?", order.UserID, asset, amount).
+		Updates(map[string]interface{}{
+			"available": gorm.Expr("available - ?", amount),
+			"locked":    gorm.Expr("locked + ?", amount),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientBalance
+	}
+
+	order.Hold = amount
+	return nil
+}
+
+// MaxSize is the most base size an order may trade in the engine: what a
+// market sell holds, and zero, for no cap, for every other order
+func MaxSize(order *models.Order) decimal.Decimal {
+	if isMarketSell(order) {
+		return order.Hold
+	}
+	return decimal.Zero
+}
+
+func isMarketSell(order *models.Order) bool {
+	return order.Side == models.OrderSideSell && order.Type == models.OrderTypeMarket
+}
+
+// sellableBalance returns a user's available balance of asset in whole lots
+// of the market, failing with ErrInsufficientBalance if there is none
+func sellableBalance(tx *gorm.DB, userID uint, asset string, market *models.Market) (decimal.Decimal, error) {
+	var balance models.Balance
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND asset = ?", userID, asset).
+		First(&balance).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return decimal.Zero, ErrInsufficientBalance
+	}
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	amount := balance.Available.Truncate(int32(market.SizePrecision))
+	if !amount.IsPositive() {
+		return decimal.Zero, ErrInsufficientBalance
+	}
+	return amount, nil
+}
+
+// HoldList locks a single hold for all legs of an order list, since at most
+// one of them executes. It covers the costliest leg and is recorded on the
+// first one; Release hands it on from leg to leg.
+func HoldList(tx *gorm.DB, legs []*models.Order, market *models.Market) error {
+	costliest := legs[0]
+	for _, leg := range legs[1:] {
+		_, amount := HoldAmount(leg, market)
+		if _, most := HoldAmount(costliest, market); amount.GreaterThan(most) {
+			costliest = leg
+		}
+	}
+
+	if err := Hold(tx, costliest, market); err != nil {
+		return err
+	}
+	if costliest != legs[0] {
+		legs[0].Hold, costliest.Hold = costliest.Hold, decimal.Zero
+	}
+	return nil
+}
+
+// Release returns whatever an order still holds to the available balance.
+// It is a no-op once the hold is gone, so every path that finishes an order
+// may call it. The shared hold of an order list moves on to the next leg
+// that is still open instead, and is released with the last one.
+func Release(tx *gorm.DB, orderID string) error {
+	order, err := lockOrder(tx, orderID)
+	if err != nil || !order.Hold.IsPositive() {
+		return err
+	}
+
+	if order.ListID != "" {
+		moved, err := passHold(tx, order)
+		if err != nil || moved {
+			return err
+		}
+	}
+
+	var market models.Market
+	if err := tx.Where("id = ?", order.MarketID).First(&market).Error; err != nil {
+		return err
+	}
+	asset, _ := HoldAmount(order, &market)
+
+	if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Update("hold", decimal.Zero).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.Balance{}).
+		Where("user_id = ? AND asset = ?", order.UserID, asset).
+		Updates(map[string]interface{}{
+			"available": gorm.Expr("available + ?", order.Hold),
+			"locked":    gorm.Expr("locked - ?", order.Hold),
+		}).Error
+}
+
+// passHold moves the hold of a finished list leg to another leg that is
+// still open and reports whether there was one
+func passHold(tx *gorm.DB, order *models.Order) (bool, error) {
+	var next models.Order
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		Where("list_id = ? AND id <> ? AND status IN ?", order.ListID, order.ID, openStatuses).
+		Order("id").
+		First(&next).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("hold", decimal.Zero).Error; err != nil {
+		return false, err
+	}
+	err = tx.Model(&models.Order{}).Where("id = ?", next.ID).
+		Update("hold", gorm.Expr("hold + ?", order.Hold)).Error
+	return err == nil, err
+}
+
+// spend pays amount of asset for an order, first out of what the order holds
+// and then out of the available balance. Holds cover what every order can
+// spend, so it fails with ErrInsufficientBalance rather than take the
+// available balance below zero.
+func spend(tx *gorm.DB, orderID string, userID uint, asset string, amount decimal.Decimal) error {
+	order, err := lockOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	held := decimal.Min(order.Hold, amount)
+	if held.IsPositive() {
+		if err := tx.Model(&models.Order{}).Where("id = ?", orderID).
+			Update("hold", gorm.Expr("hold - ?", held)).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Balance{}).
+			Where("user_id = ? AND asset = ?", userID, asset).
+			Update("locked", gorm.Expr("locked - ?", held)).Error; err != nil {
+			return err
+		}
+	}
+
+	rest := amount.Sub(held)
+	if !rest.IsPositive() {
+		return nil
+	}
+
+	result := tx.Model(&models.Balance{}).
+		Where("user_id = ? AND asset = ? AND available >= ?", userID, asset, rest).
+		Update("available", gorm.Expr("available - ?", rest))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientBalance
+	}
+	return nil
+}
+
+// lockOrder loads an order and locks its row until tx ends, so concurrent
+// settlements and cancellations see each other's hold updates
+func lockOrder(tx *gorm.DB, orderID string) (*models.Order, error) {
+	var order models.Order
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "user_id", "market_id", "side", "type", "hold", "list_id").
+		Where("id = ?", orderID).
+		First(&order).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &order, nil
+}
@@ -0,0 +1,94 @@
+package settlement
+
+import (
+	"bixor-engine/pkg/models"
+	"gorm.io/gorm"
+)
+
+// UpdateOrderList sets the status of an order list from the state of its
+// legs. The legs of a bracket are its entry order and the legs of the lists
+// its fills opened.
+func UpdateOrderList(tx *gorm.DB, listID string) error {
+	children := tx.Model(&models.OrderList{}).Select("id").Where("parent_id = ?", listID)
+
+	var legs []models.Order
+	err := tx.Select("id", "status", "filled_size").
+		Where("list_id = ? OR list_id IN (?)", listID, children).
+		Find(&legs).Error
+	if err != nil || len(legs) == 0 {
+		return err
+	}
+
+	status := listStatus(legs)
+	return tx.Model(&models.OrderList{}).
+		Where("id = ? AND status <> ?", listID, status).
+		Update("status", status).Error
+}
+
+// listStatus is open until a leg trades or finishes, executing while a leg
+// is still working after that, and done or cancelled once no leg is left
+func listStatus(legs []models.Order) models.OrderListStatus {
+	working, failed, traded := 0, 0, false
+	for _, leg := range legs {
+		switch leg.Status {
+		case models.OrderStatusPending, models.OrderStatusOpen:
+			working++
+		case models.OrderStatusFailed:
+			failed++
+		}
+		if leg.FilledSize.IsPositive() {
+			traded = true
+		}
+	}
+
+	switch {
+	case failed == len(legs):
+		return models.OrderListStatusFailed
+	case working == len(legs) && !traded:
+		return models.OrderListStatusOpen
+	case working > 0:
+		return models.OrderListStatusExecuting
+	case traded:
+		return models.OrderListStatusDone
+	default:
+		return models.OrderListStatusCancelled
+	}
+}
+
+// updateOrderLists refreshes the lists that settled orders are legs of
+func updateOrderLists(tx *gorm.DB, touched map[string]bool) error {
+	ids := make([]string, 0, len(touched))
+	for id := range touched {
+		ids = append(ids, id)
+	}
+
+	var listIDs []string
+	err := tx.Model(&models.Order{}).
+		Where("id IN ? AND list_id <> ''", ids).
+		Distinct().
+		Pluck("list_id", &listIDs).Error
+	if err != nil {
+		return err
+	}
+
+	if len(listIDs) == 0 {
+		return nil
+	}
+
+	// a bracket follows the lists its fills opened
+	var parentIDs []string
+	err = tx.Model(&models.OrderList{}).
+		Where("id IN ? AND parent_id <> ''", listIDs).
+		Distinct().
+		Pluck("parent_id", &parentIDs).Error
+	if err != nil {
+		return err
+	}
+
+	for _, listID := range append(listIDs, parentIDs...) {
+		if err := UpdateOrderList(tx, listID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
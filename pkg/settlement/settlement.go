@@ -0,0 +1,321 @@
+package settlement
+
+import (
+	"sync"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/models"
+	wsocket "bixor-engine/pkg/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Settlement persists engine fills: it records trades, advances the filled
+// and remaining sizes of both orders and moves balances between the buyer
+// and the seller, charging the market's maker and taker fees on the asset
+// each side receives. Each side pays out of its order's hold first, and an
+// order's leftover hold is released once it is filled or cancelled. The
+// status of order lists follows their legs, and every fill of a bracket's
+// entry order opens its take-profit and stop-loss list in the engine.
+// Pegged orders the engine moves are saved at their new price.
+//
+// Each PublishTrades call carries the outcome of a single taker order and is
+// applied in one database transaction.
+type Settlement struct {
+	db     *gorm.DB
+	hub    *wsocket.WebSocketHub
+	engine *matching.MatchingEngine
+
+	mu      sync.RWMutex
+	markets map[string]*models.Market
+}
+
+// New creates a new settlement consumer
+func New(db *gorm.DB, hub *wsocket.WebSocketHub) *Settlement {
+	return &Settlement{
+		db:      db,
+		hub:     hub,
+		markets: make(map[string]*models.Market),
+	}
+}
+
+// SetEngine sets the engine that bracket child lists are placed in. It must
+// be called before the engine starts.
+func (s *Settlement) SetEngine(engine *matching.MatchingEngine) {
+	s.engine = engine
+}
+
+// PublishTrades implements matching.PublishTrader
+func (s *Settlement) PublishTrades(trades ...*matching.Trade) {
+	if s.db == nil || len(trades) == 0 {
+		return
+	}
+
+	market, err := s.market(trades[0].MarketID)
+	if err != nil {
+		logrus.Errorf("Failed to settle %d trades for order %s: unknown market %s: %v",
+			len(trades), trades[0].TakerOrderID, trades[0].MarketID, err)
+		return
+	}
+
+	touched := make(map[string]bool)
+	var lists []*models.OrderList
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.settle(tx, market, trades, touched); err != nil {
+			return err
+		}
+
+		var err error
+		if lists, err = openBrackets(tx, market, trades); err != nil {
+			return err
+		}
+		return updateOrderLists(tx, touched)
+	})
+	if err != nil {
+		logrus.Errorf("Failed to settle %d trades for order %s: %v", len(trades), trades[0].TakerOrderID, err)
+		return
+	}
+
+	s.placeLists(lists)
+	for _, list := range lists {
+		for _, leg := range list.Orders {
+			touched[leg.ID] = true
+		}
+	}
+	s.broadcastOrders(touched)
+}
+
+// PublishOrderUpdates implements matching.OrderUpdatePublisher. It records
+// the prices the engine moved pegged orders to.
+func (s *Settlement) PublishOrderUpdates(updates ...*matching.OrderUpdate) {
+	if s.db == nil {
+		return
+	}
+
+	touched := make(map[string]bool)
+	for _, update := range updates {
+		err := s.db.Model(&models.Order{}).
+			Where("id = ? AND status IN ?", update.OrderID, openStatuses).
+			Update("price", update.Price).Error
+		if err != nil {
+			logrus.Errorf("Failed to reprice order %s: %v", update.OrderID, err)
+			continue
+		}
+		touched[update.OrderID] = true
+	}
+	s.broadcastOrders(touched)
+}
+
+// settle applies one taker order's trades inside tx and records the IDs of
+// every order it changed in touched
+func (s *Settlement) settle(tx *gorm.DB, market *models.Market, trades []*matching.Trade, touched map[string]bool) error {
+	taker := trades[0]
+	filled := false
+	cancelled := false
+
+	for _, trade := range trades {
+		if trade.IsCancel {
+			cancelled = true
+			continue
+		}
+
+		if err := s.settleFill(tx, market, trade); err != nil {
+			return err
+		}
+
+		filled = true
+		touched[trade.MakerOrderID] = true
+	}
+	touched[taker.TakerOrderID] = true
+
+	now := time.Now()
+	switch {
+	case cancelled:
+		// the engine dropped the unfilled rest of the taker order, or a
+		// resting order was cancelled
+		err := tx.Model(&models.Order{}).
+			Where("id = ? AND status IN ?", taker.TakerOrderID, openStatuses).
+			Updates(map[string]interface{}{
+				"status":       models.OrderStatusCancelled,
+				"cancelled_at": now,
+			}).Error
+		if err != nil {
+			return err
+		}
+		return Release(tx, taker.TakerOrderID)
+	case taker.TakerOrderType == matching.Market && filled:
+		// market orders never rest, so whatever they matched is final
+		err := tx.Model(&models.Order{}).
+			Where("id = ? AND status IN ?", taker.TakerOrderID, openStatuses).
+			Updates(map[string]interface{}{
+				"status":    models.OrderStatusFilled,
+				"filled_at": now,
+			}).Error
+		if err != nil {
+			return err
+		}
+		return Release(tx, taker.TakerOrderID)
+	}
+
+	return nil
+}
+
+var openStatuses = []models.OrderStatus{models.OrderStatusPending, models.OrderStatusOpen}
+
+// settleFill records a single fill and moves the funds it exchanged
+func (s *Settlement) settleFill(tx *gorm.DB, market *models.Market, trade *matching.Trade) error {
+	notional := trade.Price.Mul(trade.Size)
+
+	buyerID, sellerID := uint(trade.TakerUserID), uint(trade.MakerUserID)
+	buyerOrderID, sellerOrderID := trade.TakerOrderID, trade.MakerOrderID
+	buyerRate, sellerRate := market.TakerFee, market.MakerFee
+	if trade.TakerOrderSide == matching.Sell {
+		buyerID, sellerID = sellerID, buyerID
+		buyerOrderID, sellerOrderID = sellerOrderID, buyerOrderID
+		buyerRate, sellerRate = sellerRate, buyerRate
+	}
+
+	// buyers pay fees in the base asset, sellers in the quote asset
+	buyerFee := trade.Size.Mul(buyerRate)
+	sellerFee := notional.Mul(sellerRate)
+
+	takerFee, makerFee := buyerFee, sellerFee
+	if trade.TakerOrderSide == matching.Sell {
+		takerFee, makerFee = sellerFee, buyerFee
+	}
+
+	record := models.Trade{
+		MarketID:     trade.MarketID,
+		TakerOrderID: trade.TakerOrderID,
+		MakerOrderID: trade.MakerOrderID,
+		TakerUserID:  uint(trade.TakerUserID),
+		MakerUserID:  uint(trade.MakerUserID),
+		Price:        trade.Price,
+		Size:         trade.Size,
+		TakerSide:    models.OrderSide(trade.TakerOrderSide),
+		TakerFee:     takerFee,
+		MakerFee:     makerFee,
+		CreatedAt:    trade.CreatedAt,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return err
+	}
+
+	// market orders are sized in quote currency, so only their filled size
+	// is meaningful
+	if err := fillOrder(tx, trade.TakerOrderID, trade.Size, takerFee, trade.TakerOrderType != matching.Market, trade.CreatedAt); err != nil {
+		return err
+	}
+	if err := fillOrder(tx, trade.MakerOrderID, trade.Size, makerFee, true, trade.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := spend(tx, buyerOrderID, buyerID, market.QuoteAsset, notional); err != nil {
+		return err
+	}
+	if err := adjustBalance(tx, buyerID, market.BaseAsset, trade.Size.Sub(buyerFee)); err != nil {
+		return err
+	}
+	if err := spend(tx, sellerOrderID, sellerID, market.BaseAsset, trade.Size); err != nil {
+		return err
+	}
+	return adjustBalance(tx, sellerID, market.QuoteAsset, notional.Sub(sellerFee))
+}
+
+// fillOrder adds a fill to an order, marks it filled once nothing remains and
+// then releases what is left of its hold
+func fillOrder(tx *gorm.DB, orderID string, size, fee decimal.Decimal, trackRemaining bool, at time.Time) error {
+	updates := map[string]interface{}{
+		"filled_size": gorm.Expr("filled_size + ?", size),
+		"fee":         gorm.Expr("fee + ?", fee),
+	}
+	if trackRemaining {
+		updates["remaining_size"] = gorm.Expr("remaining_size - ?", size)
+	}
+
+	if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	if !trackRemaining {
+		return nil
+	}
+
+	result := tx.Model(&models.Order{}).
+		Where("id = ? AND remaining_size <= 0 AND status IN ?", orderID, openStatuses).
+		Updates(map[string]interface{}{
+			"status":    models.OrderStatusFilled,
+			"filled_at": at,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	return Release(tx, orderID)
+}
+
+// adjustBalance adds delta to a user's available balance, creating the
+// balance row if the user has never held the asset
+func adjustBalance(tx *gorm.DB, userID uint, asset string, delta decimal.Decimal) error {
+	result := tx.Model(&models.Balance{}).
+		Where("user_id = ? AND asset = ?", userID, asset).
+		Update("available", gorm.Expr("available + ?", delta))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	return tx.Create(&models.Balance{
+		UserID:    userID,
+		Asset:     asset,
+		Available: delta,
+	}).Error
+}
+
+// market returns a market's fee and asset configuration, loading it once
+func (s *Settlement) market(marketID string) (*models.Market, error) {
+	s.mu.RLock()
+	market, ok := s.markets[marketID]
+	s.mu.RUnlock()
+	if ok {
+		return market, nil
+	}
+
+	market = &models.Market{}
+	if err := s.db.Where("id = ?", marketID).First(market).Error; err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.markets[marketID] = market
+	s.mu.Unlock()
+
+	return market, nil
+}
+
+// broadcastOrders pushes the settled state of every touched order to its
+// owner
+func (s *Settlement) broadcastOrders(touched map[string]bool) {
+	if s.hub == nil || len(touched) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(touched))
+	for id := range touched {
+		ids = append(ids, id)
+	}
+
+	var orders []models.Order
+	if err := s.db.Where("id IN ?", ids).Find(&orders).Error; err != nil {
+		logrus.Errorf("Failed to load settled orders: %v", err)
+		return
+	}
+
+	for _, order := range orders {
+		s.hub.BroadcastUserOrderUpdate(order.UserID, order)
+	}
+}
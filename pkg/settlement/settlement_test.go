@@ -0,0 +1,229 @@
+package settlement
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bixor-engine/internal/matching"
+	"bixor-engine/pkg/database/databasetest"
+	"bixor-engine/pkg/models"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/gorm"
+)
+
+const (
+	testMarket = "BTC-USDT"
+
+	// how long to wait for settlement, and how often to look
+	timeout = 2 * time.Second
+	tick    = 10 * time.Millisecond
+)
+
+type SettlementTestSuite struct {
+	suite.Suite
+	db      *gorm.DB
+	settler *Settlement
+	engine  *matching.MatchingEngine
+	market  models.Market
+	buyer   models.User
+	seller  models.User
+}
+
+func TestSettlementTestSuite(t *testing.T) {
+	suite.Run(t, new(SettlementTestSuite))
+}
+
+// setup gives the running test its own database and an engine settled into
+// it, with a buyer who has quote funds and a seller who has base funds
+func (suite *SettlementTestSuite) setup() {
+	suite.db = databasetest.Open(suite.T())
+
+	suite.buyer = models.User{Email: "buyer@example.com", Username: "buyer", Role: models.RoleTrader, IsActive: true, IsVerified: true}
+	suite.seller = models.User{Email: "seller@example.com", Username: "seller", Role: models.RoleTrader, IsActive: true, IsVerified: true}
+	suite.Require().NoError(suite.db.Create(&suite.buyer).Error)
+	suite.Require().NoError(suite.db.Create(&suite.seller).Error)
+	suite.market = models.Market{
+		ID:             testMarket,
+		BaseAsset:      "BTC",
+		QuoteAsset:     "USDT",
+		IsActive:       true,
+		PricePrecision: 2,
+		SizePrecision:  4,
+		MakerFee:       decimal.RequireFromString("0.001"),
+		TakerFee:       decimal.RequireFromString("0.002"),
+	}
+	suite.Require().NoError(suite.db.Create(&suite.market).Error)
+	suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.buyer.ID, Asset: "USDT", Available: decimal.NewFromInt(10000)}).Error)
+	suite.Require().NoError(suite.db.Create(&models.Balance{UserID: suite.seller.ID, Asset: "BTC", Available: decimal.NewFromInt(10)}).Error)
+
+	suite.settler = New(suite.db, nil)
+	suite.engine = matching.NewMatchingEngine(suite.settler)
+	suite.settler.SetEngine(suite.engine)
+	suite.Require().NoError(suite.engine.RegisterMarket(matching.MarketConfig{ID: testMarket, PricePrecision: 2, SizePrecision: 4}))
+	suite.Require().NoError(suite.engine.Start(context.Background()))
+	engine := suite.engine
+	suite.T().Cleanup(func() {
+		// some tests stop the engine themselves
+		_, _ = engine.Stop(context.Background())
+	})
+}
+
+// engineOrder converts a saved order for the engine
+func engineOrder(order *models.Order) *matching.Order {
+	return &matching.Order{
+		ID:        order.ID,
+		MarketID:  order.MarketID,
+		Side:      matching.Side(order.Side),
+		Price:     order.Price,
+		Size:      order.Size,
+		Type:      matching.OrderType(order.Type),
+		UserID:    int64(order.UserID),
+		CreatedAt: time.Now(),
+		StopPrice: order.StopPrice,
+	}
+}
+
+// place holds the funds of a limit order, saves it and submits it to the
+// engine
+func (suite *SettlementTestSuite) place(id string, user models.User, side models.OrderSide, size, price int64) *models.Order {
+	return suite.placeOrder(&models.Order{
+		ID:       id,
+		UserID:   user.ID,
+		MarketID: testMarket,
+		Side:     side,
+		Type:     models.OrderTypeLimit,
+		Status:   models.OrderStatusPending,
+		Price:    decimal.NewFromInt(price),
+		Size:     decimal.NewFromInt(size),
+	})
+}
+
+func (suite *SettlementTestSuite) placeOrder(order *models.Order) *models.Order {
+	suite.Require().NoError(suite.db.Transaction(func(tx *gorm.DB) error {
+		if err := Hold(tx, order, &suite.market); err != nil {
+			return err
+		}
+		return tx.Create(order).Error
+	}))
+	suite.Require().NoError(suite.engine.AddOrder(context.Background(), engineOrder(order)))
+	suite.db.Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, models.OrderStatusPending).
+		Update("status", models.OrderStatusOpen)
+	return order
+}
+
+// placeOCO places a sell list of the seller with a take-profit leg at price
+// and a stop-loss leg triggered at stopPrice
+func (suite *SettlementTestSuite) placeOCO(id string, size, price, stopPrice, stopLimitPrice int64) []*models.Order {
+	list := &models.OrderList{ID: id, UserID: suite.seller.ID, MarketID: testMarket, Type: models.OrderListTypeOCO, Status: models.OrderListStatusOpen}
+	legs := []*models.Order{
+		{ID: id + "1", Type: models.OrderTypeLimit, Price: decimal.NewFromInt(price)},
+		{ID: id + "2", Type: models.OrderTypeStopLimit, Price: decimal.NewFromInt(stopLimitPrice), StopPrice: decimal.NewFromInt(stopPrice)},
+	}
+	for _, leg := range legs {
+		leg.UserID, leg.MarketID, leg.Side, leg.Status = suite.seller.ID, testMarket, models.OrderSideSell, models.OrderStatusPending
+		leg.Size, leg.ListID = decimal.NewFromInt(size), id
+	}
+
+	suite.Require().NoError(suite.db.Transaction(func(tx *gorm.DB) error {
+		if err := HoldList(tx, legs, &suite.market); err != nil {
+			return err
+		}
+		if err := tx.Create(list).Error; err != nil {
+			return err
+		}
+		return tx.Create(legs).Error
+	}))
+	suite.Require().NoError(suite.engine.AddOCO(context.Background(), id, engineOrder(legs[0]), engineOrder(legs[1])))
+	suite.db.Model(&models.Order{}).
+		Where("list_id = ? AND status = ?", id, models.OrderStatusPending).
+		Update("status", models.OrderStatusOpen)
+	return legs
+}
+
+func (suite *SettlementTestSuite) order(id string) models.Order {
+	var order models.Order
+	suite.Require().NoError(suite.db.Where("id = ?", id).First(&order).Error)
+	return order
+}
+
+func (suite *SettlementTestSuite) list(id string) models.OrderList {
+	var list models.OrderList
+	suite.Require().NoError(suite.db.Preload("Orders", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).Where("id = ?", id).First(&list).Error)
+	return list
+}
+
+func (suite *SettlementTestSuite) balance(user models.User, asset string) models.Balance {
+	var balance models.Balance
+	suite.Require().NoError(suite.db.Where("user_id = ? AND asset = ?", user.ID, asset).First(&balance).Error)
+	return balance
+}
+
+// settled waits until an order reached status
+func (suite *SettlementTestSuite) settled(id string, status models.OrderStatus) {
+	suite.Eventually(func() bool { return suite.order(id).Status == status }, timeout, tick, "order %s", id)
+}
+
+func (suite *SettlementTestSuite) TestOCOLegCancellation() {
+	tests := []struct {
+		name   string
+		act    func()
+		limit  models.OrderStatus
+		stop   models.OrderStatus
+		status models.OrderListStatus
+		locked int64
+	}{
+		{
+			name:   "the limit leg filling cancels the stop leg",
+			act:    func() { suite.place("taker", suite.buyer, models.OrderSideBuy, 1, 110) },
+			limit:  models.OrderStatusFilled,
+			stop:   models.OrderStatusCancelled,
+			status: models.OrderListStatusDone,
+		},
+		{
+			name: "the stop leg triggering cancels the limit leg",
+			act: func() {
+				// a trade at the stop price
+				suite.place("bid", suite.buyer, models.OrderSideBuy, 1, 90)
+				suite.place("ask", suite.seller, models.OrderSideSell, 1, 90)
+			},
+			limit:  models.OrderStatusCancelled,
+			stop:   models.OrderStatusOpen,
+			status: models.OrderListStatusExecuting,
+			locked: 1,
+		},
+		{
+			name: "cancelling the list cancels both legs",
+			act: func() {
+				suite.Require().NoError(suite.engine.CancelOrderList(context.Background(), testMarket, "oco"))
+			},
+			limit:  models.OrderStatusCancelled,
+			stop:   models.OrderStatusCancelled,
+			status: models.OrderListStatusCancelled,
+		},
+	}
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.setup()
+			suite.placeOCO("oco", 1, 110, 90, 89)
+			suite.Equal(decimal.NewFromInt(1).String(), suite.balance(suite.seller, "BTC").Locked.String())
+
+			tt.act()
+			suite.settled("oco1", tt.limit)
+			suite.settled("oco2", tt.stop)
+			suite.Eventually(func() bool { return suite.list("oco").Status == tt.status }, timeout, tick)
+
+			// the shared hold stays with a working leg and is released
+			// with the last one
+			balance := suite.balance(suite.seller, "BTC")
+			suite.True(balance.Locked.Equal(decimal.NewFromInt(tt.locked)), balance.Locked.String())
+			if tt.locked == 0 {
+				for _, leg := range suite.list("oco").Orders {
+					suite.True(leg.Hold.IsZero(), "hold of %s", leg.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"time"
+
+	"bixor-engine/internal/matching"
+	"github.com/shopspring/decimal"
+)
+
+// PublicTrade is the anonymised trade sent on the trades.<market_id> channel
+type PublicTrade struct {
+	MarketID  string          `json:"market_id"`
+	Price     decimal.Decimal `json:"price"`
+	Size      decimal.Decimal `json:"size"`
+	TakerSide matching.Side   `json:"taker_side"`
+	Time      time.Time       `json:"time"`
+}
+
+// UserTrade is a fill as seen by one of its two parties
+type UserTrade struct {
+	MarketID      string          `json:"market_id"`
+	OrderID       string          `json:"order_id"`
+	ClientOrderID string          `json:"client_order_id,omitempty"`
+	Side          matching.Side   `json:"side"`
+	Role          string          `json:"role"` // taker or maker
+	Price         decimal.Decimal `json:"price"`
+	Size          decimal.Decimal `json:"size"`
+	Time          time.Time       `json:"time"`
+}
+
+// TradeFeed turns engine fills into public trade updates and private fill
+// notifications for the taker and the maker
+type TradeFeed struct {
+	hub *WebSocketHub
+}
+
+// NewTradeFeed creates a new trade feed on top of hub
+func NewTradeFeed(hub *WebSocketHub) *TradeFeed {
+	return &TradeFeed{
+		hub: hub,
+	}
+}
+
+// PublishTrades implements matching.PublishTrader
+func (f *TradeFeed) PublishTrades(trades ...*matching.Trade) {
+	for _, trade := range trades {
+		if trade.IsCancel {
+			continue
+		}
+
+		f.hub.BroadcastTradeUpdate(trade.MarketID, PublicTrade{
+			MarketID:  trade.MarketID,
+			Price:     trade.Price,
+			Size:      trade.Size,
+			TakerSide: trade.TakerOrderSide,
+			Time:      trade.CreatedAt,
+		})
+
+		makerSide := matching.Buy
+		if trade.TakerOrderSide == matching.Buy {
+			makerSide = matching.Sell
+		}
+
+		f.hub.BroadcastUserTradeUpdate(uint(trade.TakerUserID), UserTrade{
+			MarketID:      trade.MarketID,
+			OrderID:       trade.TakerOrderID,
+			ClientOrderID: trade.TakerClientOrderID,
+			Side:          trade.TakerOrderSide,
+			Role:          "taker",
+			Price:         trade.Price,
+			Size:          trade.Size,
+			Time:          trade.CreatedAt,
+		})
+		f.hub.BroadcastUserTradeUpdate(uint(trade.MakerUserID), UserTrade{
+			MarketID:      trade.MarketID,
+			OrderID:       trade.MakerOrderID,
+			ClientOrderID: trade.MakerClientOrderID,
+			Side:          makerSide,
+			Role:          "maker",
+			Price:         trade.Price,
+			Size:          trade.Size,
+			Time:          trade.CreatedAt,
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -34,6 +35,12 @@ type WebSocketHub struct {
 	// User subscriptions
 	userSubscriptions map[uint]map[*Client]bool
 	
+	// Channel subscriptions (e.g. bookTicker.BTC-USDT)
+	channelSubscriptions map[string]map[*Client]bool
+
+	// Called with the user of a cancel-on-disconnect client that went away
+	onDisconnect func(userID uint)
+
 	// Mutex for thread-safe operations
 	mu sync.RWMutex
 }
@@ -59,6 +66,9 @@ type Client struct {
 	
 	// Last seen timestamp
 	lastSeen time.Time
+
+	// Cancel the user's open orders when this connection drops
+	cancelOnDisconnect atomic.Bool
 }
 
 // Message represents a WebSocket message
@@ -75,30 +85,38 @@ type SubscriptionRequest struct {
 	Type    string `json:"type"`
 	Channel string `json:"channel"`
 	Auth    string `json:"auth,omitempty"`
+	Enabled bool   `json:"enabled,omitempty"` // cancel_on_disconnect
 }
 
 // Message types
 const (
-	MessageTypeSubscribe        = "subscribe"
-	MessageTypeUnsubscribe      = "unsubscribe"
-	MessageTypePing             = "ping"
-	MessageTypePong             = "pong"
-	MessageTypeError            = "error"
-	MessageTypeOrderBookUpdate  = "orderbook_update"
-	MessageTypeTradeUpdate      = "trade_update"
-	MessageTypeOrderUpdate      = "order_update"
-	MessageTypeBalanceUpdate    = "balance_update"
-	MessageTypeMarketStatsUpdate = "market_stats_update"
+	MessageTypeSubscribe          = "subscribe"
+	MessageTypeUnsubscribe        = "unsubscribe"
+	MessageTypePing               = "ping"
+	MessageTypePong               = "pong"
+	MessageTypeError              = "error"
+	MessageTypeOrderBookUpdate    = "orderbook_update"
+	MessageTypeTradeUpdate        = "trade_update"
+	MessageTypeOrderUpdate        = "order_update"
+	MessageTypeBalanceUpdate      = "balance_update"
+	MessageTypeMarketStatsUpdate  = "market_stats_update"
+	MessageTypeBookTicker         = "book_ticker"
+	MessageTypeKlineUpdate        = "kline_update"
+	MessageTypeCancelOnDisconnect = "cancel_on_disconnect"
+	MessageTypeAlgoOrderUpdate    = "algo_order_update"
 )
 
 // Channel types
 const (
-	ChannelOrderBook    = "orderbook"
-	ChannelTrades       = "trades"
-	ChannelMarketStats  = "market_stats"
-	ChannelUserOrders   = "user_orders"
-	ChannelUserBalances = "user_balances"
-	ChannelUserTrades   = "user_trades"
+	ChannelOrderBook      = "orderbook"
+	ChannelTrades         = "trades"
+	ChannelMarketStats    = "market_stats"
+	ChannelUserOrders     = "user_orders"
+	ChannelUserBalances   = "user_balances"
+	ChannelUserTrades     = "user_trades"
+	ChannelBookTicker     = "bookTicker"
+	ChannelKline          = "kline"
+	ChannelUserAlgoOrders = "user_algo_orders"
 )
 
 // WebSocket connection settings
@@ -121,15 +139,24 @@ var upgrader = websocket.Upgrader{
 // NewHub creates a new WebSocket hub
 func NewHub() *WebSocketHub {
 	return &WebSocketHub{
-		clients:             make(map[*Client]bool),
-		broadcast:           make(chan []byte),
-		register:            make(chan *Client),
-		unregister:          make(chan *Client),
-		marketSubscriptions: make(map[string]map[*Client]bool),
-		userSubscriptions:   make(map[uint]map[*Client]bool),
+		clients:              make(map[*Client]bool),
+		broadcast:            make(chan []byte),
+		register:             make(chan *Client),
+		unregister:           make(chan *Client),
+		marketSubscriptions:  make(map[string]map[*Client]bool),
+		userSubscriptions:    make(map[uint]map[*Client]bool),
+		channelSubscriptions: make(map[string]map[*Client]bool),
 	}
 }
 
+// SetDisconnectHandler sets what runs when a client that opted into
+// cancel-on-disconnect goes away. It is called on its own goroutine.
+func (h *WebSocketHub) SetDisconnectHandler(handler func(userID uint)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onDisconnect = handler
+}
+
 // Run starts the WebSocket hub
 func (h *WebSocketHub) Run(ctx context.Context) {
 	ticker := time.NewTicker(pingPeriod)
@@ -138,6 +165,7 @@ func (h *WebSocketHub) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			h.closeClients()
 			return
 		case client := <-h.register:
 			h.registerClient(client)
@@ -176,6 +204,22 @@ func (h *WebSocketHub) registerClient(client *Client) {
 	}
 }
 
+// closeClients disconnects every client on shutdown. Closing the send
+// channel lets the write pump flush what is queued and send a close frame.
+func (h *WebSocketHub) closeClients() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		close(client.send)
+	}
+	h.clients = make(map[*Client]bool)
+	h.marketSubscriptions = make(map[string]map[*Client]bool)
+	h.userSubscriptions = make(map[uint]map[*Client]bool)
+	h.channelSubscriptions = make(map[string]map[*Client]bool)
+	logrus.Info("WebSocket hub closed all client connections")
+}
+
 // unregisterClient unregisters a client
 func (h *WebSocketHub) unregisterClient(client *Client) {
 	h.mu.Lock()
@@ -195,6 +239,16 @@ func (h *WebSocketHub) unregisterClient(client *Client) {
 			}
 		}
 		
+		// Remove from channel subscriptions
+		for channel, clients := range h.channelSubscriptions {
+			if _, exists := clients[client]; exists {
+				delete(clients, client)
+				if len(clients) == 0 {
+					delete(h.channelSubscriptions, channel)
+				}
+			}
+		}
+
 		// Remove from user subscriptions
 		if client.user != nil {
 			if clients, exists := h.userSubscriptions[client.user.ID]; exists {
@@ -203,6 +257,10 @@ func (h *WebSocketHub) unregisterClient(client *Client) {
 					delete(h.userSubscriptions, client.user.ID)
 				}
 			}
+
+			if client.cancelOnDisconnect.Load() && h.onDisconnect != nil {
+				go h.onDisconnect(client.user.ID)
+			}
 		}
 		
 		logrus.Infof("WebSocket client unregistered: %s", client.id)
@@ -290,6 +348,84 @@ func (h *WebSocketHub) SubscribeToUser(client *Client, userID uint) {
 	logrus.Infof("Client %s subscribed to user %d", client.id, userID)
 }
 
+// SubscribeToChannel subscribes a client to a named channel
+func (h *WebSocketHub) SubscribeToChannel(client *Client, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.channelSubscriptions[channel] == nil {
+		h.channelSubscriptions[channel] = make(map[*Client]bool)
+	}
+	h.channelSubscriptions[channel][client] = true
+	client.subscriptions[channel] = true
+
+	logrus.Infof("Client %s subscribed to channel %s", client.id, channel)
+}
+
+// UnsubscribeFromChannel unsubscribes a client from a named channel
+func (h *WebSocketHub) UnsubscribeFromChannel(client *Client, channel string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if clients, exists := h.channelSubscriptions[channel]; exists {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.channelSubscriptions, channel)
+		}
+	}
+	delete(client.subscriptions, channel)
+
+	logrus.Infof("Client %s unsubscribed from channel %s", client.id, channel)
+}
+
+// broadcastToChannel sends a message to every client subscribed to a named channel
+func (h *WebSocketHub) broadcastToChannel(channel, messageType string, payload interface{}) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	clients := h.channelSubscriptions[channel]
+	if len(clients) == 0 {
+		return
+	}
+
+	message := Message{
+		Type:      messageType,
+		Channel:   channel,
+		Data:      payload,
+		Timestamp: time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	for client := range clients {
+		select {
+		case client.send <- data:
+		default:
+			// Slow client, drop the update; the next one supersedes it
+		}
+	}
+}
+
+// BroadcastBookTicker broadcasts best bid/offer changes to subscribed clients
+func (h *WebSocketHub) BroadcastBookTicker(marketID string, ticker interface{}) {
+	h.broadcastToChannel(fmt.Sprintf("%s.%s", ChannelBookTicker, marketID), MessageTypeBookTicker, ticker)
+}
+
+// BroadcastKline broadcasts candlestick updates to clients subscribed to kline.<market_id>.<interval>
+func (h *WebSocketHub) BroadcastKline(marketID, interval string, kline interface{}) {
+	h.broadcastToChannel(fmt.Sprintf("%s.%s.%s", ChannelKline, marketID, interval), MessageTypeKlineUpdate, kline)
+}
+
+// BroadcastMarketStats broadcasts rolling 24h statistics to clients subscribed
+// to the market_stats channel, either for all markets or for this market only
+func (h *WebSocketHub) BroadcastMarketStats(marketID string, stats interface{}) {
+	h.broadcastToChannel(ChannelMarketStats, MessageTypeMarketStatsUpdate, stats)
+	h.broadcastToChannel(fmt.Sprintf("%s.%s", ChannelMarketStats, marketID), MessageTypeMarketStatsUpdate, stats)
+}
+
 // BroadcastOrderBookUpdate broadcasts order book updates to subscribed clients
 func (h *WebSocketHub) BroadcastOrderBookUpdate(marketID string, orderBook interface{}) {
 	h.mu.RLock()
@@ -377,6 +513,35 @@ func (h *WebSocketHub) BroadcastUserOrderUpdate(userID uint, order interface{})
 	}
 }
 
+// BroadcastUserTradeUpdate broadcasts a user's own fills to that user
+func (h *WebSocketHub) BroadcastUserTradeUpdate(userID uint, trade interface{}) {
+	h.mu.RLock()
+	clients := h.userSubscriptions[userID]
+	h.mu.RUnlock()
+
+	if len(clients) == 0 {
+		return
+	}
+
+	message := Message{
+		Type:      MessageTypeTradeUpdate,
+		Channel:   ChannelUserTrades,
+		Data:      trade,
+		Timestamp: time.Now().Unix(),
+	}
+
+	if data, err := json.Marshal(message); err == nil {
+		for client := range clients {
+			select {
+			case client.send <- data:
+			default:
+				close(client.send)
+				delete(h.clients, client)
+			}
+		}
+	}
+}
+
 // BroadcastUserBalanceUpdate broadcasts balance updates to a specific user
 func (h *WebSocketHub) BroadcastUserBalanceUpdate(userID uint, balances interface{}) {
 	h.mu.RLock()
@@ -393,6 +558,35 @@ func (h *WebSocketHub) BroadcastUserBalanceUpdate(userID uint, balances interfac
 		Data:      balances,
 		Timestamp: time.Now().Unix(),
 	}
+
+	if data, err := json.Marshal(message); err == nil {
+		for client := range clients {
+			select {
+			case client.send <- data:
+			default:
+				close(client.send)
+				delete(h.clients, client)
+			}
+		}
+	}
+}
+
+// BroadcastUserAlgoOrderUpdate broadcasts the progress of an algo order to its owner
+func (h *WebSocketHub) BroadcastUserAlgoOrderUpdate(userID uint, algo interface{}) {
+	h.mu.RLock()
+	clients := h.userSubscriptions[userID]
+	h.mu.RUnlock()
+
+	if len(clients) == 0 {
+		return
+	}
+
+	message := Message{
+		Type:      MessageTypeAlgoOrderUpdate,
+		Channel:   ChannelUserAlgoOrders,
+		Data:      algo,
+		Timestamp: time.Now().Unix(),
+	}
 	
 	if data, err := json.Marshal(message); err == nil {
 		for client := range clients {
@@ -526,6 +720,8 @@ func (c *Client) handleMessage(message []byte) {
 		c.handleUnsubscribe(req)
 	case MessageTypePong:
 		c.lastSeen = time.Now()
+	case MessageTypeCancelOnDisconnect:
+		c.handleCancelOnDisconnect(req)
 	default:
 		c.sendError("Unknown message type")
 	}
@@ -542,7 +738,17 @@ func (c *Client) handleSubscribe(req SubscriptionRequest) {
 		// Subscribe to specific market orderbook
 		marketID := req.Channel[len(ChannelOrderBook)+1:]
 		c.hub.SubscribeToMarket(c, marketID)
-	case req.Channel == ChannelUserOrders || req.Channel == ChannelUserBalances:
+	case isMarketChannel(req.Channel, ChannelTrades):
+		// Trade updates are delivered to market subscribers
+		c.hub.SubscribeToMarket(c, req.Channel[len(ChannelTrades)+1:])
+	case isMarketChannel(req.Channel, ChannelBookTicker), isMarketChannel(req.Channel, ChannelKline):
+		// Subscribe to a market's best bid/offer or candlestick stream
+		c.hub.SubscribeToChannel(c, req.Channel)
+	case req.Channel == ChannelMarketStats, isMarketChannel(req.Channel, ChannelMarketStats):
+		// Subscribe to 24h statistics for all markets or a single one
+		c.hub.SubscribeToChannel(c, req.Channel)
+	case req.Channel == ChannelUserOrders || req.Channel == ChannelUserBalances || req.Channel == ChannelUserTrades ||
+		req.Channel == ChannelUserAlgoOrders:
 		// Require authentication for user channels
 		if c.user == nil {
 			c.sendError("Authentication required for user channels")
@@ -579,6 +785,12 @@ func (c *Client) handleUnsubscribe(req SubscriptionRequest) {
 	case len(req.Channel) > len(ChannelOrderBook)+1 && req.Channel[:len(ChannelOrderBook)+1] == ChannelOrderBook+".":
 		marketID := req.Channel[len(ChannelOrderBook)+1:]
 		c.hub.UnsubscribeFromMarket(c, marketID)
+	case isMarketChannel(req.Channel, ChannelTrades):
+		c.hub.UnsubscribeFromMarket(c, req.Channel[len(ChannelTrades)+1:])
+	case isMarketChannel(req.Channel, ChannelBookTicker), isMarketChannel(req.Channel, ChannelKline):
+		c.hub.UnsubscribeFromChannel(c, req.Channel)
+	case req.Channel == ChannelMarketStats, isMarketChannel(req.Channel, ChannelMarketStats):
+		c.hub.UnsubscribeFromChannel(c, req.Channel)
 	}
 	
 	// Send unsubscription confirmation
@@ -597,6 +809,35 @@ func (c *Client) handleUnsubscribe(req SubscriptionRequest) {
 	}
 }
 
+// handleCancelOnDisconnect opts the connection in or out of having the
+// user's open orders cancelled when it drops
+func (c *Client) handleCancelOnDisconnect(req SubscriptionRequest) {
+	if c.user == nil {
+		c.sendError("Authentication required for cancel on disconnect")
+		return
+	}
+	c.cancelOnDisconnect.Store(req.Enabled)
+
+	response := Message{
+		Type:      MessageTypeCancelOnDisconnect,
+		Data:      map[string]bool{"enabled": req.Enabled},
+		Timestamp: time.Now().Unix(),
+	}
+
+	if data, err := json.Marshal(response); err == nil {
+		select {
+		case c.send <- data:
+		default:
+			close(c.send)
+		}
+	}
+}
+
+// isMarketChannel reports whether channel is "<prefix>.<market_id>"
+func isMarketChannel(channel, prefix string) bool {
+	return len(channel) > len(prefix)+1 && channel[:len(prefix)+1] == prefix+"."
+}
+
 // sendError sends an error message to the client
 func (c *Client) sendError(message string) {
 	errorMsg := Message{